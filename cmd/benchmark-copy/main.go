@@ -3,24 +3,33 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io"
 	"os"
+	"strings"
 	"time"
 
 	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
 )
 
+// result holds the timings of one writer
+type result struct {
+	writer    diskmanager.WriterType
+	durations []time.Duration
+}
+
 func main() {
 	var (
-		imagePath  = flag.String("image", "", "Path to FAT32 disk image (required)")
+		imagePath  = flag.String("image", "", "Path to FAT disk image (required)")
 		sourceFile = flag.String("source", "", "Path to source file to copy (required)")
 		destPath   = flag.String("dest", "/test.bin", "Destination path in image")
 		iterations = flag.Int("iterations", 3, "Number of iterations to run")
+		writers    = flag.String("writers", "fat,loopback,diskfs", "Comma-separated filesystem writers to compare (fat, loopback, diskfs)")
 	)
 	flag.Parse()
 
 	if *imagePath == "" || *sourceFile == "" {
-		fmt.Println("Usage: benchmark-copy -image <disk.img> -source <file>")
+		fmt.Println("Usage: benchmark-copy -image <disk.img> -source <file> [-writers fat,loopback,diskfs]")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
@@ -43,111 +52,130 @@ func main() {
 	}
 	fileSize := srcInfo.Size()
 
+	var writerTypes []diskmanager.WriterType
+	for _, name := range strings.Split(*writers, ",") {
+		switch w := diskmanager.WriterType(strings.TrimSpace(name)); w {
+		case diskmanager.WriterFAT, diskmanager.WriterLoopback, diskmanager.WriterDiskfs:
+			writerTypes = append(writerTypes, w)
+		default:
+			fmt.Printf("Error: Unknown writer %q\n", name)
+			os.Exit(1)
+		}
+	}
+
 	fmt.Printf("Benchmark Configuration:\n")
 	fmt.Printf("  Image: %s\n", *imagePath)
 	fmt.Printf("  Source: %s (%d bytes / %.2f MB)\n", *sourceFile, fileSize, float64(fileSize)/1024/1024)
 	fmt.Printf("  Destination: %s\n", *destPath)
+	fmt.Printf("  Writers: %s\n", *writers)
 	fmt.Printf("  Iterations: %d\n\n", *iterations)
 
 	// Run benchmarks
-	var durations []time.Duration
-	var totalBytes int64
+	var results []result
+	for _, writer := range writerTypes {
+		fmt.Printf("=== %s writer ===\n", writer)
+		r := result{writer: writer}
 
-	for i := 0; i < *iterations; i++ {
-		fmt.Printf("Iteration %d/%d...\n", i+1, *iterations)
+		for i := 0; i < *iterations; i++ {
+			fmt.Printf("Iteration %d/%d...\n", i+1, *iterations)
 
-		start := time.Now()
-		bytesWritten, err := copyFileToImage(*imagePath, *sourceFile, *destPath)
-		duration := time.Since(start)
+			start := time.Now()
+			err := copyFileToImage(writer, *imagePath, *sourceFile, *destPath, fileSize)
+			duration := time.Since(start)
 
-		if err != nil {
-			fmt.Printf("  Error: %v\n", err)
-			continue
-		}
+			if err != nil {
+				fmt.Printf("  Error: %v\n", err)
+				continue
+			}
 
-		durations = append(durations, duration)
-		totalBytes = bytesWritten
+			r.durations = append(r.durations, duration)
 
-		fmt.Printf("  Duration: %v\n", duration)
-		fmt.Printf("  Throughput: %.2f MB/s\n", float64(bytesWritten)/duration.Seconds()/1024/1024)
-	}
-
-	// Calculate statistics
-	if len(durations) == 0 {
-		fmt.Println("\nAll iterations failed!")
-		os.Exit(1)
+			fmt.Printf("  Duration: %v\n", duration)
+			fmt.Printf("  Throughput: %.2f MB/s\n", float64(fileSize)/duration.Seconds()/1024/1024)
+		}
+		fmt.Println()
+		results = append(results, r)
 	}
 
-	fmt.Println("\n=== Results ===")
-	fmt.Printf("Successful iterations: %d/%d\n", len(durations), *iterations)
-	fmt.Printf("Bytes written per iteration: %d (%.2f MB)\n\n", totalBytes, float64(totalBytes)/1024/1024)
+	fmt.Println("=== Results ===")
+	fmt.Printf("Bytes written per iteration: %d (%.2f MB)\n\n", fileSize, float64(fileSize)/1024/1024)
+	fmt.Printf("%-10s %8s %14s %14s %14s\n", "Writer", "Success", "Min", "Max", "Avg")
 
-	var sum time.Duration
-	minDuration := durations[0]
-	maxDuration := durations[0]
-
-	for _, d := range durations {
-		sum += d
-		if d < minDuration {
-			minDuration = d
+	succeeded := false
+	for _, r := range results {
+		if len(r.durations) == 0 {
+			fmt.Printf("%-10s %5d/%-2d %14s %14s %14s\n", r.writer, 0, *iterations, "-", "-", "-")
+			continue
 		}
-		if d > maxDuration {
-			maxDuration = d
+		succeeded = true
+
+		var sum time.Duration
+		minDuration := r.durations[0]
+		maxDuration := r.durations[0]
+
+		for _, d := range r.durations {
+			sum += d
+			if d < minDuration {
+				minDuration = d
+			}
+			if d > maxDuration {
+				maxDuration = d
+			}
 		}
+		avgDuration := sum / time.Duration(len(r.durations))
+
+		fmt.Printf("%-10s %5d/%-2d %14s %14s %14s\n", r.writer, len(r.durations), *iterations,
+			throughput(fileSize, minDuration), throughput(fileSize, maxDuration), throughput(fileSize, avgDuration))
 	}
 
-	avgDuration := sum / time.Duration(len(durations))
-	avgThroughput := float64(totalBytes) / avgDuration.Seconds() / 1024 / 1024
+	if !succeeded {
+		fmt.Println("\nAll iterations failed!")
+		os.Exit(1)
+	}
+}
 
-	fmt.Printf("Min duration:  %v (%.2f MB/s)\n", minDuration, float64(totalBytes)/minDuration.Seconds()/1024/1024)
-	fmt.Printf("Max duration:  %v (%.2f MB/s)\n", maxDuration, float64(totalBytes)/maxDuration.Seconds()/1024/1024)
-	fmt.Printf("Avg duration:  %v (%.2f MB/s)\n", avgDuration, avgThroughput)
+// throughput formats a duration with the throughput it represents
+func throughput(bytes int64, d time.Duration) string {
+	return fmt.Sprintf("%.2f MB/s", float64(bytes)/d.Seconds()/1024/1024)
 }
 
-// copyFileToImage copies a file into a FAT32 disk image using go-diskfs
-func copyFileToImage(imagePath, sourcePath, destPath string) (int64, error) {
-	// Open the disk image
-	disk, err := diskfs.Open(imagePath, diskfs.WithOpenMode(diskfs.ReadWriteExclusive))
-	if err != nil {
-		return 0, fmt.Errorf("failed to open disk image: %w", err)
-	}
+// copyFileToImage copies a file into a disk image with one of the disk
+// manager's filesystem writers, including its setup and teardown
+func copyFileToImage(writerType diskmanager.WriterType, imagePath, sourcePath, destPath string, size int64) error {
+	// The go-diskfs writer needs the filesystem opened through go-diskfs
+	var fs filesystem.FileSystem
+	if writerType == diskmanager.WriterDiskfs {
+		disk, err := diskfs.Open(imagePath, diskfs.WithOpenMode(diskfs.ReadWriteExclusive))
+		if err != nil {
+			return fmt.Errorf("failed to open disk image: %w", err)
+		}
+		defer disk.Close()
 
-	// Get the filesystem
-	fs, err := disk.GetFilesystem(0)
-	if err != nil {
-		return 0, fmt.Errorf("failed to get filesystem: %w", err)
+		fs, err = disk.GetFilesystem(0)
+		if err != nil {
+			return fmt.Errorf("failed to get filesystem: %w", err)
+		}
 	}
 
 	// Open source file
 	srcFile, err := os.Open(sourcePath)
 	if err != nil {
-		return 0, fmt.Errorf("failed to open source file: %w", err)
+		return fmt.Errorf("failed to open source file: %w", err)
 	}
 	defer srcFile.Close()
 
-	// Get file size
-	srcInfo, err := srcFile.Stat()
-	if err != nil {
-		return 0, fmt.Errorf("failed to stat source file: %w", err)
-	}
-	fileSize := srcInfo.Size()
-
-	// Create destination file in the image
-	destFile, err := fs.OpenFile(destPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC)
-	if err != nil {
-		return 0, fmt.Errorf("failed to create destination file: %w", err)
+	writer := diskmanager.NewFilesystemWriterOfType(writerType, imagePath, fs)
+	if err := writer.Begin(); err != nil {
+		return fmt.Errorf("failed to initialize writer: %w", err)
 	}
-	defer destFile.Close()
 
-	// Copy the data
-	bytesWritten, err := io.Copy(destFile, srcFile)
-	if err != nil {
-		return 0, fmt.Errorf("failed to copy data: %w", err)
+	if err := writer.WriteFile(destPath, srcFile, size); err != nil {
+		writer.End()
+		return fmt.Errorf("failed to copy data: %w", err)
 	}
 
-	if bytesWritten != fileSize {
-		return bytesWritten, fmt.Errorf("incomplete copy: wrote %d bytes, expected %d", bytesWritten, fileSize)
+	if err := writer.End(); err != nil {
+		return fmt.Errorf("failed to finalize writer: %w", err)
 	}
-
-	return bytesWritten, nil
+	return nil
 }
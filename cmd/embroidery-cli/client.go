@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/apiclient"
+)
+
+// Exit codes
+const (
+	exitOK          = 0
+	exitError       = 1 // the device refused the request or something failed locally
+	exitUsage       = 2 // bad command line
+	exitNotFound    = 3 // the file or directory doesn't exist on the device
+	exitUnreachable = 4 // no device found, or it didn't answer
+	exitDiskFull    = 5 // the disk is full
+	exitDenied      = 6 // the device needs a login, or the token's role isn't allowed to do it
+)
+
+// cliError is an error with the exit code it should end the program with
+type cliError struct {
+	code int
+	err  error
+}
+
+func (e *cliError) Error() string { return e.err.Error() }
+func (e *cliError) Unwrap() error { return e.err }
+
+// exitCode returns the exit code for an error
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var ce *cliError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return exitError
+}
+
+// usageError reports a bad command line
+func usageError(format string, args ...any) error {
+	return &cliError{code: exitUsage, err: fmt.Errorf(format, args...)}
+}
+
+// client talks to the device's HTTP API, turning its errors into cliErrors
+type client struct {
+	base string
+	api  *apiclient.Client
+
+	// chunkTimeout limits each chunk of a resumable upload
+	chunkTimeout time.Duration
+}
+
+// newClient creates a client for the device at base
+func newClient(base, token string, timeout time.Duration) *client {
+	return &client{
+		base: base,
+		api: apiclient.New(base, apiclient.Options{
+			Token:      token,
+			HTTPClient: &http.Client{Timeout: timeout},
+			Name:       "embroidery-cli",
+		}),
+	}
+}
+
+// cliErr gives an error from the API client a matching exit code
+func cliErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	var apiErr *apiclient.Error
+	if !errors.As(err, &apiErr) {
+		if errors.As(err, new(*tls.CertificateVerificationError)) {
+			return &cliError{code: exitUnreachable, err: fmt.Errorf("%w (use -insecure to accept a self-signed certificate)", err)}
+		}
+		if errors.As(err, new(*url.Error)) {
+			return &cliError{code: exitUnreachable, err: err}
+		}
+		return err
+	}
+
+	// Uploads are streamed, so they can't follow the device's redirect to HTTPS
+	if location := apiErr.Location; location != nil {
+		return &cliError{code: exitError, err: fmt.Errorf("%w, use -host %s://%s", apiErr, location.Scheme, location.Host)}
+	}
+
+	code := exitError
+	switch apiErr.Code {
+	case api.CodeNotFound:
+		code = exitNotFound
+	case api.CodeDiskFull:
+		code = exitDiskFull
+	case api.CodeUnauthorized, api.CodeForbidden:
+		code = exitDenied
+	case "":
+		// Not an API response, such as a proxy's error page
+		switch apiErr.StatusCode {
+		case http.StatusNotFound:
+			code = exitNotFound
+		case http.StatusInsufficientStorage:
+			code = exitDiskFull
+		case http.StatusUnauthorized, http.StatusForbidden:
+			code = exitDenied
+		}
+	}
+	return &cliError{code: code, err: apiErr}
+}
+
+// health returns the device status
+func (c *client) health() (*apiclient.Health, error) {
+	h, err := c.api.Health()
+	return h, cliErr(err)
+}
+
+// list returns the entries of a directory on the disk
+func (c *client) list(dir string) ([]apiclient.FileInfo, error) {
+	files, err := c.api.ListFiles(dir)
+	return files, cliErr(err)
+}
+
+// upload sends one file (a design or a ZIP archive) of size bytes into a
+// directory, in chunks that carry on where they stopped if the connection
+// drops. Devices without resumable uploads get it streamed in one request.
+func (c *client) upload(name string, r io.ReadSeeker, size int64, dir, duplicates string) (*apiclient.UploadResult, error) {
+	options := apiclient.UploadOptions{Path: dir, Duplicates: duplicates}
+	if size > 0 {
+		result, err := c.api.UploadResumable(name, r, size, apiclient.ResumableOptions{
+			UploadOptions: options,
+			ChunkTimeout:  c.chunkTimeout,
+			OnRetry: func(err error, delay time.Duration) {
+				fmt.Fprintf(os.Stderr, "%s: %v, retrying in %s\n", name, err, delay)
+			},
+		})
+		if !resumableUnsupported(err) {
+			return result, cliErr(err)
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	result, err := c.api.Upload(name, r, options)
+	return result, cliErr(err)
+}
+
+// resumableUnsupported reports whether err means the device has resumable
+// uploads turned off, or is too old to have them
+func resumableUnsupported(err error) bool {
+	var apiErr *apiclient.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code == api.CodeNotEnabled || (apiErr.Code == "" && apiErr.StatusCode == http.StatusNotFound)
+}
+
+// download copies a file on the disk to w
+func (c *client) download(remote string, w io.Writer) error {
+	return cliErr(c.api.Download(remote, w))
+}
+
+// remove deletes a file or empty directory on the disk
+func (c *client) remove(remote string) error {
+	return cliErr(c.api.DeleteFile(remote))
+}
+
+// move renames a file on the disk
+func (c *client) move(from, to string) error {
+	_, err := c.api.MoveFile(from, to)
+	return cliErr(err)
+}
+
+// clear empties the disk, or one directory of it
+func (c *client) clear(dir string) error {
+	return cliErr(c.api.Clear(dir))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/apiclient"
+)
+
+// TestExitCodes tests the exit code each kind of error ends the program with
+func TestExitCodes(t *testing.T) {
+	unreachable := &url.Error{Op: "Get", URL: "http://embroidery.local/api/status", Err: errors.New("connection refused")}
+	untrusted := &url.Error{Op: "Get", URL: "https://embroidery.local/api/status", Err: &tls.CertificateVerificationError{Err: errors.New("unknown authority")}}
+
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{"success", nil, exitOK},
+		{"local failure", errors.New("open rose.pes: no such file"), exitError},
+		{"usage", usageError("missing file"), exitUsage},
+		{"not found", &apiclient.Error{StatusCode: http.StatusNotFound, Code: api.CodeNotFound}, exitNotFound},
+		{"disk full", &apiclient.Error{StatusCode: http.StatusInsufficientStorage, Code: api.CodeDiskFull}, exitDiskFull},
+		{"unauthorized", &apiclient.Error{StatusCode: http.StatusUnauthorized, Code: api.CodeUnauthorized}, exitDenied},
+		{"forbidden", &apiclient.Error{StatusCode: http.StatusForbidden, Code: api.CodeForbidden}, exitDenied},
+		{"other API error", &apiclient.Error{StatusCode: http.StatusConflict, Code: api.CodeInUse}, exitError},
+		{"proxy 404", &apiclient.Error{StatusCode: http.StatusNotFound}, exitNotFound},
+		{"proxy 507", &apiclient.Error{StatusCode: http.StatusInsufficientStorage}, exitDiskFull},
+		{"proxy 401", &apiclient.Error{StatusCode: http.StatusUnauthorized}, exitDenied},
+		{"proxy 403", &apiclient.Error{StatusCode: http.StatusForbidden}, exitDenied},
+		{"proxy 502", &apiclient.Error{StatusCode: http.StatusBadGateway}, exitError},
+		{"redirect", &apiclient.Error{StatusCode: http.StatusMovedPermanently, Code: api.CodeNotFound, Location: &url.URL{Scheme: "https", Host: "embroidery.local"}}, exitError},
+		{"unreachable", unreachable, exitUnreachable},
+		{"untrusted certificate", untrusted, exitUnreachable},
+	}
+
+	for _, tt := range tests {
+		if code := exitCode(cliErr(tt.err)); code != tt.expected {
+			t.Errorf("%s: exit code %d, expected %d", tt.name, code, tt.expected)
+		}
+	}
+}
+
+// TestErrorHints tests that errors the user can fix say how
+func TestErrorHints(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{&apiclient.Error{StatusCode: http.StatusMovedPermanently, Location: &url.URL{Scheme: "https", Host: "embroidery.local:8443", Path: "/api/upload"}}, "use -host https://embroidery.local:8443"},
+		{&url.Error{Op: "Get", URL: "https://embroidery.local", Err: &tls.CertificateVerificationError{Err: errors.New("unknown authority")}}, "use -insecure"},
+	}
+
+	for _, tt := range tests {
+		if msg := cliErr(tt.err).Error(); !strings.Contains(msg, tt.expected) {
+			t.Errorf("Expected %q to contain %q", msg, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,616 @@
+// embroidery-cli manages an Embroidery Buddy over its HTTP API: it finds
+// devices with mDNS, lists and transfers files, and reports status.
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jgarman/embroidery-buddy/internal/apiclient"
+	"github.com/jgarman/embroidery-buddy/internal/mdns"
+)
+
+const usage = `Usage: embroidery-cli [-host URL] [-token TOKEN] [-insecure] [-timeout 30s] <command> [arguments]
+
+Commands:
+  discover [-timeout 3s] [-all]      Find devices on the local network
+  ls [-l] [path]                     List a directory on the disk
+  put [-to dir] [-duplicates p] <local>...
+                                     Upload files, folders and ZIP archives
+  get <remote> [local|-]             Download a file
+  rm <remote>...                     Delete files or empty directories
+  mv <from> <to>                     Move or rename a file
+  clear [path]                       Delete everything on the disk, or in a directory
+  status                             Show the device status
+  watch [-interval 2s] [path]        Print changes to the disk until interrupted
+
+The device is taken from -host or $EMBROIDERY_HOST. Without either, the only
+device found with mDNS is used, over HTTPS when it offers it. Devices that
+require a login need an API token from -token or $EMBROIDERY_TOKEN. Use
+-insecure for a device with a self-signed certificate.
+
+Exit codes: 0 ok, 1 error, 2 usage, 3 not found, 4 unreachable, 5 disk full,
+6 login required or not allowed
+`
+
+// serviceTypes are the mDNS services the daemon advertises, HTTPS first so
+// it is used when a device offers both
+var serviceTypes = []struct {
+	service string
+	scheme  string
+}{
+	{"_https._tcp", "https"},
+	{"_http._tcp", "http"},
+}
+
+func main() {
+	flags := flag.NewFlagSet("embroidery-cli", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	host := flags.String("host", os.Getenv("EMBROIDERY_HOST"), "Device URL (e.g. http://embroidery.local)")
+	token := flags.String("token", os.Getenv("EMBROIDERY_TOKEN"), "API token for devices that require a login")
+	insecure := flags.Bool("insecure", false, "Accept the device's HTTPS certificate without checking it (for self-signed certificates)")
+	timeout := flags.Duration("timeout", 30*time.Second, "Timeout for each request (for uploads, each chunk)")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
+	if *insecure {
+		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	err := run(flags.Args(), *host, *token, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		if exitCode(err) == exitUsage {
+			fmt.Fprint(os.Stderr, "\n"+usage)
+		}
+	}
+	os.Exit(exitCode(err))
+}
+
+// run dispatches a command
+func run(args []string, host, token string, timeout time.Duration) error {
+	if len(args) == 0 {
+		return usageError("no command given")
+	}
+	command, args := args[0], args[1:]
+
+	if command == "discover" {
+		return discover(args, token)
+	}
+
+	commands := map[string]func(*client, []string) error{
+		"ls":     list,
+		"put":    put,
+		"get":    get,
+		"rm":     remove,
+		"mv":     move,
+		"clear":  clear,
+		"status": status,
+		"watch":  watch,
+	}
+	cmd, ok := commands[command]
+	if !ok {
+		return usageError("unknown command %q", command)
+	}
+
+	base, err := resolveHost(host, token)
+	if err != nil {
+		return err
+	}
+	c := newClient(base, token, timeout)
+	if command == "put" {
+		// Uploads take as long as they take, but each chunk of a resumable
+		// upload must arrive in time
+		c = newClient(base, token, 0)
+		c.chunkTimeout = timeout
+	}
+	return cmd(c, args)
+}
+
+// resolveHost turns -host into a base URL, or discovers the device
+func resolveHost(host, token string) (string, error) {
+	if host == "" {
+		devices, err := findDevices(3*time.Second, false, token)
+		if err != nil {
+			return "", err
+		}
+		switch len(devices) {
+		case 0:
+			return "", &cliError{code: exitUnreachable, err: errors.New("no device found on the network; use -host")}
+		case 1:
+			return devices[0].url, nil
+		default:
+			var names []string
+			for _, d := range devices {
+				names = append(names, fmt.Sprintf("%s (%s)", d.name, d.url))
+			}
+			return "", usageError("found %d devices, pick one with -host: %s", len(devices), strings.Join(names, ", "))
+		}
+	}
+
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return strings.TrimSuffix(host, "/"), nil
+}
+
+// device is an HTTP service found with mDNS
+type device struct {
+	name   string
+	url    string
+	status string
+}
+
+// findDevices browses for HTTPS and HTTP services and asks each for its
+// health, which only Embroidery Buddy devices answer. A host offering both is
+// listed once, with its HTTPS URL. Devices that require a login and don't
+// accept the token are listed as locked, and those whose certificate isn't
+// trusted as untrusted. With all set, other services are kept with an empty
+// status.
+func findDevices(timeout time.Duration, all bool, token string) ([]device, error) {
+	found := make([][]mdns.Instance, len(serviceTypes))
+	errs := make([]error, len(serviceTypes))
+	var wg sync.WaitGroup
+	for i, st := range serviceTypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found[i], errs[i] = mdns.Browse(st.service, timeout)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, &cliError{code: exitUnreachable, err: fmt.Errorf("mDNS discovery failed: %w", err)}
+	}
+
+	var devices []device
+	seen := make(map[string]bool)
+	for i, st := range serviceTypes {
+		for _, inst := range found[i] {
+			if seen[inst.Host] {
+				continue
+			}
+			d := device{name: inst.Name, url: inst.URL(st.scheme)}
+			h, err := newClient(d.url, token, 2*time.Second).health()
+			if err == nil && h.Status != "" {
+				d.status = h.Status
+			} else if exitCode(err) == exitDenied && err.Error() == "authentication required" {
+				d.status = "locked"
+			} else if errors.As(err, new(*tls.CertificateVerificationError)) {
+				d.status = "untrusted"
+			} else if !all {
+				continue
+			}
+			if d.status != "" {
+				seen[inst.Host] = true
+			}
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+func discover(args []string, token string) error {
+	flags := flag.NewFlagSet("discover", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", 3*time.Second, "How long to listen for answers")
+	all := flags.Bool("all", false, "Also list HTTP services that aren't Embroidery Buddy devices")
+	if err := parseFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	devices, err := findDevices(*timeout, *all, token)
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		return &cliError{code: exitUnreachable, err: errors.New("no device found")}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tURL\tSTATUS")
+	for _, d := range devices {
+		status := d.status
+		if status == "" {
+			status = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", d.name, d.url, status)
+	}
+	return w.Flush()
+}
+
+func list(c *client, args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	long := flags.Bool("l", false, "Show size, modification time and SHA-256")
+	if err := parseFlags(flags, args, 0, 1); err != nil {
+		return err
+	}
+	dir := remotePath(flags.Arg(0))
+
+	files, err := c.list(dir)
+	if err != nil {
+		return err
+	}
+
+	if !*long {
+		for _, f := range files {
+			fmt.Println(displayName(f))
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, f := range files {
+		size := fmt.Sprint(f.Size)
+		if f.IsDir {
+			size = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", size, f.Modified.Local().Format("2006-01-02 15:04"), f.SHA256, displayName(f))
+	}
+	return w.Flush()
+}
+
+func put(c *client, args []string) error {
+	flags := flag.NewFlagSet("put", flag.ContinueOnError)
+	to := flags.String("to", "/", "Directory on the disk to upload into")
+	duplicates := flags.String("duplicates", "", "What to do with files already on the disk: keep, skip or replace (default: the device's setting)")
+	if err := parseFlags(flags, args, 1, -1); err != nil {
+		return err
+	}
+	dir := remotePath(*to)
+	locals := flags.Args()
+
+	var (
+		name string
+		body io.ReadSeeker
+		size int64
+	)
+	info, err := os.Stat(locals[0])
+	if err != nil {
+		return err
+	}
+	if len(locals) == 1 && info.Mode().IsRegular() {
+		// A single design or ZIP archive goes up as it is
+		f, err := os.Open(locals[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		name, body, size = filepath.Base(locals[0]), f, info.Size()
+	} else {
+		// Everything else is bundled into one archive, so it is written in a
+		// single transaction
+		archive, err := bundle(locals)
+		if err != nil {
+			return err
+		}
+		name, body, size = "upload.zip", bytes.NewReader(archive.Bytes()), int64(archive.Len())
+	}
+
+	result, err := c.upload(name, body, size, dir, *duplicates)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range result.Files {
+		// Stored is a full path; only mention names the device had to change
+		if path.Base(f.Original) != path.Base(f.Stored) {
+			fmt.Printf("%s stored as %s\n", f.Original, f.Stored)
+		}
+	}
+	for _, d := range result.Duplicates {
+		switch {
+		case d.Skipped:
+			fmt.Printf("%s skipped, already present as %s\n", d.Path, strings.Join(d.DuplicateOf, ", "))
+		case d.Replaced:
+			fmt.Printf("%s replaced %s\n", d.Path, strings.Join(d.DuplicateOf, ", "))
+		default:
+			fmt.Printf("%s is also present as %s\n", d.Path, strings.Join(d.DuplicateOf, ", "))
+		}
+	}
+	return nil
+}
+
+// bundle zips files and folders into memory. Folders keep their own name as
+// the top-level directory of their contents.
+func bundle(locals []string) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	add := func(local, name string) error {
+		f, err := os.Open(local)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, f)
+		return err
+	}
+
+	for _, local := range locals {
+		local = filepath.Clean(local)
+		info, err := os.Stat(local)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			if err := add(local, filepath.Base(local)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		parent := filepath.Dir(local)
+		err = filepath.WalkDir(local, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(parent, p)
+			if err != nil {
+				return err
+			}
+			return add(p, filepath.ToSlash(rel))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+func get(c *client, args []string) error {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	if err := parseFlags(flags, args, 1, 2); err != nil {
+		return err
+	}
+	remote := remotePath(flags.Arg(0))
+	local := flags.Arg(1)
+	if local == "-" {
+		return c.download(remote, os.Stdout)
+	}
+	if local == "" {
+		local = path.Base(remote)
+	} else if info, err := os.Stat(local); err == nil && info.IsDir() {
+		local = filepath.Join(local, path.Base(remote))
+	}
+
+	// Download next to the target so a failure doesn't leave half a file
+	tmp, err := os.CreateTemp(filepath.Dir(local), ".embroidery-cli-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = c.download(remote, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), local)
+}
+
+func remove(c *client, args []string) error {
+	flags := flag.NewFlagSet("rm", flag.ContinueOnError)
+	if err := parseFlags(flags, args, 1, -1); err != nil {
+		return err
+	}
+
+	// Carry on past failures, but exit with the first one's code
+	var first error
+	for _, arg := range flags.Args() {
+		if err := c.remove(remotePath(arg)); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", arg, err)
+			if first == nil {
+				first = &cliError{code: exitCode(err), err: fmt.Errorf("failed to remove %s", arg)}
+			}
+		}
+	}
+	return first
+}
+
+func move(c *client, args []string) error {
+	flags := flag.NewFlagSet("mv", flag.ContinueOnError)
+	if err := parseFlags(flags, args, 2, 2); err != nil {
+		return err
+	}
+	return c.move(remotePath(flags.Arg(0)), remotePath(flags.Arg(1)))
+}
+
+func clear(c *client, args []string) error {
+	flags := flag.NewFlagSet("clear", flag.ContinueOnError)
+	if err := parseFlags(flags, args, 0, 1); err != nil {
+		return err
+	}
+	return c.clear(remotePath(flags.Arg(0)))
+}
+
+func status(c *client, args []string) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	if err := parseFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	h, err := c.health()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Device:      %s\n", c.base)
+	fmt.Printf("Status:      %s\n", h.Status)
+	if h.Temperature != "" {
+		fmt.Printf("Temperature: %s\n", h.Temperature)
+	}
+	if fsys := h.Filesystem; fsys != nil {
+		switch {
+		case fsys.Error != "":
+			fmt.Printf("Filesystem:  check failed: %s\n", fsys.Error)
+		default:
+			fmt.Printf("Filesystem:  %d files, %d problems", fsys.Files, len(fsys.Problems))
+			if fsys.Repaired {
+				fmt.Print(" (repaired)")
+			}
+			fmt.Println()
+		}
+	}
+
+	if h.Status != "ok" {
+		return fmt.Errorf("device is %s", h.Status)
+	}
+	return nil
+}
+
+func watch(c *client, args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := flags.Duration("interval", 2*time.Second, "How often to poll the device")
+	if err := parseFlags(flags, args, 0, 1); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return usageError("-interval must be positive")
+	}
+	dir := remotePath(flags.Arg(0))
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	var (
+		lastStatus string
+		lastFiles  map[string]apiclient.FileInfo
+		reachable  = true
+	)
+	for {
+		h, err := c.health()
+		var files []apiclient.FileInfo
+		if err == nil {
+			files, err = c.list(dir)
+		}
+
+		switch {
+		case err != nil && exitCode(err) == exitUnreachable:
+			if reachable {
+				logChange("!", "device unreachable: %v", err)
+				reachable = false
+			}
+		case err != nil:
+			return err
+		default:
+			if !reachable {
+				logChange("!", "device reachable again")
+				reachable = true
+			}
+			if h.Status != lastStatus {
+				logChange("*", "status %s", h.Status)
+				lastStatus = h.Status
+			}
+			current := make(map[string]apiclient.FileInfo, len(files))
+			for _, f := range files {
+				current[f.Name] = f
+			}
+			if lastFiles != nil {
+				printChanges(dir, lastFiles, current)
+			}
+			lastFiles = current
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// printChanges prints the entries added (+), removed (-) and changed (~)
+// between two listings
+func printChanges(dir string, before, after map[string]apiclient.FileInfo) {
+	var names []string
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		old, hadOld := before[name]
+		cur, hasCur := after[name]
+		switch {
+		case !hadOld:
+			logChange("+", "%s", path.Join(dir, displayName(cur)))
+		case !hasCur:
+			logChange("-", "%s", path.Join(dir, displayName(old)))
+		case old.SHA256 != cur.SHA256 || old.Size != cur.Size:
+			logChange("~", "%s", path.Join(dir, displayName(cur)))
+		}
+	}
+}
+
+func logChange(mark, format string, args ...any) {
+	fmt.Printf("%s %s %s\n", time.Now().Format("15:04:05"), mark, fmt.Sprintf(format, args...))
+}
+
+// parseFlags parses a command's flags and checks the number of arguments left
+// (max -1 means no limit)
+func parseFlags(flags *flag.FlagSet, args []string, min, max int) error {
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			flags.SetOutput(os.Stderr)
+			fmt.Fprintf(os.Stderr, "Options for %s:\n", flags.Name())
+			flags.PrintDefaults()
+			return &cliError{code: exitUsage, err: errors.New("help requested")}
+		}
+		return usageError("%s: %v", flags.Name(), err)
+	}
+	n := flags.NArg()
+	if n < min || (max >= 0 && n > max) {
+		return usageError("%s: wrong number of arguments", flags.Name())
+	}
+	return nil
+}
+
+// remotePath makes a path on the disk absolute
+func remotePath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// displayName marks directories with a trailing slash
+func displayName(f apiclient.FileInfo) string {
+	if f.IsDir {
+		return f.Name + "/"
+	}
+	return f.Name
+}
@@ -1,20 +1,32 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/gorilla/mux"
+	"github.com/jgarman/embroidery-buddy/internal/auth"
 	"github.com/jgarman/embroidery-buddy/internal/config"
+	"github.com/jgarman/embroidery-buddy/internal/dav"
 	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+	"github.com/jgarman/embroidery-buddy/internal/filenames"
+	"github.com/jgarman/embroidery-buddy/internal/ftp"
+	"github.com/jgarman/embroidery-buddy/internal/library"
 	"github.com/jgarman/embroidery-buddy/internal/mdns"
+	"github.com/jgarman/embroidery-buddy/internal/tlscert"
+	"github.com/jgarman/embroidery-buddy/internal/uploads"
 	"github.com/jgarman/embroidery-buddy/internal/webui"
 	"github.com/rs/cors"
 )
@@ -23,8 +35,32 @@ func main() {
 	// Parse command line flags
 	configPath := flag.String("config", "", "Path to configuration file (default: use built-in defaults)")
 	generateConfig := flag.Bool("generate-config", false, "Generate example configuration file and exit")
+	hashPassword := flag.Bool("hash-password", false, "Read a password from stdin, print its password_hash for the auth config and exit")
+	generateToken := flag.Bool("generate-token", false, "Print a new API token and its hash for the auth config and exit")
 	flag.Parse()
 
+	if *hashPassword {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+		hash, err := auth.HashPassword(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatalf("Failed to hash password: %v", err)
+		}
+		fmt.Println(hash)
+		return
+	}
+	if *generateToken {
+		token, hash, err := auth.GenerateToken()
+		if err != nil {
+			log.Fatalf("Failed to generate token: %v", err)
+		}
+		fmt.Printf("token: %s\nhash:  %s\n", token, hash)
+		return
+	}
+
 	// Handle config generation
 	if *generateConfig {
 		cfg := config.Default()
@@ -53,19 +89,46 @@ func main() {
 		cfg = config.Default()
 		// For development, use temp directory
 		cfg.Disk.Path = "/tmp/embroidery.img"
+		cfg.Disk.ImagesDir = "/tmp/embroidery-images"
+		cfg.Disk.SnapshotDir = "/tmp/embroidery-snapshots"
+		cfg.Library.Path = "/tmp/embroidery-library"
+		cfg.Upload.StagingDir = "/tmp/embroidery-uploads"
 		cfg.USBGadget.UseNoOp = true
 	}
 
+	diskFormat := diskmanager.DiskFormat{
+		Filesystem:     diskmanager.FilesystemType(cfg.Disk.Filesystem),
+		PartitionTable: diskmanager.PartitionTable(cfg.Disk.PartitionTable),
+		ClusterSize:    cfg.Disk.ClusterSize,
+		Label:          cfg.Disk.Label,
+	}
+	if err := diskFormat.Validate(); err != nil {
+		log.Fatalf("Invalid disk format: %v", err)
+	}
+
 	// Create disk image if it doesn't exist and auto-create is enabled
 	if cfg.Disk.AutoCreate {
 		if _, err := os.Stat(cfg.Disk.Path); os.IsNotExist(err) {
-			log.Printf("Creating disk image: %s (%dMB)", cfg.Disk.Path, cfg.Disk.SizeMB)
-			if err := diskmanager.CreateDiskImage(cfg.Disk.Path, cfg.Disk.SizeMB); err != nil {
+			log.Printf("Creating disk image: %s (%dMB, %s)", cfg.Disk.Path, cfg.Disk.SizeMB, cfg.Disk.Filesystem)
+			if err := diskmanager.CreateDiskImage(cfg.Disk.Path, cfg.Disk.SizeMB, diskFormat); err != nil {
 				log.Fatalf("Failed to create disk image: %v", err)
 			}
 		}
 	}
 
+	// Use the disk image that was active before the restart
+	var images *diskmanager.ImageStore
+	if cfg.Disk.ImagesDir != "" {
+		images, err = diskmanager.NewImageStore(cfg.Disk.ImagesDir, cfg.Disk.Path, diskFormat)
+		if err != nil {
+			log.Fatalf("Failed to open disk image directory: %v", err)
+		}
+		if active := images.ActiveName(); active != diskmanager.DefaultImageName {
+			log.Printf("Using disk image: %s", active)
+			cfg.Disk.Path = images.Path(active)
+		}
+	}
+
 	// Parse USB gadget hex values
 	vendorId, err := config.ParseHex(cfg.USBGadget.VendorID)
 	if err != nil {
@@ -94,6 +157,14 @@ func main() {
 		GadgetBcdUsb:       bcdUsb,
 		GadgetProductName:  cfg.USBGadget.ProductName,
 		GadgetManufacturer: cfg.USBGadget.Manufacturer,
+		AutoSort:           diskmanager.SortKey(cfg.Disk.AutoSort),
+		SnapshotDir:        cfg.Disk.SnapshotDir,
+		SnapshotLimit:      cfg.Disk.SnapshotLimit,
+		Format:             diskFormat,
+		StartupCheck:       diskmanager.CheckMode(cfg.Disk.StartupCheck),
+		TransactionMode:    diskmanager.TransactionMode(cfg.Disk.TransactionMode),
+		Writer:             diskmanager.WriterType(cfg.Disk.Writer),
+		DuplicatePolicy:    diskmanager.DuplicatePolicy(cfg.Disk.DuplicatePolicy),
 	}
 
 	// Initialize disk manager with appropriate gadget implementation
@@ -107,68 +178,175 @@ func main() {
 	log.Printf("Disk manager initialized with disk: %s", cfg.Disk.Path)
 
 	// Create web UI handler
-	webHandler, err := webui.New(dm)
+	webOptions := webui.DefaultOptions()
+	webOptions.FilenamePolicy = filenames.Policy{
+		Mode:        filenames.Mode(cfg.Upload.Filenames.Mode),
+		MaxLength:   cfg.Upload.Filenames.MaxLength,
+		OnCollision: filenames.Collision(cfg.Upload.Filenames.OnCollision),
+	}
+	webOptions.Images = images
+	if cfg.Library.Enabled {
+		lib, err := library.Open(cfg.Library.Path)
+		if err != nil {
+			log.Fatalf("Failed to open design library: %v", err)
+		}
+		webOptions.Library = lib
+		log.Printf("Design library opened at: %s", cfg.Library.Path)
+	}
+	if cfg.Upload.StagingDir != "" {
+		store, err := uploads.Open(cfg.Upload.StagingDir, uploads.Options{
+			MaxSize:  cfg.Upload.MaxSizeMB * 1024 * 1024,
+			MaxTotal: cfg.Upload.StagingMaxMB * 1024 * 1024,
+			MaxAge:   time.Duration(cfg.Upload.AbandonHours) * time.Hour,
+		})
+		if err != nil {
+			log.Fatalf("Failed to open upload staging directory: %v", err)
+		}
+		webOptions.Uploads = store
+		go collectUploads(store)
+		log.Printf("Resumable uploads staged in: %s", cfg.Upload.StagingDir)
+	}
+	webHandler, err := webui.New(dm, webOptions)
 	if err != nil {
 		log.Fatalf("Failed to initialize web UI: %v", err)
 	}
 
-	// Setup CORS
-	c := cors.New(cors.Options{
-		AllowedOrigins:   cfg.Server.CORS.AllowedOrigins,
-		AllowedMethods:   cfg.Server.CORS.AllowedMethods,
-		AllowedHeaders:   cfg.Server.CORS.AllowedHeaders,
-		AllowCredentials: cfg.Server.CORS.AllowCredentials,
-	})
+	var authenticator *auth.Authenticator
+	if cfg.Auth.Enabled {
+		authenticator, err = newAuthenticator(cfg.Auth)
+		if err != nil {
+			log.Fatalf("Invalid auth configuration: %v", err)
+		}
+		log.Printf("Login required for the web UI and API")
+	}
 
-	// Setup routes
-	r := mux.NewRouter()
-	r.HandleFunc("/", webHandler.IndexHandler).Methods("GET")
-	r.HandleFunc("/api/upload", webHandler.UploadHandler).Methods("POST")
-	r.HandleFunc("/api/health", webHandler.HealthHandler).Methods("GET")
-	r.HandleFunc("/api/clear", webHandler.ClearFilesHandler).Methods("POST")
+	// WebDAV and FTP share the changes waiting to be written to the disk
+	var davFS *dav.FileSystem
+	if cfg.WebDAV.Enabled || cfg.FTP.Enabled {
+		davFS = dav.New(dm, dav.Options{
+			Delay:       time.Duration(cfg.WebDAV.CommitDelayMS) * time.Millisecond,
+			MaxFileSize: cfg.Upload.MaxSizeMB * 1024 * 1024,
+		})
+	}
 
-	handler := c.Handler(r)
+	// Mount the disk over WebDAV
+	var davHandler http.Handler
+	if cfg.WebDAV.Enabled {
+		davHandler = davFS.Handler("/dav")
+		log.Printf("WebDAV enabled at /dav/")
+	}
+
+	r := newRouter(webHandler, authenticator, davHandler)
+
+	// Only the configured origins may call the API from other sites
+	var handler http.Handler = r
+	if len(cfg.Server.CORS.AllowedOrigins) > 0 {
+		handler = cors.New(cors.Options{
+			AllowedOrigins:   cfg.Server.CORS.AllowedOrigins,
+			AllowedMethods:   cfg.Server.CORS.AllowedMethods,
+			AllowedHeaders:   cfg.Server.CORS.AllowedHeaders,
+			AllowCredentials: cfg.Server.CORS.AllowCredentials,
+			// Let pages on those origins resume uploads
+			ExposedHeaders: []string{"Location", "Tus-Resumable", "Upload-Length", "Upload-Offset"},
+		}).Handler(r)
+	}
+
+	// Serve HTTPS so passwords and tokens aren't sent in the clear. Plain HTTP
+	// is then either redirected or served as before.
+	httpHandler := handler
+	var tlsSrv *http.Server
+	if cfg.Server.TLS.Enabled {
+		cert, err := loadCertificate(cfg.Server.TLS)
+		if err != nil {
+			log.Fatalf("Failed to set up HTTPS: %v", err)
+		}
+		tlsSrv = &http.Server{
+			Addr:         fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.TLS.Port),
+			Handler:      handler,
+			TLSConfig:    &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+			ReadTimeout:  time.Second * time.Duration(cfg.Server.ReadTimeout),
+			WriteTimeout: time.Second * time.Duration(cfg.Server.WriteTimeout),
+			IdleTimeout:  time.Second * time.Duration(cfg.Server.IdleTimeout),
+		}
+		if cfg.Server.TLS.RedirectHTTP {
+			httpHandler = redirectToHTTPS(cfg.Server.TLS.Port)
+		}
+	}
 
 	// Create HTTP server
 	srv := &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
-		Handler:      handler,
+		Handler:      httpHandler,
 		ReadTimeout:  time.Second * time.Duration(cfg.Server.ReadTimeout),
 		WriteTimeout: time.Second * time.Duration(cfg.Server.WriteTimeout),
 		IdleTimeout:  time.Second * time.Duration(cfg.Server.IdleTimeout),
 	}
 
-	// Publish mDNS service if enabled
-	var mdnsPublisher interface{ Stop() error }
+	// Accept uploads from software that only speaks FTP
+	var ftpServer *ftp.Server
+	if cfg.FTP.Enabled {
+		ftpAuth, err := newFTPAuthenticator(cfg.FTP.Users, cfg.Auth)
+		if err != nil {
+			log.Fatalf("Invalid FTP configuration: %v", err)
+		}
+		ftpServer = ftp.New(davFS, ftp.Options{
+			Authenticator:  ftpAuth,
+			PassivePortMin: cfg.FTP.PassivePortMin,
+			PassivePortMax: cfg.FTP.PassivePortMax,
+			PublicHost:     cfg.FTP.PublicHost,
+			IdleTimeout:    5 * time.Minute,
+		})
+	}
+
+	// Publish mDNS services if enabled
+	var mdnsPublishers []interface{ Stop() error }
 	if cfg.MDNS.Enabled {
-		if cfg.MDNS.UseDBus && mdns.IsAvahiDBusAvailable() {
-			log.Printf("Publishing mDNS service '%s' via DBus...", cfg.MDNS.ServiceName)
-			mdnsPublisher, err = mdns.PublishHTTPDBus(
-				cfg.MDNS.ServiceName,
-				cfg.Server.Port,
-				cfg.MDNS.TXTRecords...,
-			)
-			if err != nil {
-				log.Printf("Warning: Failed to publish mDNS service via DBus: %v", err)
-			} else {
-				log.Printf("mDNS service published: %s.local:%d", cfg.MDNS.ServiceName, cfg.Server.Port)
-				defer mdnsPublisher.Stop()
+		services := []*mdns.Service{{
+			Name:       cfg.MDNS.ServiceName,
+			Type:       "_http._tcp",
+			Port:       cfg.Server.Port,
+			TXTRecords: cfg.MDNS.TXTRecords,
+		}}
+		if cfg.WebDAV.Enabled {
+			services = append(services, &mdns.Service{
+				Name:       cfg.MDNS.ServiceName,
+				Type:       "_webdav._tcp",
+				Port:       cfg.Server.Port,
+				TXTRecords: []string{"path=/dav/"},
+			})
+		}
+		if tlsSrv != nil {
+			services = append(services, &mdns.Service{
+				Name:       cfg.MDNS.ServiceName,
+				Type:       "_https._tcp",
+				Port:       cfg.Server.TLS.Port,
+				TXTRecords: cfg.MDNS.TXTRecords,
+			})
+			if cfg.WebDAV.Enabled {
+				services = append(services, &mdns.Service{
+					Name:       cfg.MDNS.ServiceName,
+					Type:       "_webdavs._tcp",
+					Port:       cfg.Server.TLS.Port,
+					TXTRecords: []string{"path=/dav/"},
+				})
 			}
-		} else if mdns.IsAvahiAvailable() {
-			log.Printf("Publishing mDNS service '%s' via avahi-publish...", cfg.MDNS.ServiceName)
-			mdnsPublisher, err = mdns.PublishHTTP(
-				cfg.MDNS.ServiceName,
-				cfg.Server.Port,
-				cfg.MDNS.TXTRecords...,
-			)
+		}
+		if ftpServer != nil {
+			services = append(services, &mdns.Service{
+				Name:       cfg.MDNS.ServiceName,
+				Type:       "_ftp._tcp",
+				Port:       cfg.FTP.Port,
+				TXTRecords: []string{"path=/"},
+			})
+		}
+		for _, service := range services {
+			publisher, err := publishService(cfg.MDNS, service)
 			if err != nil {
-				log.Printf("Warning: Failed to publish mDNS service: %v", err)
-			} else {
-				log.Printf("mDNS service published: %s.local:%d", cfg.MDNS.ServiceName, cfg.Server.Port)
-				defer mdnsPublisher.Stop()
+				log.Printf("Warning: Failed to publish mDNS service %s: %v", service.Type, err)
+				continue
 			}
-		} else {
-			log.Println("Warning: mDNS enabled but Avahi not available")
+			log.Printf("mDNS service published: %s.local:%d (%s)", service.Name, service.Port, service.Type)
+			mdnsPublishers = append(mdnsPublishers, publisher)
 		}
 	}
 
@@ -181,6 +359,25 @@ func main() {
 		}
 	}()
 
+	if tlsSrv != nil {
+		go func() {
+			log.Printf("Starting HTTPS server at %s", tlsSrv.Addr)
+			if err := tlsSrv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				log.Panicf("Failed to start HTTPS server: %s\n", err)
+			}
+		}()
+	}
+
+	if ftpServer != nil {
+		go func() {
+			addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.FTP.Port)
+			log.Printf("Starting FTP server at %s", addr)
+			if err := ftpServer.ListenAndServe(addr); err != nil && err != ftp.ErrServerClosed {
+				log.Panicf("Failed to start FTP server: %s\n", err)
+			}
+		}()
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -189,9 +386,9 @@ func main() {
 	log.Println("Shutting down server...")
 
 	// Stop mDNS publishing
-	if mdnsPublisher != nil {
+	for _, publisher := range mdnsPublishers {
 		log.Println("Stopping mDNS service...")
-		mdnsPublisher.Stop()
+		publisher.Stop()
 	}
 
 	// Graceful shutdown with timeout
@@ -201,7 +398,146 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Printf("Server forced to shutdown: %s", err)
 	}
+	if tlsSrv != nil {
+		if err := tlsSrv.Shutdown(ctx); err != nil {
+			log.Printf("HTTPS server forced to shutdown: %s", err)
+		}
+	}
+
+	if ftpServer != nil {
+		ftpServer.Close()
+	}
+
+	// Write what WebDAV and FTP clients copied in the last moments
+	if davFS != nil {
+		if err := davFS.Close(); err != nil {
+			log.Printf("Failed to write pending changes: %v", err)
+		}
+	}
 
 	log.Println("Server exited")
 
 }
+
+// publishService advertises a service with Avahi, over DBus when configured and
+// available, otherwise with avahi-publish-service
+func publishService(cfg config.MDNSConfig, service *mdns.Service) (interface{ Stop() error }, error) {
+	if cfg.UseDBus && mdns.IsAvahiDBusAvailable() {
+		publisher, err := mdns.NewDBusPublisher()
+		if err != nil {
+			return nil, err
+		}
+		if err := publisher.PublishService(service); err != nil {
+			publisher.Stop()
+			return nil, err
+		}
+		return publisher, nil
+	}
+
+	if mdns.IsAvahiAvailable() {
+		publisher := mdns.NewPublisher()
+		if err := publisher.Publish(service); err != nil {
+			return nil, err
+		}
+		return publisher, nil
+	}
+
+	return nil, errors.New("Avahi is not available")
+}
+
+// newAuthenticator creates the authenticator for the configured users and
+// tokens
+func newAuthenticator(cfg config.AuthConfig) (*auth.Authenticator, error) {
+	options := auth.Options{SessionTTL: time.Duration(cfg.SessionHours) * time.Hour}
+	for _, u := range cfg.Users {
+		role, err := auth.ParseRole(u.Role)
+		if err != nil {
+			return nil, fmt.Errorf("user %q: %w", u.Username, err)
+		}
+		options.Users = append(options.Users, auth.User{Username: u.Username, PasswordHash: u.PasswordHash, Role: role})
+	}
+	for _, t := range cfg.Tokens {
+		role, err := auth.ParseRole(t.Role)
+		if err != nil {
+			return nil, fmt.Errorf("token %q: %w", t.Name, err)
+		}
+		options.Tokens = append(options.Tokens, auth.Token{Name: t.Name, Hash: t.Hash, Role: role})
+	}
+	return auth.New(options)
+}
+
+// newFTPAuthenticator creates an authenticator for the auth users allowed to
+// log in over FTP. Tokens can't be sent over FTP, so none are included.
+func newFTPAuthenticator(usernames []string, cfg config.AuthConfig) (*auth.Authenticator, error) {
+	if len(usernames) == 0 {
+		return nil, errors.New("no users are configured")
+	}
+	accounts := make(map[string]config.AuthUser)
+	for _, u := range cfg.Users {
+		accounts[u.Username] = u
+	}
+	ftpCfg := config.AuthConfig{SessionHours: cfg.SessionHours}
+	for _, name := range usernames {
+		u, ok := accounts[name]
+		if !ok {
+			return nil, fmt.Errorf("user %q is not in auth.users", name)
+		}
+		ftpCfg.Users = append(ftpCfg.Users, u)
+	}
+	return newAuthenticator(ftpCfg)
+}
+
+// loadCertificate loads the configured certificate, or the self-signed one for
+// the device's current names and addresses
+func loadCertificate(cfg config.TLSConfig) (tls.Certificate, error) {
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tlscert.Load(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		log.Printf("Using TLS certificate %s", cfg.CertFile)
+		return cert, nil
+	}
+
+	hosts, err := tlscert.LocalHosts()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := tlscert.SelfSigned(cfg.SelfSignedDir, hosts)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Printf("Using self-signed certificate for %s", strings.Join(hosts, ", "))
+	log.Printf("Certificate SHA-256 fingerprint: %s", tlscert.Fingerprint(cert))
+	return cert, nil
+}
+
+// redirectToHTTPS sends every request to the same URL on the HTTPS port. The
+// redirect is temporary so browsers don't remember it if HTTPS is turned off,
+// and keeps the method and body for API clients.
+func redirectToHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		target := net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+		target = strings.TrimSuffix(target, ":443")
+		http.Redirect(w, r, "https://"+target+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
+
+// collectUploads deletes abandoned resumable uploads at startup and then
+// every ten minutes, so they don't fill the SD card
+func collectUploads(store *uploads.Store) {
+	for {
+		removed, err := store.Collect()
+		if err != nil {
+			log.Printf("Warning: Failed to delete abandoned uploads: %v", err)
+		}
+		for _, u := range removed {
+			log.Printf("Deleted abandoned upload %s: %s (%d of %d bytes)", u.ID, u.Filename, u.Offset, u.Length)
+		}
+		time.Sleep(10 * time.Minute)
+	}
+}
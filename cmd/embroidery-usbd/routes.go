@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/auth"
+	"github.com/jgarman/embroidery-buddy/internal/csrf"
+	"github.com/jgarman/embroidery-buddy/internal/webui"
+)
+
+// newRouter sets up the pages, the API and WebDAV. Pages and the API check
+// CSRF tokens, and each group of routes needs a role when logins are required.
+// authenticator is nil when logins are off and davHandler when WebDAV is.
+//
+// Every API route must be described in the OpenAPI document (internal/api/openapi.json).
+func newRouter(webHandler *webui.Handler, authenticator *auth.Authenticator, davHandler http.Handler) *mux.Router {
+	r := mux.NewRouter()
+	web := r.NewRoute().Subrouter()
+	web.Use(csrf.Protect)
+	viewer := web.NewRoute().Subrouter()
+	uploader := web.NewRoute().Subrouter()
+	admin := web.NewRoute().Subrouter()
+	if authenticator != nil {
+		viewer.Use(authenticator.Require(auth.Viewer))
+		uploader.Use(authenticator.Require(auth.Uploader))
+		admin.Use(authenticator.Require(auth.Admin))
+
+		web.HandleFunc(auth.LoginPath, webHandler.LoginPageHandler).Methods("GET")
+		web.HandleFunc("/api/login", authenticator.LoginHandler).Methods("POST")
+		web.HandleFunc("/api/logout", authenticator.LogoutHandler).Methods("POST")
+		viewer.HandleFunc("/api/me", authenticator.MeHandler).Methods("GET")
+	}
+
+	viewer.HandleFunc("/", webHandler.IndexHandler).Methods("GET")
+	viewer.HandleFunc("/api/openapi.json", api.OpenAPIHandler).Methods("GET")
+	viewer.HandleFunc("/api/health", webHandler.HealthHandler).Methods("GET")
+	viewer.HandleFunc("/api/files", webHandler.ListFilesHandler).Methods("GET")
+	viewer.HandleFunc("/api/files/{path:.+}", webHandler.DownloadFileHandler).Methods("GET")
+	viewer.HandleFunc("/api/sync/plan", webHandler.SyncPlanHandler).Methods("POST")
+	viewer.HandleFunc("/api/library", webHandler.LibraryListHandler).Methods("GET")
+	viewer.HandleFunc("/api/library/{id}", webHandler.LibraryGetHandler).Methods("GET")
+	viewer.HandleFunc("/api/library/{id}/file", webHandler.LibraryDownloadHandler).Methods("GET")
+	viewer.HandleFunc("/api/sets", webHandler.SetListHandler).Methods("GET")
+	viewer.HandleFunc("/api/sets/{name}", webHandler.SetGetHandler).Methods("GET")
+	viewer.HandleFunc("/api/images", webHandler.ImageListHandler).Methods("GET")
+	viewer.HandleFunc("/api/snapshots", webHandler.SnapshotListHandler).Methods("GET")
+	viewer.HandleFunc("/api/uploads", webHandler.UploadListHandler).Methods("GET")
+	viewer.HandleFunc("/api/uploads/{id}", webHandler.UploadStatusHandler).Methods("GET", "HEAD")
+
+	uploader.HandleFunc("/api/upload", webHandler.UploadHandler).Methods("POST")
+	uploader.HandleFunc("/api/uploads", webHandler.UploadCreateHandler).Methods("POST")
+	uploader.HandleFunc("/api/uploads/{id}", webHandler.UploadChunkHandler).Methods("PATCH")
+	uploader.HandleFunc("/api/uploads/{id}", webHandler.UploadCancelHandler).Methods("DELETE")
+	uploader.HandleFunc("/api/sort", webHandler.SortHandler).Methods("POST")
+	uploader.HandleFunc("/api/sync", webHandler.SyncHandler).Methods("POST")
+	uploader.HandleFunc("/api/library", webHandler.LibraryAddHandler).Methods("POST")
+	uploader.HandleFunc("/api/library/load", webHandler.LibraryLoadHandler).Methods("POST")
+	uploader.HandleFunc("/api/library/unload", webHandler.LibraryUnloadHandler).Methods("POST")
+	uploader.HandleFunc("/api/library/{id}", webHandler.LibraryUpdateHandler).Methods("PUT")
+	uploader.HandleFunc("/api/library/{id}", webHandler.LibraryDeleteHandler).Methods("DELETE")
+	uploader.HandleFunc("/api/sets/{name}", webHandler.SetSaveHandler).Methods("PUT")
+	uploader.HandleFunc("/api/sets/{name}", webHandler.SetDeleteHandler).Methods("DELETE")
+	uploader.HandleFunc("/api/sets/{name}/activate", webHandler.SetActivateHandler).Methods("POST")
+	uploader.HandleFunc("/api/disk/check", webHandler.CheckHandler).Methods("POST")
+	uploader.HandleFunc("/api/files/{path:.+}/transform", webHandler.TransformHandler).Methods("POST")
+	uploader.HandleFunc("/api/files/{path:.+}/move", webHandler.MoveFileHandler).Methods("POST")
+	uploader.HandleFunc("/api/files/{path:.+}", webHandler.DeleteFileHandler).Methods("DELETE")
+
+	admin.HandleFunc("/api/clear", webHandler.ClearFilesHandler).Methods("POST")
+	admin.HandleFunc("/api/images", webHandler.ImageCreateHandler).Methods("POST")
+	admin.HandleFunc("/api/images/{name}", webHandler.ImageDeleteHandler).Methods("DELETE")
+	admin.HandleFunc("/api/images/{name}/clone", webHandler.ImageCloneHandler).Methods("POST")
+	admin.HandleFunc("/api/images/{name}/activate", webHandler.ImageActivateHandler).Methods("POST")
+	admin.HandleFunc("/api/disk/resize", webHandler.ResizeHandler).Methods("POST")
+	admin.HandleFunc("/api/disk/repair", webHandler.RepairHandler).Methods("POST")
+	admin.HandleFunc("/api/snapshots", webHandler.SnapshotCreateHandler).Methods("POST")
+	admin.HandleFunc("/api/snapshots/{name}", webHandler.SnapshotDeleteHandler).Methods("DELETE")
+	admin.HandleFunc("/api/snapshots/{name}/restore", webHandler.SnapshotRestoreHandler).Methods("POST")
+
+	// WebDAV clients can't send CSRF tokens, and don't need to: browsers
+	// can't make other sites send WebDAV methods
+	if davHandler != nil {
+		davRouter := r.NewRoute().Subrouter()
+		if authenticator != nil {
+			davRouter.Use(authenticator.RequireWebDAV())
+		}
+		davRouter.Handle("/dav", davHandler)
+		davRouter.PathPrefix("/dav/").Handler(davHandler)
+	}
+
+	return r
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/auth"
+	"github.com/jgarman/embroidery-buddy/internal/dav"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+	"github.com/jgarman/embroidery-buddy/internal/uploads"
+	"github.com/jgarman/embroidery-buddy/internal/webui"
+)
+
+// routePattern matches a route variable with a pattern, such as {path:.+}
+var routePattern = regexp.MustCompile(`\{(\w+):[^}]*\}`)
+
+// TestOpenAPIDescribesRoutes tests that every API route of the router, with
+// every optional feature on, is in the OpenAPI document and the other way round
+func TestOpenAPIDescribesRoutes(t *testing.T) {
+	webHandler, err := webui.New(nil, webui.DefaultOptions())
+	if err != nil {
+		t.Fatalf("Failed to create web UI: %v", err)
+	}
+	_, hash, err := auth.GenerateToken()
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %v", err)
+	}
+	authenticator, err := auth.New(auth.Options{Tokens: []auth.Token{{Name: "test", Hash: hash, Role: auth.Admin}}})
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	r := newRouter(webHandler, authenticator, dav.New(nil, dav.Options{}).Handler("/dav"))
+
+	registered := make(map[string]bool)
+	err = r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tpl, "/api/") {
+			// Subrouters, the pages and WebDAV
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			t.Errorf("Route %s doesn't restrict its methods", tpl)
+			return nil
+		}
+		for _, method := range methods {
+			registered[strings.ToLower(method)+" "+routePattern.ReplaceAllString(tpl, "{$1}")] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(api.OpenAPI, &doc); err != nil {
+		t.Fatalf("Failed to parse the OpenAPI document: %v", err)
+	}
+	described := make(map[string]bool)
+	for p, ops := range doc.Paths {
+		for method := range ops {
+			described[method+" "+p] = true
+		}
+	}
+
+	for _, route := range sortedKeys(registered) {
+		if !described[route] {
+			t.Errorf("%s is not described in the OpenAPI document", route)
+		}
+	}
+	for _, route := range sortedKeys(described) {
+		if !registered[route] {
+			t.Errorf("%s is described in the OpenAPI document but not registered", route)
+		}
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// TestTusUpload tests that a plain tus client, which sends no CSRF token or
+// X-Requested-With header, can create, send and cancel resumable uploads
+func TestTusUpload(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "test.img")
+	if err := diskmanager.CreateDiskImage(diskPath, 10, diskmanager.DiskFormat{}); err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+	manager, err := diskmanager.New(diskmanager.Config{DiskPath: diskPath}, diskmanager.NewNoOpUsbGadget())
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	t.Cleanup(func() { manager.Close() })
+	store, err := uploads.Open(t.TempDir(), uploads.Options{})
+	if err != nil {
+		t.Fatalf("Failed to open upload store: %v", err)
+	}
+	options := webui.DefaultOptions()
+	options.Uploads = store
+	webHandler, err := webui.New(manager, options)
+	if err != nil {
+		t.Fatalf("Failed to create web UI: %v", err)
+	}
+	r := newRouter(webHandler, nil, nil)
+
+	send := func(method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	create := func() string {
+		t.Helper()
+		rec := send("POST", "/api/uploads", "", map[string]string{
+			"Upload-Length":   "8",
+			"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("rose.dst")),
+		})
+		if rec.Code != http.StatusCreated || rec.Header().Get("Location") == "" {
+			t.Fatalf("Expected the upload to be created, got %d: %s", rec.Code, rec.Body.String())
+		}
+		return rec.Header().Get("Location")
+	}
+
+	location := create()
+	rec := send("PATCH", location, "stitches", map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	})
+	if rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "8" {
+		t.Fatalf("Expected the chunk to be accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+	f, err := manager.ReadFile("/rose.dst")
+	if err != nil {
+		t.Fatalf("Expected the upload to be stored: %v", err)
+	}
+	f.Close()
+
+	location = create()
+	if rec := send("DELETE", location, "", nil); rec.Code != http.StatusOK {
+		t.Errorf("Expected the upload to be cancelled, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if list := store.List(); len(list) != 0 {
+		t.Errorf("Expected no staged uploads, got %+v", list)
+	}
+
+	// Other requests still need a token
+	req := httptest.NewRequest("POST", "/api/sort", nil)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without a token, got %d", rec.Code)
+	}
+}
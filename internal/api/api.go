@@ -0,0 +1,108 @@
+// Package api defines the envelope every JSON response of the HTTP API is
+// sent in.
+//
+// Successful responses have "success": true next to their own fields. Failed
+// ones have "success": false, an "error" message for people and a "code" for
+// programs. The codes are stable; the messages may change.
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Code is the machine-readable reason a request failed
+type Code string
+
+const (
+	// CodeBadRequest is a malformed request: bad JSON, a missing field or an
+	// unknown option
+	CodeBadRequest Code = "BAD_REQUEST"
+
+	// CodeInvalidPath is a path or filename the disk can't store
+	CodeInvalidPath Code = "INVALID_PATH"
+
+	// CodeInvalidName is an invalid name for a disk image, snapshot, design or set
+	CodeInvalidName Code = "INVALID_NAME"
+
+	// CodeNotFound is a file, directory, disk image, snapshot, design or set
+	// that doesn't exist
+	CodeNotFound Code = "NOT_FOUND"
+
+	// CodeNotEnabled is a feature turned off in the configuration
+	CodeNotEnabled Code = "NOT_ENABLED"
+
+	// CodeAlreadyExists is a path, disk image or snapshot that is taken
+	CodeAlreadyExists Code = "ALREADY_EXISTS"
+
+	// CodeInUse is a disk image that is active or a design used by a set
+	CodeInUse Code = "IN_USE"
+
+	// CodeImageMismatch is a snapshot taken from another disk image than the
+	// active one
+	CodeImageMismatch Code = "IMAGE_MISMATCH"
+
+	// CodeDirectoryNotEmpty is a directory that has to be empty to be removed
+	CodeDirectoryNotEmpty Code = "DIRECTORY_NOT_EMPTY"
+
+	// CodeDiskFull means the files don't fit on the disk
+	CodeDiskFull Code = "DISK_FULL"
+
+	// CodeDiskNotInitialized means there is no disk image to work on
+	CodeDiskNotInitialized Code = "DISK_NOT_INITIALIZED"
+
+	// CodeInvalidDesign is a design file whose stitch data can't be read
+	CodeInvalidDesign Code = "INVALID_DESIGN"
+
+	// CodeUnsupportedFormat is a design format that can't be transformed
+	CodeUnsupportedFormat Code = "UNSUPPORTED_FORMAT"
+
+	// CodeTooLarge is a request body or resumable upload over the size limit
+	CodeTooLarge Code = "TOO_LARGE"
+
+	// CodeOffsetMismatch is a chunk of a resumable upload sent for another
+	// offset than the upload has reached
+	CodeOffsetMismatch Code = "OFFSET_MISMATCH"
+
+	// CodeUnauthorized means the request needs a login
+	CodeUnauthorized Code = "UNAUTHORIZED"
+
+	// CodeForbidden means the login's role isn't allowed to do it
+	CodeForbidden Code = "FORBIDDEN"
+
+	// CodeInvalidCSRFToken is a browser request without the page's CSRF token
+	CodeInvalidCSRFToken Code = "INVALID_CSRF_TOKEN"
+
+	// CodeInternal is anything else that went wrong on the device
+	CodeInternal Code = "INTERNAL"
+)
+
+// Response is the envelope of a successful response without other fields
+type Response struct {
+	Success bool `json:"success"`
+}
+
+// OK is the response to a request that has nothing else to report
+var OK = Response{Success: true}
+
+// ErrorResponse is the body of every failed request
+type ErrorResponse struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+	Code    Code   `json:"code"`
+}
+
+// WriteJSON encodes v as the response body with the given status code
+func WriteJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON response: %v", err)
+	}
+}
+
+// WriteError writes a failed response
+func WriteError(w http.ResponseWriter, statusCode int, code Code, message string) {
+	WriteJSON(w, statusCode, ErrorResponse{Success: false, Error: message, Code: code})
+}
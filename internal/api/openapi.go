@@ -0,0 +1,19 @@
+package api
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// OpenAPI is the OpenAPI 3 document describing every endpoint of the API. It
+// is kept by hand next to the handlers; the router's and the client's tests
+// check that they match it.
+//
+//go:embed openapi.json
+var OpenAPI []byte
+
+// OpenAPIHandler serves the OpenAPI document
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(OpenAPI)
+}
@@ -0,0 +1,302 @@
+// Package apiclient is a typed Go client for the HTTP API of an Embroidery
+// Buddy device.
+//
+// It is written by hand to match the OpenAPI document served at
+// /api/openapi.json (internal/api/openapi.json). Its tests check that every
+// operation of the document has a method here and that the types have the
+// document's fields, so a change to one must be made to the other.
+package apiclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jgarman/embroidery-buddy/internal/api"
+)
+
+// Options configures a Client
+type Options struct {
+	// Token is the API token for devices that require a login
+	Token string
+
+	// HTTPClient sends the requests (default http.DefaultClient)
+	HTTPClient *http.Client
+
+	// Name identifies the program in the X-Requested-With header, which tells
+	// the device the requests come from a program rather than a page, so they
+	// need no CSRF token (default "embroidery-buddy-client")
+	Name string
+}
+
+// Client talks to one device
+type Client struct {
+	base    string
+	options Options
+}
+
+// New creates a client for the device at base, such as http://embroidery.local
+func New(base string, options Options) *Client {
+	if options.HTTPClient == nil {
+		options.HTTPClient = http.DefaultClient
+	}
+	if options.Name == "" {
+		options.Name = "embroidery-buddy-client"
+	}
+	return &Client{base: strings.TrimSuffix(base, "/"), options: options}
+}
+
+// Base returns the URL of the device
+func (c *Client) Base() string {
+	return c.base
+}
+
+// Error is a request the device refused
+type Error struct {
+	// StatusCode is the HTTP status of the response
+	StatusCode int
+
+	// Code is the reason given by the API, empty if the response didn't come
+	// from it (a proxy's error page, say)
+	Code api.Code
+
+	// Message is the API's error message, or the response body or status
+	Message string
+
+	// Location is where the device redirected a request that couldn't follow
+	// it, such as an upload to HTTP when the device redirects to HTTPS
+	Location *url.URL
+}
+
+func (e *Error) Error() string {
+	if e.Location != nil {
+		return fmt.Sprintf("the device redirects to %s", e.Location)
+	}
+	return e.Message
+}
+
+// endpoint is the method and path of an operation
+type endpoint struct {
+	method string
+	path   string
+}
+
+// operations are the endpoints of the OpenAPI document by operationId
+var operations = map[string]endpoint{
+	"login":           {http.MethodPost, "/api/login"},
+	"logout":          {http.MethodPost, "/api/logout"},
+	"getMe":           {http.MethodGet, "/api/me"},
+	"getOpenAPI":      {http.MethodGet, "/api/openapi.json"},
+	"getHealth":       {http.MethodGet, "/api/health"},
+	"upload":          {http.MethodPost, "/api/upload"},
+	"createUpload":    {http.MethodPost, "/api/uploads"},
+	"listUploads":     {http.MethodGet, "/api/uploads"},
+	"getUpload":       {http.MethodGet, "/api/uploads/{id}"},
+	"getUploadOffset": {http.MethodHead, "/api/uploads/{id}"},
+	"uploadChunk":     {http.MethodPatch, "/api/uploads/{id}"},
+	"cancelUpload":    {http.MethodDelete, "/api/uploads/{id}"},
+	"clear":           {http.MethodPost, "/api/clear"},
+	"listFiles":       {http.MethodGet, "/api/files"},
+	"downloadFile":    {http.MethodGet, "/api/files/{path}"},
+	"deleteFile":      {http.MethodDelete, "/api/files/{path}"},
+	"moveFile":        {http.MethodPost, "/api/files/{path}/move"},
+	"transformFile":   {http.MethodPost, "/api/files/{path}/transform"},
+	"sortDirectory":   {http.MethodPost, "/api/sort"},
+	"planSync":        {http.MethodPost, "/api/sync/plan"},
+	"sync":            {http.MethodPost, "/api/sync"},
+	"listLibrary":     {http.MethodGet, "/api/library"},
+	"addToLibrary":    {http.MethodPost, "/api/library"},
+	"getDesign":       {http.MethodGet, "/api/library/{id}"},
+	"updateDesign":    {http.MethodPut, "/api/library/{id}"},
+	"deleteDesign":    {http.MethodDelete, "/api/library/{id}"},
+	"downloadDesign":  {http.MethodGet, "/api/library/{id}/file"},
+	"loadDesigns":     {http.MethodPost, "/api/library/load"},
+	"unloadDesigns":   {http.MethodPost, "/api/library/unload"},
+	"listSets":        {http.MethodGet, "/api/sets"},
+	"getSet":          {http.MethodGet, "/api/sets/{name}"},
+	"saveSet":         {http.MethodPut, "/api/sets/{name}"},
+	"deleteSet":       {http.MethodDelete, "/api/sets/{name}"},
+	"activateSet":     {http.MethodPost, "/api/sets/{name}/activate"},
+	"listImages":      {http.MethodGet, "/api/images"},
+	"createImage":     {http.MethodPost, "/api/images"},
+	"deleteImage":     {http.MethodDelete, "/api/images/{name}"},
+	"cloneImage":      {http.MethodPost, "/api/images/{name}/clone"},
+	"activateImage":   {http.MethodPost, "/api/images/{name}/activate"},
+	"checkDisk":       {http.MethodPost, "/api/disk/check"},
+	"repairDisk":      {http.MethodPost, "/api/disk/repair"},
+	"resizeDisk":      {http.MethodPost, "/api/disk/resize"},
+	"listSnapshots":   {http.MethodGet, "/api/snapshots"},
+	"createSnapshot":  {http.MethodPost, "/api/snapshots"},
+	"deleteSnapshot":  {http.MethodDelete, "/api/snapshots/{name}"},
+	"restoreSnapshot": {http.MethodPost, "/api/snapshots/{name}/restore"},
+}
+
+// call is one request: the operation, the values of its path parameters in
+// order, and its query
+type call struct {
+	op     string
+	params []string
+	query  url.Values
+}
+
+// url builds the URL of a call. Each segment of a path parameter is escaped
+// on its own, so file paths keep their slashes.
+func (c *Client) url(ca call) (endpoint, string) {
+	ep, ok := operations[ca.op]
+	if !ok {
+		panic("apiclient: unknown operation " + ca.op)
+	}
+	p := ep.path
+	for _, value := range ca.params {
+		start := strings.Index(p, "{")
+		end := strings.Index(p, "}")
+		var escaped []string
+		for _, part := range strings.Split(strings.Trim(value, "/"), "/") {
+			escaped = append(escaped, url.PathEscape(part))
+		}
+		p = p[:start] + strings.Join(escaped, "/") + p[end+1:]
+	}
+	u := c.base + p
+	if len(ca.query) > 0 {
+		u += "?" + ca.query.Encode()
+	}
+	return ep, u
+}
+
+// newRequest creates the request for a call
+func (c *Client) newRequest(ca call, body io.Reader, contentType string) (*http.Request, error) {
+	ep, u := c.url(ca)
+	req, err := http.NewRequest(ep.method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req, nil
+}
+
+// send sends a request with the API token, returning an *Error for a failed
+// response
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	req.Header.Set("X-Requested-With", c.options.Name)
+	if c.options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.options.Token)
+	}
+	resp, err := c.options.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// do sends a request and decodes the JSON response into out (if not nil)
+func (c *Client) do(req *http.Request, out any) error {
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response from device: %w", err)
+	}
+	return nil
+}
+
+// doJSON makes a call with in (if not nil) as its JSON body
+func (c *Client) doJSON(ca call, in, out any) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+	req, err := c.newRequest(ca, body, contentType)
+	if err != nil {
+		return err
+	}
+	return c.do(req, out)
+}
+
+// doMultipart makes a call with a multipart body, which write fills in while
+// it is being sent
+func (c *Client) doMultipart(ca call, write func(*multipart.Writer) error, out any) error {
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		err := write(form)
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	req, err := c.newRequest(ca, body, form.FormDataContentType())
+	if err != nil {
+		body.Close()
+		return err
+	}
+	err = c.do(req, out)
+	// Stop the writer if the device answered before reading everything
+	body.Close()
+	return err
+}
+
+// download copies the body of a call to w
+func (c *Client) download(ca call, w io.Writer) error {
+	req, err := c.newRequest(ca, nil, "")
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// responseError turns a failed response into an *Error
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	e := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+
+	var decoded api.ErrorResponse
+	if json.Unmarshal(body, &decoded) == nil && decoded.Error != "" {
+		e.Message = decoded.Error
+		e.Code = decoded.Code
+	}
+	if e.Message == "" {
+		e.Message = resp.Status
+	}
+	if location, err := resp.Location(); err == nil && resp.StatusCode < 400 {
+		e.Location = location
+	}
+	return e
+}
+
+// IsCode reports whether err is an *Error with the given code
+func IsCode(err error, code api.Code) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
@@ -0,0 +1,448 @@
+package apiclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jgarman/embroidery-buddy/internal/api"
+)
+
+// document is the part of the OpenAPI document the tests need
+type document struct {
+	Paths      map[string]map[string]operation `json:"paths"`
+	Components struct {
+		Schemas map[string]schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	OperationID string `json:"operationId"`
+}
+
+type schema struct {
+	Ref        string                     `json:"$ref"`
+	AllOf      []schema                   `json:"allOf"`
+	Properties map[string]json.RawMessage `json:"properties"`
+}
+
+func loadDocument(t *testing.T) document {
+	t.Helper()
+	var doc document
+	if err := json.Unmarshal(api.OpenAPI, &doc); err != nil {
+		t.Fatalf("Failed to parse the OpenAPI document: %v", err)
+	}
+	return doc
+}
+
+// TestOperations tests that the client has every operation of the document,
+// with its method and path
+func TestOperations(t *testing.T) {
+	doc := loadDocument(t)
+
+	described := make(map[string]endpoint)
+	for p, ops := range doc.Paths {
+		for method, op := range ops {
+			described[op.OperationID] = endpoint{strings.ToUpper(method), p}
+		}
+	}
+
+	for id, want := range described {
+		got, ok := operations[id]
+		if !ok {
+			t.Errorf("Operation %s (%s %s) is missing from the client", id, want.method, want.path)
+		} else if got != want {
+			t.Errorf("Operation %s is %s %s in the client, want %s %s", id, got.method, got.path, want.method, want.path)
+		}
+	}
+	for id := range operations {
+		if _, ok := described[id]; !ok {
+			t.Errorf("Operation %s is not in the OpenAPI document", id)
+		}
+	}
+}
+
+// schemaTypes are the Go types of the document's schemas. Responses are
+// compared without the envelope's "success" field.
+var schemaTypes = map[string]any{
+	"Response":                 api.Response{},
+	"ErrorResponse":            api.ErrorResponse{},
+	"LoginRequest":             loginRequest{},
+	"IdentityResponse":         Identity{},
+	"HealthResponse":           Health{},
+	"Rename":                   Rename{},
+	"WriteResult":              WriteResult{},
+	"UploadResult":             UploadResult{},
+	"UploadResponse":           UploadResult{},
+	"StagedUpload":             StagedUpload{},
+	"StagedUploadResponse":     StagedUpload{},
+	"StagedUploadListResponse": stagedUploadListResponse{},
+	"ChunkResponse":            ChunkResult{},
+	"FileInfo":                 FileInfo{},
+	"ListResponse":             listResponse{},
+	"PathResponse":             pathResponse{},
+	"MoveRequest":              moveRequest{},
+	"SortRequest":              SortRequest{},
+	"Operation":                Operation{},
+	"TransformRequest":         TransformRequest{},
+	"TransformResponse":        TransformResult{},
+	"SyncFile":                 SyncFile{},
+	"SyncManifest":             SyncManifest{},
+	"SyncPlan":                 SyncPlan{},
+	"SyncResponse":             SyncResult{},
+	"LibraryEntry":             LibraryEntry{},
+	"LibraryEntryResponse":     LibraryEntry{},
+	"LibraryListResponse":      LibraryList{},
+	"LibraryDuplicate":         LibraryDuplicate{},
+	"LibraryAddResponse":       LibraryAddResult{},
+	"LibraryUpdate":            LibraryUpdate{},
+	"LibraryDriveRequest":      libraryDriveRequest{},
+	"LibraryLoaded":            LibraryLoaded{},
+	"LibraryLoadResponse":      libraryLoadResponse{},
+	"LibraryUnloadResponse":    libraryUnloadResponse{},
+	"SetItem":                  SetItem{},
+	"Set":                      Set{},
+	"SetResponse":              Set{},
+	"SetListResponse":          SetList{},
+	"SetRequest":               setRequest{},
+	"SetActivateResponse":      SetActivation{},
+	"Image":                    Image{},
+	"ImageResponse":            Image{},
+	"ImageListResponse":        imageListResponse{},
+	"ImageRequest":             ImageRequest{},
+	"Problem":                  Problem{},
+	"CheckResult":              CheckResult{},
+	"CheckResponse":            checkResponse{},
+	"ResizeRequest":            resizeRequest{},
+	"ResizePlan":               ResizePlan{},
+	"ResizeResponse":           resizeResponse{},
+	"Snapshot":                 Snapshot{},
+	"SnapshotResponse":         Snapshot{},
+	"SnapshotListResponse":     snapshotListResponse{},
+	"SnapshotRequest":          snapshotRequest{},
+	"RestoreResponse":          restoreResponse{},
+}
+
+// TestTypes tests that the client's types have the fields of the document's
+// schemas
+func TestTypes(t *testing.T) {
+	doc := loadDocument(t)
+
+	for name, s := range doc.Components.Schemas {
+		if name == "ErrorCode" {
+			continue
+		}
+		v, ok := schemaTypes[name]
+		if !ok {
+			t.Errorf("Schema %s has no type in the client", name)
+			continue
+		}
+		want := schemaProperties(t, doc, s)
+		got := jsonFields(reflect.TypeOf(v))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Schema %s has properties %v, %T has %v", name, want, v, got)
+		}
+	}
+	for name := range schemaTypes {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("Schema %s is not in the OpenAPI document", name)
+		}
+	}
+}
+
+// schemaProperties returns the sorted properties of a schema, following
+// allOf, without "success"
+func schemaProperties(t *testing.T, doc document, s schema) []string {
+	t.Helper()
+	if s.Ref != "" {
+		s = doc.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	var names []string
+	for name := range s.Properties {
+		if name != "success" {
+			names = append(names, name)
+		}
+	}
+	for _, sub := range s.AllOf {
+		names = append(names, schemaProperties(t, doc, sub)...)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// jsonFields returns the sorted JSON names of a struct's fields, including
+// those of embedded structs, without "success"
+func jsonFields(typ reflect.Type) []string {
+	var names []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous {
+			names = append(names, jsonFields(field.Type)...)
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" || name == "success" {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// recorder is a device that answers every request with an empty success and
+// records which operations were called
+type recorder struct {
+	t       *testing.T
+	routes  map[string]*regexp.Regexp
+	called  map[string]bool
+	headers http.Header
+}
+
+func newRecorder(t *testing.T) *recorder {
+	r := &recorder{t: t, routes: make(map[string]*regexp.Regexp), called: make(map[string]bool)}
+	param := regexp.MustCompile(`\\\{(\w+)\\\}`)
+	for id, ep := range operations {
+		// Path parameters are one segment, except a file's path
+		pattern := param.ReplaceAllStringFunc(regexp.QuoteMeta(ep.path), func(p string) string {
+			if p == `\{path\}` {
+				return `.+`
+			}
+			return `[^/]+`
+		})
+		r.routes[id] = regexp.MustCompile("^" + ep.method + " " + pattern + "$")
+	}
+	return r
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.headers = req.Header
+	io.Copy(io.Discard, req.Body)
+
+	// Several operations can match, such as a file called "move": record
+	// the longest path, as the router does
+	key := req.Method + " " + req.URL.EscapedPath()
+	best := ""
+	for id, route := range r.routes {
+		if route.MatchString(key) && (best == "" || len(operations[id].path) > len(operations[best].path)) {
+			best = id
+		}
+	}
+	if best == "" {
+		r.t.Errorf("%s matches no operation", key)
+		http.NotFound(w, req)
+		return
+	}
+	r.called[best] = true
+	w.Header().Set("Upload-Offset", "0")
+	api.WriteJSON(w, http.StatusOK, api.OK)
+}
+
+// TestEveryOperation tests that the client has a method for every operation
+func TestEveryOperation(t *testing.T) {
+	rec := newRecorder(t)
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	c := New(server.URL, Options{Token: "secret"})
+
+	open := func(string) (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("data")), nil }
+	plan := SyncPlan{Add: []SyncFile{{Path: "a/b.pes", Size: 4}}}
+	calls := []func() error{
+		func() error { _, err := c.Login("admin", "password"); return err },
+		c.Logout,
+		func() error { _, err := c.Me(); return err },
+		func() error { _, err := c.OpenAPI(); return err },
+		func() error { _, err := c.Health(); return err },
+		func() error {
+			_, err := c.Upload("rose.pes", strings.NewReader("data"), UploadOptions{Path: "/flowers"})
+			return err
+		},
+		func() error { _, err := c.CreateUpload("rose.pes", 4, UploadOptions{Path: "/flowers"}); return err },
+		func() error { _, err := c.ListUploads(); return err },
+		func() error { _, err := c.GetUpload("abc"); return err },
+		func() error { _, err := c.UploadOffset("abc"); return err },
+		func() error { _, err := c.UploadChunk("abc", 0, strings.NewReader("data")); return err },
+		func() error { return c.CancelUpload("abc") },
+		func() error { return c.Clear("/flowers") },
+		func() error { _, err := c.ListFiles("/"); return err },
+		func() error { return c.Download("/flowers/rose.pes", io.Discard) },
+		func() error { return c.DeleteFile("/flowers/rose.pes") },
+		func() error { _, err := c.MoveFile("/flowers/rose.pes", "/rose.pes"); return err },
+		func() error { _, err := c.Transform("/rose.pes", TransformRequest{}); return err },
+		func() error { _, err := c.Sort(SortRequest{Order: "name"}); return err },
+		func() error { _, err := c.PlanSync(SyncManifest{}); return err },
+		func() error { _, err := c.Sync(SyncManifest{}, plan, open); return err },
+		func() error { _, err := c.SearchLibrary(LibraryQuery{Tags: []string{"a", "b"}}); return err },
+		func() error {
+			_, err := c.AddToLibrary("rose.pes", strings.NewReader("data"), []string{"flowers"})
+			return err
+		},
+		func() error { _, err := c.GetDesign("abc"); return err },
+		func() error { _, err := c.UpdateDesign("abc", LibraryUpdate{}); return err },
+		func() error { return c.DeleteDesign("abc") },
+		func() error { return c.DownloadDesign("abc", io.Discard) },
+		func() error { _, err := c.LoadDesigns([]string{"abc"}, ""); return err },
+		func() error { _, err := c.UnloadDesigns([]string{"abc"}); return err },
+		func() error { _, err := c.ListSets(); return err },
+		func() error { _, err := c.GetSet("spring"); return err },
+		func() error { _, err := c.SaveSet("spring", "", nil); return err },
+		func() error { return c.DeleteSet("spring") },
+		func() error { _, err := c.ActivateSet("spring"); return err },
+		func() error { _, err := c.ListImages(); return err },
+		func() error { _, err := c.CreateImage(ImageRequest{Name: "big"}); return err },
+		func() error { return c.DeleteImage("big") },
+		func() error { _, err := c.CloneImage("big", ImageRequest{Name: "copy"}); return err },
+		func() error { _, err := c.ActivateImage("big"); return err },
+		func() error { _, err := c.CheckDisk(); return err },
+		func() error { _, err := c.RepairDisk(); return err },
+		func() error { _, err := c.PlanResize(64); return err },
+		func() error { _, err := c.ListSnapshots(); return err },
+		func() error { _, err := c.CreateSnapshot(""); return err },
+		func() error { return c.DeleteSnapshot("old") },
+		func() error { return c.RestoreSnapshot("old") },
+	}
+	for i, call := range calls {
+		if err := call(); err != nil {
+			t.Errorf("Call %d failed: %v", i, err)
+		}
+	}
+
+	for id := range operations {
+		if !rec.called[id] {
+			t.Errorf("No method calls operation %s", id)
+		}
+	}
+	if got := rec.headers.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Authorization = %q, want the token", got)
+	}
+	if got := rec.headers.Get("X-Requested-With"); got != "embroidery-buddy-client" {
+		t.Errorf("X-Requested-With = %q, want the default name", got)
+	}
+}
+
+// TestPathParameters tests that path parameters are escaped segment by segment
+func TestPathParameters(t *testing.T) {
+	c := New("http://device/", Options{})
+	_, u := c.url(call{op: "moveFile", params: []string{"/my designs/rose #1.pes"}})
+	if want := "http://device/api/files/my%20designs/rose%20%231.pes/move"; u != want {
+		t.Errorf("URL = %s, want %s", u, want)
+	}
+}
+
+// TestErrors tests that failed responses become *Error with the API's code
+func TestErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/files/missing.pes":
+			api.WriteError(w, http.StatusNotFound, api.CodeNotFound, "File not found")
+		case "/api/health":
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+		default:
+			http.Redirect(w, r, "https://device"+r.URL.Path, http.StatusPermanentRedirect)
+		}
+	}))
+	defer server.Close()
+	// Don't follow redirects, so they become errors
+	c := New(server.URL, Options{HTTPClient: &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}})
+
+	var buf bytes.Buffer
+	err := c.Download("missing.pes", &buf)
+	if !IsCode(err, api.CodeNotFound) {
+		t.Fatalf("Download error = %v, want NOT_FOUND", err)
+	}
+	if e := err.(*Error); e.StatusCode != http.StatusNotFound || e.Message != "File not found" {
+		t.Errorf("Error = %+v", e)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Download wrote the error body: %q", buf.String())
+	}
+
+	_, err = c.Health()
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != http.StatusBadGateway || e.Code != "" || e.Message != "bad gateway" {
+		t.Errorf("Health error = %#v, want a 502 without code", err)
+	}
+
+	err = c.Clear("")
+	e, ok = err.(*Error)
+	if !ok || e.Location == nil || e.Location.String() != "https://device/api/clear" {
+		t.Errorf("Clear error = %#v, want the redirect location", err)
+	}
+}
+
+// TestUploadResumable tests that an upload resumes from the device's offset
+// after the connection drops in the middle of a chunk
+func TestUploadResumable(t *testing.T) {
+	var mu sync.Mutex
+	var stored []byte
+	dropped := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(stored)))
+		switch r.Method {
+		case http.MethodPost:
+			api.WriteJSON(w, http.StatusCreated, map[string]any{"success": true, "id": "abc", "length": 10})
+		case http.MethodHead:
+		case http.MethodPatch:
+			if r.Header.Get("Upload-Offset") != strconv.Itoa(len(stored)) {
+				api.WriteError(w, http.StatusConflict, api.CodeOffsetMismatch, "Wrong offset")
+				return
+			}
+			if len(stored) == 4 && !dropped {
+				// Keep half of the second chunk, then drop the connection
+				dropped = true
+				half := make([]byte, 2)
+				io.ReadFull(r.Body, half)
+				stored = append(stored, half...)
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			data, _ := io.ReadAll(r.Body)
+			stored = append(stored, data...)
+			response := map[string]any{"success": true, "id": "abc", "length": 10, "offset": len(stored)}
+			if len(stored) == 10 {
+				response["stored"] = UploadResult{Filename: "rose.pes", Size: 10}
+			}
+			api.WriteJSON(w, http.StatusOK, response)
+		default:
+			t.Errorf("Unexpected %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+	c := New(server.URL, Options{})
+
+	retries := 0
+	var progress []int64
+	result, err := c.UploadResumable("rose.pes", strings.NewReader("0123456789"), 10, ResumableOptions{
+		ChunkSize:  4,
+		RetryDelay: time.Millisecond,
+		Progress:   func(sent, total int64) { progress = append(progress, sent) },
+		OnRetry:    func(error, time.Duration) { retries++ },
+	})
+	if err != nil {
+		t.Fatalf("UploadResumable failed: %v", err)
+	}
+	if result.Filename != "rose.pes" || string(stored) != "0123456789" {
+		t.Errorf("Stored %q as %+v", stored, result)
+	}
+	if retries != 1 {
+		t.Errorf("Expected one retry, got %d", retries)
+	}
+	if want := []int64{4, 10}; !reflect.DeepEqual(progress, want) {
+		t.Errorf("Progress = %v, want %v", progress, want)
+	}
+}
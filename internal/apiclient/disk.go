@@ -0,0 +1,108 @@
+package apiclient
+
+// ListImages lists the disk images
+func (c *Client) ListImages() ([]Image, error) {
+	var response imageListResponse
+	if err := c.doJSON(call{op: "listImages"}, nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Images, nil
+}
+
+// CreateImage creates an empty disk image
+func (c *Client) CreateImage(request ImageRequest) (*Image, error) {
+	var image Image
+	if err := c.doJSON(call{op: "createImage"}, request, &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// DeleteImage deletes a disk image that isn't active
+func (c *Client) DeleteImage(name string) error {
+	return c.doJSON(call{op: "deleteImage", params: []string{name}}, nil, nil)
+}
+
+// CloneImage copies the disk image called name
+func (c *Client) CloneImage(name string, request ImageRequest) (*Image, error) {
+	var image Image
+	if err := c.doJSON(call{op: "cloneImage", params: []string{name}}, request, &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// ActivateImage switches the drive to a disk image
+func (c *Client) ActivateImage(name string) (*Image, error) {
+	var image Image
+	if err := c.doJSON(call{op: "activateImage", params: []string{name}}, nil, &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// CheckDisk checks the filesystem without changing it
+func (c *Client) CheckDisk() (*CheckResult, error) {
+	var response checkResponse
+	if err := c.doJSON(call{op: "checkDisk"}, nil, &response); err != nil {
+		return nil, err
+	}
+	return &response.Check, nil
+}
+
+// RepairDisk checks the filesystem and repairs what it can
+func (c *Client) RepairDisk() (*CheckResult, error) {
+	var response checkResponse
+	if err := c.doJSON(call{op: "repairDisk"}, nil, &response); err != nil {
+		return nil, err
+	}
+	return &response.Check, nil
+}
+
+// PlanResize estimates whether the files fit a disk of sizeMB, without
+// resizing it
+func (c *Client) PlanResize(sizeMB int64) (*ResizePlan, error) {
+	return c.resize(resizeRequest{SizeMB: sizeMB, DryRun: true})
+}
+
+// Resize rebuilds the disk at sizeMB with the same files
+func (c *Client) Resize(sizeMB int64) (*ResizePlan, error) {
+	return c.resize(resizeRequest{SizeMB: sizeMB})
+}
+
+func (c *Client) resize(request resizeRequest) (*ResizePlan, error) {
+	var response resizeResponse
+	if err := c.doJSON(call{op: "resizeDisk"}, request, &response); err != nil {
+		return nil, err
+	}
+	return &response.Plan, nil
+}
+
+// ListSnapshots lists the snapshots of the disk image, newest first
+func (c *Client) ListSnapshots() ([]Snapshot, error) {
+	var response snapshotListResponse
+	if err := c.doJSON(call{op: "listSnapshots"}, nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Snapshots, nil
+}
+
+// CreateSnapshot saves a copy of the active disk image; an empty name uses
+// the current time
+func (c *Client) CreateSnapshot(name string) (*Snapshot, error) {
+	var snapshot Snapshot
+	if err := c.doJSON(call{op: "createSnapshot"}, snapshotRequest{Name: name}, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// DeleteSnapshot deletes a snapshot
+func (c *Client) DeleteSnapshot(name string) error {
+	return c.doJSON(call{op: "deleteSnapshot", params: []string{name}}, nil, nil)
+}
+
+// RestoreSnapshot replaces the drive contents with a snapshot
+func (c *Client) RestoreSnapshot(name string) error {
+	return c.doJSON(call{op: "restoreSnapshot", params: []string{name}}, nil, &restoreResponse{})
+}
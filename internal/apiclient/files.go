@@ -0,0 +1,201 @@
+package apiclient
+
+import (
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/url"
+	"strings"
+)
+
+// Login starts a session for a user. The session cookie is only kept if the
+// HTTP client has a cookie jar; programs normally use an API token instead.
+func (c *Client) Login(username, password string) (*Identity, error) {
+	var id Identity
+	err := c.doJSON(call{op: "login"}, loginRequest{Username: username, Password: password}, &id)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// Logout ends the session
+func (c *Client) Logout() error {
+	return c.doJSON(call{op: "logout"}, nil, nil)
+}
+
+// Me returns who the token or session belongs to
+func (c *Client) Me() (*Identity, error) {
+	var id Identity
+	if err := c.doJSON(call{op: "getMe"}, nil, &id); err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// OpenAPI returns the OpenAPI document of the device
+func (c *Client) OpenAPI() (json.RawMessage, error) {
+	var doc json.RawMessage
+	if err := c.doJSON(call{op: "getOpenAPI"}, nil, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Health returns the device status
+func (c *Client) Health() (*Health, error) {
+	var h Health
+	if err := c.doJSON(call{op: "getHealth"}, nil, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// UploadOptions configures an upload
+type UploadOptions struct {
+	// Path is the directory to store the file in (default "/")
+	Path string
+
+	// Duplicates is what to do with files whose contents are already on the
+	// disk: "keep", "skip" or "replace" (default: the device's setting)
+	Duplicates string
+}
+
+// Upload stores a design, or the designs of a ZIP archive, read from r
+func (c *Client) Upload(name string, r io.Reader, options UploadOptions) (*UploadResult, error) {
+	query := url.Values{}
+	if options.Path != "" {
+		query.Set("path", options.Path)
+	}
+	if options.Duplicates != "" {
+		query.Set("duplicates", options.Duplicates)
+	}
+
+	var result UploadResult
+	err := c.doMultipart(call{op: "upload", query: query}, func(form *multipart.Writer) error {
+		part, err := form.CreateFormFile("file", name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(part, r)
+		return err
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Clear deletes everything in a directory ("" or "/" for the whole disk)
+func (c *Client) Clear(dir string) error {
+	query := url.Values{}
+	if dir != "" {
+		query.Set("path", dir)
+	}
+	return c.doJSON(call{op: "clear", query: query}, nil, nil)
+}
+
+// ListFiles lists a directory
+func (c *Client) ListFiles(dir string) ([]FileInfo, error) {
+	var response listResponse
+	err := c.doJSON(call{op: "listFiles", query: url.Values{"path": {dir}}}, nil, &response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Files, nil
+}
+
+// Download copies a file on the disk to w
+func (c *Client) Download(remote string, w io.Writer) error {
+	return c.download(call{op: "downloadFile", params: []string{remote}}, w)
+}
+
+// DeleteFile deletes a file or an empty directory
+func (c *Client) DeleteFile(remote string) error {
+	return c.doJSON(call{op: "deleteFile", params: []string{remote}}, nil, &pathResponse{})
+}
+
+// MoveFile moves or renames a file or directory, returning its new path
+func (c *Client) MoveFile(from, to string) (string, error) {
+	var response pathResponse
+	err := c.doJSON(call{op: "moveFile", params: []string{from}}, moveRequest{To: to}, &response)
+	if err != nil {
+		return "", err
+	}
+	return response.Path, nil
+}
+
+// Transform rotates, mirrors, scales or recentres a design on the disk
+func (c *Client) Transform(remote string, request TransformRequest) (*TransformResult, error) {
+	var result TransformResult
+	err := c.doJSON(call{op: "transformFile", params: []string{remote}}, request, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Sort reorders the entries of a directory, returning its path
+func (c *Client) Sort(request SortRequest) (string, error) {
+	var response pathResponse
+	if err := c.doJSON(call{op: "sortDirectory"}, request, &response); err != nil {
+		return "", err
+	}
+	return response.Path, nil
+}
+
+// PlanSync returns what syncing a local folder would change, without
+// changing anything
+func (c *Client) PlanSync(manifest SyncManifest) (*SyncResult, error) {
+	var result SyncResult
+	if err := c.doJSON(call{op: "planSync"}, manifest, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Sync makes a directory of the disk match a local folder in one
+// transaction. plan is the result of PlanSync; open is called for every file
+// it adds or updates, with the file's manifest path.
+func (c *Client) Sync(manifest SyncManifest, plan SyncPlan, open func(path string) (io.ReadCloser, error)) (*SyncResult, error) {
+	var result SyncResult
+	err := c.doMultipart(call{op: "sync"}, func(form *multipart.Writer) error {
+		field, err := form.CreateFormField("manifest")
+		if err != nil {
+			return err
+		}
+		if err := json.NewEncoder(field).Encode(manifest); err != nil {
+			return err
+		}
+
+		for _, list := range [][]SyncFile{plan.Add, plan.Update} {
+			for _, f := range list {
+				if err := writeFile(form, f.Path, open); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// writeFile adds a "file" part named after the file's path, directories
+// included
+func writeFile(form *multipart.Writer, name string, open func(string) (io.ReadCloser, error)) error {
+	r, err := open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	part, err := form.CreateFormFile("file", strings.TrimPrefix(name, "/"))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, r)
+	return err
+}
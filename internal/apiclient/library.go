@@ -0,0 +1,154 @@
+package apiclient
+
+import (
+	"io"
+	"mime/multipart"
+	"net/url"
+	"strings"
+)
+
+// LibraryQuery filters a library search; empty fields match everything
+type LibraryQuery struct {
+	// Text matches names and notes
+	Text string
+
+	// Tags must all be on a design
+	Tags []string
+
+	// Format is a design format such as "pes"
+	Format string
+}
+
+// SearchLibrary lists the designs of the library matching a query
+func (c *Client) SearchLibrary(q LibraryQuery) (*LibraryList, error) {
+	query := url.Values{}
+	if q.Text != "" {
+		query.Set("q", q.Text)
+	}
+	for _, tag := range q.Tags {
+		query.Add("tag", tag)
+	}
+	if q.Format != "" {
+		query.Set("format", q.Format)
+	}
+
+	var list LibraryList
+	if err := c.doJSON(call{op: "listLibrary", query: query}, nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// AddToLibrary stores a design read from r in the library
+func (c *Client) AddToLibrary(name string, r io.Reader, tags []string) (*LibraryAddResult, error) {
+	var result LibraryAddResult
+	err := c.doMultipart(call{op: "addToLibrary"}, func(form *multipart.Writer) error {
+		if len(tags) > 0 {
+			if err := form.WriteField("tags", strings.Join(tags, ",")); err != nil {
+				return err
+			}
+		}
+		part, err := form.CreateFormFile("file", name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(part, r)
+		return err
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetDesign returns a design of the library
+func (c *Client) GetDesign(id string) (*LibraryEntry, error) {
+	var entry LibraryEntry
+	if err := c.doJSON(call{op: "getDesign", params: []string{id}}, nil, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// UpdateDesign renames, retags or annotates a design of the library
+func (c *Client) UpdateDesign(id string, update LibraryUpdate) (*LibraryEntry, error) {
+	var entry LibraryEntry
+	if err := c.doJSON(call{op: "updateDesign", params: []string{id}}, update, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// DeleteDesign removes a design from the library
+func (c *Client) DeleteDesign(id string) error {
+	return c.doJSON(call{op: "deleteDesign", params: []string{id}}, nil, nil)
+}
+
+// DownloadDesign copies a design of the library to w
+func (c *Client) DownloadDesign(id string, w io.Writer) error {
+	return c.download(call{op: "downloadDesign", params: []string{id}}, w)
+}
+
+// LoadDesigns copies designs of the library onto the drive, into folder
+// ("" for the root)
+func (c *Client) LoadDesigns(ids []string, folder string) ([]LibraryLoaded, error) {
+	var response libraryLoadResponse
+	err := c.doJSON(call{op: "loadDesigns"}, libraryDriveRequest{IDs: ids, Folder: folder}, &response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Files, nil
+}
+
+// UnloadDesigns removes the copies of designs from the drive, returning how
+// many files were removed
+func (c *Client) UnloadDesigns(ids []string) (int, error) {
+	var response libraryUnloadResponse
+	err := c.doJSON(call{op: "unloadDesigns"}, libraryDriveRequest{IDs: ids}, &response)
+	if err != nil {
+		return 0, err
+	}
+	return response.Removed, nil
+}
+
+// ListSets lists the saved sets
+func (c *Client) ListSets() (*SetList, error) {
+	var list SetList
+	if err := c.doJSON(call{op: "listSets"}, nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// GetSet returns a saved set
+func (c *Client) GetSet(name string) (*Set, error) {
+	var set Set
+	if err := c.doJSON(call{op: "getSet", params: []string{name}}, nil, &set); err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+// SaveSet creates or replaces a set
+func (c *Client) SaveSet(name, description string, items []SetItem) (*Set, error) {
+	var set Set
+	request := setRequest{Description: description, Items: items}
+	if err := c.doJSON(call{op: "saveSet", params: []string{name}}, request, &set); err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+// DeleteSet deletes a saved set
+func (c *Client) DeleteSet(name string) error {
+	return c.doJSON(call{op: "deleteSet", params: []string{name}}, nil, nil)
+}
+
+// ActivateSet replaces the designs on the drive with those of a set
+func (c *Client) ActivateSet(name string) (*SetActivation, error) {
+	var activation SetActivation
+	if err := c.doJSON(call{op: "activateSet", params: []string{name}}, nil, &activation); err != nil {
+		return nil, err
+	}
+	return &activation, nil
+}
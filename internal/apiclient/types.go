@@ -0,0 +1,360 @@
+package apiclient
+
+import "time"
+
+// The types below are the schemas of the OpenAPI document, without the
+// "success" field of the response envelope. Fields the device may leave out
+// are marked omitempty so requests leave them out too.
+
+// Identity is who a session or token belongs to (IdentityResponse)
+type Identity struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Health is the device status (HealthResponse)
+type Health struct {
+	// Status is "degraded" while the last filesystem check lists problems
+	// that weren't repaired
+	Status      string `json:"status"`
+	Temperature string `json:"temperature"`
+
+	// Filesystem is the last filesystem check, if there was one
+	Filesystem *CheckResult `json:"filesystem,omitempty"`
+}
+
+// Rename maps an uploaded name to the path it was stored under
+type Rename struct {
+	Original string `json:"original"`
+	Stored   string `json:"stored"`
+}
+
+// WriteResult describes a stored file whose contents were already on the disk
+type WriteResult struct {
+	Path        string   `json:"path"`
+	Size        int64    `json:"size"`
+	SHA256      string   `json:"sha256"`
+	DuplicateOf []string `json:"duplicateOf,omitempty"`
+	Skipped     bool     `json:"skipped,omitempty"`
+	Replaced    bool     `json:"replaced,omitempty"`
+}
+
+// UploadResult is what an upload stored on the disk (UploadResponse)
+type UploadResult struct {
+	Filename       string        `json:"filename"`
+	Size           int64         `json:"size"`
+	FilesExtracted int           `json:"filesExtracted,omitempty"`
+	Files          []Rename      `json:"files"`
+	Duplicates     []WriteResult `json:"duplicates,omitempty"`
+}
+
+// StagedUpload is a resumable upload in the device's staging area
+type StagedUpload struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+
+	// Path is the directory on the disk the file is stored in
+	Path       string `json:"path"`
+	Duplicates string `json:"duplicates,omitempty"`
+
+	// Length is the size of the whole file, Offset how much of it arrived
+	Length  int64     `json:"length"`
+	Offset  int64     `json:"offset"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+type stagedUploadListResponse struct {
+	Uploads []StagedUpload `json:"uploads"`
+}
+
+// ChunkResult is the state of a resumable upload after a chunk (ChunkResponse)
+type ChunkResult struct {
+	StagedUpload
+
+	// Stored is set once the last chunk has arrived and the file is on the disk
+	Stored *UploadResult `json:"stored,omitempty"`
+}
+
+// FileInfo is one entry of a directory listing
+type FileInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	IsDir    bool      `json:"isDir"`
+	Modified time.Time `json:"modified"`
+	SHA256   string    `json:"sha256,omitempty"`
+}
+
+type listResponse struct {
+	Path  string     `json:"path"`
+	Files []FileInfo `json:"files"`
+}
+
+type pathResponse struct {
+	Path string `json:"path"`
+}
+
+type moveRequest struct {
+	To string `json:"to"`
+}
+
+// SortRequest reorders the entries of a directory
+type SortRequest struct {
+	// Path is the directory to sort (default "/")
+	Path string `json:"path,omitempty"`
+
+	// Order is "name", "time" or "custom"
+	Order string `json:"order"`
+
+	// Names gives the wanted order for "custom"
+	Names []string `json:"names,omitempty"`
+}
+
+// Operation is one step of a transform
+type Operation struct {
+	// Type is "rotate", "mirror", "scale" or "recentre"
+	Type    string  `json:"type"`
+	Degrees float64 `json:"degrees,omitempty"`
+	Axis    string  `json:"axis,omitempty"`
+	Factor  float64 `json:"factor,omitempty"`
+}
+
+// TransformRequest transforms a design on the disk
+type TransformRequest struct {
+	Operations []Operation `json:"operations"`
+
+	// Output is the path to write the result to; empty overwrites the source
+	Output string `json:"output,omitempty"`
+}
+
+// TransformResult describes a transformed design (TransformResponse)
+type TransformResult struct {
+	Path     string   `json:"path"`
+	Stitches int      `json:"stitches"`
+	WidthMM  float64  `json:"widthMm"`
+	HeightMM float64  `json:"heightMm"`
+	Warnings []string `json:"warnings"`
+}
+
+// SyncFile is a file of a sync manifest or plan
+type SyncFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// SyncManifest is every file of a local folder
+type SyncManifest struct {
+	// Path is the directory on the disk the folder maps to (default "/")
+	Path  string     `json:"path,omitempty"`
+	Files []SyncFile `json:"files"`
+}
+
+// SyncPlan is what a sync changes
+type SyncPlan struct {
+	Add       []SyncFile `json:"add"`
+	Update    []SyncFile `json:"update"`
+	Delete    []string   `json:"delete"`
+	Unchanged int        `json:"unchanged"`
+}
+
+// SyncResult is the plan of a sync (SyncResponse)
+type SyncResult struct {
+	Path string   `json:"path"`
+	Plan SyncPlan `json:"plan"`
+}
+
+// LibraryEntry is a design in the library
+type LibraryEntry struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Format    string    `json:"format"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Tags      []string  `json:"tags"`
+	Notes     string    `json:"notes,omitempty"`
+	Added     time.Time `json:"added"`
+	Stitches  int       `json:"stitches,omitempty"`
+	WidthMM   float64   `json:"widthMm,omitempty"`
+	HeightMM  float64   `json:"heightMm,omitempty"`
+	DrivePath string    `json:"drivePath,omitempty"`
+}
+
+// LibraryList is the result of a library search (LibraryListResponse)
+type LibraryList struct {
+	Designs []LibraryEntry `json:"designs"`
+
+	// Tags are all the tags in the library
+	Tags []string `json:"tags"`
+}
+
+// LibraryDuplicate is an added file whose contents were already in the library
+type LibraryDuplicate struct {
+	Name     string       `json:"name"`
+	Existing LibraryEntry `json:"existing"`
+}
+
+// LibraryAddResult is the response to adding designs (LibraryAddResponse)
+type LibraryAddResult struct {
+	Designs    []LibraryEntry     `json:"designs"`
+	Duplicates []LibraryDuplicate `json:"duplicates"`
+}
+
+// LibraryUpdate changes a design; nil fields are kept
+type LibraryUpdate struct {
+	Name  *string   `json:"name,omitempty"`
+	Tags  *[]string `json:"tags,omitempty"`
+	Notes *string   `json:"notes,omitempty"`
+}
+
+type libraryDriveRequest struct {
+	IDs    []string `json:"ids"`
+	Folder string   `json:"folder,omitempty"`
+}
+
+// LibraryLoaded is where a design was copied onto the drive
+type LibraryLoaded struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+}
+
+type libraryLoadResponse struct {
+	Files []LibraryLoaded `json:"files"`
+}
+
+type libraryUnloadResponse struct {
+	Removed int `json:"removed"`
+}
+
+// SetItem is a design of a set and the folder it goes in
+type SetItem struct {
+	ID     string `json:"id"`
+	Folder string `json:"folder"`
+}
+
+// Set is a saved drive layout
+type Set struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Items       []SetItem `json:"items"`
+	Updated     time.Time `json:"updated"`
+}
+
+// SetList is the saved sets (SetListResponse)
+type SetList struct {
+	// Active is the set last activated onto the drive
+	Active string `json:"active"`
+	Sets   []Set  `json:"sets"`
+}
+
+type setRequest struct {
+	Description string    `json:"description,omitempty"`
+	Items       []SetItem `json:"items"`
+}
+
+// SetActivation is the result of activating a set (SetActivateResponse)
+type SetActivation struct {
+	Set   string          `json:"set"`
+	Files []LibraryLoaded `json:"files"`
+}
+
+// Image is a disk image
+type Image struct {
+	Name        string    `json:"name"`
+	Label       string    `json:"label"`
+	Description string    `json:"description,omitempty"`
+	SizeMB      int64     `json:"sizeMb"`
+	Created     time.Time `json:"created"`
+	Active      bool      `json:"active"`
+}
+
+type imageListResponse struct {
+	Images []Image `json:"images"`
+}
+
+// ImageRequest creates or clones a disk image
+type ImageRequest struct {
+	Name string `json:"name"`
+
+	// Label defaults to the name
+	Label       string `json:"label,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	// SizeMB is the size of a new image (create only)
+	SizeMB int64 `json:"sizeMb,omitempty"`
+}
+
+// Problem is something wrong with the filesystem
+type Problem struct {
+	Kind   string `json:"kind"`
+	Path   string `json:"path,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// CheckResult is the outcome of a filesystem check or repair
+type CheckResult struct {
+	Files        int       `json:"files"`
+	Directories  int       `json:"directories"`
+	UsedClusters int       `json:"usedClusters"`
+	FreeClusters int       `json:"freeClusters"`
+	LostClusters int       `json:"lostClusters"`
+	Problems     []Problem `json:"problems"`
+	Repaired     bool      `json:"repaired"`
+	Time         time.Time `json:"time"`
+
+	// Error is set when the check couldn't complete
+	Error string `json:"error,omitempty"`
+}
+
+type checkResponse struct {
+	Check CheckResult `json:"check"`
+}
+
+type resizeRequest struct {
+	SizeMB int64 `json:"sizeMb"`
+	DryRun bool  `json:"dryRun,omitempty"`
+}
+
+// ResizePlan estimates whether the files fit a new disk size
+type ResizePlan struct {
+	CurrentSizeMB int64 `json:"currentSizeMb"`
+	NewSizeMB     int64 `json:"newSizeMb"`
+	Files         int   `json:"files"`
+	Directories   int   `json:"directories"`
+	DataBytes     int64 `json:"dataBytes"`
+	RequiredBytes int64 `json:"requiredBytes"`
+	CapacityBytes int64 `json:"capacityBytes"`
+	Fits          bool  `json:"fits"`
+}
+
+type resizeResponse struct {
+	DryRun bool       `json:"dryRun"`
+	Plan   ResizePlan `json:"plan"`
+}
+
+// Snapshot is a saved copy of a disk image
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+
+	// Source is the disk image the snapshot was taken from
+	Source string `json:"source"`
+	Size   int64  `json:"size"`
+}
+
+type snapshotListResponse struct {
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+type snapshotRequest struct {
+	Name string `json:"name,omitempty"`
+}
+
+type restoreResponse struct {
+	Snapshot string `json:"snapshot"`
+}
@@ -0,0 +1,246 @@
+package apiclient
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jgarman/embroidery-buddy/internal/api"
+)
+
+// Resumable uploads follow the tus protocol (https://tus.io)
+const (
+	tusVersion     = "1.0.0"
+	tusContentType = "application/offset+octet-stream"
+)
+
+// CreateUpload starts a resumable upload of a file of length bytes. The
+// device stages it until the last chunk arrives, then stores it like Upload.
+func (c *Client) CreateUpload(name string, length int64, options UploadOptions) (*StagedUpload, error) {
+	metadata := []string{"filename " + base64.StdEncoding.EncodeToString([]byte(name))}
+	if options.Path != "" {
+		metadata = append(metadata, "path "+base64.StdEncoding.EncodeToString([]byte(options.Path)))
+	}
+	if options.Duplicates != "" {
+		metadata = append(metadata, "duplicates "+base64.StdEncoding.EncodeToString([]byte(options.Duplicates)))
+	}
+
+	req, err := c.newRequest(call{op: "createUpload"}, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.FormatInt(length, 10))
+	req.Header.Set("Upload-Metadata", strings.Join(metadata, ","))
+
+	var u StagedUpload
+	if err := c.do(req, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// ListUploads lists the resumable uploads the device is staging
+func (c *Client) ListUploads() ([]StagedUpload, error) {
+	var response stagedUploadListResponse
+	if err := c.doJSON(call{op: "listUploads"}, nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Uploads, nil
+}
+
+// GetUpload returns a resumable upload
+func (c *Client) GetUpload(id string) (*StagedUpload, error) {
+	var u StagedUpload
+	if err := c.doJSON(call{op: "getUpload", params: []string{id}}, nil, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// UploadOffset returns how much of a resumable upload the device has
+func (c *Client) UploadOffset(id string) (int64, error) {
+	req, err := c.newRequest(call{op: "getUploadOffset", params: []string{id}}, nil, "")
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	resp, err := c.send(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid response from device: no Upload-Offset")
+	}
+	return offset, nil
+}
+
+// UploadChunk sends the data of r as the part of a resumable upload that
+// starts at offset, which must be the offset the device has reached. The
+// result's Stored is set once the last chunk has arrived.
+func (c *Client) UploadChunk(id string, offset int64, r io.Reader) (*ChunkResult, error) {
+	return c.uploadChunk(context.Background(), id, offset, r, -1)
+}
+
+// uploadChunk sends a chunk of length bytes, or of unknown length if it is -1
+func (c *Client) uploadChunk(ctx context.Context, id string, offset int64, r io.Reader, length int64) (*ChunkResult, error) {
+	if length == 0 {
+		r = http.NoBody
+	}
+	req, err := c.newRequest(call{op: "uploadChunk", params: []string{id}}, r, tusContentType)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if length >= 0 {
+		req.ContentLength = length
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	var result ChunkResult
+	if err := c.do(req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// CancelUpload cancels a resumable upload and deletes what the device staged
+func (c *Client) CancelUpload(id string) error {
+	req, err := c.newRequest(call{op: "cancelUpload", params: []string{id}}, nil, "")
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	return c.do(req, nil)
+}
+
+// ResumableOptions configures UploadResumable
+type ResumableOptions struct {
+	UploadOptions
+
+	// ChunkSize is the most sent in one request (default 1 MiB)
+	ChunkSize int64
+
+	// Retries is how many times in a row a chunk is retried before giving
+	// up (default 5)
+	Retries int
+
+	// RetryDelay is the wait before the first retry, doubled for each
+	// further one (default 1s)
+	RetryDelay time.Duration
+
+	// ChunkTimeout limits each request, so a stalled connection is retried
+	// rather than waited on (default no limit)
+	ChunkTimeout time.Duration
+
+	// Progress is called after every chunk with the bytes the device has
+	Progress func(sent, total int64)
+
+	// OnRetry is called before waiting to retry after err
+	OnRetry func(err error, delay time.Duration)
+}
+
+// UploadResumable uploads size bytes from r in chunks, resuming from where
+// the device got to when a chunk fails, so a flaky connection doesn't start
+// a large upload over. If it gives up the upload is cancelled.
+func (c *Client) UploadResumable(name string, r io.ReadSeeker, size int64, options ResumableOptions) (*UploadResult, error) {
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = 1024 * 1024
+	}
+	if options.Retries <= 0 {
+		options.Retries = 5
+	}
+	if options.RetryDelay <= 0 {
+		options.RetryDelay = time.Second
+	}
+
+	u, err := c.CreateUpload(name, size, options.UploadOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := u.Offset
+	failures := 0
+	delay := options.RetryDelay
+	for {
+		result, err := c.sendChunk(u.ID, r, offset, size, options)
+		if err == nil {
+			failures = 0
+			delay = options.RetryDelay
+			offset = result.Offset
+			if options.Progress != nil {
+				options.Progress(offset, size)
+			}
+			if result.Stored != nil {
+				return result.Stored, nil
+			}
+			continue
+		}
+
+		for {
+			if !retryable(err) || failures >= options.Retries {
+				// Best effort: the device also drops abandoned uploads
+				c.CancelUpload(u.ID)
+				return nil, err
+			}
+			failures++
+			if options.OnRetry != nil {
+				options.OnRetry(err, delay)
+			}
+			time.Sleep(delay)
+			delay *= 2
+
+			offset, err = c.UploadOffset(u.ID)
+			if IsCode(err, api.CodeNotFound) {
+				// Stored after the response was lost, or expired
+				return nil, fmt.Errorf("upload %s is no longer on the device, the last chunk may have been stored: %w", u.ID, err)
+			}
+			if err == nil {
+				break
+			}
+		}
+	}
+}
+
+// sendChunk sends the chunk of r that starts at offset
+func (c *Client) sendChunk(id string, r io.ReadSeeker, offset, size int64, options ResumableOptions) (*ChunkResult, error) {
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	length := min(options.ChunkSize, size-offset)
+
+	ctx := context.Background()
+	if options.ChunkTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.ChunkTimeout)
+		defer cancel()
+	}
+	return c.uploadChunk(ctx, id, offset, io.LimitReader(r, length), length)
+}
+
+// retryable reports whether a chunk that failed with err could succeed if
+// sent again from the device's offset: the connection failed, the offsets
+// disagree, or a proxy or the device was briefly unavailable
+func retryable(err error) bool {
+	var e *Error
+	if !errors.As(err, &e) {
+		return true
+	}
+	switch {
+	case e.Code == api.CodeOffsetMismatch, e.Code == api.CodeInUse:
+		return true
+	case e.Code == "" && e.StatusCode >= 500:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,325 @@
+// Package auth logs users in to the web UI and API.
+//
+// Users are configured with bcrypt password hashes and one of three roles:
+// viewers can look, uploaders can change what is on the disk, and admins can
+// also clear it and manage disk images and snapshots. The browser UI logs in
+// once and gets a session cookie; scripts send an API token as a bearer token,
+// or a username and password with HTTP Basic authentication (which WebDAV
+// clients use too).
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrInvalidRole is returned for a role other than viewer, uploader or admin
+	ErrInvalidRole = errors.New("invalid role")
+
+	// ErrInvalidCredentials is returned when a username or password is wrong
+	ErrInvalidCredentials = errors.New("invalid username or password")
+)
+
+// Role is what a user is allowed to do. Each role can do everything the
+// roles before it can.
+type Role int
+
+const (
+	// Viewer can list and download files and check the device's status
+	Viewer Role = iota + 1
+
+	// Uploader can also upload, move and delete files and manage the library
+	Uploader
+
+	// Admin can also clear the disk and manage disk images and snapshots
+	Admin
+)
+
+// ParseRole parses "viewer", "uploader" or "admin"
+func ParseRole(s string) (Role, error) {
+	switch strings.ToLower(s) {
+	case "viewer":
+		return Viewer, nil
+	case "uploader":
+		return Uploader, nil
+	case "admin":
+		return Admin, nil
+	}
+	return 0, fmt.Errorf("%w: %q (must be \"viewer\", \"uploader\" or \"admin\")", ErrInvalidRole, s)
+}
+
+func (r Role) String() string {
+	switch r {
+	case Viewer:
+		return "viewer"
+	case Uploader:
+		return "uploader"
+	case Admin:
+		return "admin"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// User is an account that can log in with a password
+type User struct {
+	Username string
+
+	// PasswordHash is a bcrypt hash, see HashPassword
+	PasswordHash string
+
+	Role Role
+}
+
+// Token is an API token for scripts
+type Token struct {
+	// Name identifies the token in logs
+	Name string
+
+	// Hash is the hex SHA-256 of the token, see GenerateToken
+	Hash string
+
+	Role Role
+}
+
+// Options configures an Authenticator
+type Options struct {
+	Users  []User
+	Tokens []Token
+
+	// SessionTTL is how long a browser stays logged in (default 7 days)
+	SessionTTL time.Duration
+}
+
+// Identity is who made a request
+type Identity struct {
+	// Name is the username, or the name of the API token
+	Name string
+	Role Role
+
+	// Token is set when the request used an API token
+	Token bool
+}
+
+// Authenticator checks credentials and keeps track of browser sessions
+type Authenticator struct {
+	users      map[string]User
+	tokens     map[[sha256.Size]byte]Token
+	sessionTTL time.Duration
+
+	mu       sync.Mutex
+	sessions map[[sha256.Size]byte]*session
+
+	// verified remembers recent Basic credentials, so WebDAV clients
+	// sending them with every request don't pay for bcrypt each time
+	verified map[[sha256.Size]byte]time.Time
+}
+
+// session is a browser that logged in
+type session struct {
+	username string
+	expires  time.Time
+}
+
+const (
+	defaultSessionTTL = 7 * 24 * time.Hour
+
+	// verifiedTTL is how long checked Basic credentials are remembered
+	verifiedTTL = 5 * time.Minute
+)
+
+// dummyHash is compared against when a username doesn't exist, so unknown
+// users take as long to refuse as wrong passwords
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("embroidery"), bcrypt.DefaultCost)
+	return hash
+})
+
+// New creates an Authenticator, checking the users and tokens
+func New(options Options) (*Authenticator, error) {
+	a := &Authenticator{
+		users:      make(map[string]User),
+		tokens:     make(map[[sha256.Size]byte]Token),
+		sessionTTL: options.SessionTTL,
+		sessions:   make(map[[sha256.Size]byte]*session),
+		verified:   make(map[[sha256.Size]byte]time.Time),
+	}
+	if a.sessionTTL <= 0 {
+		a.sessionTTL = defaultSessionTTL
+	}
+
+	for _, u := range options.Users {
+		if u.Username == "" {
+			return nil, errors.New("user without a username")
+		}
+		if _, ok := a.users[u.Username]; ok {
+			return nil, fmt.Errorf("user %q is configured twice", u.Username)
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("user %q: password_hash is not a bcrypt hash: %w", u.Username, err)
+		}
+		if err := checkRole(u.Role); err != nil {
+			return nil, fmt.Errorf("user %q: %w", u.Username, err)
+		}
+		a.users[u.Username] = u
+	}
+
+	for _, t := range options.Tokens {
+		raw, err := hex.DecodeString(t.Hash)
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("token %q: hash must be a hex SHA-256", t.Name)
+		}
+		if err := checkRole(t.Role); err != nil {
+			return nil, fmt.Errorf("token %q: %w", t.Name, err)
+		}
+		a.tokens[[sha256.Size]byte(raw)] = t
+	}
+
+	if len(a.users) == 0 && len(a.tokens) == 0 {
+		return nil, errors.New("no users or tokens configured")
+	}
+	return a, nil
+}
+
+func checkRole(r Role) error {
+	if r < Viewer || r > Admin {
+		return fmt.Errorf("%w: %v", ErrInvalidRole, r)
+	}
+	return nil
+}
+
+// HashPassword returns the bcrypt hash to configure for a password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// GenerateToken returns a new random API token and the hash to configure
+// for it
+func GenerateToken() (token, hash string, err error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(raw)
+	sum := sha256.Sum256([]byte(token))
+	return token, hex.EncodeToString(sum[:]), nil
+}
+
+// CheckPassword returns the identity of a user if the password is right
+func (a *Authenticator) CheckPassword(username, password string) (Identity, error) {
+	u, ok := a.users[username]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return Identity{}, ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{Name: u.Username, Role: u.Role}, nil
+}
+
+// checkBasic is CheckPassword for credentials sent with every request
+func (a *Authenticator) checkBasic(username, password string) (Identity, error) {
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	now := time.Now()
+
+	a.mu.Lock()
+	expires, ok := a.verified[key]
+	a.mu.Unlock()
+	if ok && now.Before(expires) {
+		u := a.users[username]
+		return Identity{Name: u.Username, Role: u.Role}, nil
+	}
+
+	id, err := a.CheckPassword(username, password)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	a.mu.Lock()
+	for k, e := range a.verified {
+		if now.After(e) {
+			delete(a.verified, k)
+		}
+	}
+	a.verified[key] = now.Add(verifiedTTL)
+	a.mu.Unlock()
+	return id, nil
+}
+
+// checkToken returns the identity of an API token
+func (a *Authenticator) checkToken(token string) (Identity, bool) {
+	t, ok := a.tokens[sha256.Sum256([]byte(token))]
+	if !ok {
+		return Identity{}, false
+	}
+	return Identity{Name: t.Name, Role: t.Role, Token: true}, true
+}
+
+// newSession starts a browser session for a user and returns its secret
+func (a *Authenticator) newSession(username string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(raw)
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, s := range a.sessions {
+		if now.After(s.expires) {
+			delete(a.sessions, k)
+		}
+	}
+	a.sessions[sha256.Sum256([]byte(secret))] = &session{username: username, expires: now.Add(a.sessionTTL)}
+	return secret, nil
+}
+
+// checkSession returns the identity of a browser session
+func (a *Authenticator) checkSession(secret string) (Identity, bool) {
+	a.mu.Lock()
+	s, ok := a.sessions[sha256.Sum256([]byte(secret))]
+	a.mu.Unlock()
+	if !ok || time.Now().After(s.expires) {
+		return Identity{}, false
+	}
+	u, ok := a.users[s.username]
+	if !ok {
+		return Identity{}, false
+	}
+	return Identity{Name: u.Username, Role: u.Role}, true
+}
+
+// endSession logs a browser session out
+func (a *Authenticator) endSession(secret string) {
+	a.mu.Lock()
+	delete(a.sessions, sha256.Sum256([]byte(secret)))
+	a.mu.Unlock()
+}
+
+type contextKey struct{}
+
+// withIdentity returns a context carrying id
+func withIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns who made a request, if it was authenticated
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(Identity)
+	return id, ok
+}
@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hash is a bcrypt hash at the lowest cost, to keep the tests quick
+func hash(t *testing.T, password string) string {
+	t.Helper()
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	return string(h)
+}
+
+// newTestAuth creates an authenticator with a user and a token for each role.
+// Passwords are the usernames; the tokens are returned by role.
+func newTestAuth(t *testing.T) (*Authenticator, map[Role]string) {
+	t.Helper()
+	options := Options{}
+	tokens := make(map[Role]string)
+	for _, role := range []Role{Viewer, Uploader, Admin} {
+		options.Users = append(options.Users, User{Username: role.String(), PasswordHash: hash(t, role.String()), Role: role})
+		token, tokenHash, err := GenerateToken()
+		if err != nil {
+			t.Fatalf("GenerateToken failed: %v", err)
+		}
+		options.Tokens = append(options.Tokens, Token{Name: role.String() + "-script", Hash: tokenHash, Role: role})
+		tokens[role] = token
+	}
+	a, err := New(options)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return a, tokens
+}
+
+// newTestRouter groups routes by role the way embroidery-usbd does
+func newTestRouter(a *Authenticator) *mux.Router {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		id, _ := FromContext(r.Context())
+		w.Write([]byte(id.Name))
+	}
+	r := mux.NewRouter()
+	viewer := r.NewRoute().Subrouter()
+	uploader := r.NewRoute().Subrouter()
+	admin := r.NewRoute().Subrouter()
+	viewer.Use(a.Require(Viewer))
+	uploader.Use(a.Require(Uploader))
+	admin.Use(a.Require(Admin))
+
+	r.HandleFunc("/api/login", a.LoginHandler).Methods("POST")
+	r.HandleFunc("/api/logout", a.LogoutHandler).Methods("POST")
+	viewer.HandleFunc("/api/me", a.MeHandler).Methods("GET")
+	viewer.HandleFunc("/", ok).Methods("GET")
+	viewer.HandleFunc("/api/library", ok).Methods("GET")
+	uploader.HandleFunc("/api/library", ok).Methods("POST")
+	admin.HandleFunc("/api/clear", ok).Methods("POST")
+
+	davRouter := r.NewRoute().Subrouter()
+	davRouter.Use(a.RequireWebDAV())
+	davRouter.PathPrefix("/dav/").HandlerFunc(ok)
+	return r
+}
+
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestRoles tests that each role reaches its routes and no further
+func TestRoles(t *testing.T) {
+	a, tokens := newTestAuth(t)
+	router := newTestRouter(a)
+
+	tests := []struct {
+		method, path string
+		role         Role
+		want         int
+	}{
+		{"GET", "/api/library", Viewer, http.StatusOK},
+		{"POST", "/api/library", Viewer, http.StatusForbidden},
+		{"POST", "/api/library", Uploader, http.StatusOK},
+		{"POST", "/api/clear", Uploader, http.StatusForbidden},
+		{"POST", "/api/clear", Admin, http.StatusOK},
+		{"GET", "/api/library", Admin, http.StatusOK},
+		{"PUT", "/api/library", Admin, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tokens[tt.role])
+		if rec := serve(router, req); rec.Code != tt.want {
+			t.Errorf("%s %s as %v: expected %d, got %d", tt.method, tt.path, tt.role, tt.want, rec.Code)
+		}
+	}
+
+	// No credentials, or wrong ones
+	for _, header := range []string{"", "Bearer nope", "Basic " + basic("admin", "wrong")} {
+		req := httptest.NewRequest("POST", "/api/clear", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := serve(router, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: expected 401, got %d", header, rec.Code)
+		}
+		if rec.Header().Get("WWW-Authenticate") != "" {
+			t.Errorf("Expected no Basic challenge outside WebDAV, the browser would prompt for it")
+		}
+	}
+
+	// Scripts can use a password instead of a token
+	req := httptest.NewRequest("POST", "/api/clear", nil)
+	req.SetBasicAuth("admin", "admin")
+	if rec := serve(router, req); rec.Code != http.StatusOK || rec.Body.String() != "admin" {
+		t.Errorf("Basic auth: expected 200 as admin, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Browsers are sent to the login page
+	req = httptest.NewRequest("GET", "/?tab=sets", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rec := serve(router, req)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login?next="+url.QueryEscape("/?tab=sets") {
+		t.Errorf("Expected a redirect to the login page, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func basic(username, password string) string {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth(username, password)
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Basic ")
+}
+
+// TestSessions tests logging in and out from the browser
+func TestSessions(t *testing.T) {
+	a, _ := newTestAuth(t)
+	router := newTestRouter(a)
+
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"username": "uploader", "password": "wrong"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if rec := serve(router, req); rec.Code != http.StatusUnauthorized || len(rec.Result().Cookies()) != 0 {
+		t.Fatalf("Expected a wrong password to be refused, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"username": "uploader", "password": "uploader"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := serve(router, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Login failed: %d %s", rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != SessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("Expected an HttpOnly session cookie, got %v", cookies)
+	}
+	session := cookies[0]
+
+	req = httptest.NewRequest("GET", "/api/me", nil)
+	req.AddCookie(session)
+	rec = serve(router, req)
+	var me struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&me); err != nil || me.Username != "uploader" || me.Role != "uploader" {
+		t.Errorf("Expected /api/me to return the uploader, got %d %+v (%v)", rec.Code, me, err)
+	}
+
+	req = httptest.NewRequest("POST", "/api/clear", nil)
+	req.AddCookie(session)
+	if rec := serve(router, req); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected the uploader to be refused /api/clear, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/api/logout", nil)
+	req.AddCookie(session)
+	serve(router, req)
+	req = httptest.NewRequest("GET", "/api/me", nil)
+	req.AddCookie(session)
+	if rec := serve(router, req); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the session to end after logging out, got %d", rec.Code)
+	}
+}
+
+// TestLoginForm tests the login page's form, which redirects afterwards
+func TestLoginForm(t *testing.T) {
+	a, _ := newTestAuth(t)
+	router := newTestRouter(a)
+
+	tests := []struct {
+		password, next, want string
+	}{
+		{"viewer", "/?tab=sets", "/?tab=sets"},
+		{"viewer", "//evil.example.com/", "/"},
+		{"viewer", "https://evil.example.com/", "/"},
+		{"wrong", "/", "/login?failed=1&next=%2F"},
+	}
+	for _, tt := range tests {
+		form := url.Values{"username": {"viewer"}, "password": {tt.password}, "next": {tt.next}}
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := serve(router, req)
+		if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != tt.want {
+			t.Errorf("next %q: expected a redirect to %q, got %d %q", tt.next, tt.want, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
+
+// TestWebDAV tests the WebDAV middleware, which asks for a password and
+// lets viewers read
+func TestWebDAV(t *testing.T) {
+	a, _ := newTestAuth(t)
+	router := newTestRouter(a)
+
+	rec := serve(router, httptest.NewRequest("PROPFIND", "/dav/", nil))
+	if rec.Code != http.StatusUnauthorized || !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Basic ") {
+		t.Errorf("Expected a Basic challenge, got %d %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+
+	tests := []struct {
+		method string
+		user   string
+		want   int
+	}{
+		{"PROPFIND", "viewer", http.StatusOK},
+		{"GET", "viewer", http.StatusOK},
+		{"PUT", "viewer", http.StatusForbidden},
+		{"DELETE", "viewer", http.StatusForbidden},
+		{"PUT", "uploader", http.StatusOK},
+		{"MOVE", "uploader", http.StatusOK},
+	}
+	for _, tt := range tests {
+		// Twice, the second time from the cache of checked passwords
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(tt.method, "/dav/rose.dst", nil)
+			req.SetBasicAuth(tt.user, tt.user)
+			if rec := serve(router, req); rec.Code != tt.want {
+				t.Errorf("%s as %s: expected %d, got %d", tt.method, tt.user, tt.want, rec.Code)
+			}
+		}
+	}
+}
+
+// TestNew tests that bad users and tokens are refused at startup
+func TestNew(t *testing.T) {
+	good := hash(t, "secret")
+	_, tokenHash, _ := GenerateToken()
+
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"nothing configured", Options{}},
+		{"plain password", Options{Users: []User{{Username: "a", PasswordHash: "secret", Role: Admin}}}},
+		{"no role", Options{Users: []User{{Username: "a", PasswordHash: good}}}},
+		{"no username", Options{Users: []User{{PasswordHash: good, Role: Admin}}}},
+		{"duplicate user", Options{Users: []User{{Username: "a", PasswordHash: good, Role: Admin}, {Username: "a", PasswordHash: good, Role: Viewer}}}},
+		{"plain token", Options{Tokens: []Token{{Name: "t", Hash: "secret", Role: Admin}}}},
+		{"token without role", Options{Tokens: []Token{{Name: "t", Hash: tokenHash}}}},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.options); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+
+	if _, err := ParseRole("owner"); err == nil {
+		t.Error("Expected ParseRole to refuse an unknown role")
+	}
+	if role, err := ParseRole("Uploader"); err != nil || role != Uploader {
+		t.Errorf("ParseRole(\"Uploader\") = %v, %v", role, err)
+	}
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jgarman/embroidery-buddy/internal/api"
+)
+
+const (
+	// SessionCookie holds the session of a browser that logged in
+	SessionCookie = "embroidery_session"
+
+	// LoginPath is the page browsers are sent to when they need to log in
+	LoginPath = "/login"
+
+	realm = `Basic realm="Embroidery Buddy", charset="UTF-8"`
+)
+
+// Require returns middleware that only lets through requests from role or a
+// role above it. Browsers asking for a page without a session are sent to the
+// login page; other requests get 401.
+func (a *Authenticator) Require(role Role) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, ok := a.identify(r)
+			if !ok {
+				if wantsPage(r) {
+					http.Redirect(w, r, LoginPath+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+					return
+				}
+				api.WriteError(w, http.StatusUnauthorized, api.CodeUnauthorized, "authentication required")
+				return
+			}
+			if id.Role < role {
+				api.WriteError(w, http.StatusForbidden, api.CodeForbidden, "this needs the "+role.String()+" role")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), id)))
+		})
+	}
+}
+
+// RequireWebDAV returns middleware for the WebDAV handler. Reading needs the
+// viewer role and changing anything the uploader role. Clients without
+// credentials are asked for a username and password.
+func (a *Authenticator) RequireWebDAV() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role := Uploader
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+				role = Viewer
+			}
+
+			id, ok := a.identify(r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", realm)
+				http.Error(w, "Authentication required", http.StatusUnauthorized)
+				return
+			}
+			if id.Role < role {
+				http.Error(w, "This needs the "+role.String()+" role", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), id)))
+		})
+	}
+}
+
+// identify works out who made a request from its API token, Basic
+// credentials or session cookie
+func (a *Authenticator) identify(r *http.Request) (Identity, bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, credentials, _ := strings.Cut(header, " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			return a.checkToken(strings.TrimSpace(credentials))
+		}
+		if username, password, ok := r.BasicAuth(); ok {
+			id, err := a.checkBasic(username, password)
+			if err != nil {
+				log.Printf("Failed login for %q from %s", username, r.RemoteAddr)
+				return Identity{}, false
+			}
+			return id, true
+		}
+		return Identity{}, false
+	}
+
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		return a.checkSession(cookie.Value)
+	}
+	return Identity{}, false
+}
+
+// wantsPage reports whether a request is a browser loading a page, rather
+// than the UI's scripts or an API client
+func wantsPage(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// loginRequest is the body of a JSON login
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// LoginHandler logs a browser in and sets the session cookie. It takes JSON
+// ({"username": ..., "password": ...}) or the login page's form, which is
+// redirected to its "next" field afterwards.
+func (a *Authenticator) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	form := !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	if form {
+		if err := r.ParseForm(); err != nil {
+			api.WriteError(w, http.StatusBadRequest, api.CodeBadRequest, "invalid form")
+			return
+		}
+		req.Username = r.PostForm.Get("username")
+		req.Password = r.PostForm.Get("password")
+	} else if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		api.WriteError(w, http.StatusBadRequest, api.CodeBadRequest, "invalid request body")
+		return
+	}
+	next := safeNext(r.FormValue("next"))
+
+	id, err := a.CheckPassword(req.Username, req.Password)
+	if err != nil {
+		log.Printf("Failed login for %q from %s", req.Username, r.RemoteAddr)
+		if form {
+			http.Redirect(w, r, LoginPath+"?failed=1&next="+url.QueryEscape(next), http.StatusSeeOther)
+			return
+		}
+		api.WriteError(w, http.StatusUnauthorized, api.CodeUnauthorized, ErrInvalidCredentials.Error())
+		return
+	}
+
+	secret, err := a.newSession(id.Name)
+	if err != nil {
+		api.WriteError(w, http.StatusInternalServerError, api.CodeInternal, "failed to start session")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    secret,
+		Path:     "/",
+		MaxAge:   int(a.sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Printf("%s logged in from %s", id.Name, r.RemoteAddr)
+
+	if form {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	api.WriteJSON(w, http.StatusOK, newIdentityResponse(id))
+}
+
+// LogoutHandler ends the browser's session
+func (a *Authenticator) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		a.endSession(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	api.WriteJSON(w, http.StatusOK, api.OK)
+}
+
+// MeHandler returns who is logged in. It must be behind Require.
+func (a *Authenticator) MeHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := FromContext(r.Context())
+	if !ok {
+		api.WriteError(w, http.StatusUnauthorized, api.CodeUnauthorized, "authentication required")
+		return
+	}
+	api.WriteJSON(w, http.StatusOK, newIdentityResponse(id))
+}
+
+// identityResponse is returned by LoginHandler and MeHandler
+type identityResponse struct {
+	Success  bool   `json:"success"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+func newIdentityResponse(id Identity) identityResponse {
+	return identityResponse{Success: true, Username: id.Name, Role: id.Role.String()}
+}
+
+// safeNext returns where to go after logging in, refusing anything that
+// isn't a path on this server
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
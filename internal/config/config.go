@@ -2,9 +2,15 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
 )
 
 // Config represents the application configuration
@@ -21,6 +27,18 @@ type Config struct {
 	// Upload configuration
 	Upload UploadConfig `json:"upload"`
 
+	// Design library configuration
+	Library LibraryConfig `json:"library"`
+
+	// WebDAV access to the disk
+	WebDAV WebDAVConfig `json:"webdav"`
+
+	// FTP access to the disk
+	FTP FTPConfig `json:"ftp"`
+
+	// Logins for the web UI and API
+	Auth AuthConfig `json:"auth"`
+
 	// mDNS/Avahi configuration
 	MDNS MDNSConfig `json:"mdns"`
 }
@@ -37,10 +55,34 @@ type ServerConfig struct {
 
 	// CORS settings
 	CORS CORSConfig `json:"cors"`
+
+	// HTTPS settings
+	TLS TLSConfig `json:"tls"`
+}
+
+// TLSConfig contains HTTPS settings
+type TLSConfig struct {
+	// Serve HTTPS as well as HTTP
+	Enabled bool `json:"enabled"`
+
+	// HTTPS port
+	Port int `json:"port"`
+
+	// PEM certificate and key ("" to use a self-signed certificate)
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// Directory the self-signed certificate is kept in
+	SelfSignedDir string `json:"self_signed_dir"`
+
+	// Redirect HTTP requests to HTTPS instead of serving them
+	RedirectHTTP bool `json:"redirect_http"`
 }
 
 // CORSConfig contains CORS settings
 type CORSConfig struct {
+	// Sites allowed to call the API from the browser, e.g. "https://example.com"
+	// (empty allows none besides the device itself)
 	AllowedOrigins   []string `json:"allowed_origins"`
 	AllowedMethods   []string `json:"allowed_methods"`
 	AllowedHeaders   []string `json:"allowed_headers"`
@@ -54,6 +96,42 @@ type DiskConfig struct {
 
 	// Auto-create the disk image if it doesn't exist
 	AutoCreate bool `json:"auto_create"`
+
+	// Directory of additional disk images that can be swapped in ("" to disable)
+	ImagesDir string `json:"images_dir"`
+
+	// Re-sort directories after every write: "name", "time" (upload order) or "" to disable
+	AutoSort string `json:"auto_sort"`
+
+	// Directory of point-in-time copies of the disk image ("" to disable)
+	SnapshotDir string `json:"snapshot_dir"`
+
+	// Number of snapshots to keep, oldest removed first (0 keeps all)
+	SnapshotLimit int `json:"snapshot_limit"`
+
+	// Filesystem of new disk images: "fat32" or "fat16"
+	Filesystem string `json:"filesystem"`
+
+	// Partition table of new disk images: "none" (superfloppy) or "mbr"
+	PartitionTable string `json:"partition_table"`
+
+	// Cluster size in bytes (0 picks one based on the disk size)
+	ClusterSize int `json:"cluster_size"`
+
+	// Volume label, up to 11 characters
+	Label string `json:"label"`
+
+	// Filesystem check before the disk is presented: "check", "repair" or "off"
+	StartupCheck string `json:"startup_check"`
+
+	// How uploads write to the image: "shadow" (copy, then swap in) or "direct" (in place)
+	TransactionMode string `json:"transaction_mode"`
+
+	// How files are written into the image: "fat" (in-process), "loopback" or "diskfs"
+	Writer string `json:"writer"`
+
+	// What to do with uploads already on the disk under another name: "keep", "skip" or "replace"
+	DuplicatePolicy string `json:"duplicate_policy"`
 }
 
 // USBGadgetConfig contains USB gadget settings
@@ -74,6 +152,110 @@ type USBGadgetConfig struct {
 type UploadConfig struct {
 	// Maximum upload size in MB
 	MaxSizeMB int64 `json:"max_size_mb"`
+
+	// How uploaded filenames are stored on the disk
+	Filenames FilenameConfig `json:"filenames"`
+
+	// Directory resumable uploads are staged in until their last chunk
+	// arrives (empty disables resumable uploads)
+	StagingDir string `json:"staging_dir"`
+
+	// Most the staged uploads may take up together, in MB (0 for no limit)
+	StagingMaxMB int64 `json:"staging_max_mb"`
+
+	// Hours after its last chunk that an unfinished upload is deleted (0
+	// keeps them until cancelled)
+	AbandonHours int `json:"abandon_hours"`
+}
+
+// FilenameConfig contains the filename policy for the target machine
+type FilenameConfig struct {
+	// Naming mode: "preserve", "ascii" (transliterate to ASCII) or "8.3" (DOS short names)
+	Mode string `json:"mode"`
+
+	// Maximum filename length including extension (0 for no limit, ignored for 8.3)
+	MaxLength int `json:"max_length"`
+
+	// What to do when a name is taken: "overwrite" or "rename" (add a numeric suffix)
+	OnCollision string `json:"on_collision"`
+}
+
+// LibraryConfig contains settings for the design library kept outside the disk image
+type LibraryConfig struct {
+	// Enable the design library
+	Enabled bool `json:"enabled"`
+
+	// Directory holding the library files and index
+	Path string `json:"path"`
+}
+
+// WebDAVConfig contains settings for mounting the disk over WebDAV
+type WebDAVConfig struct {
+	// Serve the disk under /dav/
+	Enabled bool `json:"enabled"`
+
+	// How long to wait for more changes before writing them to the disk, in
+	// milliseconds. Every write disconnects the USB gadget, so copying a
+	// folder should end up as one write. FTP uploads wait the same way.
+	CommitDelayMS int `json:"commit_delay_ms"`
+}
+
+// FTPConfig contains settings for the FTP server
+type FTPConfig struct {
+	// Enable the FTP server
+	Enabled bool `json:"enabled"`
+
+	// Port of the control connection
+	Port int `json:"port"`
+
+	// Range of ports for passive data connections (0 lets the system choose)
+	PassivePortMin int `json:"passive_port_min"`
+	PassivePortMax int `json:"passive_port_max"`
+
+	// IPv4 address announced for passive connections ("" uses the address the client connected to)
+	PublicHost string `json:"public_host"`
+
+	// Usernames from auth.users allowed to log in over FTP, which sends
+	// passwords in the clear
+	Users []string `json:"users"`
+}
+
+// AuthConfig contains the accounts allowed to use the web UI, API and WebDAV
+type AuthConfig struct {
+	// Require a login (when disabled anyone on the network has full access)
+	Enabled bool `json:"enabled"`
+
+	// Accounts that log in with a password
+	Users []AuthUser `json:"users"`
+
+	// API tokens for scripts, sent as "Authorization: Bearer <token>"
+	Tokens []AuthToken `json:"tokens"`
+
+	// How long a browser stays logged in, in hours
+	SessionHours int `json:"session_hours"`
+}
+
+// AuthUser is an account for the web UI and API
+type AuthUser struct {
+	Username string `json:"username"`
+
+	// bcrypt hash of the password (embroidery-usbd -hash-password prints one)
+	PasswordHash string `json:"password_hash"`
+
+	// "viewer", "uploader" or "admin"
+	Role string `json:"role"`
+}
+
+// AuthToken is an API token
+type AuthToken struct {
+	// Name shown in logs
+	Name string `json:"name"`
+
+	// Hex SHA-256 of the token (embroidery-usbd -generate-token prints one)
+	Hash string `json:"hash"`
+
+	// "viewer", "uploader" or "admin"
+	Role string `json:"role"`
 }
 
 // MDNSConfig contains mDNS/Avahi service discovery settings
@@ -101,16 +283,35 @@ func Default() *Config {
 			WriteTimeout: 15,
 			IdleTimeout:  60,
 			CORS: CORSConfig{
-				AllowedOrigins:   []string{"*"},
-				AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-				AllowedHeaders:   []string{"*"},
-				AllowCredentials: true,
+				AllowedOrigins: []string{},
+				AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+				AllowedHeaders: []string{
+					"Authorization", "Content-Type", "X-CSRF-Token", "X-Requested-With",
+					"Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata",
+				},
+				AllowCredentials: false,
+			},
+			TLS: TLSConfig{
+				Enabled:       false,
+				Port:          8443,
+				SelfSignedDir: "/var/lib/embroidery-buddy/tls",
+				RedirectHTTP:  true,
 			},
 		},
 		Disk: DiskConfig{
-			Path:       "/var/lib/embroidery-buddy/disk.img",
-			SizeMB:     100,
-			AutoCreate: true,
+			Path:            "/var/lib/embroidery-buddy/disk.img",
+			SizeMB:          100,
+			AutoCreate:      true,
+			ImagesDir:       "/var/lib/embroidery-buddy/images",
+			SnapshotDir:     "/var/lib/embroidery-buddy/snapshots",
+			SnapshotLimit:   5,
+			Filesystem:      "fat32",
+			PartitionTable:  "none",
+			Label:           "EMBROIDERY",
+			StartupCheck:    "check",
+			TransactionMode: "shadow",
+			Writer:          "fat",
+			DuplicatePolicy: "keep",
 		},
 		USBGadget: USBGadgetConfig{
 			ShortName:    "embroidery",
@@ -124,6 +325,32 @@ func Default() *Config {
 		},
 		Upload: UploadConfig{
 			MaxSizeMB: 100,
+			Filenames: FilenameConfig{
+				Mode:        "preserve",
+				MaxLength:   0,
+				OnCollision: "overwrite",
+			},
+			StagingDir:   "/var/lib/embroidery-buddy/uploads",
+			StagingMaxMB: 1024,
+			AbandonHours: 24,
+		},
+		Library: LibraryConfig{
+			Enabled: true,
+			Path:    "/var/lib/embroidery-buddy/library",
+		},
+		WebDAV: WebDAVConfig{
+			Enabled:       true,
+			CommitDelayMS: 2000,
+		},
+		FTP: FTPConfig{
+			Enabled:        false,
+			Port:           21,
+			PassivePortMin: 50000,
+			PassivePortMax: 50100,
+		},
+		Auth: AuthConfig{
+			Enabled:      false,
+			SessionHours: 168,
 		},
 		MDNS: MDNSConfig{
 			Enabled:     true,
@@ -156,10 +383,73 @@ func Load(path string) (*Config, error) {
 	if err := json.Unmarshal(data, config); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
+	config.migrate()
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
 
 	return config, nil
 }
 
+// migrate updates settings older releases accepted but are no longer safe,
+// so existing config files keep working
+func (c *Config) migrate() {
+	// Older releases shipped any origin with credentials
+	if cors := &c.Server.CORS; cors.AllowCredentials && cors.allowsAnyOrigin() {
+		log.Printf(`Warning: server.cors: allow_credentials is ignored with allowed_origins "*"; list the origins that need the session instead`)
+		cors.AllowCredentials = false
+	}
+}
+
+// Validate checks settings that would be unsafe, or only fail once the server
+// is running
+func (c *Config) Validate() error {
+	if err := c.Server.CORS.Validate(); err != nil {
+		return fmt.Errorf("server.cors: %w", err)
+	}
+	return nil
+}
+
+// Validate checks that the origins are origins and the methods and headers
+// are valid names. Any origin ("*") can't be combined with credentials, as
+// every site on the internet could then act as the logged-in user.
+func (c CORSConfig) Validate() error {
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				return errors.New(`allowed_origins "*" can't be used with allow_credentials, list the origins instead`)
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			u.User != nil || u.Path != "" || u.RawQuery != "" || u.Fragment != "" || strings.Count(origin, "*") > 1 {
+			return fmt.Errorf(`allowed_origins: %q is not an origin like "https://example.com"`, origin)
+		}
+	}
+	for _, method := range c.AllowedMethods {
+		if !httpguts.ValidHeaderFieldName(method) {
+			return fmt.Errorf("allowed_methods: invalid method %q", method)
+		}
+	}
+	for _, header := range c.AllowedHeaders {
+		if header != "*" && !httpguts.ValidHeaderFieldName(header) {
+			return fmt.Errorf("allowed_headers: invalid header %q", header)
+		}
+	}
+	return nil
+}
+
+// allowsAnyOrigin reports whether "*" is one of the allowed origins
+func (c CORSConfig) allowsAnyOrigin() bool {
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			return true
+		}
+	}
+	return false
+}
+
 // Save writes the configuration to a JSON file
 func (c *Config) Save(path string) error {
 	// Ensure directory exists
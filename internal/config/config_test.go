@@ -0,0 +1,41 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLoadWildcardCredentials tests that the CORS settings older releases
+// shipped still load, without the credentials
+func TestLoadWildcardCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"server": {"cors": {"allowed_origins": ["*"], "allow_credentials": true}}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Server.CORS.AllowCredentials {
+		t.Error("Expected credentials to be dropped for any origin")
+	}
+	if len(cfg.Server.CORS.AllowedOrigins) != 1 || cfg.Server.CORS.AllowedOrigins[0] != "*" {
+		t.Errorf("Expected the origins to be kept, got %v", cfg.Server.CORS.AllowedOrigins)
+	}
+}
+
+// TestLoadInvalidOrigin tests that an origin that isn't one is still refused
+func TestLoadInvalidOrigin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"server": {"cors": {"allowed_origins": ["example.com/path"]}}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	if _, err := Load(path); err == nil {
+		t.Error("Expected an error for an invalid origin")
+	}
+}
@@ -0,0 +1,135 @@
+// Package csrf stops other websites from using a visitor's browser to change
+// things on the device, such as clearing the disk with a hidden form.
+//
+// Every browser gets a random token in a cookie, which the pages it is served
+// repeat in a header or form field when they change something. Another site
+// can make the browser send the cookie but can't read it, so it can't repeat
+// the token. API clients don't need a token: a JSON body, a bearer token or an
+// X-Requested-With or Tus-Resumable header can't be sent cross-site without a
+// CORS preflight, which the server refuses unless the site is an allowed
+// origin.
+package csrf
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jgarman/embroidery-buddy/internal/api"
+)
+
+const (
+	// CookieName holds the browser's token
+	CookieName = "embroidery_csrf"
+
+	// HeaderName is the header the web UI's scripts send the token in
+	HeaderName = "X-CSRF-Token"
+
+	// FormField is the form field HTML forms send the token in
+	FormField = "csrf_token"
+
+	// ClientHeader marks a request from an API client rather than a page
+	ClientHeader = "X-Requested-With"
+
+	// TusHeader marks a request from a tus client uploading a file
+	TusHeader = "Tus-Resumable"
+
+	tokenBytes = 32
+
+	// cookieAge is how long a browser keeps its token, long enough that
+	// pages restored after restarting the browser still work
+	cookieAge = 365 * 24 * time.Hour
+)
+
+type contextKey struct{}
+
+// Protect is middleware that gives each browser a token and refuses requests
+// that change something unless they carry it or come from an API client.
+func Protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if cookie, err := r.Cookie(CookieName); err == nil && validToken(cookie.Value) {
+			token = cookie.Value
+		}
+		if token == "" {
+			token = newToken()
+			http.SetCookie(w, &http.Cookie{
+				Name:     CookieName,
+				Value:    token,
+				Path:     "/",
+				MaxAge:   int(cookieAge.Seconds()),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		r = r.WithContext(context.WithValue(r.Context(), contextKey{}, token))
+
+		if !safeMethod(r.Method) && !allowed(r, token) {
+			api.WriteError(w, http.StatusForbidden, api.CodeInvalidCSRFToken,
+				"missing or invalid CSRF token, reload the page")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Token returns the browser's token, for pages to repeat. The request must
+// have been through Protect.
+func Token(r *http.Request) string {
+	token, _ := r.Context().Value(contextKey{}).(string)
+	return token
+}
+
+// safeMethod reports whether a method only reads
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// allowed reports whether a request that changes something carries the token
+// or comes from an API client
+func allowed(r *http.Request, token string) bool {
+	if sameToken(r.Header.Get(HeaderName), token) {
+		return true
+	}
+	if r.Header.Get(ClientHeader) != "" || r.Header.Get(TusHeader) != "" {
+		return true
+	}
+	if scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " "); strings.EqualFold(scheme, "Bearer") {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		return true
+	case "application/x-www-form-urlencoded":
+		return sameToken(r.PostFormValue(FormField), token)
+	}
+	return false
+}
+
+func sameToken(got, want string) bool {
+	return got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+func newToken() string {
+	raw := make([]byte, tokenBytes)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// validToken reports whether a cookie holds a token this package made
+func validToken(token string) bool {
+	raw, err := hex.DecodeString(token)
+	return err == nil && len(raw) == tokenBytes
+}
@@ -0,0 +1,98 @@
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// handler echoes the token Protect passed on
+var handler = Protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(Token(r)))
+}))
+
+func serve(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// visit loads a page the way a browser does the first time, returning the
+// cookie it is given
+func visit(t *testing.T) *http.Cookie {
+	t.Helper()
+	rec := serve(httptest.NewRequest("GET", "/", nil))
+	cookies := rec.Result().Cookies()
+	if rec.Code != http.StatusOK || len(cookies) != 1 || cookies[0].Name != CookieName {
+		t.Fatalf("Expected a token cookie, got %d %v", rec.Code, cookies)
+	}
+	if !cookies[0].HttpOnly || cookies[0].Value != rec.Body.String() {
+		t.Fatalf("Expected an HttpOnly cookie holding the page's token, got %+v and %q", cookies[0], rec.Body.String())
+	}
+	return cookies[0]
+}
+
+// TestProtect tests which requests that change something get through
+func TestProtect(t *testing.T) {
+	cookie := visit(t)
+	token := cookie.Value
+	form := url.Values{FormField: {token}}.Encode()
+
+	tests := []struct {
+		name    string
+		method  string
+		body    string
+		headers map[string]string
+		cookie  bool
+		want    int
+	}{
+		{"GET without a token", "GET", "", nil, true, http.StatusOK},
+		{"POST without a token", "POST", "", nil, true, http.StatusForbidden},
+		{"DELETE without a token", "DELETE", "", nil, true, http.StatusForbidden},
+		{"header token", "POST", "", map[string]string{HeaderName: token}, true, http.StatusOK},
+		{"wrong header token", "POST", "", map[string]string{HeaderName: strings.Repeat("0", 64)}, true, http.StatusForbidden},
+		{"header token without the cookie", "POST", "", map[string]string{HeaderName: token}, false, http.StatusForbidden},
+		{"form token", "POST", form, map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, true, http.StatusOK},
+		{"form without a token", "POST", "a=b", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, true, http.StatusForbidden},
+		{"multipart form", "POST", "", map[string]string{"Content-Type": "multipart/form-data; boundary=x"}, true, http.StatusForbidden},
+		{"text/plain body", "POST", `{"path": "/"}`, map[string]string{"Content-Type": "text/plain"}, true, http.StatusForbidden},
+		{"JSON body", "POST", `{"path": "/"}`, map[string]string{"Content-Type": "application/json; charset=utf-8"}, false, http.StatusOK},
+		{"API client header", "DELETE", "", map[string]string{ClientHeader: "embroidery-cli"}, false, http.StatusOK},
+		{"tus client", "PATCH", "", map[string]string{TusHeader: "1.0.0"}, false, http.StatusOK},
+		{"bearer token", "PUT", "", map[string]string{"Authorization": "Bearer abc"}, false, http.StatusOK},
+		{"Basic credentials", "PUT", "", map[string]string{"Authorization": "Basic YTpi"}, false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/api/clear", strings.NewReader(tt.body))
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		if tt.cookie {
+			req.AddCookie(cookie)
+		}
+		if rec := serve(req); rec.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, rec.Code)
+		}
+	}
+}
+
+// TestCookie tests that a browser keeps its token and a bad cookie is replaced
+func TestCookie(t *testing.T) {
+	cookie := visit(t)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	rec := serve(req)
+	if len(rec.Result().Cookies()) != 0 || rec.Body.String() != cookie.Value {
+		t.Errorf("Expected the browser's token to be kept, got %v", rec.Result().Cookies())
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: "chosen-by-attacker"})
+	rec = serve(req)
+	if cookies := rec.Result().Cookies(); len(cookies) != 1 || cookies[0].Value == "chosen-by-attacker" {
+		t.Errorf("Expected a malformed token to be replaced, got %v", cookies)
+	}
+}
@@ -0,0 +1,540 @@
+// Package dav serves the disk over WebDAV so it can be mounted from Finder or
+// Windows Explorer.
+//
+// Every write to the disk disconnects the USB gadget, so changes are not
+// written one request at a time. They are held in memory, shown to WebDAV
+// clients as if they were already on the disk, and written in one transaction
+// once no more have arrived for a short while. Twenty files copied at once
+// reconnect the machine once rather than twenty times. A file's upload only
+// succeeds once the transaction writing it has. The FTP server shares the same
+// FileSystem, so its uploads are batched with WebDAV's.
+package dav
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+	"github.com/jgarman/embroidery-buddy/internal/fat"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	// ErrClosed is returned for changes made after Close
+	ErrClosed = errors.New("webdav filesystem is closed")
+
+	// ErrFileTooLarge is returned when a file is bigger than Options.MaxFileSize
+	ErrFileTooLarge = errors.New("file too large")
+
+	// errCaseMismatch refuses to delete a file named with different case
+	errCaseMismatch = errors.New("name differs in case from the file on the disk")
+)
+
+// maxPending is how much file data is held before the pending changes are
+// written without waiting for the delay to pass
+const maxPending = 32 * 1024 * 1024
+
+// Options configures a FileSystem
+type Options struct {
+	// Delay is how long to wait after a change for more before writing them
+	// all to the disk. A steady stream of changes is written at least every
+	// five delays.
+	Delay time.Duration
+
+	// MaxFileSize limits the size of a single file (0 for no limit)
+	MaxFileSize int64
+}
+
+// FileSystem is a webdav.FileSystem on the disk of a Manager
+type FileSystem struct {
+	manager *diskmanager.Manager
+	options Options
+
+	mu sync.Mutex
+
+	// overlay holds the changes not yet on the disk, keyed by lower-case path
+	overlay map[string]*entry
+
+	// ops are the changes for the next transaction, in order
+	ops     []op
+	pending int64
+
+	// gen numbers the batch collecting changes, and batch reports its result
+	gen     uint64
+	batch   *batch
+	started time.Time
+	timer   *time.Timer
+	closed  bool
+
+	// commitMu keeps transactions in order
+	commitMu sync.Mutex
+}
+
+// entry is a change not yet on the disk
+type entry struct {
+	path    string // as named by the client
+	dir     bool
+	deleted bool
+	data    []byte
+	modTime time.Time
+
+	// gen is the batch that will write the change
+	gen uint64
+
+	// local entries are never written to the disk
+	local bool
+}
+
+// batch is the result of the transaction writing a set of changes
+type batch struct {
+	// done is closed once the transaction has run
+	done chan struct{}
+	err  error
+}
+
+func newBatch() *batch {
+	return &batch{done: make(chan struct{})}
+}
+
+// wait returns the error of the transaction
+func (b *batch) wait() error {
+	<-b.done
+	return b.err
+}
+
+type opKind int
+
+const (
+	opWrite opKind = iota
+	opRemove
+	opMkdir
+)
+
+// op is a change to apply in the next transaction
+type op struct {
+	kind opKind
+	path string
+	data []byte
+}
+
+// New creates a WebDAV filesystem on the disk of manager
+func New(manager *diskmanager.Manager, options Options) *FileSystem {
+	return &FileSystem{
+		manager: manager,
+		options: options,
+		overlay: make(map[string]*entry),
+		batch:   newBatch(),
+	}
+}
+
+// Handler returns an HTTP handler serving fs under prefix (e.g. "/dav")
+func (fs *FileSystem) Handler(prefix string) http.Handler {
+	h := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("WebDAV %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			h.ServeHTTP(w, r)
+			return
+		}
+		pw := &putWriter{ResponseWriter: w}
+		h.ServeHTTP(pw, r.WithContext(context.WithValue(r.Context(), putWriterKey{}, pw)))
+	})
+}
+
+// putWriterKey finds the putWriter of a PUT in its request's context
+type putWriterKey struct{}
+
+// putWriter reports a PUT whose file couldn't be written to the disk. webdav
+// answers 405 to any PUT that fails; the file records why when it is closed.
+type putWriter struct {
+	http.ResponseWriter
+	err      error
+	replaced bool
+}
+
+func (w *putWriter) WriteHeader(code int) {
+	if code != http.StatusMethodNotAllowed || w.err == nil {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	status := http.StatusInternalServerError
+	if errors.Is(w.err, diskmanager.ErrDiskFull) {
+		status = http.StatusInsufficientStorage
+	}
+	w.ResponseWriter.WriteHeader(status)
+	w.ResponseWriter.Write([]byte(http.StatusText(status)))
+	w.replaced = true
+}
+
+func (w *putWriter) Write(p []byte) (int, error) {
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush writes the pending changes to the disk now
+func (fs *FileSystem) Flush() error {
+	fs.commitMu.Lock()
+	defer fs.commitMu.Unlock()
+
+	fs.mu.Lock()
+	ops := fs.ops
+	gen := fs.gen
+	b := fs.batch
+	fs.batch = newBatch()
+	fs.ops = nil
+	fs.pending = 0
+	fs.gen++
+	if fs.timer != nil {
+		fs.timer.Stop()
+		fs.timer = nil
+	}
+	fs.mu.Unlock()
+
+	var err error
+	if len(ops) > 0 {
+		log.Printf("Writing %d pending changes to the disk", len(ops))
+		err = fs.manager.BeginTransaction(func(tx *diskmanager.Transaction) error {
+			// Clients copy what they mean to, duplicates included
+			if err := tx.SetDuplicatePolicy(diskmanager.DuplicateKeep); err != nil {
+				return err
+			}
+			return apply(tx, ops)
+		})
+		if err != nil {
+			log.Printf("Failed to write %d pending changes to the disk: %v", len(ops), err)
+		}
+	}
+
+	// The disk now shows the batch, or the batch is lost
+	fs.mu.Lock()
+	for key, e := range fs.overlay {
+		if e.gen <= gen && !e.local {
+			delete(fs.overlay, key)
+		}
+	}
+	fs.mu.Unlock()
+
+	b.err = err
+	close(b.done)
+	return err
+}
+
+// Close writes the pending changes and refuses any more
+func (fs *FileSystem) Close() error {
+	fs.mu.Lock()
+	fs.closed = true
+	fs.mu.Unlock()
+	return fs.Flush()
+}
+
+// apply makes the changes of a batch in a transaction
+func apply(tx *diskmanager.Transaction, ops []op) error {
+	for _, o := range ops {
+		var err error
+		switch o.kind {
+		case opWrite:
+			err = tx.WriteFile(o.path, bytes.NewReader(o.data), int64(len(o.data)))
+		case opMkdir:
+			err = tx.Mkdir(o.path)
+		case opRemove:
+			err = tx.RemoveFile(o.path)
+			switch {
+			case errors.Is(err, diskmanager.ErrFileNotFound):
+				// Created and removed within the batch, or removed elsewhere
+				err = nil
+			case errors.Is(err, diskmanager.ErrDirectoryNotEmpty):
+				// Something else wrote to the directory in the meantime
+				log.Printf("Keeping %s, which is no longer empty", o.path)
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queue records a change and schedules the transaction that writes it.
+// The caller must hold fs.mu.
+func (fs *FileSystem) queue(e *entry, kind opKind) error {
+	if fs.closed {
+		return ErrClosed
+	}
+	key := keyOf(e.path)
+
+	// Finder metadata only lives as long as the server
+	if isLocalOnly(e.path) {
+		e.local = true
+		if e.deleted {
+			delete(fs.overlay, key)
+		} else {
+			fs.overlay[key] = e
+		}
+		return nil
+	}
+
+	e.gen = fs.gen
+	fs.overlay[key] = e
+
+	// A later write or removal makes earlier writes of the path pointless
+	if kind != opMkdir {
+		kept := fs.ops[:0]
+		for _, o := range fs.ops {
+			if o.kind == opWrite && keyOf(o.path) == key {
+				fs.pending -= int64(len(o.data))
+				continue
+			}
+			kept = append(kept, o)
+		}
+		fs.ops = kept
+	}
+	fs.ops = append(fs.ops, op{kind: kind, path: e.path, data: e.data})
+	fs.pending += int64(len(e.data))
+
+	fs.schedule()
+	return nil
+}
+
+// schedule (re)starts the delay before the next transaction. The caller must
+// hold fs.mu.
+func (fs *FileSystem) schedule() {
+	if fs.pending >= maxPending {
+		if fs.timer != nil {
+			fs.timer.Stop()
+			fs.timer = nil
+		}
+		go fs.flushLogged()
+		return
+	}
+
+	if fs.timer == nil {
+		fs.started = time.Now()
+		fs.timer = time.AfterFunc(fs.options.Delay, fs.flushLogged)
+		return
+	}
+	if time.Since(fs.started) < 5*fs.options.Delay {
+		fs.timer.Reset(fs.options.Delay)
+	}
+}
+
+// flushLogged runs Flush from a timer; Flush logs its own errors
+func (fs *FileSystem) flushLogged() {
+	_ = fs.Flush()
+}
+
+// lookup returns the pending change of a path, if there is one
+func (fs *FileSystem) lookup(p string) (*entry, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	e, ok := fs.overlay[keyOf(p)]
+	return e, ok
+}
+
+// stat returns the file or directory at p as the client sees it
+func (fs *FileSystem) stat(p string) (*fileInfo, error) {
+	if p == "/" {
+		return &fileInfo{name: "/", dir: true}, nil
+	}
+	if e, ok := fs.lookup(p); ok {
+		if e.deleted {
+			return nil, os.ErrNotExist
+		}
+		return e.info(), nil
+	}
+
+	entries, err := fs.manager.ReadDir(path.Dir(p))
+	if err != nil {
+		if errors.Is(err, diskmanager.ErrFileNotFound) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	for _, e := range entries {
+		if strings.EqualFold(e.Name(), path.Base(p)) {
+			return diskInfo(e), nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// readDir lists a directory as the client sees it
+func (fs *FileSystem) readDir(p string) ([]*fileInfo, error) {
+	info, err := fs.stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !info.dir {
+		return nil, fmt.Errorf("%s is not a directory", p)
+	}
+
+	// A directory created through WebDAV may not be on the disk yet
+	entries, err := fs.manager.ReadDir(p)
+	if err != nil && !errors.Is(err, diskmanager.ErrFileNotFound) {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var list []*fileInfo
+	seen := make(map[string]bool)
+	for _, d := range entries {
+		key := keyOf(path.Join(p, d.Name()))
+		seen[key] = true
+		if e, ok := fs.overlay[key]; ok {
+			if !e.deleted {
+				list = append(list, e.info())
+			}
+			continue
+		}
+		list = append(list, diskInfo(d))
+	}
+
+	var added []*fileInfo
+	dirKey := keyOf(p)
+	for key, e := range fs.overlay {
+		if !seen[key] && !e.deleted && keyOf(path.Dir(e.path)) == dirKey {
+			added = append(added, e.info())
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i].name < added[j].name })
+	return append(list, added...), nil
+}
+
+// readFile returns the contents of a file as the client sees it
+func (fs *FileSystem) readFile(p string) ([]byte, error) {
+	if e, ok := fs.lookup(p); ok {
+		if e.deleted || e.dir {
+			return nil, os.ErrNotExist
+		}
+		return e.data, nil
+	}
+
+	r, err := fs.manager.ReadFile(p)
+	if err != nil {
+		if errors.Is(err, diskmanager.ErrFileNotFound) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	defer r.Close()
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// checkParent checks that the directory a new entry goes into exists
+func (fs *FileSystem) checkParent(p string) error {
+	parent, err := fs.stat(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	if !parent.dir {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// writeFile queues a file's new contents. It returns the batch that will
+// write them, or nil for files that never reach the disk.
+func (fs *FileSystem) writeFile(p string, data []byte) (*batch, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	e := &entry{path: p, data: data, modTime: time.Now()}
+	if err := fs.queue(e, opWrite); err != nil {
+		return nil, err
+	}
+	if e.local {
+		return nil, nil
+	}
+	return fs.batch, nil
+}
+
+// remove queues the removal of a file or empty directory
+func (fs *FileSystem) remove(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.queue(&entry{path: p, deleted: true}, opRemove)
+}
+
+// mkdir queues a new directory
+func (fs *FileSystem) mkdir(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.queue(&entry{path: p, dir: true, modTime: time.Now()}, opMkdir)
+}
+
+// treeNode is a file or directory being removed or moved
+type treeNode struct {
+	rel  string // path below the root of the tree ("" for the root)
+	info *fileInfo
+}
+
+// tree lists p and everything below it, parents before their children
+func (fs *FileSystem) tree(p string, info *fileInfo) ([]treeNode, error) {
+	nodes := []treeNode{{info: info}}
+	for i := 0; i < len(nodes); i++ {
+		if !nodes[i].info.dir {
+			continue
+		}
+		children, err := fs.readDir(path.Join(p, nodes[i].rel))
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range children {
+			nodes = append(nodes, treeNode{rel: path.Join(nodes[i].rel, c.name), info: c})
+		}
+	}
+	return nodes, nil
+}
+
+// cleanPath turns a WebDAV name into an absolute path on the disk
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// keyOf folds case the way FAT compares names
+func keyOf(p string) string {
+	return strings.ToLower(cleanPath(p))
+}
+
+// validName checks that the last element of p can be stored on the disk
+func validName(p string) error {
+	if err := fat.ValidateName(path.Base(p)); err != nil {
+		return &os.PathError{Op: "create", Path: p, Err: err}
+	}
+	return nil
+}
+
+// isLocalOnly reports whether p is metadata macOS writes next to every file
+// (AppleDouble "._" files and .DS_Store). These are kept in memory so Finder
+// is happy, but never reach the machine.
+func isLocalOnly(p string) bool {
+	name := path.Base(p)
+	return strings.HasPrefix(name, "._") || name == ".DS_Store"
+}
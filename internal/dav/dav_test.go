@@ -0,0 +1,301 @@
+package dav
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+)
+
+// newTestFS creates a WebDAV filesystem on a fresh disk image. The delay is
+// long enough that tests decide when changes are written.
+func newTestFS(t *testing.T) (*FileSystem, *diskmanager.Manager, *diskmanager.NoOpUsbGadget) {
+	t.Helper()
+	diskPath := filepath.Join(t.TempDir(), "test.img")
+	if err := diskmanager.CreateDiskImage(diskPath, 10, diskmanager.DiskFormat{}); err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+	gadget := diskmanager.NewNoOpUsbGadget()
+	manager, err := diskmanager.New(diskmanager.Config{DiskPath: diskPath}, gadget)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	t.Cleanup(func() { manager.Close() })
+	gadget.ResetCounts()
+
+	return New(manager, Options{Delay: time.Hour}), manager, gadget
+}
+
+// put writes a file and returns once its contents are pending. Closing the
+// file waits for them to be written, so that finishes in the background; the
+// returned function waits for it.
+func put(t *testing.T, fs *FileSystem, name, contents string) func() error {
+	t.Helper()
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile %s failed: %v", name, err)
+	}
+	if _, err := io.WriteString(f, contents); err != nil {
+		t.Fatalf("Write %s failed: %v", name, err)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- f.Close() }()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if e, ok := fs.lookup(cleanPath(name)); ok && string(e.data) == contents {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never became pending", name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return func() error { return <-closed }
+}
+
+func read(t *testing.T, fs *FileSystem, name string) string {
+	t.Helper()
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile %s failed: %v", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Read %s failed: %v", name, err)
+	}
+	return string(data)
+}
+
+// diskNames lists a directory of the disk image itself
+func diskNames(t *testing.T, manager *diskmanager.Manager, dir string) []string {
+	t.Helper()
+	entries, err := manager.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir %s failed: %v", dir, err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestBatchedWrites tests that a burst of writes reaches the disk in one
+// transaction, and is visible to WebDAV clients before it does
+func TestBatchedWrites(t *testing.T) {
+	fs, manager, gadget := newTestFS(t)
+	ctx := context.Background()
+
+	if err := fs.Mkdir(ctx, "/Flowers", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	var waits []func() error
+	for i := 0; i < 20; i++ {
+		waits = append(waits, put(t, fs, fmt.Sprintf("/Flowers/rose%02d.dst", i), fmt.Sprintf("rose %d", i)))
+	}
+
+	if gadget.GetDisconnectCalls() != 0 {
+		t.Fatalf("Expected no transaction before the delay, got %d", gadget.GetDisconnectCalls())
+	}
+	if names := diskNames(t, manager, "/"); len(names) != 0 {
+		t.Fatalf("Expected an empty disk before the flush, got %v", names)
+	}
+
+	// Clients see the pending files
+	info, err := fs.Stat(ctx, "/flowers/ROSE07.DST")
+	if err != nil || info.Size() != int64(len("rose 7")) {
+		t.Fatalf("Stat of a pending file: %v, %v", info, err)
+	}
+	dir, err := fs.OpenFile(ctx, "/Flowers", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile of a pending directory failed: %v", err)
+	}
+	listed, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil || len(listed) != 20 {
+		t.Fatalf("Expected 20 pending entries, got %d (%v)", len(listed), err)
+	}
+	if got := read(t, fs, "/Flowers/rose03.dst"); got != "rose 3" {
+		t.Errorf("Expected pending contents %q, got %q", "rose 3", got)
+	}
+
+	if err := fs.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	for _, wait := range waits {
+		if err := wait(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	}
+	if gadget.GetDisconnectCalls() != 1 {
+		t.Errorf("Expected one transaction, got %d", gadget.GetDisconnectCalls())
+	}
+	if names := diskNames(t, manager, "/Flowers"); len(names) != 20 {
+		t.Errorf("Expected 20 files on the disk, got %v", names)
+	}
+	if got := read(t, fs, "/Flowers/rose03.dst"); got != "rose 3" {
+		t.Errorf("Expected contents %q from the disk, got %q", "rose 3", got)
+	}
+
+	// Nothing pending, nothing written
+	if err := fs.Flush(); err != nil {
+		t.Fatalf("Empty flush failed: %v", err)
+	}
+	if gadget.GetDisconnectCalls() != 1 {
+		t.Errorf("Expected an empty flush to leave the gadget alone, got %d transactions", gadget.GetDisconnectCalls())
+	}
+}
+
+// TestDelay tests that pending changes are written once no more arrive
+func TestDelay(t *testing.T) {
+	fs, manager, _ := newTestFS(t)
+	fs.options.Delay = 20 * time.Millisecond
+
+	put(t, fs, "/rose.dst", "rose")
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if names := diskNames(t, manager, "/"); len(names) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Pending change was never written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestDiskFull tests that an upload the disk can't take fails rather than
+// being reported as written
+func TestDiskFull(t *testing.T) {
+	fs, manager, _ := newTestFS(t)
+	fs.options.Delay = 10 * time.Millisecond
+	server := httptest.NewServer(fs.Handler("/dav"))
+	defer server.Close()
+
+	upload := func(name string, size int) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/dav/"+name, bytes.NewReader(make([]byte, size)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("PUT %s failed: %v", name, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := upload("rose.dst", 1000); status != http.StatusCreated {
+		t.Fatalf("Expected 201 for a file that fits, got %d", status)
+	}
+	if names := diskNames(t, manager, "/"); len(names) != 1 {
+		t.Errorf("Expected the file on the disk once the PUT returned, got %v", names)
+	}
+
+	if status := upload("big.dst", 12*1024*1024); status != http.StatusInsufficientStorage {
+		t.Errorf("Expected 507 for a file bigger than the disk, got %d", status)
+	}
+	if _, err := fs.Stat(context.Background(), "/big.dst"); !os.IsNotExist(err) {
+		t.Errorf("Expected the file not to be shown after failing, got %v", err)
+	}
+}
+
+// TestRenameAndRemove tests moving a directory and deleting files, before and
+// after they reach the disk
+func TestRenameAndRemove(t *testing.T) {
+	fs, manager, _ := newTestFS(t)
+	ctx := context.Background()
+
+	if err := fs.Mkdir(ctx, "/Flowers", 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	put(t, fs, "/Flowers/rose.dst", "rose")
+	put(t, fs, "/Flowers/tulip.dst", "tulip")
+	put(t, fs, "/Flowers/._rose.dst", "finder metadata")
+	if err := fs.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if names := diskNames(t, manager, "/Flowers"); len(names) != 2 {
+		t.Fatalf("Expected the metadata file to stay off the disk, got %v", names)
+	}
+	if got := read(t, fs, "/Flowers/._rose.dst"); got != "finder metadata" {
+		t.Errorf("Expected the metadata file to be readable, got %q", got)
+	}
+
+	// A file written and removed within one batch never reaches the disk
+	put(t, fs, "/Flowers/daisy.dst", "daisy")
+	if err := fs.RemoveAll(ctx, "/Flowers/daisy.dst"); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	if err := fs.Rename(ctx, "/Flowers", "/Roses"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if _, err := fs.Stat(ctx, "/Flowers/rose.dst"); !os.IsNotExist(err) {
+		t.Errorf("Expected the old path to be gone, got %v", err)
+	}
+	if got := read(t, fs, "/Roses/tulip.dst"); got != "tulip" {
+		t.Errorf("Expected the moved file before the flush, got %q", got)
+	}
+	if err := fs.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if names := diskNames(t, manager, "/"); len(names) != 1 || names[0] != "Roses" {
+		t.Errorf("Expected only /Roses on the disk, got %v", names)
+	}
+	if names := diskNames(t, manager, "/Roses"); len(names) != 2 || names[0] != "rose.dst" || names[1] != "tulip.dst" {
+		t.Errorf("Expected rose.dst and tulip.dst in /Roses, got %v", names)
+	}
+
+	if err := fs.RemoveAll(ctx, "/Roses"); err != nil {
+		t.Fatalf("RemoveAll of a directory failed: %v", err)
+	}
+	if err := fs.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if names := diskNames(t, manager, "/"); len(names) != 0 {
+		t.Errorf("Expected an empty disk, got %v", names)
+	}
+}
+
+// TestInvalidChanges tests the changes refused before they are queued
+func TestInvalidChanges(t *testing.T) {
+	fs, _, _ := newTestFS(t)
+	ctx := context.Background()
+	put(t, fs, "/rose.dst", "rose")
+
+	if _, err := fs.OpenFile(ctx, "/Missing/rose.dst", os.O_RDWR|os.O_CREATE, 0644); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing parent to be reported as not existing, got %v", err)
+	}
+	if _, err := fs.OpenFile(ctx, "/what?.dst", os.O_RDWR|os.O_CREATE, 0644); err == nil {
+		t.Error("Expected a name FAT can't store to be refused")
+	}
+	if err := fs.Mkdir(ctx, "/ROSE.DST", 0755); !os.IsExist(err) {
+		t.Errorf("Expected Mkdir over a file to fail with exists, got %v", err)
+	}
+
+	// A MOVE that only changes case deletes the destination first, which
+	// must not take the source with it
+	if err := fs.RemoveAll(ctx, "/Rose.dst"); err == nil {
+		t.Error("Expected RemoveAll with different case to be refused")
+	}
+	if got := read(t, fs, "/rose.dst"); got != "rose" {
+		t.Errorf("Expected the file to survive, got %q", got)
+	}
+
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := fs.Mkdir(ctx, "/Tulips", 0755); err != ErrClosed {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+}
@@ -0,0 +1,382 @@
+package dav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// fileInfo describes a file or directory on the disk or in the overlay
+type fileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() any           { return nil }
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ContentType guesses the type from the extension. Without it webdav opens
+// every file of a listing to sniff its contents.
+func (fi *fileInfo) ContentType(ctx context.Context) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(fi.name)); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// info describes a pending change
+func (e *entry) info() *fileInfo {
+	return &fileInfo{name: path.Base(e.path), size: int64(len(e.data)), dir: e.dir, modTime: e.modTime}
+}
+
+// diskInfo describes an entry read from the disk
+func diskInfo(fi os.FileInfo) *fileInfo {
+	return &fileInfo{name: fi.Name(), size: fi.Size(), dir: fi.IsDir(), modTime: fi.ModTime()}
+}
+
+// file is an open file. Contents are read from the disk on first use, and
+// written contents are queued when the file is closed.
+type file struct {
+	fs      *FileSystem
+	path    string
+	info    *fileInfo
+	data    []byte
+	loaded  bool
+	pos     int64
+	writing bool
+	closed  bool
+
+	// put is the response of the PUT writing the file, if there is one
+	put *putWriter
+}
+
+func (f *file) load() error {
+	if f.loaded {
+		return nil
+	}
+	data, err := f.fs.readFile(f.path)
+	if err != nil {
+		return err
+	}
+	f.data = data
+	f.loaded = true
+	return nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	if f.pos >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if !f.writing {
+		return 0, &os.PathError{Op: "write", Path: f.path, Err: os.ErrPermission}
+	}
+	end := f.pos + int64(len(p))
+	if max := f.fs.options.MaxFileSize; max > 0 && end > max {
+		return 0, &os.PathError{Op: "write", Path: f.path, Err: ErrFileTooLarge}
+	}
+	if end > int64(len(f.data)) {
+		if end > int64(cap(f.data)) {
+			grown := make([]byte, end, 2*end)
+			copy(grown, f.data)
+			f.data = grown
+		}
+		f.data = f.data[:end]
+	}
+	copy(f.data[f.pos:], p)
+	f.pos = end
+	return len(p), nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *file) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.path, Err: errors.New("not a directory")}
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	if f.writing {
+		return &fileInfo{name: path.Base(f.path), size: int64(len(f.data)), modTime: time.Now()}, nil
+	}
+	return f.info, nil
+}
+
+// Close queues written contents and waits until the transaction writing
+// them has run, so an upload only succeeds once the file is on the disk
+func (f *file) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	if !f.writing {
+		return nil
+	}
+	b, err := f.fs.writeFile(f.path, f.data)
+	if err != nil || b == nil {
+		return err
+	}
+	if err := b.wait(); err != nil {
+		if f.put != nil {
+			f.put.err = err
+		}
+		return &os.PathError{Op: "write", Path: f.path, Err: err}
+	}
+	return nil
+}
+
+// dirFile is an open directory
+type dirFile struct {
+	fs      *FileSystem
+	path    string
+	info    *fileInfo
+	entries []*fileInfo
+	listed  bool
+}
+
+func (d *dirFile) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: d.path, Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: d.path, Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+// Readdir returns the next count entries, or all that are left if count <= 0
+func (d *dirFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.listed {
+		entries, err := d.fs.readDir(d.path)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.listed = true
+	}
+
+	n := len(d.entries)
+	if count > 0 {
+		if n == 0 {
+			return nil, io.EOF
+		}
+		n = min(n, count)
+	}
+	list := make([]fs.FileInfo, n)
+	for i := range list {
+		list[i] = d.entries[i]
+	}
+	d.entries = d.entries[n:]
+	return list, nil
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dirFile) Close() error               { return nil }
+
+// OpenFile opens a file or directory. Files opened for writing are written to
+// the disk after they are closed.
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	p := cleanPath(name)
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+
+	info, err := fs.stat(p)
+	if err != nil && !(write && os.IsNotExist(err)) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if !write {
+		if info.dir {
+			return &dirFile{fs: fs, path: p, info: info}, nil
+		}
+		return &file{fs: fs, path: p, info: info}, nil
+	}
+
+	switch {
+	case info != nil && info.dir:
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	case info != nil && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case info == nil && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if err := validName(p); err != nil {
+		return nil, err
+	}
+	if err := fs.checkParent(p); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	f := &file{fs: fs, path: p, info: info, writing: true, loaded: true}
+	f.put, _ = ctx.Value(putWriterKey{}).(*putWriter)
+	if info != nil && flag&os.O_TRUNC == 0 {
+		if f.data, err = fs.readFile(p); err != nil {
+			return nil, err
+		}
+		if flag&os.O_APPEND != 0 {
+			f.pos = int64(len(f.data))
+		}
+	}
+	return f, nil
+}
+
+// Mkdir creates a directory
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	p := cleanPath(name)
+	if _, err := fs.stat(p); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := validName(p); err != nil {
+		return err
+	}
+	if err := fs.checkParent(p); err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return fs.mkdir(p)
+}
+
+// Stat describes a file or directory
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := fs.stat(cleanPath(name))
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+// RemoveAll removes a file, or a directory and everything in it. The name must
+// match the case stored on the disk: a MOVE that only changes case first
+// deletes the destination, which is the source on a FAT disk.
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	p := cleanPath(name)
+	if p == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	info, err := fs.stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.name != path.Base(p) {
+		return &os.PathError{Op: "remove", Path: name, Err: errCaseMismatch}
+	}
+	p = path.Join(path.Dir(p), info.name)
+
+	nodes, err := fs.tree(p, info)
+	if err != nil {
+		return err
+	}
+	// Children go before their parents
+	for i := len(nodes) - 1; i >= 0; i-- {
+		if err := fs.remove(path.Join(p, nodes[i].rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename moves a file or directory. FAT can't rename in place, so the
+// contents are copied to the new path and removed from the old one.
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldPath, newPath := cleanPath(oldName), cleanPath(newName)
+	if oldPath == "/" || newPath == "/" || strings.HasPrefix(keyOf(newPath), keyOf(oldPath)+"/") {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrInvalid}
+	}
+	info, err := fs.stat(oldPath)
+	if err != nil {
+		return &os.PathError{Op: "rename", Path: oldName, Err: err}
+	}
+	oldPath = path.Join(path.Dir(oldPath), info.name)
+	if err := validName(newPath); err != nil {
+		return err
+	}
+	if err := fs.checkParent(newPath); err != nil {
+		return &os.PathError{Op: "rename", Path: newName, Err: err}
+	}
+	if existing, err := fs.stat(newPath); err == nil && keyOf(newPath) != keyOf(oldPath) {
+		if existing.dir {
+			return &os.PathError{Op: "rename", Path: newName, Err: os.ErrExist}
+		}
+	}
+
+	// Read everything before changing anything
+	nodes, err := fs.tree(oldPath, info)
+	if err != nil {
+		return err
+	}
+	contents := make([][]byte, len(nodes))
+	for i, n := range nodes {
+		if !n.info.dir {
+			if contents[i], err = fs.readFile(path.Join(oldPath, n.rel)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Removing first lets a change of case reuse the same names
+	for i := len(nodes) - 1; i >= 0; i-- {
+		if err := fs.remove(path.Join(oldPath, nodes[i].rel)); err != nil {
+			return err
+		}
+	}
+	for i, n := range nodes {
+		target := path.Join(newPath, n.rel)
+		if n.info.dir {
+			err = fs.mkdir(target)
+		} else {
+			_, err = fs.writeFile(target, contents[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package design
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported design format")
+	ErrInvalidDesign     = errors.New("invalid design data")
+)
+
+// Command identifies what the machine does at a stitch position
+type Command int
+
+const (
+	// Stitch moves the needle with the thread engaged
+	Stitch Command = iota
+	// Jump moves the frame without stitching
+	Jump
+	// Trim cuts the thread (position is unchanged)
+	Trim
+	// ColorChange stops the machine for the next thread colour
+	ColorChange
+)
+
+// Point is a single needle position in absolute coordinates.
+// Units are 0.1 mm; the Y axis points down as seen on screen.
+type Point struct {
+	X       int
+	Y       int
+	Command Command
+}
+
+// Design holds the parsed stitch data of an embroidery file
+type Design struct {
+	// Label is the design name stored in the file header (if the format has one)
+	Label string
+
+	// Points holds every needle position in order
+	Points []Point
+}
+
+// Bounds returns the extents of the design as min/max coordinates
+func (d *Design) Bounds() (minX, minY, maxX, maxY int) {
+	for i, p := range d.Points {
+		if i == 0 {
+			minX, maxX, minY, maxY = p.X, p.X, p.Y, p.Y
+			continue
+		}
+		minX = min(minX, p.X)
+		maxX = max(maxX, p.X)
+		minY = min(minY, p.Y)
+		maxY = max(maxY, p.Y)
+	}
+	return minX, minY, maxX, maxY
+}
+
+// StitchCount returns the number of real stitches (jumps and commands excluded)
+func (d *Design) StitchCount() int {
+	count := 0
+	for _, p := range d.Points {
+		if p.Command == Stitch {
+			count++
+		}
+	}
+	return count
+}
+
+// Format reads and writes one embroidery file format
+type Format interface {
+	// Name returns the short name of the format (e.g., "dst")
+	Name() string
+
+	// Decode parses stitch data from a reader
+	Decode(r io.Reader) (*Design, error)
+
+	// Encode writes stitch data to a writer
+	Encode(w io.Writer, d *Design) error
+}
+
+// formats maps lower-case file extensions to their format implementation
+var formats = map[string]Format{
+	".dst": dstFormat{},
+	".exp": expFormat{},
+}
+
+// FormatForPath returns the format matching the extension of a file path
+func FormatForPath(filePath string) (Format, error) {
+	ext := strings.ToLower(path.Ext(filePath))
+	format, ok := formats[ext]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, ext)
+	}
+	return format, nil
+}
+
+// IsSupported checks if a file path has an extension we can parse
+func IsSupported(filePath string) bool {
+	_, err := FormatForPath(filePath)
+	return err == nil
+}
@@ -0,0 +1,226 @@
+package design
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// square returns a 10mm square outline starting at the origin
+func square() *Design {
+	return &Design{
+		Label: "square",
+		Points: []Point{
+			{X: 0, Y: 0, Command: Stitch},
+			{X: 100, Y: 0, Command: Stitch},
+			{X: 100, Y: 100, Command: Stitch},
+			{X: 0, Y: 100, Command: Stitch},
+			{X: 0, Y: 0, Command: Stitch},
+		},
+	}
+}
+
+// roundTrip encodes and decodes a design with the format for the given path
+func roundTrip(t *testing.T, filePath string, d *Design) *Design {
+	t.Helper()
+
+	format, err := FormatForPath(filePath)
+	if err != nil {
+		t.Fatalf("FormatForPath(%q) failed: %v", filePath, err)
+	}
+
+	var buf bytes.Buffer
+	if err := format.Encode(&buf, d); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	decoded, err := format.Decode(&buf)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	return decoded
+}
+
+// stitchesOf returns only the stitch points of a design
+func stitchesOf(d *Design) []Point {
+	var out []Point
+	for _, p := range d.Points {
+		if p.Command == Stitch {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// TestDSTRoundTrip tests that DST encoding preserves stitch positions and the label
+func TestDSTRoundTrip(t *testing.T) {
+	original := square()
+	original.Points = append(original.Points,
+		Point{X: 0, Y: 0, Command: ColorChange},
+		Point{X: -40, Y: 55, Command: Stitch},
+	)
+
+	decoded := roundTrip(t, "design.DST", original)
+
+	if decoded.Label != "square" {
+		t.Errorf("Expected label %q, got %q", "square", decoded.Label)
+	}
+
+	want := stitchesOf(original)
+	got := stitchesOf(decoded)
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d stitches, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].X != want[i].X || got[i].Y != want[i].Y {
+			t.Errorf("Stitch %d: expected (%d,%d), got (%d,%d)", i, want[i].X, want[i].Y, got[i].X, got[i].Y)
+		}
+	}
+}
+
+// TestDSTLongStitchSplit tests that moves beyond a single DST record are split into jumps
+func TestDSTLongStitchSplit(t *testing.T) {
+	original := &Design{Points: []Point{{X: 500, Y: -300, Command: Stitch}}}
+
+	decoded := roundTrip(t, "long.dst", original)
+
+	stitches := stitchesOf(decoded)
+	if len(stitches) != 1 {
+		t.Fatalf("Expected 1 stitch, got %d", len(stitches))
+	}
+	if stitches[0].X != 500 || stitches[0].Y != -300 {
+		t.Errorf("Expected stitch at (500,-300), got (%d,%d)", stitches[0].X, stitches[0].Y)
+	}
+	if len(decoded.Points) < 2 {
+		t.Error("Expected jumps before the long stitch")
+	}
+}
+
+// TestEXPRoundTrip tests that EXP encoding preserves stitches and commands
+func TestEXPRoundTrip(t *testing.T) {
+	original := square()
+	original.Points = append(original.Points,
+		Point{X: 0, Y: 0, Command: Trim},
+		Point{X: 300, Y: 300, Command: Jump},
+		Point{X: 310, Y: 300, Command: Stitch},
+	)
+
+	decoded := roundTrip(t, "design.exp", original)
+
+	want := stitchesOf(original)
+	got := stitchesOf(decoded)
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d stitches, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Stitch %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+// TestFormatForPathUnsupported tests that unknown extensions are rejected
+func TestFormatForPathUnsupported(t *testing.T) {
+	_, err := FormatForPath("/designs/flower.pes")
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+// TestRotate90 tests that a quarter turn swaps width and height around the centre
+func TestRotate90(t *testing.T) {
+	d := &Design{Points: []Point{
+		{X: 0, Y: 0, Command: Stitch},
+		{X: 200, Y: 0, Command: Stitch},
+		{X: 200, Y: 100, Command: Stitch},
+	}}
+
+	d.Rotate(90)
+
+	minX, minY, maxX, maxY := d.Bounds()
+	if maxX-minX != 100 || maxY-minY != 200 {
+		t.Errorf("Expected 100x200 after rotation, got %dx%d", maxX-minX, maxY-minY)
+	}
+
+	// Clockwise on screen: the first point (top left) moves to the top right
+	if d.Points[0].X != maxX || d.Points[0].Y != minY {
+		t.Errorf("Expected first point at top right (%d,%d), got (%d,%d)", maxX, minY, d.Points[0].X, d.Points[0].Y)
+	}
+}
+
+// TestMirror tests mirroring on both axes
+func TestMirror(t *testing.T) {
+	d := &Design{Points: []Point{
+		{X: 0, Y: 0, Command: Stitch},
+		{X: 100, Y: 50, Command: Stitch},
+	}}
+
+	if err := d.Mirror("horizontal"); err != nil {
+		t.Fatalf("Mirror failed: %v", err)
+	}
+	if d.Points[0].X != 100 || d.Points[1].X != 0 {
+		t.Errorf("Horizontal mirror: got %+v", d.Points)
+	}
+
+	if err := d.Mirror("vertical"); err != nil {
+		t.Fatalf("Mirror failed: %v", err)
+	}
+	if d.Points[0].Y != 50 || d.Points[1].Y != 0 {
+		t.Errorf("Vertical mirror: got %+v", d.Points)
+	}
+
+	if err := d.Mirror("diagonal"); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Expected ErrInvalidOperation, got %v", err)
+	}
+}
+
+// TestScaleWarnings tests that large scale changes produce density warnings
+func TestScaleWarnings(t *testing.T) {
+	tests := []struct {
+		factor       float64
+		wantWarnings bool
+	}{
+		{1.0, false},
+		{1.1, false},
+		{0.5, true},
+		{2.0, true},
+	}
+
+	for _, tt := range tests {
+		d := square()
+		warnings, err := d.Scale(tt.factor)
+		if err != nil {
+			t.Fatalf("Scale(%v) failed: %v", tt.factor, err)
+		}
+		if (len(warnings) > 0) != tt.wantWarnings {
+			t.Errorf("Scale(%v): expected warnings=%v, got %v", tt.factor, tt.wantWarnings, warnings)
+		}
+	}
+
+	if _, err := square().Scale(0); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Expected ErrInvalidOperation for zero factor, got %v", err)
+	}
+}
+
+// TestApplyRecentre tests that a chain of operations ends centred on the origin
+func TestApplyRecentre(t *testing.T) {
+	d := square()
+
+	_, err := Apply(d, []Operation{
+		{Type: "rotate", Degrees: 90},
+		{Type: "mirror", Axis: "horizontal"},
+		{Type: "recentre"},
+	})
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	minX, minY, maxX, maxY := d.Bounds()
+	if minX+maxX != 0 || minY+maxY != 0 {
+		t.Errorf("Expected design centred on origin, got bounds (%d,%d)-(%d,%d)", minX, minY, maxX, maxY)
+	}
+
+	if _, err := Apply(d, []Operation{{Type: "shear"}}); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Expected ErrInvalidOperation for unknown type, got %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+package design
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// dstHeaderSize is the fixed size of the Tajima DST text header
+	dstHeaderSize = 512
+
+	// dstMaxMove is the largest offset a single DST record can encode on either axis
+	dstMaxMove = 121
+)
+
+// dstFormat implements the Tajima DST format.
+// Each record is three bytes encoding a relative move in balanced ternary.
+type dstFormat struct{}
+
+func (dstFormat) Name() string {
+	return "dst"
+}
+
+// Decode parses a DST file
+func (dstFormat) Decode(r io.Reader) (*Design, error) {
+	header := make([]byte, dstHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: short DST header: %v", ErrInvalidDesign, err)
+	}
+
+	d := &Design{Label: dstHeaderField(header, "LA:")}
+
+	br := bufio.NewReader(r)
+	record := make([]byte, 3)
+	x, y := 0, 0
+	for {
+		if _, err := io.ReadFull(br, record); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// Some writers omit the end record
+				break
+			}
+			return nil, fmt.Errorf("failed to read DST record: %w", err)
+		}
+
+		dx, dy := dstDecodeMove(record)
+		b2 := record[2]
+
+		switch {
+		case b2&0xF3 == 0xF3:
+			return d, nil
+		case b2&0xC3 == 0xC3:
+			d.Points = append(d.Points, Point{X: x, Y: y, Command: ColorChange})
+		case b2&0x83 == 0x83:
+			x += dx
+			y += dy
+			d.Points = append(d.Points, Point{X: x, Y: y, Command: Jump})
+		default:
+			x += dx
+			y += dy
+			d.Points = append(d.Points, Point{X: x, Y: y, Command: Stitch})
+		}
+	}
+
+	return d, nil
+}
+
+// dstHeaderField extracts a field value (e.g., the "LA:" label) from a DST header
+func dstHeaderField(header []byte, key string) string {
+	for _, line := range bytes.Split(header, []byte{'\r'}) {
+		if bytes.HasPrefix(line, []byte(key)) {
+			return strings.TrimSpace(string(line[len(key):]))
+		}
+	}
+	return ""
+}
+
+// dstDecodeMove decodes the relative move of a DST record (Y converted to point down)
+func dstDecodeMove(b []byte) (int, int) {
+	x, y := 0, 0
+	bit := func(v byte, mask byte) bool { return v&mask != 0 }
+
+	if bit(b[0], 0x01) {
+		x += 1
+	}
+	if bit(b[0], 0x02) {
+		x -= 1
+	}
+	if bit(b[0], 0x04) {
+		x += 9
+	}
+	if bit(b[0], 0x08) {
+		x -= 9
+	}
+	if bit(b[0], 0x80) {
+		y += 1
+	}
+	if bit(b[0], 0x40) {
+		y -= 1
+	}
+	if bit(b[0], 0x20) {
+		y += 9
+	}
+	if bit(b[0], 0x10) {
+		y -= 9
+	}
+	if bit(b[1], 0x01) {
+		x += 3
+	}
+	if bit(b[1], 0x02) {
+		x -= 3
+	}
+	if bit(b[1], 0x04) {
+		x += 27
+	}
+	if bit(b[1], 0x08) {
+		x -= 27
+	}
+	if bit(b[1], 0x80) {
+		y += 3
+	}
+	if bit(b[1], 0x40) {
+		y -= 3
+	}
+	if bit(b[1], 0x20) {
+		y += 27
+	}
+	if bit(b[1], 0x10) {
+		y -= 27
+	}
+	if bit(b[2], 0x04) {
+		x += 81
+	}
+	if bit(b[2], 0x08) {
+		x -= 81
+	}
+	if bit(b[2], 0x20) {
+		y += 81
+	}
+	if bit(b[2], 0x10) {
+		y -= 81
+	}
+
+	// DST stores Y pointing up
+	return x, -y
+}
+
+// dstEncodeMove encodes a relative move (|dx|, |dy| <= dstMaxMove) into a DST record
+func dstEncodeMove(dx, dy int, jump bool) [3]byte {
+	var b [3]byte
+	x, y := dx, -dy
+
+	b[2] = 0x03
+	if jump {
+		b[2] |= 0x80
+	}
+
+	// Balanced ternary digits from the largest weight down
+	digits := []struct {
+		weight        int
+		idx           int
+		plusX, minusX byte
+		plusY, minusY byte
+	}{
+		{81, 2, 0x04, 0x08, 0x20, 0x10},
+		{27, 1, 0x04, 0x08, 0x20, 0x10},
+		{9, 0, 0x04, 0x08, 0x20, 0x10},
+		{3, 1, 0x01, 0x02, 0x80, 0x40},
+		{1, 0, 0x01, 0x02, 0x80, 0x40},
+	}
+	for _, dg := range digits {
+		half := dg.weight / 2
+		if x > half {
+			b[dg.idx] |= dg.plusX
+			x -= dg.weight
+		} else if x < -half {
+			b[dg.idx] |= dg.minusX
+			x += dg.weight
+		}
+		if y > half {
+			b[dg.idx] |= dg.plusY
+			y -= dg.weight
+		} else if y < -half {
+			b[dg.idx] |= dg.minusY
+			y += dg.weight
+		}
+	}
+
+	return b
+}
+
+// Encode writes a design as a DST file
+func (dstFormat) Encode(w io.Writer, d *Design) error {
+	var body bytes.Buffer
+	colors := 0
+	x, y := 0, 0
+
+	for _, p := range d.Points {
+		switch p.Command {
+		case ColorChange:
+			body.Write([]byte{0x00, 0x00, 0xC3})
+			colors++
+		case Trim:
+			// DST has no trim record; machines trim on a short run of jumps
+			for i := 0; i < 3; i++ {
+				rec := dstEncodeMove(0, 0, true)
+				body.Write(rec[:])
+			}
+		default:
+			dx, dy := p.X-x, p.Y-y
+			// Moves longer than a single record are split into jumps
+			for abs(dx) > dstMaxMove || abs(dy) > dstMaxMove {
+				stepX := clamp(dx, dstMaxMove)
+				stepY := clamp(dy, dstMaxMove)
+				rec := dstEncodeMove(stepX, stepY, true)
+				body.Write(rec[:])
+				dx -= stepX
+				dy -= stepY
+			}
+			rec := dstEncodeMove(dx, dy, p.Command == Jump)
+			body.Write(rec[:])
+			x, y = p.X, p.Y
+		}
+	}
+	body.Write([]byte{0x00, 0x00, 0xF3})
+	stitches := body.Len() / 3
+
+	minX, minY, maxX, maxY := d.Bounds()
+	label := d.Label
+	if len(label) > 16 {
+		label = label[:16]
+	}
+
+	var header bytes.Buffer
+	fmt.Fprintf(&header, "LA:%-16s\r", label)
+	fmt.Fprintf(&header, "ST:%7d\r", stitches)
+	fmt.Fprintf(&header, "CO:%3d\r", colors)
+	fmt.Fprintf(&header, "+X:%5d\r", max(maxX, 0))
+	fmt.Fprintf(&header, "-X:%5d\r", max(-minX, 0))
+	// DST extents are stored with Y pointing up
+	fmt.Fprintf(&header, "+Y:%5d\r", max(-minY, 0))
+	fmt.Fprintf(&header, "-Y:%5d\r", max(maxY, 0))
+	fmt.Fprintf(&header, "AX:%s%5d\r", sign(x), abs(x))
+	fmt.Fprintf(&header, "AY:%s%5d\r", sign(-y), abs(y))
+	fmt.Fprintf(&header, "MX:+%5d\r", 0)
+	fmt.Fprintf(&header, "MY:+%5d\r", 0)
+	fmt.Fprintf(&header, "PD:%6s\r", "******")
+	header.WriteByte(0x1A)
+	for header.Len() < dstHeaderSize {
+		header.WriteByte(' ')
+	}
+
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return fmt.Errorf("failed to write DST header: %w", err)
+	}
+	if _, err := w.Write(body.Bytes()); err != nil {
+		return fmt.Errorf("failed to write DST records: %w", err)
+	}
+	return nil
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// clamp limits v to the range [-limit, limit]
+func clamp(v, limit int) int {
+	return max(-limit, min(v, limit))
+}
+
+func sign(v int) string {
+	if v < 0 {
+		return "-"
+	}
+	return "+"
+}
@@ -0,0 +1,103 @@
+package design
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// expMaxMove is the largest offset a single EXP record can encode on either axis
+const expMaxMove = 127
+
+// expFormat implements the Melco EXP format.
+// Stitches are pairs of signed bytes; 0x80 introduces a control record.
+type expFormat struct{}
+
+func (expFormat) Name() string {
+	return "exp"
+}
+
+// Decode parses an EXP file
+func (expFormat) Decode(r io.Reader) (*Design, error) {
+	d := &Design{}
+	br := bufio.NewReader(r)
+	record := make([]byte, 2)
+	x, y := 0, 0
+
+	for {
+		if _, err := io.ReadFull(br, record); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, fmt.Errorf("failed to read EXP record: %w", err)
+		}
+
+		if record[0] != 0x80 {
+			x += int(int8(record[0]))
+			y -= int(int8(record[1]))
+			d.Points = append(d.Points, Point{X: x, Y: y, Command: Stitch})
+			continue
+		}
+
+		// Control record: the second byte selects the command, followed by two more bytes
+		control := record[1]
+		if _, err := io.ReadFull(br, record); err != nil {
+			return nil, fmt.Errorf("%w: truncated EXP control record", ErrInvalidDesign)
+		}
+
+		switch {
+		case control&0x01 != 0:
+			d.Points = append(d.Points, Point{X: x, Y: y, Command: ColorChange})
+		case control == 0x04:
+			x += int(int8(record[0]))
+			y -= int(int8(record[1]))
+			d.Points = append(d.Points, Point{X: x, Y: y, Command: Jump})
+		case control == 0x80:
+			d.Points = append(d.Points, Point{X: x, Y: y, Command: Trim})
+		default:
+			return nil, fmt.Errorf("%w: unknown EXP control 0x%02x", ErrInvalidDesign, control)
+		}
+	}
+
+	return d, nil
+}
+
+// Encode writes a design as an EXP file
+func (expFormat) Encode(w io.Writer, d *Design) error {
+	var body bytes.Buffer
+	x, y := 0, 0
+
+	writeMove := func(dx, dy int, jump bool) {
+		if jump {
+			body.Write([]byte{0x80, 0x04})
+		}
+		body.Write([]byte{byte(int8(dx)), byte(int8(-dy))})
+	}
+
+	for _, p := range d.Points {
+		switch p.Command {
+		case ColorChange:
+			body.Write([]byte{0x80, 0x01, 0x00, 0x00})
+		case Trim:
+			body.Write([]byte{0x80, 0x80, 0x07, 0x00})
+		default:
+			dx, dy := p.X-x, p.Y-y
+			// Moves longer than a single record are split into jumps
+			for abs(dx) > expMaxMove || abs(dy) > expMaxMove {
+				stepX := clamp(dx, expMaxMove)
+				stepY := clamp(dy, expMaxMove)
+				writeMove(stepX, stepY, true)
+				dx -= stepX
+				dy -= stepY
+			}
+			writeMove(dx, dy, p.Command == Jump)
+			x, y = p.X, p.Y
+		}
+	}
+
+	if _, err := w.Write(body.Bytes()); err != nil {
+		return fmt.Errorf("failed to write EXP records: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package design
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var ErrInvalidOperation = errors.New("invalid transform operation")
+
+const (
+	// Scaling outside this range changes stitch density enough to need re-digitising
+	minSafeScale = 0.8
+	maxSafeScale = 1.2
+
+	// Allowed scale factors
+	minScale = 0.1
+	maxScale = 5.0
+
+	// Stitch lengths (0.1 mm units) outside this range sew badly on most machines
+	minStitchLength = 3
+	maxStitchLength = 121
+)
+
+// Operation describes a single transform step as sent by API clients
+type Operation struct {
+	// Type is one of "rotate", "mirror", "scale" or "recentre"
+	Type string `json:"type"`
+
+	// Degrees to rotate clockwise (rotate only)
+	Degrees float64 `json:"degrees,omitempty"`
+
+	// Axis to mirror across: "horizontal" flips left/right, "vertical" flips top/bottom (mirror only)
+	Axis string `json:"axis,omitempty"`
+
+	// Factor to scale by, e.g. 1.1 for 110% (scale only)
+	Factor float64 `json:"factor,omitempty"`
+}
+
+// Apply runs the operations in order and returns any warnings raised along the way.
+// Rotate, mirror and scale act around the centre of the design so it stays in place.
+func Apply(d *Design, ops []Operation) ([]string, error) {
+	var warnings []string
+
+	for i, op := range ops {
+		switch strings.ToLower(op.Type) {
+		case "rotate":
+			d.Rotate(op.Degrees)
+		case "mirror":
+			if err := d.Mirror(op.Axis); err != nil {
+				return nil, fmt.Errorf("operation %d: %w", i+1, err)
+			}
+		case "scale":
+			w, err := d.Scale(op.Factor)
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: %w", i+1, err)
+			}
+			warnings = append(warnings, w...)
+		case "recentre", "recenter":
+			d.Recentre()
+		default:
+			return nil, fmt.Errorf("operation %d: %w: unknown type %q", i+1, ErrInvalidOperation, op.Type)
+		}
+	}
+
+	return warnings, nil
+}
+
+// centre returns the centre of the design bounding box
+func (d *Design) centre() (int, int) {
+	minX, minY, maxX, maxY := d.Bounds()
+	return (minX + maxX) / 2, (minY + maxY) / 2
+}
+
+// Rotate turns the design clockwise by the given angle around its centre.
+// Multiples of 90 degrees are exact; other angles round to the nearest 0.1 mm.
+func (d *Design) Rotate(degrees float64) {
+	cx, cy := d.centre()
+
+	quarter := math.Mod(degrees, 360)
+	if quarter < 0 {
+		quarter += 360
+	}
+
+	for i := range d.Points {
+		x, y := d.Points[i].X-cx, d.Points[i].Y-cy
+
+		switch quarter {
+		case 0:
+		case 90:
+			x, y = -y, x
+		case 180:
+			x, y = -x, -y
+		case 270:
+			x, y = y, -x
+		default:
+			// Y points down, so a positive angle turns clockwise on screen
+			rad := quarter * math.Pi / 180
+			sin, cos := math.Sincos(rad)
+			fx, fy := float64(x), float64(y)
+			x = int(math.Round(fx*cos - fy*sin))
+			y = int(math.Round(fx*sin + fy*cos))
+		}
+
+		d.Points[i].X, d.Points[i].Y = x+cx, y+cy
+	}
+}
+
+// Mirror flips the design around its centre.
+// "horizontal" mirrors left to right, "vertical" mirrors top to bottom.
+func (d *Design) Mirror(axis string) error {
+	cx, cy := d.centre()
+
+	switch strings.ToLower(axis) {
+	case "horizontal", "x":
+		for i := range d.Points {
+			d.Points[i].X = 2*cx - d.Points[i].X
+		}
+	case "vertical", "y":
+		for i := range d.Points {
+			d.Points[i].Y = 2*cy - d.Points[i].Y
+		}
+	default:
+		return fmt.Errorf("%w: unknown mirror axis %q", ErrInvalidOperation, axis)
+	}
+
+	return nil
+}
+
+// Scale resizes the design around its centre.
+// The returned warnings describe stitch density problems the new size may cause.
+func (d *Design) Scale(factor float64) ([]string, error) {
+	if factor < minScale || factor > maxScale {
+		return nil, fmt.Errorf("%w: scale factor %.2f outside %.1f-%.1f", ErrInvalidOperation, factor, minScale, maxScale)
+	}
+
+	cx, cy := d.centre()
+	for i := range d.Points {
+		fx := float64(d.Points[i].X-cx) * factor
+		fy := float64(d.Points[i].Y-cy) * factor
+		d.Points[i].X = int(math.Round(fx)) + cx
+		d.Points[i].Y = int(math.Round(fy)) + cy
+	}
+
+	var warnings []string
+	if factor < minSafeScale {
+		warnings = append(warnings, fmt.Sprintf(
+			"scaling to %.0f%% packs the same stitches into less space; expect dense, stiff embroidery and thread breaks",
+			factor*100))
+	} else if factor > maxSafeScale {
+		warnings = append(warnings, fmt.Sprintf(
+			"scaling to %.0f%% spreads the same stitches further apart; expect gaps in fills and loose satin columns",
+			factor*100))
+	}
+
+	short, long := d.stitchLengthOutliers()
+	if short > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d stitches are shorter than %.1f mm", short, float64(minStitchLength)/10))
+	}
+	if long > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d stitches are longer than %.1f mm", long, float64(maxStitchLength)/10))
+	}
+
+	return warnings, nil
+}
+
+// stitchLengthOutliers counts stitches that are too short or too long to sew well
+func (d *Design) stitchLengthOutliers() (short, long int) {
+	for i := 1; i < len(d.Points); i++ {
+		prev, p := d.Points[i-1], d.Points[i]
+		if p.Command != Stitch || prev.Command != Stitch {
+			continue
+		}
+		length := math.Hypot(float64(p.X-prev.X), float64(p.Y-prev.Y))
+		if length == 0 {
+			continue
+		}
+		if length < minStitchLength {
+			short++
+		} else if length > maxStitchLength {
+			long++
+		}
+	}
+	return short, long
+}
+
+// Recentre moves the design so the centre of its bounding box sits at the origin,
+// which is the hoop centre on most machines
+func (d *Design) Recentre() {
+	cx, cy := d.centre()
+	for i := range d.Points {
+		d.Points[i].X -= cx
+		d.Points[i].Y -= cy
+	}
+}
@@ -0,0 +1,151 @@
+package diskmanager
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jgarman/embroidery-buddy/internal/fat"
+)
+
+// CheckMode selects what New does to the disk image before presenting it to
+// the USB host
+type CheckMode string
+
+const (
+	// CheckOff skips the startup check
+	CheckOff CheckMode = "off"
+
+	// CheckOnly checks the filesystem and reports problems without fixing them
+	CheckOnly CheckMode = "check"
+
+	// CheckRepair checks the filesystem and repairs what it finds
+	CheckRepair CheckMode = "repair"
+)
+
+// CheckResult is the outcome of a filesystem check or repair
+type CheckResult struct {
+	fat.Report
+
+	Time time.Time `json:"time"`
+
+	// Error is set when the check couldn't complete
+	Error string `json:"error,omitempty"`
+}
+
+// checkState remembers the last check result for health reporting
+type checkState struct {
+	mu   sync.Mutex
+	last *CheckResult
+}
+
+// Check validates the FAT, directory entries and cluster chains of the disk
+// image without changing it. The host can keep the disk connected, so a check
+// that runs while the machine is writing may report problems that go away once
+// it's done.
+func (m *Manager) Check() (CheckResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.filesystem == nil {
+		return CheckResult{}, ErrDiskNotInitialized
+	}
+	return m.runCheck(false)
+}
+
+// Repair checks the disk image and fixes lost clusters, cross-linked and broken
+// chains, wrong file sizes and out of date FAT copies. The USB gadget is
+// disconnected while the image is repaired.
+func (m *Manager) Repair() (CheckResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.filesystem == nil {
+		return CheckResult{}, ErrDiskNotInitialized
+	}
+
+	// Disconnect the USB gadget before repairing
+	if err := m.gadget.Disconnect(); err != nil {
+		return CheckResult{}, fmt.Errorf("failed to disconnect USB gadget: %w", err)
+	}
+
+	// Ensure we reconnect even if there's an error
+	defer func() {
+		if err := m.gadget.Reconnect(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to reconnect USB gadget: %v\n", err)
+		}
+	}()
+
+	return m.runCheck(true)
+}
+
+// LastCheck returns the result of the most recent check or repair, if any
+func (m *Manager) LastCheck() (CheckResult, bool) {
+	m.check.mu.Lock()
+	defer m.check.mu.Unlock()
+
+	if m.check.last == nil {
+		return CheckResult{}, false
+	}
+	return *m.check.last, true
+}
+
+// runCheck checks or repairs the volume and records the result. The caller
+// must hold the lock, and for repairs have disconnected the USB gadget.
+func (m *Manager) runCheck(repair bool) (CheckResult, error) {
+	result := CheckResult{Time: time.Now()}
+
+	var err error
+	if repair {
+		err = m.editVolume(func(volume *fat.Volume) error {
+			report, err := volume.Repair()
+			result.Report = report
+			return err
+		})
+
+		// Reopen the disk so go-diskfs doesn't use its cached FAT
+		if reopenErr := m.openDisk(); reopenErr != nil && err == nil {
+			err = fmt.Errorf("failed to reopen disk: %w", reopenErr)
+		}
+	} else {
+		err = m.readVolume(func(volume *fat.Volume) error {
+			report, err := volume.Check()
+			result.Report = report
+			return err
+		})
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	m.check.mu.Lock()
+	m.check.last = &result
+	m.check.mu.Unlock()
+
+	if err != nil {
+		return result, fmt.Errorf("filesystem check failed: %w", err)
+	}
+	return result, nil
+}
+
+// startupCheck runs the configured check before the disk is presented to the
+// host. Failures are reported but don't stop the disk from being used.
+func (m *Manager) startupCheck() {
+	switch m.config.StartupCheck {
+	case "", CheckOff:
+		return
+	}
+
+	result, err := m.runCheck(m.config.StartupCheck == CheckRepair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		return
+	}
+	for _, problem := range result.Problems {
+		fmt.Fprintf(os.Stderr, "warning: filesystem %s %s: %s\n", problem.Kind, problem.Path, problem.Detail)
+	}
+	if result.Repaired {
+		fmt.Printf("Repaired %d filesystem problems\n", len(result.Problems))
+	}
+}
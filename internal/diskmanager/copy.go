@@ -0,0 +1,84 @@
+package diskmanager
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// CopyImage copies a disk image file. Where the filesystem supports it the copy
+// is a reflink (sharing blocks until either file changes); otherwise blocks of
+// zeros are skipped so the copy is sparse.
+func CopyImage(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open source image: %w", err)
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat source image: %w", err)
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create image copy: %w", err)
+	}
+
+	// A reflink is instant and needs no extra space; fall back to copying the data
+	if err := reflink(out, in); err == nil {
+		return out.Close()
+	}
+
+	if err := copySparse(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("failed to copy image: %w", err)
+	}
+	// Extend to the full size in case the image ends with skipped zeros
+	if err := out.Truncate(info.Size()); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("failed to size image copy: %w", err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("failed to sync image copy: %w", err)
+	}
+	return out.Close()
+}
+
+// copySparse copies in to out, seeking over blocks that are entirely zero
+func copySparse(out *os.File, in io.Reader) error {
+	buf := make([]byte, 64*1024)
+	var offset int64
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			if !isZero(buf[:n]) {
+				if _, werr := out.WriteAt(buf[:n], offset); werr != nil {
+					return werr
+				}
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// isZero reports whether a buffer holds only zero bytes
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,14 @@
+//go:build linux
+
+package diskmanager
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink clones src into dst with the FICLONE ioctl (btrfs, XFS and others)
+func reflink(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package diskmanager
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink is not supported on this platform
+func reflink(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,266 @@
+package diskmanager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+	"github.com/jgarman/embroidery-buddy/internal/fat"
+)
+
+var ErrInvalidFormat = errors.New("invalid disk format")
+
+// FilesystemType is the filesystem written to new disk images
+type FilesystemType string
+
+const (
+	FilesystemFAT32 FilesystemType = "fat32"
+	FilesystemFAT16 FilesystemType = "fat16"
+)
+
+// PartitionTable selects whether new disk images are partitioned
+type PartitionTable string
+
+const (
+	// PartitionNone formats the whole image ("superfloppy"), like most USB sticks
+	PartitionNone PartitionTable = "none"
+
+	// PartitionMBR writes an MBR with a single FAT partition
+	PartitionMBR PartitionTable = "mbr"
+)
+
+// DefaultVolumeLabel is used when DiskFormat.Label is empty
+const DefaultVolumeLabel = "EMBROIDERY"
+
+// mbrPartitionStart is the first sector of the partition on MBR images (1 MiB aligned)
+const mbrPartitionStart = 2048
+
+// DiskFormat describes how new disk images are formatted. The zero value is a
+// FAT32 superfloppy labelled EMBROIDERY.
+type DiskFormat struct {
+	Filesystem     FilesystemType
+	PartitionTable PartitionTable
+
+	// ClusterSize in bytes; 0 picks one based on the disk size
+	ClusterSize int
+
+	Label string
+}
+
+// withDefaults fills in the unset fields
+func (f DiskFormat) withDefaults() DiskFormat {
+	if f.Filesystem == "" {
+		f.Filesystem = FilesystemFAT32
+	}
+	if f.PartitionTable == "" {
+		f.PartitionTable = PartitionNone
+	}
+	if f.Label == "" {
+		f.Label = DefaultVolumeLabel
+	}
+	return f
+}
+
+// Validate checks the format options
+func (f DiskFormat) Validate() error {
+	f = f.withDefaults()
+	switch f.Filesystem {
+	case FilesystemFAT32, FilesystemFAT16:
+	default:
+		// exFAT would need a reader as well as a formatter; neither go-diskfs nor
+		// internal/fat has one
+		return fmt.Errorf("%w: unsupported filesystem %q (fat16 or fat32)", ErrInvalidFormat, f.Filesystem)
+	}
+	switch f.PartitionTable {
+	case PartitionNone, PartitionMBR:
+	default:
+		return fmt.Errorf("%w: unsupported partition table %q (none or mbr)", ErrInvalidFormat, f.PartitionTable)
+	}
+	if f.ClusterSize != 0 && (f.ClusterSize < 512 || f.ClusterSize > 65536 || f.ClusterSize&(f.ClusterSize-1) != 0) {
+		return fmt.Errorf("%w: cluster size %d must be a power of two from 512 to 65536", ErrInvalidFormat, f.ClusterSize)
+	}
+	if len(f.Label) > 11 {
+		return fmt.Errorf("%w: label %q is longer than 11 characters", ErrInvalidFormat, f.Label)
+	}
+	return nil
+}
+
+// fatType returns the internal/fat type of the filesystem
+func (f DiskFormat) fatType() fat.Type {
+	if f.Filesystem == FilesystemFAT16 {
+		return fat.FAT16
+	}
+	return fat.FAT32
+}
+
+// mbrType returns the MBR partition type of the filesystem
+func (f DiskFormat) mbrType() mbr.Type {
+	if f.Filesystem == FilesystemFAT16 {
+		return mbr.Fat16b
+	}
+	return mbr.Fat32LBA
+}
+
+// CreateDiskImage creates a disk image of the given size and format.
+// go-diskfs formats FAT32 at its default cluster size; FAT16 and explicit
+// cluster sizes are formatted by internal/fat.
+func CreateDiskImage(diskPath string, diskSizeMb int64, format DiskFormat) error {
+	format = format.withDefaults()
+	if err := format.Validate(); err != nil {
+		return err
+	}
+
+	size := diskSizeMb * 1024 * 1024
+	mydisk, err := diskfs.Create(diskPath, size,
+		diskfs.SectorSizeDefault)
+
+	if err != nil {
+		return fmt.Errorf("failed to create disk: %w", err)
+	}
+
+	partition := 0
+	offset := int64(0)
+	if format.PartitionTable == PartitionMBR {
+		sectors := size / 512
+		if sectors <= mbrPartitionStart {
+			mydisk.Close()
+			return fmt.Errorf("%w: %dMB is too small for a partitioned disk", ErrInvalidFormat, diskSizeMb)
+		}
+		table := &mbr.Table{
+			LogicalSectorSize:  512,
+			PhysicalSectorSize: 512,
+			Partitions: []*mbr.Partition{{
+				Type:  format.mbrType(),
+				Start: mbrPartitionStart,
+				Size:  uint32(sectors - mbrPartitionStart),
+			}},
+		}
+		if err := mydisk.Partition(table); err != nil {
+			mydisk.Close()
+			return fmt.Errorf("failed to write partition table: %w", err)
+		}
+		partition = 1
+		offset = mbrPartitionStart * 512
+	}
+
+	if format.Filesystem == FilesystemFAT32 && format.ClusterSize == 0 {
+		_, err = mydisk.CreateFilesystem(disk.FilesystemSpec{
+			Partition:   partition,
+			FSType:      filesystem.TypeFat32,
+			VolumeLabel: format.Label,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create filesystem: %w", err)
+		}
+		return nil
+	}
+	mydisk.Close()
+
+	file, err := os.OpenFile(diskPath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open disk: %w", err)
+	}
+	defer file.Close()
+
+	err = fat.Format(file, offset, size-offset, fat.FormatOptions{
+		Type:          format.fatType(),
+		ClusterSize:   format.ClusterSize,
+		Label:         format.Label,
+		HiddenSectors: uint32(offset / 512),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create filesystem: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync disk: %w", err)
+	}
+	return nil
+}
+
+// editVolume opens the FAT volume of the disk image for direct modification and
+// syncs the image after fn succeeds. The caller must hold the lock and have
+// disconnected the USB gadget, and reopen the disk afterwards.
+func (m *Manager) editVolume(fn func(volume *fat.Volume) error) error {
+	return editImage(m.config.DiskPath, fn)
+}
+
+// editImage opens the FAT volume of a disk image for direct modification and
+// syncs the image after fn succeeds
+func editImage(diskPath string, fn func(volume *fat.Volume) error) error {
+	file, err := os.OpenFile(diskPath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open disk image: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat disk image: %w", err)
+	}
+
+	offset, _, err := fat.FindVolume(file, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to find FAT volume: %w", err)
+	}
+	volume, err := fat.Open(file, offset)
+	if err != nil {
+		return fmt.Errorf("failed to open FAT volume: %w", err)
+	}
+
+	if err := fn(volume); err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync disk image: %w", err)
+	}
+	return nil
+}
+
+// readVolume opens the FAT volume of the disk image read-only and runs fn on it
+func (m *Manager) readVolume(fn func(volume *fat.Volume) error) error {
+	file, err := os.Open(m.config.DiskPath)
+	if err != nil {
+		return fmt.Errorf("failed to open disk image: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat disk image: %w", err)
+	}
+
+	offset, _, err := fat.FindVolume(file, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to find FAT volume: %w", err)
+	}
+	volume, err := fat.Open(file, offset)
+	if err != nil {
+		return fmt.Errorf("failed to open FAT volume: %w", err)
+	}
+	return fn(volume)
+}
+
+// volumeOffset returns the byte offset of the FAT volume in a disk image
+// (0 for superfloppy images)
+func volumeOffset(diskPath string) (int64, error) {
+	file, err := os.Open(diskPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open disk image: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat disk image: %w", err)
+	}
+	offset, _, err := fat.FindVolume(file, info.Size())
+	if err != nil {
+		return 0, fmt.Errorf("failed to find FAT volume: %w", err)
+	}
+	return offset, nil
+}
@@ -0,0 +1,164 @@
+package diskmanager
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/jgarman/embroidery-buddy/internal/fat"
+)
+
+// fatReadOnlyFilesystem reads FAT16 volumes, which go-diskfs can't open. Writes
+// go through the FAT or loopback writer, so only ReadDir and read-only OpenFile
+// are supported. The image is reopened for every call so no file handle outlives
+// the disk it belongs to.
+type fatReadOnlyFilesystem struct {
+	diskPath string
+	offset   int64
+	label    string
+}
+
+// openFATReadOnly opens the FAT volume at offset in a disk image
+func openFATReadOnly(diskPath string, offset int64) (*fatReadOnlyFilesystem, error) {
+	fs := &fatReadOnlyFilesystem{diskPath: diskPath, offset: offset}
+	var label string
+	err := fs.withVolume(func(v *fat.Volume) error {
+		label = v.Label
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fs.label = label
+	return fs, nil
+}
+
+// withVolume opens the volume and runs fn on it
+func (f *fatReadOnlyFilesystem) withVolume(fn func(v *fat.Volume) error) error {
+	file, err := os.Open(f.diskPath)
+	if err != nil {
+		return fmt.Errorf("failed to open disk image: %w", err)
+	}
+	defer file.Close()
+
+	v, err := fat.Open(file, f.offset)
+	if err != nil {
+		return err
+	}
+	return fn(v)
+}
+
+// Type returns TypeFat32, the only FAT type go-diskfs has a constant for
+func (f *fatReadOnlyFilesystem) Type() filesystem.Type {
+	return filesystem.TypeFat32
+}
+
+func (f *fatReadOnlyFilesystem) ReadDir(pathname string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	err := f.withVolume(func(v *fat.Volume) error {
+		entries, err := v.ReadDir(pathname)
+		if err != nil {
+			return err
+		}
+		infos = make([]os.FileInfo, 0, len(entries))
+		for _, e := range entries {
+			infos = append(infos, fatFileInfo{e})
+		}
+		return nil
+	})
+	return infos, err
+}
+
+func (f *fatReadOnlyFilesystem) OpenFile(pathname string, flag int) (filesystem.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_TRUNC) != 0 {
+		return nil, filesystem.ErrReadonlyFilesystem
+	}
+
+	var data []byte
+	err := f.withVolume(func(v *fat.Volume) error {
+		var err error
+		data, err = v.ReadFile(pathname)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &fatFile{Reader: bytes.NewReader(data)}, nil
+}
+
+func (f *fatReadOnlyFilesystem) Label() string {
+	return f.label
+}
+
+func (f *fatReadOnlyFilesystem) Mkdir(pathname string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+func (f *fatReadOnlyFilesystem) Mknod(pathname string, mode uint32, dev int) error {
+	return filesystem.ErrNotSupported
+}
+
+func (f *fatReadOnlyFilesystem) Link(oldpath, newpath string) error {
+	return filesystem.ErrNotSupported
+}
+
+func (f *fatReadOnlyFilesystem) Symlink(oldpath, newpath string) error {
+	return filesystem.ErrNotSupported
+}
+
+func (f *fatReadOnlyFilesystem) Chmod(name string, mode os.FileMode) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+func (f *fatReadOnlyFilesystem) Chown(name string, uid, gid int) error {
+	return filesystem.ErrNotSupported
+}
+
+func (f *fatReadOnlyFilesystem) Rename(oldpath, newpath string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+func (f *fatReadOnlyFilesystem) Remove(pathname string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+func (f *fatReadOnlyFilesystem) SetLabel(label string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+func (f *fatReadOnlyFilesystem) Close() error {
+	return nil
+}
+
+// fatFile is an open file of a fatReadOnlyFilesystem
+type fatFile struct {
+	*bytes.Reader
+}
+
+func (f *fatFile) Write(p []byte) (int, error) {
+	return 0, filesystem.ErrReadonlyFilesystem
+}
+
+func (f *fatFile) Close() error {
+	return nil
+}
+
+// fatFileInfo adapts a fat.DirEntry to os.FileInfo
+type fatFileInfo struct {
+	entry fat.DirEntry
+}
+
+func (i fatFileInfo) Name() string       { return i.entry.Name }
+func (i fatFileInfo) Size() int64        { return int64(i.entry.Size) }
+func (i fatFileInfo) ModTime() time.Time { return i.entry.ModTime }
+func (i fatFileInfo) IsDir() bool        { return i.entry.IsDir() }
+func (i fatFileInfo) Sys() interface{}   { return i.entry }
+
+func (i fatFileInfo) Mode() os.FileMode {
+	if i.entry.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
@@ -3,7 +3,7 @@ package diskmanager
 import "io"
 
 // FilesystemWriter is an interface for writing files to the disk image.
-// Different implementations can use different methods (loopback mount, go-diskfs, etc.)
+// Different implementations can use different methods (internal/fat, loopback mount, go-diskfs)
 type FilesystemWriter interface {
 	// Begin prepares the filesystem for writing (e.g., mounting)
 	Begin() error
@@ -11,6 +11,12 @@ type FilesystemWriter interface {
 	// WriteFile writes a file to the filesystem at the given path
 	WriteFile(filePath string, reader io.Reader, size int64) error
 
+	// RemoveFile removes a file from the filesystem (ErrFileNotFound if it doesn't exist)
+	RemoveFile(filePath string) error
+
+	// Mkdir creates a directory and any missing parents (existing directories are left alone)
+	Mkdir(dirPath string) error
+
 	// End finalizes the filesystem writes (e.g., unmounting)
 	End() error
 }
@@ -112,6 +112,34 @@ func (w *DiskfsFilesystemWriter) WriteFile(filePath string, reader io.Reader, si
 	return nil
 }
 
+// RemoveFile removes a file from the filesystem using go-diskfs
+func (w *DiskfsFilesystemWriter) RemoveFile(filePath string) error {
+	if w.filesystem == nil {
+		return ErrDiskNotInitialized
+	}
+
+	filePath = normalizePath(filePath)
+	file, err := w.filesystem.OpenFile(filePath, os.O_RDONLY)
+	if err != nil {
+		return ErrFileNotFound
+	}
+	file.Close()
+
+	if err := w.filesystem.Remove(filePath); err != nil {
+		return fmt.Errorf("failed to remove file: %w", err)
+	}
+
+	return nil
+}
+
+// Mkdir creates a directory using go-diskfs, with any missing parents
+func (w *DiskfsFilesystemWriter) Mkdir(dirPath string) error {
+	if w.filesystem == nil {
+		return ErrDiskNotInitialized
+	}
+	return w.ensureDir(normalizePath(dirPath))
+}
+
 // End finalizes the filesystem writes (no-op for diskfs)
 func (w *DiskfsFilesystemWriter) End() error {
 	return nil
@@ -1,10 +1,52 @@
 package diskmanager
 
-import "github.com/diskfs/go-diskfs/filesystem"
+import (
+	"fmt"
 
-// NewFilesystemWriter creates the appropriate FilesystemWriter based on the platform.
-// On Linux, it returns a LoopbackFilesystemWriter for fast writes using kernel operations.
-// On other platforms, it returns a DiskfsFilesystemWriter as a fallback.
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// WriterType selects how transactions write files into the disk image
+type WriterType string
+
+const (
+	// WriterFAT writes through internal/fat in-process: no mount, root or loop
+	// device needed, and FAT16 is supported
+	WriterFAT WriterType = "fat"
+
+	// WriterLoopback loop-mounts the image and writes through the kernel's vfat
+	// driver. Needs root (CAP_SYS_ADMIN) and a free loop device.
+	WriterLoopback WriterType = "loopback"
+
+	// WriterDiskfs writes through go-diskfs, which only handles FAT32 and is slow
+	// for large files
+	WriterDiskfs WriterType = "diskfs"
+)
+
+// validate checks that the writer type is known ("" means WriterFAT)
+func (t WriterType) validate() error {
+	switch t {
+	case "", WriterFAT, WriterLoopback, WriterDiskfs:
+		return nil
+	}
+	return fmt.Errorf("unsupported filesystem writer %q (fat, loopback or diskfs)", t)
+}
+
+// NewFilesystemWriter creates the default FilesystemWriter, the in-process FAT writer
 func NewFilesystemWriter(diskPath string, fs filesystem.FileSystem) FilesystemWriter {
-	return newFilesystemWriterPlatform(diskPath, fs)
-}
\ No newline at end of file
+	return NewFilesystemWriterOfType(WriterFAT, diskPath, fs)
+}
+
+// NewFilesystemWriterOfType creates a FilesystemWriter of the given type for the
+// disk image at diskPath. fs is the go-diskfs filesystem of the image, used by
+// WriterDiskfs.
+func NewFilesystemWriterOfType(writer WriterType, diskPath string, fs filesystem.FileSystem) FilesystemWriter {
+	switch writer {
+	case WriterLoopback:
+		return NewLoopbackFilesystemWriter(diskPath)
+	case WriterDiskfs:
+		return NewDiskfsFilesystemWriter(fs)
+	default:
+		return NewFATFilesystemWriter(diskPath)
+	}
+}
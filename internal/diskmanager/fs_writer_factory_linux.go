@@ -1,10 +0,0 @@
-// +build linux
-
-package diskmanager
-
-import "github.com/diskfs/go-diskfs/filesystem"
-
-// newFilesystemWriterPlatform returns a LoopbackFilesystemWriter on Linux
-func newFilesystemWriterPlatform(diskPath string, fs filesystem.FileSystem) FilesystemWriter {
-	return NewLoopbackFilesystemWriter(diskPath)
-}
\ No newline at end of file
@@ -1,10 +0,0 @@
-// +build !linux
-
-package diskmanager
-
-import "github.com/diskfs/go-diskfs/filesystem"
-
-// newFilesystemWriterPlatform returns a DiskfsFilesystemWriter on non-Linux platforms
-func newFilesystemWriterPlatform(diskPath string, fs filesystem.FileSystem) FilesystemWriter {
-	return NewDiskfsFilesystemWriter(fs)
-}
\ No newline at end of file
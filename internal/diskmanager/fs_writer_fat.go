@@ -0,0 +1,133 @@
+package diskmanager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jgarman/embroidery-buddy/internal/fat"
+)
+
+// FATFilesystemWriter writes files straight into the FAT volume of the disk
+// image. Clusters are preallocated per file, data goes out in large contiguous
+// writes and the FAT is written once, when the transaction ends.
+type FATFilesystemWriter struct {
+	diskPath string
+	file     *os.File
+	volume   *fat.Volume
+}
+
+// NewFATFilesystemWriter creates a new in-process FAT filesystem writer
+func NewFATFilesystemWriter(diskPath string) *FATFilesystemWriter {
+	return &FATFilesystemWriter{
+		diskPath: diskPath,
+	}
+}
+
+// Begin opens the FAT volume of the disk image
+func (w *FATFilesystemWriter) Begin() error {
+	file, err := os.OpenFile(w.diskPath, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open disk image: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat disk image: %w", err)
+	}
+	offset, _, err := fat.FindVolume(file, info.Size())
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to find FAT volume: %w", err)
+	}
+	volume, err := fat.Open(file, offset)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open FAT volume: %w", err)
+	}
+
+	w.file = file
+	w.volume = volume
+	return nil
+}
+
+// WriteFile writes a file to the volume, creating parent directories as needed
+func (w *FATFilesystemWriter) WriteFile(filePath string, reader io.Reader, size int64) error {
+	if w.volume == nil {
+		return fmt.Errorf("filesystem not open")
+	}
+
+	err := w.volume.WriteFile(normalizePath(filePath), reader, size, time.Now())
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fat.ErrNoSpace):
+		return ErrDiskFull
+	case errors.Is(err, fat.ErrInvalidName):
+		return fmt.Errorf("%w: %v", ErrInvalidPath, err)
+	case errors.Is(err, fat.ErrExists), errors.Is(err, fat.ErrNotDirectory):
+		return fmt.Errorf("%w: %v", ErrPathExists, err)
+	}
+	return fmt.Errorf("failed to write file: %w", err)
+}
+
+// RemoveFile removes a file from the volume
+func (w *FATFilesystemWriter) RemoveFile(filePath string) error {
+	if w.volume == nil {
+		return fmt.Errorf("filesystem not open")
+	}
+
+	if err := w.volume.Remove(normalizePath(filePath)); err != nil {
+		if errors.Is(err, fat.ErrNotFound) || errors.Is(err, fat.ErrNotDirectory) {
+			return ErrFileNotFound
+		}
+		if errors.Is(err, fat.ErrNotEmpty) {
+			return fmt.Errorf("%w: %s", ErrDirectoryNotEmpty, filePath)
+		}
+		return fmt.Errorf("failed to remove file: %w", err)
+	}
+	return nil
+}
+
+// Mkdir creates a directory on the volume, with any missing parents
+func (w *FATFilesystemWriter) Mkdir(dirPath string) error {
+	if w.volume == nil {
+		return fmt.Errorf("filesystem not open")
+	}
+
+	err := w.volume.Mkdir(normalizePath(dirPath), time.Now())
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fat.ErrNoSpace):
+		return ErrDiskFull
+	case errors.Is(err, fat.ErrInvalidName):
+		return fmt.Errorf("%w: %v", ErrInvalidPath, err)
+	case errors.Is(err, fat.ErrNotDirectory):
+		return fmt.Errorf("%w: %v", ErrPathExists, err)
+	}
+	return fmt.Errorf("failed to create directory: %w", err)
+}
+
+// End writes the FAT and syncs the disk image
+func (w *FATFilesystemWriter) End() error {
+	if w.volume == nil {
+		return nil // Already finalized or never opened
+	}
+	defer func() {
+		w.file.Close()
+		w.file = nil
+		w.volume = nil
+	}()
+
+	if err := w.volume.Flush(); err != nil {
+		return fmt.Errorf("failed to write FAT: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync disk image: %w", err)
+	}
+	return nil
+}
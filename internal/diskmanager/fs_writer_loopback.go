@@ -2,17 +2,30 @@ package diskmanager
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
-// LoopbackFilesystemWriter uses loopback mounting for fast filesystem writes
+// ErrImageStillAttached is returned when the loopback writer couldn't release
+// the disk image: the kernel may still write to it, so it must not be handed to
+// the USB host
+var ErrImageStillAttached = errors.New("disk image still attached to a loop device")
+
+// mountDirPrefix names the temporary directories the loopback writer mounts on
+const mountDirPrefix = "bernina-mount-"
+
+// LoopbackFilesystemWriter mounts the disk image through a loop device for fast
+// filesystem writes. Linux only, and needs CAP_SYS_ADMIN.
 type LoopbackFilesystemWriter struct {
 	diskPath string
 	mountDir string
+	loop     *loopDevice
 }
 
 // NewLoopbackFilesystemWriter creates a new loopback-based filesystem writer
@@ -22,22 +35,38 @@ func NewLoopbackFilesystemWriter(diskPath string) *LoopbackFilesystemWriter {
 	}
 }
 
-// Begin mounts the disk image to a temporary directory using loopback mount
+// Begin attaches the disk image to a loop device and mounts it on a temporary
+// directory
 func (w *LoopbackFilesystemWriter) Begin() error {
 	// Create temporary mount directory
-	mountDir, err := os.MkdirTemp("", "bernina-mount-*")
+	mountDir, err := os.MkdirTemp("", mountDirPrefix+"*")
 	if err != nil {
 		return fmt.Errorf("failed to create temp mount directory: %w", err)
 	}
 
-	// Mount the disk image loopback
-	cmd := exec.Command("mount", "-o", "loop", w.diskPath, mountDir)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		os.RemoveAll(mountDir)
-		return fmt.Errorf("failed to mount loopback: %w (output: %s)", err, string(output))
+	// Partitioned images need the offset of the FAT volume
+	offset, err := volumeOffset(w.diskPath)
+	if err != nil {
+		os.Remove(mountDir)
+		return err
+	}
+
+	loop, err := attachLoop(w.diskPath, offset)
+	if err != nil {
+		os.Remove(mountDir)
+		return fmt.Errorf("failed to attach loop device: %w", err)
+	}
+
+	if err := mountLoop(loop, mountDir); err != nil {
+		if detachErr := loop.detach(); detachErr != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", detachErr)
+		}
+		os.Remove(mountDir)
+		return err
 	}
 
 	w.mountDir = mountDir
+	w.loop = loop
 	return nil
 }
 
@@ -101,6 +130,44 @@ func (w *LoopbackFilesystemWriter) WriteFile(filePath string, reader io.Reader,
 	return nil
 }
 
+// RemoveFile removes a file from the mounted filesystem
+func (w *LoopbackFilesystemWriter) RemoveFile(filePath string) error {
+	if w.mountDir == "" {
+		return fmt.Errorf("filesystem not mounted")
+	}
+
+	absPath := filepath.Join(w.mountDir, normalizePath(filePath))
+	if err := os.Remove(absPath); err != nil {
+		if os.IsNotExist(err) {
+			return ErrFileNotFound
+		}
+		if errors.Is(err, syscall.ENOTEMPTY) {
+			return fmt.Errorf("%w: %s", ErrDirectoryNotEmpty, filePath)
+		}
+		return fmt.Errorf("failed to remove file: %w", err)
+	}
+
+	return nil
+}
+
+// Mkdir creates a directory on the mounted filesystem, with any missing parents
+func (w *LoopbackFilesystemWriter) Mkdir(dirPath string) error {
+	if w.mountDir == "" {
+		return fmt.Errorf("filesystem not mounted")
+	}
+
+	if err := os.MkdirAll(filepath.Join(w.mountDir, normalizePath(dirPath)), 0755); err != nil {
+		if isOutOfSpaceError(err) {
+			return ErrDiskFull
+		}
+		if errors.Is(err, syscall.ENOTDIR) {
+			return fmt.Errorf("%w: %s", ErrPathExists, dirPath)
+		}
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	return nil
+}
+
 // isOutOfSpaceError checks if an error is a "no space left on device" error
 func isOutOfSpaceError(err error) bool {
 	if err == nil {
@@ -110,23 +177,45 @@ func isOutOfSpaceError(err error) bool {
 	return err.Error() == "no space left on device"
 }
 
-// End unmounts the loopback mount and removes the temporary directory
+// End unmounts the filesystem, detaches the loop device and removes the
+// temporary directory. If the image can't be released the error wraps
+// ErrImageStillAttached.
 func (w *LoopbackFilesystemWriter) End() error {
 	if w.mountDir == "" {
 		return nil // Already unmounted or never mounted
 	}
 
-	// Unmount
-	cmd := exec.Command("umount", w.mountDir)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to unmount: %w (output: %s)", err, string(output))
+	if err := unmountDir(w.mountDir); err != nil {
+		// Leave the directory for recoverStaleMounts at the next start
+		return fmt.Errorf("%w: %v", ErrImageStillAttached, err)
 	}
+	os.Remove(w.mountDir)
+	w.mountDir = ""
 
-	// Remove temporary directory
-	if err := os.RemoveAll(w.mountDir); err != nil {
-		return fmt.Errorf("failed to remove temp directory: %w", err)
+	loop := w.loop
+	w.loop = nil
+	if err := loop.detach(); err != nil {
+		return fmt.Errorf("%w: %v", ErrImageStillAttached, err)
 	}
-
-	w.mountDir = ""
 	return nil
 }
+
+// removeStaleMountDirs removes empty mount directories left in the temp
+// directory by earlier runs. Recent ones may belong to a writer that is just
+// starting up, and directories that are still mount points can't be removed.
+func removeStaleMountDirs() {
+	entries, err := os.ReadDir(os.TempDir())
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), mountDirPrefix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < time.Hour {
+			continue
+		}
+		os.Remove(filepath.Join(os.TempDir(), e.Name()))
+	}
+}
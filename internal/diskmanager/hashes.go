@@ -0,0 +1,440 @@
+package diskmanager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// DuplicatePolicy selects what Transaction.WriteFile does with a file whose
+// contents are already on the disk under another name. There is no policy that
+// links the copies: FAT has no hard links, and two entries sharing clusters are
+// cross-linked, which the filesystem check reports and deleting either corrupts.
+type DuplicatePolicy string
+
+const (
+	// DuplicateKeep stores the new copy and reports the existing ones
+	DuplicateKeep DuplicatePolicy = "keep"
+
+	// DuplicateSkip drops the new copy when it is a duplicate. A file already
+	// at the same path is left as it was.
+	DuplicateSkip DuplicatePolicy = "skip"
+
+	// DuplicateReplace stores the new copy and removes the existing ones
+	DuplicateReplace DuplicatePolicy = "replace"
+)
+
+// validate checks that the policy is known (empty means DuplicateKeep)
+func (p DuplicatePolicy) validate() error {
+	switch p {
+	case "", DuplicateKeep, DuplicateSkip, DuplicateReplace:
+		return nil
+	}
+	return fmt.Errorf("unsupported duplicate policy %q (keep, skip or replace)", p)
+}
+
+// WriteResult describes a file written by Transaction.WriteFile
+type WriteResult struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+
+	// DuplicateOf lists the files that already had the same contents
+	DuplicateOf []string `json:"duplicateOf,omitempty"`
+
+	// Skipped is set when the new copy was dropped (DuplicateSkip)
+	Skipped bool `json:"skipped,omitempty"`
+
+	// Replaced is set when the files in DuplicateOf were removed (DuplicateReplace)
+	Replaced bool `json:"replaced,omitempty"`
+}
+
+// indexEntry is the content hash of one file on the disk
+type indexEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// contentIndex maps the files on the disk to SHA-256 hashes of their contents.
+// Entries are kept while a file's size and modification time are unchanged, so
+// files the host wrote are hashed again on the next refresh.
+type contentIndex struct {
+	mu sync.Mutex
+
+	// files is keyed by indexKey of the path
+	files map[string]indexEntry
+}
+
+// indexKey folds case the way FAT compares names
+func indexKey(p string) string {
+	return strings.ToLower(normalizePath(p))
+}
+
+// emptySum is the hash of an empty file, which go-diskfs can't open
+var emptySum = hex.EncodeToString(sha256.New().Sum(nil))
+
+// refresh brings the index up to date with the files in dirPath, and those in
+// its subdirectories if recursive, hashing new and changed files and dropping
+// removed ones. Entries for the rest of the disk are kept as they are.
+func (c *contentIndex) refresh(fs filesystem.FileSystem, dirPath string, recursive bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dirKey := indexKey(dirPath)
+	inScope := func(key string) bool {
+		if !recursive {
+			return path.Dir(key) == dirKey
+		}
+		return dirKey == "/" || key == dirKey || strings.HasPrefix(key, dirKey+"/")
+	}
+
+	files := make(map[string]indexEntry, len(c.files))
+	for key, e := range c.files {
+		if !inScope(key) {
+			files[key] = e
+		}
+	}
+	err := walkFiles(fs, normalizePath(dirPath), recursive, func(p string, info os.FileInfo) error {
+		key := indexKey(p)
+		if e, ok := c.files[key]; ok && e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+			e.path = p
+			files[key] = e
+			return nil
+		}
+
+		sum, err := hashFile(fs, p, info.Size())
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %w", p, err)
+		}
+		files[key] = indexEntry{path: p, size: info.Size(), modTime: info.ModTime(), sum: sum}
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrFileNotFound) {
+		return err
+	}
+
+	c.files = files
+	return nil
+}
+
+// reset empties the index so the next refresh hashes every file
+func (c *contentIndex) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files = nil
+}
+
+// snapshot returns a copy of the index
+func (c *contentIndex) snapshot() map[string]indexEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files := make(map[string]indexEntry, len(c.files))
+	for key, e := range c.files {
+		files[key] = e
+	}
+	return files
+}
+
+// apply records the files a committed transaction wrote and removed. Written
+// files take their size and modification time from fs, which must show the
+// transaction's changes; files that don't match are left for refresh to hash.
+func (c *contentIndex) apply(fs filesystem.FileSystem, tx *Transaction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.files == nil {
+		return
+	}
+	for key := range tx.removed {
+		delete(c.files, key)
+	}
+	for key, e := range tx.pending {
+		delete(c.files, key)
+		info, err := statFile(fs, e.path)
+		if err != nil || info.Size() != e.size {
+			continue
+		}
+		e.modTime = info.ModTime()
+		c.files[key] = e
+	}
+}
+
+// walkFiles calls fn for every file in dirPath, and in its subdirectories if
+// recursive. A missing dirPath is ErrFileNotFound.
+func walkFiles(fs filesystem.FileSystem, dirPath string, recursive bool, fn func(p string, info os.FileInfo) error) error {
+	entries, err := readDir(fs, dirPath)
+	if err != nil {
+		return fmt.Errorf("failed to read directory %s: %w", dirPath, err)
+	}
+	for _, e := range entries {
+		p := path.Join(dirPath, e.Name())
+		if e.IsDir() {
+			if recursive {
+				err = walkFiles(fs, p, recursive, fn)
+			}
+		} else {
+			err = fn(p, e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statFile returns the directory entry of a file
+func statFile(fs filesystem.FileSystem, p string) (os.FileInfo, error) {
+	entries, err := readDir(fs, path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if strings.EqualFold(e.Name(), path.Base(p)) {
+			return e, nil
+		}
+	}
+	return nil, ErrFileNotFound
+}
+
+// hashFile returns the SHA-256 of a file's contents
+func hashFile(fs filesystem.FileSystem, p string, size int64) (string, error) {
+	if size == 0 {
+		return emptySum, nil
+	}
+	f, err := fs.OpenFile(p, os.O_RDONLY)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.LimitReader(f, size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashingReader hashes and counts the bytes read through it
+type hashingReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	n      int64
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+// SetDuplicatePolicy overrides the configured duplicate policy for the rest
+// of the transaction
+func (t *Transaction) SetDuplicatePolicy(policy DuplicatePolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	t.policy = policy
+	return nil
+}
+
+// Written returns what each WriteFile call of the transaction stored, in order
+func (t *Transaction) Written() []WriteResult {
+	return t.written
+}
+
+// record adds a written file to the transaction and applies the duplicate
+// policy when its contents are already on the disk
+func (t *Transaction) record(filePath string, r *hashingReader) error {
+	p := normalizePath(filePath)
+	key := indexKey(p)
+	result := WriteResult{Path: p, Size: r.n, SHA256: hex.EncodeToString(r.hash.Sum(nil))}
+	delete(t.removed, key)
+
+	// Every empty file is the same; they're not worth reporting
+	if r.n > 0 {
+		result.DuplicateOf = t.duplicatesOf(key, result.SHA256)
+	}
+
+	if len(result.DuplicateOf) > 0 {
+		switch t.policy {
+		case DuplicateSkip:
+			if err := t.writer.RemoveFile(p); err != nil {
+				return fmt.Errorf("failed to remove duplicate %s: %w", p, err)
+			}
+			delete(t.pending, key)
+			t.removed[key] = true
+			result.Skipped = true
+			t.written = append(t.written, result)
+			return nil
+
+		case DuplicateReplace:
+			for _, dup := range result.DuplicateOf {
+				t.touch(dup)
+				if err := t.writer.RemoveFile(dup); err != nil && !errors.Is(err, ErrFileNotFound) {
+					return fmt.Errorf("failed to remove duplicate %s: %w", dup, err)
+				}
+				delete(t.pending, indexKey(dup))
+				t.removed[indexKey(dup)] = true
+			}
+			result.Replaced = true
+		}
+	}
+
+	t.pending[key] = indexEntry{path: p, size: r.n, sum: result.SHA256}
+	t.written = append(t.written, result)
+	return nil
+}
+
+// writeUnlessDuplicate hashes a file before writing it, so a duplicate is
+// skipped without overwriting the file already at filePath. Readers that
+// can't seek back are spooled to a temporary file next to the disk image.
+func (t *Transaction) writeUnlessDuplicate(filePath string, reader io.Reader, size int64) error {
+	rs, ok := reader.(io.ReadSeeker)
+	if !ok {
+		spool, err := os.CreateTemp(t.spoolDir, ".duplicate-*")
+		if err != nil {
+			return fmt.Errorf("failed to create temporary file: %w", err)
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		if _, err := io.Copy(spool, io.LimitReader(reader, size)); err != nil {
+			return fmt.Errorf("failed to buffer %s: %w", filePath, err)
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		rs = spool
+	}
+
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, io.LimitReader(rs, size))
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %w", filePath, err)
+	}
+
+	// Every empty file is the same; they're not worth reporting
+	p := normalizePath(filePath)
+	sum := hex.EncodeToString(h.Sum(nil))
+	if n > 0 {
+		if dups := t.duplicatesOf(indexKey(p), sum); len(dups) > 0 {
+			t.written = append(t.written, WriteResult{Path: p, Size: n, SHA256: sum, DuplicateOf: dups, Skipped: true})
+			return nil
+		}
+	}
+
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	return t.write(filePath, rs, size)
+}
+
+// exists reports whether there is a file at filePath, as the disk will look
+// once the transaction so far is applied
+func (t *Transaction) exists(filePath string) bool {
+	key := indexKey(filePath)
+	if _, ok := t.pending[key]; ok {
+		return true
+	}
+	if t.removed[key] {
+		return false
+	}
+	_, err := statFile(t.fs, normalizePath(filePath))
+	return err == nil
+}
+
+// duplicatesOf lists the other files with the given hash, as the disk will
+// look once the transaction so far is applied. The index was refreshed before
+// the host was disconnected, so files changed since are checked and left out.
+func (t *Transaction) duplicatesOf(key, sum string) []string {
+	var dups []string
+	for k, e := range t.indexed {
+		if k != key && e.sum == sum && !t.removed[k] {
+			if _, rewritten := t.pending[k]; !rewritten && t.unchanged(e) {
+				dups = append(dups, e.path)
+			}
+		}
+	}
+	for k, e := range t.pending {
+		if k != key && e.sum == sum {
+			dups = append(dups, e.path)
+		}
+	}
+	sort.Strings(dups)
+	return dups
+}
+
+// unchanged reports whether an indexed file still has the size and
+// modification time it was hashed with
+func (t *Transaction) unchanged(e indexEntry) bool {
+	info, err := statFile(t.fs, e.path)
+	return err == nil && info.Size() == e.size && info.ModTime().Equal(e.modTime)
+}
+
+// ContentHash returns the SHA-256 of a file as the disk will look once the
+// transaction so far is applied. It comes from the content index unless the
+// file changed since it was indexed, when it is hashed again.
+func (t *Transaction) ContentHash(filePath string) (string, error) {
+	key := indexKey(filePath)
+	if e, ok := t.pending[key]; ok {
+		return e.sum, nil
+	}
+	if t.removed[key] {
+		return "", ErrFileNotFound
+	}
+
+	p := normalizePath(filePath)
+	info, err := statFile(t.fs, p)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory", p)
+	}
+	if e, ok := t.indexed[key]; ok && e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+		return e.sum, nil
+	}
+	return hashFile(t.fs, p, info.Size())
+}
+
+// ContentHashes returns the SHA-256 of every file in a directory on the disk,
+// keyed by name. Files in the directory changed since they were last hashed
+// are read again; the rest of the disk isn't looked at.
+func (m *Manager) ContentHashes(dirPath string) (map[string]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.filesystem == nil {
+		return nil, ErrDiskNotInitialized
+	}
+	if err := m.index.refresh(m.filesystem, dirPath, false); err != nil {
+		return nil, err
+	}
+
+	dirPath = normalizePath(dirPath)
+	hashes := make(map[string]string)
+	for _, e := range m.index.snapshot() {
+		if strings.EqualFold(path.Dir(e.path), dirPath) {
+			hashes[path.Base(e.path)] = e.sum
+		}
+	}
+	return hashes, nil
+}
@@ -0,0 +1,361 @@
+package diskmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrImageNotFound = errors.New("disk image not found")
+	ErrImageExists   = errors.New("disk image already exists")
+	ErrImageActive   = errors.New("disk image is active")
+	ErrInvalidImage  = errors.New("invalid disk image name")
+)
+
+// DefaultImageName refers to the disk image configured in Config.DiskPath
+const DefaultImageName = "default"
+
+const activeImageFile = "active"
+
+// imageNamePattern restricts image names to safe filenames
+var imageNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Image describes one disk image in an ImageStore
+type Image struct {
+	Name        string    `json:"name"`
+	Label       string    `json:"label"`
+	Description string    `json:"description,omitempty"`
+	SizeMB      int64     `json:"sizeMb"`
+	Created     time.Time `json:"created"`
+	Active      bool      `json:"active"`
+}
+
+// ImageStore manages a directory of disk images, each stored as <name>.img with a
+// <name>.json metadata file next to it. The image from the main configuration is
+// always available as "default".
+type ImageStore struct {
+	dir         string
+	defaultPath string
+	format      DiskFormat
+
+	mu sync.Mutex
+}
+
+// NewImageStore opens (and creates if needed) an image directory. New images are
+// formatted with format.
+func NewImageStore(dir, defaultPath string, format DiskFormat) (*ImageStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create image directory: %w", err)
+	}
+	return &ImageStore{dir: dir, defaultPath: defaultPath, format: format}, nil
+}
+
+// Path returns the disk image file of an image
+func (s *ImageStore) Path(name string) string {
+	if name == DefaultImageName {
+		return s.defaultPath
+	}
+	return filepath.Join(s.dir, name+".img")
+}
+
+// metaPath returns the metadata file of an image
+func (s *ImageStore) metaPath(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// ActiveName returns the image presented to the host
+func (s *ImageStore) ActiveName() string {
+	data, err := os.ReadFile(filepath.Join(s.dir, activeImageFile))
+	if err != nil {
+		return DefaultImageName
+	}
+	name := strings.TrimSpace(string(data))
+	if name != DefaultImageName {
+		if _, err := os.Stat(s.Path(name)); err != nil {
+			return DefaultImageName
+		}
+	}
+	return name
+}
+
+// SetActive records which image is presented to the host, so it is used again after a restart
+func (s *ImageStore) SetActive(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.get(name); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(s.dir, activeImageFile), []byte(name+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to record active image: %w", err)
+	}
+	return nil
+}
+
+// get reads the metadata of an image. The caller must hold the lock.
+func (s *ImageStore) get(name string) (Image, error) {
+	if name == DefaultImageName {
+		info, err := os.Stat(s.defaultPath)
+		if err != nil {
+			return Image{}, fmt.Errorf("%w: %s", ErrImageNotFound, name)
+		}
+		return Image{
+			Name:    DefaultImageName,
+			Label:   "Default",
+			SizeMB:  info.Size() / (1024 * 1024),
+			Created: info.ModTime(),
+		}, nil
+	}
+
+	data, err := os.ReadFile(s.metaPath(name))
+	if os.IsNotExist(err) {
+		return Image{}, fmt.Errorf("%w: %s", ErrImageNotFound, name)
+	}
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to read image metadata: %w", err)
+	}
+	var image Image
+	if err := json.Unmarshal(data, &image); err != nil {
+		return Image{}, fmt.Errorf("failed to parse image metadata: %w", err)
+	}
+	if info, err := os.Stat(s.Path(name)); err == nil {
+		image.SizeMB = info.Size() / (1024 * 1024)
+	}
+	return image, nil
+}
+
+// Get returns one image
+func (s *ImageStore) Get(name string) (Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	image, err := s.get(name)
+	if err != nil {
+		return Image{}, err
+	}
+	image.Active = name == s.ActiveName()
+	return image, nil
+}
+
+// List returns every image, the default image first and the rest sorted by name
+func (s *ImageStore) List() ([]Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	active := s.ActiveName()
+	images := make([]Image, 0)
+	if image, err := s.get(DefaultImageName); err == nil {
+		image.Active = active == DefaultImageName
+		images = append(images, image)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+	sort.Strings(matches)
+	for _, match := range matches {
+		name := strings.TrimSuffix(filepath.Base(match), ".json")
+		image, err := s.get(name)
+		if err != nil {
+			continue
+		}
+		image.Active = active == name
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// validateNew checks that a name can be used for a new image. The caller must hold the lock.
+func (s *ImageStore) validateNew(name string) error {
+	if !imageNamePattern.MatchString(name) || name == DefaultImageName {
+		return fmt.Errorf("%w: %q (use lowercase letters, digits, '-' and '_')", ErrInvalidImage, name)
+	}
+	if _, err := os.Stat(s.metaPath(name)); err == nil {
+		return fmt.Errorf("%w: %s", ErrImageExists, name)
+	}
+	return nil
+}
+
+// writeMeta stores the metadata of an image. The caller must hold the lock.
+func (s *ImageStore) writeMeta(image Image) error {
+	image.Active = false
+	data, err := json.MarshalIndent(image, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal image metadata: %w", err)
+	}
+	if err := os.WriteFile(s.metaPath(image.Name), data, 0644); err != nil {
+		return fmt.Errorf("failed to write image metadata: %w", err)
+	}
+	return nil
+}
+
+// Create formats a new, empty disk image
+func (s *ImageStore) Create(name, label, description string, sizeMB int64) (Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.validateNew(name); err != nil {
+		return Image{}, err
+	}
+	if sizeMB < 1 {
+		return Image{}, fmt.Errorf("%w: size must be at least 1 MB", ErrInvalidImage)
+	}
+
+	if err := CreateDiskImage(s.Path(name), sizeMB, s.format); err != nil {
+		os.Remove(s.Path(name))
+		return Image{}, err
+	}
+
+	image := Image{Name: name, Label: label, Description: description, SizeMB: sizeMB, Created: time.Now().UTC()}
+	if err := s.writeMeta(image); err != nil {
+		os.Remove(s.Path(name))
+		return Image{}, err
+	}
+	return image, nil
+}
+
+// Clone creates a new image from the contents of an existing one. copyFile makes
+// the copy; pass Manager.CopyDisk when the source is the active image so the host
+// can't change it mid-copy.
+func (s *ImageStore) Clone(source, name, label, description string, copyFile func(src, dst string) error) (Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.get(source); err != nil {
+		return Image{}, err
+	}
+	if err := s.validateNew(name); err != nil {
+		return Image{}, err
+	}
+
+	if err := copyFile(s.Path(source), s.Path(name)); err != nil {
+		os.Remove(s.Path(name))
+		return Image{}, err
+	}
+
+	info, err := os.Stat(s.Path(name))
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to stat cloned image: %w", err)
+	}
+	image := Image{
+		Name:        name,
+		Label:       label,
+		Description: description,
+		SizeMB:      info.Size() / (1024 * 1024),
+		Created:     time.Now().UTC(),
+	}
+	if err := s.writeMeta(image); err != nil {
+		os.Remove(s.Path(name))
+		return Image{}, err
+	}
+	return image, nil
+}
+
+// Delete removes an image. The active image and the default image can't be deleted.
+func (s *ImageStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if name == DefaultImageName {
+		return fmt.Errorf("%w: the default image can't be deleted", ErrInvalidImage)
+	}
+	if _, err := s.get(name); err != nil {
+		return err
+	}
+	if name == s.ActiveName() {
+		return fmt.Errorf("%w: %s", ErrImageActive, name)
+	}
+
+	if err := os.Remove(s.Path(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove disk image: %w", err)
+	}
+	if err := os.Remove(s.metaPath(name)); err != nil {
+		return fmt.Errorf("failed to remove image metadata: %w", err)
+	}
+	return nil
+}
+
+// DiskPath returns the disk image currently presented to the host
+func (m *Manager) DiskPath() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.config.DiskPath
+}
+
+// SwitchDisk presents a different disk image to the host. The gadget is
+// disconnected, lun.0/file is rewritten and the new image is opened before
+// reconnecting. On failure the previous image stays active.
+func (m *Manager) SwitchDisk(diskPath string) error {
+	if _, err := os.Stat(diskPath); err != nil {
+		return fmt.Errorf("disk image %s doesn't exist: %w", diskPath, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Disconnect the USB gadget before swapping the backing file
+	if err := m.gadget.Disconnect(); err != nil {
+		return fmt.Errorf("failed to disconnect USB gadget: %w", err)
+	}
+
+	// Ensure we reconnect even if there's an error
+	defer func() {
+		if err := m.gadget.Reconnect(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to reconnect USB gadget: %v\n", err)
+		}
+	}()
+
+	// The hashes are of the previous image's files
+	m.index.reset()
+
+	previous := m.config.DiskPath
+	m.config.DiskPath = diskPath
+	if err := m.openDisk(); err != nil {
+		m.config.DiskPath = previous
+		if reopenErr := m.openDisk(); reopenErr != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to reopen previous disk: %v\n", reopenErr)
+		}
+		return err
+	}
+
+	if err := m.gadget.SetBackingFile(diskPath); err != nil {
+		m.config.DiskPath = previous
+		if reopenErr := m.openDisk(); reopenErr != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to reopen previous disk: %v\n", reopenErr)
+		}
+		return fmt.Errorf("failed to change USB gadget backing file: %w", err)
+	}
+
+	return nil
+}
+
+// CopyDisk copies the current disk image to dst while the host is disconnected,
+// so the copy is consistent
+func (m *Manager) CopyDisk(dst string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Disconnect the USB gadget so the host can't write during the copy
+	if err := m.gadget.Disconnect(); err != nil {
+		return fmt.Errorf("failed to disconnect USB gadget: %w", err)
+	}
+
+	// Ensure we reconnect even if there's an error
+	defer func() {
+		if err := m.gadget.Reconnect(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to reconnect USB gadget: %v\n", err)
+		}
+	}()
+
+	return CopyImage(m.config.DiskPath, dst)
+}
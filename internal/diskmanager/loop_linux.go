@@ -0,0 +1,248 @@
+//go:build linux
+
+package diskmanager
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// loopDevice is a loop device attached to a disk image
+type loopDevice struct {
+	path string
+	file *os.File
+}
+
+// attachLoop attaches the disk image to a free loop device, exposing the
+// filesystem that starts offset bytes into it. The device clears itself once
+// it is unmounted and closed, so a crash can't leave it attached for long.
+func attachLoop(imagePath string, offset int64) (*loopDevice, error) {
+	control, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open loop control: %w", err)
+	}
+	defer control.Close()
+
+	image, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open disk image: %w", err)
+	}
+	defer image.Close()
+
+	// Another process can take the free device between the two calls
+	for attempt := 0; attempt < 5; attempt++ {
+		n, err := unix.IoctlRetInt(int(control.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find a free loop device: %w", err)
+		}
+
+		devPath := fmt.Sprintf("/dev/loop%d", n)
+		dev, err := os.OpenFile(devPath, os.O_RDWR, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", devPath, err)
+		}
+
+		if err := unix.IoctlSetInt(int(dev.Fd()), unix.LOOP_SET_FD, int(image.Fd())); err != nil {
+			dev.Close()
+			if errors.Is(err, unix.EBUSY) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to attach %s: %w", devPath, err)
+		}
+
+		info := unix.LoopInfo64{
+			Offset: uint64(offset),
+			Flags:  unix.LO_FLAGS_AUTOCLEAR,
+		}
+		copy(info.File_name[:], imagePath)
+		if err := unix.IoctlLoopSetStatus64(int(dev.Fd()), &info); err != nil {
+			unix.IoctlSetInt(int(dev.Fd()), unix.LOOP_CLR_FD, 0)
+			dev.Close()
+			return nil, fmt.Errorf("failed to configure %s: %w", devPath, err)
+		}
+
+		return &loopDevice{path: devPath, file: dev}, nil
+	}
+	return nil, fmt.Errorf("failed to attach a loop device: all free devices were taken")
+}
+
+// detach releases the loop device and waits for the kernel to let go of the
+// disk image. It fails if the device is still attached afterwards.
+func (d *loopDevice) detach() error {
+	err := unix.IoctlSetInt(int(d.file.Fd()), unix.LOOP_CLR_FD, 0)
+	d.file.Close()
+	if err != nil && !errors.Is(err, unix.ENXIO) {
+		return fmt.Errorf("failed to detach %s: %w", d.path, err)
+	}
+
+	// The kernel may finish clearing the device after the last close
+	name := filepath.Base(d.path)
+	for attempt := 0; attempt < 20; attempt++ {
+		if _, err := loopBackingFile(name); err != nil {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("%s is still attached", d.path)
+}
+
+// mountLoop mounts the FAT filesystem on a loop device
+func mountLoop(dev *loopDevice, mountDir string) error {
+	if err := unix.Mount(dev.path, mountDir, "vfat", 0, ""); err != nil {
+		return fmt.Errorf("failed to mount %s: %w", dev.path, err)
+	}
+	return nil
+}
+
+// unmountDir unmounts a directory, retrying while it is busy. If it stays busy
+// the mount is detached lazily: it disappears from the directory now and the
+// kernel releases it once the last user lets go.
+func unmountDir(mountDir string) error {
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		err = unix.Unmount(mountDir, 0)
+		if err == nil || errors.Is(err, unix.EINVAL) {
+			// EINVAL: not a mount point (any more)
+			return nil
+		}
+		if !errors.Is(err, unix.EBUSY) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if lazyErr := unix.Unmount(mountDir, unix.MNT_DETACH); lazyErr != nil && !errors.Is(lazyErr, unix.EINVAL) {
+		return fmt.Errorf("failed to unmount %s: %w", mountDir, err)
+	}
+	return nil
+}
+
+// loopBackingFile returns the image a loop device (e.g. "loop0") is attached
+// to, or an error if it is not attached
+func loopBackingFile(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join("/sys/block", name, "loop", "backing_file"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// loopDevicesFor lists the loop devices attached to any of the given images
+func loopDevicesFor(imagePaths ...string) []string {
+	wanted := make(map[string]bool)
+	for _, p := range imagePaths {
+		if abs, err := filepath.Abs(p); err == nil {
+			wanted[abs] = true
+		}
+	}
+
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return nil
+	}
+	var devices []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "loop") {
+			continue
+		}
+		backing, err := loopBackingFile(e.Name())
+		if err != nil {
+			continue
+		}
+		// A deleted backing file is reported with a " (deleted)" suffix
+		if wanted[strings.TrimSuffix(backing, " (deleted)")] {
+			devices = append(devices, "/dev/"+e.Name())
+		}
+	}
+	return devices
+}
+
+// mountedLoopDevices maps mount points to the loop devices mounted on them
+func mountedLoopDevices() map[string]string {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	mounts := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/loop") {
+			continue
+		}
+		mounts[unescapeMountPath(fields[1])] = fields[0]
+	}
+	return mounts
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for space) used in
+// /proc/self/mounts
+func unescapeMountPath(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// recoverStaleMounts cleans up after a loopback writer that never reached End,
+// typically because the process crashed mid-transaction: mounts of the disk
+// image (or its shadow copy) are unmounted, loop devices still attached to it
+// are detached, and the mount directories are removed. Loop devices and mounts
+// of other images are left alone.
+func recoverStaleMounts(diskPath string) {
+	images := []string{diskPath, shadowImagePath(diskPath)}
+	ours := make(map[string]bool)
+	for _, dev := range loopDevicesFor(images...) {
+		ours[dev] = true
+	}
+	if len(ours) == 0 {
+		removeStaleMountDirs()
+		return
+	}
+
+	for mountDir, dev := range mountedLoopDevices() {
+		if !ours[dev] {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "warning: unmounting stale mount of %s at %s\n", dev, mountDir)
+		if err := unmountDir(mountDir); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			continue
+		}
+		if strings.HasPrefix(filepath.Base(mountDir), mountDirPrefix) {
+			os.Remove(mountDir)
+		}
+	}
+
+	for dev := range ours {
+		f, err := os.OpenFile(dev, os.O_RDWR, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to open stale loop device %s: %v\n", dev, err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "warning: detaching stale loop device %s\n", dev)
+		if err := (&loopDevice{path: dev, file: f}).detach(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+
+	removeStaleMountDirs()
+}
@@ -0,0 +1,40 @@
+//go:build !linux
+
+package diskmanager
+
+import (
+	"errors"
+	"os"
+)
+
+// loopDevice is a loop device attached to a disk image
+type loopDevice struct {
+	path string
+	file *os.File
+}
+
+// attachLoop is not supported on this platform
+func attachLoop(imagePath string, offset int64) (*loopDevice, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// detach is not supported on this platform
+func (d *loopDevice) detach() error {
+	return errors.ErrUnsupported
+}
+
+// mountLoop is not supported on this platform
+func mountLoop(dev *loopDevice, mountDir string) error {
+	return errors.ErrUnsupported
+}
+
+// unmountDir is not supported on this platform
+func unmountDir(mountDir string) error {
+	return errors.ErrUnsupported
+}
+
+// recoverStaleMounts only removes leftover mount directories: nothing can be
+// mounted on this platform
+func recoverStaleMounts(diskPath string) {
+	removeStaleMountDirs()
+}
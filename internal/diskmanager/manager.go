@@ -1,17 +1,20 @@
 package diskmanager
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 
 	diskfs "github.com/diskfs/go-diskfs"
 	"github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/jgarman/embroidery-buddy/internal/fat"
 )
 
 var (
@@ -22,6 +25,7 @@ var (
 	ErrDiskFull           = errors.New("disk full")
 	ErrOperationFailed    = errors.New("operation failed")
 	ErrTransactionActive  = errors.New("transaction already active")
+	ErrDirectoryNotEmpty  = errors.New("directory not empty")
 )
 
 type Config struct {
@@ -36,6 +40,35 @@ type Config struct {
 
 	GadgetProductName  string
 	GadgetManufacturer string
+
+	// AutoSort re-sorts every directory a transaction touched (SortByName or
+	// SortByTime). Empty disables automatic sorting.
+	AutoSort SortKey
+
+	// SnapshotDir holds point-in-time copies of the disk image. Empty disables snapshots.
+	SnapshotDir string
+
+	// SnapshotLimit is the number of snapshots kept; older ones are removed. 0 keeps all.
+	SnapshotLimit int
+
+	// Format is used whenever the disk image is recreated (clearing, resizing)
+	Format DiskFormat
+
+	// Writer selects how files are written into the disk image (WriterFAT when empty)
+	Writer WriterType
+
+	// TransactionMode selects whether transactions write to the disk image in
+	// place (TransactionDirect, the default) or to a shadow copy that replaces
+	// it when the transaction succeeds (TransactionShadow)
+	TransactionMode TransactionMode
+
+	// DuplicatePolicy selects what a transaction does with files whose contents
+	// are already on the disk under another name (DuplicateKeep when empty)
+	DuplicatePolicy DuplicatePolicy
+
+	// StartupCheck checks (CheckOnly) or repairs (CheckRepair) the filesystem
+	// before the disk is presented to the host. Empty disables the check.
+	StartupCheck CheckMode
 }
 
 type Manager struct {
@@ -56,24 +89,55 @@ type Manager struct {
 
 	// USB gadget handler (injected dependency)
 	gadget UsbGadget
+
+	// result of the last filesystem check
+	check checkState
+
+	// content hashes of the files on the disk
+	index contentIndex
 }
 
 func (m *Manager) openDisk() error {
+	disk, fs, err := openImage(m.config.DiskPath)
+	if err != nil {
+		return err
+	}
+
+	m.disk = disk
+	m.filesystem = fs
+
+	return nil
+}
+
+// openImage opens a disk image read-write and returns its filesystem
+func openImage(diskPath string) (*disk.Disk, filesystem.FileSystem, error) {
 	// Open disk in read-write mode
-	disk, err := diskfs.Open(m.config.DiskPath, diskfs.WithOpenMode(diskfs.ReadWriteExclusive))
+	disk, err := diskfs.Open(diskPath, diskfs.WithOpenMode(diskfs.ReadWriteExclusive))
 	if err != nil {
-		return fmt.Errorf("failed to open disk: %w", err)
+		return nil, nil, fmt.Errorf("failed to open disk: %w", err)
 	}
 
-	fs, err := disk.GetFilesystem(0)
+	// Partitioned images keep the filesystem in the first partition
+	offset, err := volumeOffset(diskPath)
 	if err != nil {
-		return fmt.Errorf("failed to get filesystem: %w", err)
+		return nil, nil, err
+	}
+	partition := 0
+	if offset > 0 {
+		partition = 1
 	}
 
-	m.disk = disk
-	m.filesystem = fs
+	fs, err := disk.GetFilesystem(partition)
+	if err != nil {
+		// go-diskfs only reads FAT32
+		fatFS, fatErr := openFATReadOnly(diskPath, offset)
+		if fatErr != nil {
+			return nil, nil, fmt.Errorf("failed to get filesystem: %w", err)
+		}
+		fs = fatFS
+	}
 
-	return nil
+	return disk, fs, nil
 }
 
 // New creates a new disk manager with the given configuration and USB gadget implementation.
@@ -97,15 +161,55 @@ func New(config Config, gadget UsbGadget) (*Manager, error) {
 		gadget:   gadget,
 	}
 
+	if err := config.Format.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch config.AutoSort {
+	case "", SortByName, SortByTime:
+	default:
+		return nil, fmt.Errorf("%w: unsupported auto sort order %q", ErrInvalidPath, config.AutoSort)
+	}
+
+	if err := config.Writer.validate(); err != nil {
+		return nil, err
+	}
+
+	switch config.TransactionMode {
+	case "", TransactionDirect, TransactionShadow:
+	default:
+		return nil, fmt.Errorf("unsupported transaction mode %q (direct or shadow)", config.TransactionMode)
+	}
+
+	if err := config.DuplicatePolicy.validate(); err != nil {
+		return nil, err
+	}
+
+	switch config.StartupCheck {
+	case "", CheckOff, CheckOnly, CheckRepair:
+	default:
+		return nil, fmt.Errorf("unsupported startup check %q (off, check or repair)", config.StartupCheck)
+	}
+
 	// Check if disk image exists
 	_, err := os.Stat(m.config.DiskPath)
 	if err != nil {
 		return nil, fmt.Errorf("disk image %s doesn't exist: %w", m.config.DiskPath, err)
 	}
+	// A loopback writer that crashed mid-transaction may have left the image mounted
+	recoverStaleMounts(m.config.DiskPath)
+
+	// A shadow image left by a crash never replaced the disk image
+	removeShadowImage(m.config.DiskPath)
+	removeRestoreImage(m.config.DiskPath)
+
 	if err := m.openDisk(); err != nil {
 		return nil, err
 	}
 
+	// Check the filesystem while the host can't see it yet
+	m.startupCheck()
+
 	// Initialize the USB gadget
 	if err = m.gadget.Initialize(); err != nil {
 		// Clean up on error
@@ -116,28 +220,6 @@ func New(config Config, gadget UsbGadget) (*Manager, error) {
 	return m, nil
 }
 
-func CreateDiskImage(diskPath string, diskSizeMb int64) error {
-	mydisk, err := diskfs.Create(diskPath, diskSizeMb*1024*1024,
-		diskfs.SectorSizeDefault)
-
-	if err != nil {
-		return fmt.Errorf("failed to create disk: %w", err)
-	}
-
-	fmt.Println("Created disk")
-
-	_, err = mydisk.CreateFilesystem(disk.FilesystemSpec{
-		Partition:   0,
-		FSType:      filesystem.TypeFat32,
-		VolumeLabel: "EMBROIDERY",
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create filesystem: %w", err)
-	}
-
-	return nil
-}
-
 // normalizePath normalizes a file path
 func normalizePath(p string) string {
 	// Ensure path starts with /
@@ -155,18 +237,116 @@ func normalizePath(p string) string {
 // with the USB gadget disconnected to prevent host access during modifications.
 type Transaction struct {
 	writer FilesystemWriter
+
+	// filesystem of the image as it was when the transaction began
+	fs filesystem.FileSystem
+
+	// directory for temporary files, next to the disk image
+	spoolDir string
+
+	// directories changed by the transaction, for automatic sorting
+	dirs map[string]bool
+
+	// content index at the start of the transaction, and the files written
+	// and removed since, keyed by indexKey
+	indexed map[string]indexEntry
+	pending map[string]indexEntry
+	removed map[string]bool
+
+	policy  DuplicatePolicy
+	written []WriteResult
+}
+
+// newTransaction creates a transaction writing with writer to the disk image
+// whose filesystem is fs
+func (m *Manager) newTransaction(writer FilesystemWriter, fs filesystem.FileSystem) *Transaction {
+	tx := &Transaction{
+		writer:   writer,
+		fs:       fs,
+		spoolDir: filepath.Dir(m.config.DiskPath),
+		pending:  make(map[string]indexEntry),
+		removed:  make(map[string]bool),
+		policy:   m.config.DuplicatePolicy,
+	}
+	if tx.policy == "" {
+		tx.policy = DuplicateKeep
+	}
+
+	// The index was refreshed before the host was disconnected
+	tx.indexed = m.index.snapshot()
+	return tx
+}
+
+// refreshIndex brings the content index up to date before a transaction, so
+// the host isn't kept waiting on hashing while the gadget is disconnected.
+// Duplicate detection is best effort; a disk that can't be read fully still
+// takes writes.
+func (m *Manager) refreshIndex() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.filesystem == nil {
+		return
+	}
+	if err := m.index.refresh(m.filesystem, "/", true); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to index disk contents: %v\n", err)
+	}
 }
 
 // WriteFile writes a file to the disk within the transaction.
 // The file path is normalized and parent directories are created automatically.
+// The contents are hashed on the way through; see Written for the result and
+// DuplicatePolicy for what happens when they are already on the disk.
 func (t *Transaction) WriteFile(filePath string, reader io.Reader, size int64) error {
-	return t.writer.WriteFile(filePath, reader, size)
+	if t.policy == DuplicateSkip && t.exists(filePath) {
+		return t.writeUnlessDuplicate(filePath, reader, size)
+	}
+	return t.write(filePath, reader, size)
+}
+
+// write writes a file, hashing it on the way through
+func (t *Transaction) write(filePath string, reader io.Reader, size int64) error {
+	t.touch(filePath)
+	r := &hashingReader{reader: reader, hash: sha256.New()}
+	if err := t.writer.WriteFile(filePath, r, size); err != nil {
+		return err
+	}
+	return t.record(filePath, r)
+}
+
+// ReadDir lists a directory of the disk the transaction writes to, so names
+// chosen before the transaction can be checked while no one else can take
+// them (Manager.ReadDir can't be called while the disk is locked). Whether
+// files the transaction already wrote show up depends on the writer, so list
+// before writing.
+func (t *Transaction) ReadDir(dirPath string) ([]os.FileInfo, error) {
+	return readDir(t.fs, dirPath)
+}
+
+// RemoveFile removes a file from the disk within the transaction
+func (t *Transaction) RemoveFile(filePath string) error {
+	t.touch(filePath)
+	if err := t.writer.RemoveFile(filePath); err != nil {
+		return err
+	}
+	key := indexKey(filePath)
+	delete(t.pending, key)
+	t.removed[key] = true
+	return nil
+}
+
+// Mkdir creates a directory, and any missing parents, within the transaction.
+// Directories that already exist are left alone.
+func (t *Transaction) Mkdir(dirPath string) error {
+	t.touch(dirPath)
+	return t.writer.Mkdir(dirPath)
 }
 
 // BeginTransaction starts a new transaction for batch write operations.
 // The USB gadget is disconnected, the filesystem writer is initialized,
 // and the transaction function runs. After completion (or panic), the writer
-// is finalized and the USB gadget is reconnected.
+// is finalized and the USB gadget is reconnected. In TransactionShadow mode the
+// changes only reach the disk image if fn returns nil.
 //
 // Example usage:
 //
@@ -179,7 +359,9 @@ func (t *Transaction) WriteFile(filePath string, reader io.Reader, size int64) e
 //	    }
 //	    return nil
 //	})
-func (m *Manager) BeginTransaction(fn func(*Transaction) error) error {
+func (m *Manager) BeginTransaction(fn func(*Transaction) error) (err error) {
+	m.refreshIndex()
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -192,28 +374,125 @@ func (m *Manager) BeginTransaction(fn func(*Transaction) error) error {
 		return fmt.Errorf("failed to disconnect USB gadget: %w", err)
 	}
 
+	// Ensure we reconnect even if there's an error
+	defer func() { m.reconnectAfter(err) }()
+
+	return m.runTransaction(fn)
+}
+
+// ReplaceContents empties the disk and runs fn to repopulate it, all while the
+// USB gadget is disconnected once. The host never sees the empty disk.
+func (m *Manager) ReplaceContents(fn func(*Transaction) error) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.filesystem == nil {
+		return ErrDiskNotInitialized
+	}
+
+	// Disconnect the USB gadget for the whole swap
+	if err := m.gadget.Disconnect(); err != nil {
+		return fmt.Errorf("failed to disconnect USB gadget: %w", err)
+	}
+
+	// Ensure we reconnect even if there's an error
+	defer func() { m.reconnectAfter(err) }()
+
+	// None of the files on the disk count as duplicates of the new contents
+	m.index.reset()
+
+	if m.config.TransactionMode == TransactionShadow {
+		return m.runShadowTransaction(true, fn)
+	}
+
+	if err := m.clearDisk(); err != nil {
+		return err
+	}
+
+	return m.runTransaction(fn)
+}
+
+// Atomic reports whether a failed transaction leaves the disk unchanged, which
+// is the case in TransactionShadow mode. In direct mode the files written before
+// the failure stay on the disk.
+func (m *Manager) Atomic() bool {
+	return m.config.TransactionMode == TransactionShadow
+}
+
+// reconnectAfter reconnects the USB gadget after a transaction, unless the
+// transaction left the disk image attached to a loop device: the host must
+// never see the image while the kernel may still write to it. The gadget then
+// stays disconnected until a later transaction or restart cleans up.
+func (m *Manager) reconnectAfter(err error) {
+	if errors.Is(err, ErrImageStillAttached) {
+		fmt.Fprintf(os.Stderr, "warning: leaving USB gadget disconnected: %v\n", err)
+		return
+	}
+	if err := m.gadget.Reconnect(); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to reconnect USB gadget: %v\n", err)
+	}
+}
+
+// runTransaction runs fn with a filesystem writer.
+// The caller must hold the lock and have disconnected the USB gadget.
+func (m *Manager) runTransaction(fn func(*Transaction) error) error {
+	if m.config.TransactionMode == TransactionShadow {
+		return m.runShadowTransaction(false, fn)
+	}
+
+	tx, err := m.writeImage(m.config.DiskPath, m.filesystem, fn)
+
+	// Reopen the disk so reads see what the writer changed behind go-diskfs's cached FAT
+	if reopenErr := m.openDisk(); reopenErr != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to reopen disk: %v\n", reopenErr)
+		m.index.reset()
+		return err
+	}
+
+	if err != nil {
+		// Part of the transaction may have been written
+		m.index.reset()
+		return err
+	}
+	m.index.apply(m.filesystem, tx)
+	return nil
+}
+
+// writeImage runs fn with a filesystem writer on a disk image and sorts the
+// directories it touched if automatic sorting is enabled
+func (m *Manager) writeImage(diskPath string, fs filesystem.FileSystem, fn func(*Transaction) error) (tx *Transaction, err error) {
 	// Create the filesystem writer
-	writer := NewFilesystemWriter(m.config.DiskPath, m.filesystem)
+	writer := NewFilesystemWriterOfType(m.config.Writer, diskPath, fs)
 
 	// Initialize the writer (mount filesystem if using loopback)
 	if err := writer.Begin(); err != nil {
-		_ = m.gadget.Reconnect()
-		return fmt.Errorf("failed to initialize filesystem writer: %w", err)
+		return nil, fmt.Errorf("failed to initialize filesystem writer: %w", err)
 	}
 
-	// Ensure we finalize the writer and reconnect even if there's an error or panic
+	tx = m.newTransaction(writer, fs)
+
+	// Ensure we finalize the writer even if there's an error or panic
 	defer func() {
-		if err := writer.End(); err != nil {
-			fmt.Fprintf(os.Stderr, "warning: failed to finalize filesystem writer: %v\n", err)
+		if endErr := writer.End(); endErr != nil {
+			switch {
+			case err == nil, errors.Is(endErr, ErrImageStillAttached):
+				err = fmt.Errorf("failed to finalize filesystem writer: %w", endErr)
+			default:
+				fmt.Fprintf(os.Stderr, "warning: failed to finalize filesystem writer: %v\n", endErr)
+			}
+			// Don't touch an image the kernel may still be writing
+			return
 		}
-		if err := m.gadget.Reconnect(); err != nil {
-			fmt.Fprintf(os.Stderr, "warning: failed to reconnect USB gadget: %v\n", err)
+		if m.config.AutoSort != "" && len(tx.dirs) > 0 {
+			less, _ := SortOrder{Key: m.config.AutoSort}.lessFunc()
+			if err := sortDirectories(diskPath, tx.touchedDirectories(), less); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: failed to sort directories: %v\n", err)
+			}
 		}
 	}()
 
-	// Create transaction and execute user function
-	tx := &Transaction{writer: writer}
-	return fn(tx)
+	// Execute user function
+	return tx, fn(tx)
 }
 
 // ReadFile reads a file from the disk
@@ -228,11 +507,15 @@ func (m *Manager) ReadFile(filePath string) (io.ReadCloser, error) {
 	// Normalize path
 	filePath = normalizePath(filePath)
 
+	// go-diskfs can't read empty files without a first cluster, which is how
+	// vfat and internal/fat store them
+	if m.isEmptyFile(filePath) {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
 	file, err := m.filesystem.OpenFile(filePath, os.O_RDONLY)
 	if err != nil {
-		// Check for file not found error (diskfs returns specific error messages)
-		errStr := err.Error()
-		if os.IsNotExist(err) || strings.Contains(errStr, "does not exist") {
+		if isNotExistError(err) {
 			return nil, ErrFileNotFound
 		}
 		return nil, fmt.Errorf("failed to open file: %w", err)
@@ -241,7 +524,68 @@ func (m *Manager) ReadFile(filePath string) (io.ReadCloser, error) {
 	return file, nil
 }
 
-// ClearFiles clears all files from the disk by recreating the filesystem
+// isEmptyFile reports whether filePath is a file of zero bytes
+func (m *Manager) isEmptyFile(filePath string) bool {
+	entries, err := m.filesystem.ReadDir(path.Dir(filePath))
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if strings.EqualFold(e.Name(), path.Base(filePath)) {
+			return !e.IsDir() && e.Size() == 0
+		}
+	}
+	return false
+}
+
+// ReadDir lists the entries of a directory on the disk.
+// The "." and ".." entries are omitted.
+func (m *Manager) ReadDir(dirPath string) ([]os.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.filesystem == nil {
+		return nil, ErrDiskNotInitialized
+	}
+	return readDir(m.filesystem, dirPath)
+}
+
+// readDir lists a directory of fs without "." and ".."
+func readDir(fs filesystem.FileSystem, dirPath string) ([]os.FileInfo, error) {
+	// Normalize path
+	dirPath = normalizePath(dirPath)
+
+	entries, err := fs.ReadDir(dirPath)
+	if err != nil {
+		if isNotExistError(err) {
+			return nil, ErrFileNotFound
+		}
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	result := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Name() == "." || entry.Name() == ".." {
+			continue
+		}
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
+// isNotExistError checks if an error means the path does not exist
+// (diskfs returns specific error messages rather than os.ErrNotExist)
+func isNotExistError(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	errStr := err.Error()
+	return strings.Contains(errStr, "does not exist") || strings.Contains(errStr, "not found")
+}
+
+// ClearFiles clears all files from the disk. Only the allocation tables and root
+// directory are rewritten, so the volume label, serial number and geometry stay.
 func (m *Manager) ClearFiles() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -262,6 +606,77 @@ func (m *Manager) ClearFiles() error {
 		}
 	}()
 
+	return m.clearDisk()
+}
+
+// ClearDirectory removes everything inside a directory, leaving the directory
+// itself and the rest of the disk untouched
+func (m *Manager) ClearDirectory(dirPath string) error {
+	dirPath = normalizePath(dirPath)
+	if dirPath == "/" {
+		return m.ClearFiles()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.filesystem == nil {
+		return ErrDiskNotInitialized
+	}
+
+	// Disconnect the USB gadget before clearing
+	if err := m.gadget.Disconnect(); err != nil {
+		return fmt.Errorf("failed to disconnect USB gadget: %w", err)
+	}
+
+	// Ensure we reconnect even if there's an error
+	defer func() {
+		if err := m.gadget.Reconnect(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to reconnect USB gadget: %v\n", err)
+		}
+	}()
+
+	clearErr := m.editVolume(func(volume *fat.Volume) error {
+		if err := volume.ClearDir(dirPath); err != nil {
+			if errors.Is(err, fat.ErrNotFound) || errors.Is(err, fat.ErrNotDirectory) {
+				return fmt.Errorf("%w: %s", ErrFileNotFound, dirPath)
+			}
+			return fmt.Errorf("failed to clear %s: %w", dirPath, err)
+		}
+		return nil
+	})
+
+	// Reopen the disk so go-diskfs doesn't use its cached FAT
+	if err := m.openDisk(); err != nil {
+		return fmt.Errorf("failed to reopen disk: %w", err)
+	}
+
+	return clearErr
+}
+
+// clearDisk empties the disk in place. If the volume can't be cleared (e.g.,
+// its FAT is damaged) the image is recreated instead.
+// The caller must hold the lock and have disconnected the USB gadget.
+func (m *Manager) clearDisk() error {
+	m.index.reset()
+	err := m.editVolume(func(volume *fat.Volume) error {
+		return volume.Clear()
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to clear disk in place, recreating it: %v\n", err)
+		return m.recreateDisk()
+	}
+
+	// Reopen the disk so go-diskfs doesn't use its cached FAT
+	if err := m.openDisk(); err != nil {
+		return fmt.Errorf("failed to reopen disk: %w", err)
+	}
+	return nil
+}
+
+// recreateDisk replaces the disk image with a fresh, empty filesystem of the same size.
+// The caller must hold the lock and have disconnected the USB gadget.
+func (m *Manager) recreateDisk() error {
 	// Get the disk size by checking the file before we remove it
 	fileInfo, err := os.Stat(m.config.DiskPath)
 	if err != nil {
@@ -279,7 +694,7 @@ func (m *Manager) ClearFiles() error {
 	}
 
 	// Recreate the disk image and filesystem
-	if err := CreateDiskImage(m.config.DiskPath, diskSizeMb); err != nil {
+	if err := CreateDiskImage(m.config.DiskPath, diskSizeMb, m.config.Format); err != nil {
 		return fmt.Errorf("failed to recreate filesystem: %w", err)
 	}
 
@@ -2,10 +2,16 @@ package diskmanager
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/jgarman/embroidery-buddy/internal/fat"
 )
 
 // TestCreateDiskImage tests the creation of a disk image
@@ -15,7 +21,7 @@ func TestCreateDiskImage(t *testing.T) {
 	diskPath := filepath.Join(tempDir, "test.img")
 
 	// Create a 10MB disk image
-	err := CreateDiskImage(diskPath, 10)
+	err := CreateDiskImage(diskPath, 10, DiskFormat{})
 	if err != nil {
 		t.Fatalf("Failed to create disk image: %v", err)
 	}
@@ -40,7 +46,7 @@ func TestNewManager(t *testing.T) {
 	diskPath := filepath.Join(tempDir, "test.img")
 
 	// Create a disk image first
-	err := CreateDiskImage(diskPath, 10)
+	err := CreateDiskImage(diskPath, 10, DiskFormat{})
 	if err != nil {
 		t.Fatalf("Failed to create disk image: %v", err)
 	}
@@ -85,7 +91,7 @@ func TestWriteFile(t *testing.T) {
 	diskPath := filepath.Join(tempDir, "test.img")
 
 	// Create a disk image
-	err := CreateDiskImage(diskPath, 10)
+	err := CreateDiskImage(diskPath, 10, DiskFormat{})
 	if err != nil {
 		t.Fatalf("Failed to create disk image: %v", err)
 	}
@@ -144,7 +150,7 @@ func TestWriteFileWithSubdirectory(t *testing.T) {
 	diskPath := filepath.Join(tempDir, "test.img")
 
 	// Create a disk image
-	err := CreateDiskImage(diskPath, 10)
+	err := CreateDiskImage(diskPath, 10, DiskFormat{})
 	if err != nil {
 		t.Fatalf("Failed to create disk image: %v", err)
 	}
@@ -204,7 +210,7 @@ func TestWriteMultipleFiles(t *testing.T) {
 	diskPath := filepath.Join(tempDir, "test.img")
 
 	// Create a disk image
-	err := CreateDiskImage(diskPath, 10)
+	err := CreateDiskImage(diskPath, 10, DiskFormat{})
 	if err != nil {
 		t.Fatalf("Failed to create disk image: %v", err)
 	}
@@ -330,7 +336,7 @@ func TestReadFile(t *testing.T) {
 	diskPath := filepath.Join(tempDir, "test.img")
 
 	// Create a disk image
-	err := CreateDiskImage(diskPath, 10)
+	err := CreateDiskImage(diskPath, 10, DiskFormat{})
 	if err != nil {
 		t.Fatalf("Failed to create disk image: %v", err)
 	}
@@ -388,7 +394,7 @@ func TestReadNonExistentFile(t *testing.T) {
 	diskPath := filepath.Join(tempDir, "test.img")
 
 	// Create a disk image
-	err := CreateDiskImage(diskPath, 10)
+	err := CreateDiskImage(diskPath, 10, DiskFormat{})
 	if err != nil {
 		t.Fatalf("Failed to create disk image: %v", err)
 	}
@@ -437,7 +443,7 @@ func TestReadWriteRoundTrip(t *testing.T) {
 	diskPath := filepath.Join(tempDir, "test.img")
 
 	// Create a disk image
-	err := CreateDiskImage(diskPath, 10)
+	err := CreateDiskImage(diskPath, 10, DiskFormat{})
 	if err != nil {
 		t.Fatalf("Failed to create disk image: %v", err)
 	}
@@ -518,7 +524,7 @@ func TestUsbGadgetDisconnectReconnect(t *testing.T) {
 	diskPath := filepath.Join(tempDir, "test.img")
 
 	// Create a disk image
-	err := CreateDiskImage(diskPath, 10)
+	err := CreateDiskImage(diskPath, 10, DiskFormat{})
 	if err != nil {
 		t.Fatalf("Failed to create disk image: %v", err)
 	}
@@ -627,7 +633,7 @@ func TestManagerCloseDisconnects(t *testing.T) {
 	diskPath := filepath.Join(tempDir, "test.img")
 
 	// Create a disk image
-	err := CreateDiskImage(diskPath, 10)
+	err := CreateDiskImage(diskPath, 10, DiskFormat{})
 	if err != nil {
 		t.Fatalf("Failed to create disk image: %v", err)
 	}
@@ -673,7 +679,7 @@ func TestManagerCloseTwice(t *testing.T) {
 	diskPath := filepath.Join(tempDir, "test.img")
 
 	// Create a disk image
-	err := CreateDiskImage(diskPath, 10)
+	err := CreateDiskImage(diskPath, 10, DiskFormat{})
 	if err != nil {
 		t.Fatalf("Failed to create disk image: %v", err)
 	}
@@ -709,3 +715,1029 @@ func TestManagerCloseTwice(t *testing.T) {
 		t.Errorf("Second Close returned error: %v", err)
 	}
 }
+
+// TestSortDirectory tests rewriting the entry order of the root directory
+func TestSortDirectory(t *testing.T) {
+	// Create temporary directory for test
+	tempDir := t.TempDir()
+	diskPath := filepath.Join(tempDir, "test.img")
+
+	// Create a disk image
+	err := CreateDiskImage(diskPath, 10, DiskFormat{})
+	if err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+
+	// Create manager with NoOp gadget
+	manager, err := New(Config{DiskPath: diskPath}, NewNoOpUsbGadget())
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+
+	// Write files through go-diskfs directly so the test doesn't need a loopback mount
+	for _, name := range []string{"/zebra.dst", "/Apple.exp", "/mango.dst"} {
+		f, err := manager.filesystem.OpenFile(name, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		if _, err := f.Write([]byte(name)); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		f.Close()
+	}
+
+	listNames := func() []string {
+		entries, err := manager.ReadDir("/")
+		if err != nil {
+			t.Fatalf("Failed to read directory: %v", err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+
+	tests := []struct {
+		order    SortOrder
+		expected []string
+	}{
+		{SortOrder{Key: SortByName}, []string{"Apple.exp", "mango.dst", "zebra.dst"}},
+		{SortOrder{Key: SortByCustom, Names: []string{"zebra.dst"}}, []string{"zebra.dst", "Apple.exp", "mango.dst"}},
+	}
+
+	for _, tt := range tests {
+		if err := manager.SortDirectory("/", tt.order); err != nil {
+			t.Fatalf("Failed to sort directory by %s: %v", tt.order.Key, err)
+		}
+		names := listNames()
+		if len(names) != len(tt.expected) {
+			t.Fatalf("Expected %v, got %v", tt.expected, names)
+		}
+		for i := range names {
+			if names[i] != tt.expected[i] {
+				t.Errorf("Sort by %s: expected %v, got %v", tt.order.Key, tt.expected, names)
+				break
+			}
+		}
+	}
+
+	if err := manager.SortDirectory("/missing", SortOrder{Key: SortByName}); err == nil {
+		t.Error("Expected error sorting a missing directory")
+	}
+	if err := manager.SortDirectory("/", SortOrder{Key: "size"}); err == nil {
+		t.Error("Expected error for unknown sort order")
+	}
+}
+
+// TestReplaceContents tests that the disk is emptied and repopulated in one disconnect
+func TestReplaceContents(t *testing.T) {
+	// Create temporary directory for test
+	tempDir := t.TempDir()
+	diskPath := filepath.Join(tempDir, "test.img")
+
+	// Create a disk image
+	err := CreateDiskImage(diskPath, 10, DiskFormat{})
+	if err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+
+	// Create manager with NoOp gadget
+	gadget := NewNoOpUsbGadget()
+	manager, err := New(Config{DiskPath: diskPath}, gadget)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+
+	old := []byte("old design")
+	err = manager.BeginTransaction(func(tx *Transaction) error {
+		return tx.WriteFile("/old.dst", bytes.NewReader(old), int64(len(old)))
+	})
+	if err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	gadget.ResetCounts()
+	replacement := []byte("new design")
+	err = manager.ReplaceContents(func(tx *Transaction) error {
+		return tx.WriteFile("/Set/new.dst", bytes.NewReader(replacement), int64(len(replacement)))
+	})
+	if err != nil {
+		t.Fatalf("Failed to replace contents: %v", err)
+	}
+
+	if gadget.GetDisconnectCalls() != 1 || gadget.GetReconnectCalls() != 1 {
+		t.Errorf("Expected one disconnect and one reconnect, got %d and %d",
+			gadget.GetDisconnectCalls(), gadget.GetReconnectCalls())
+	}
+
+	if _, err := manager.ReadFile("/old.dst"); err != ErrFileNotFound {
+		t.Errorf("Expected old file to be gone, got %v", err)
+	}
+
+	readFile, err := manager.ReadFile("/Set/new.dst")
+	if err != nil {
+		t.Fatalf("Failed to read new file: %v", err)
+	}
+	defer readFile.Close()
+	content, _ := io.ReadAll(readFile)
+	if !bytes.Equal(content, replacement) {
+		t.Errorf("Content mismatch: expected %q, got %q", replacement, content)
+	}
+}
+
+// TestImageStore tests creating, cloning and deleting managed disk images
+func TestImageStore(t *testing.T) {
+	tempDir := t.TempDir()
+	defaultPath := filepath.Join(tempDir, "default.img")
+	if err := CreateDiskImage(defaultPath, 10, DiskFormat{}); err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+
+	store, err := NewImageStore(filepath.Join(tempDir, "images"), defaultPath, DiskFormat{})
+	if err != nil {
+		t.Fatalf("Failed to create image store: %v", err)
+	}
+
+	if _, err := store.Create("Bad Name", "", "", 10); !errors.Is(err, ErrInvalidImage) {
+		t.Errorf("Expected ErrInvalidImage, got %v", err)
+	}
+	if _, err := store.Create("machine-a", "Machine A", "Left machine", 10); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	if _, err := store.Create("machine-a", "", "", 10); !errors.Is(err, ErrImageExists) {
+		t.Errorf("Expected ErrImageExists, got %v", err)
+	}
+	if _, err := store.Clone("machine-a", "machine-b", "Machine B", "", CopyImage); err != nil {
+		t.Fatalf("Failed to clone image: %v", err)
+	}
+
+	images, err := store.List()
+	if err != nil {
+		t.Fatalf("Failed to list images: %v", err)
+	}
+	if len(images) != 3 || images[0].Name != DefaultImageName || !images[0].Active {
+		t.Fatalf("Expected default (active), machine-a and machine-b, got %+v", images)
+	}
+	if images[2].SizeMB != 10 {
+		t.Errorf("Expected cloned image of 10 MB, got %d", images[2].SizeMB)
+	}
+
+	if err := store.SetActive("machine-b"); err != nil {
+		t.Fatalf("Failed to set active image: %v", err)
+	}
+	if err := store.Delete("machine-b"); !errors.Is(err, ErrImageActive) {
+		t.Errorf("Expected ErrImageActive, got %v", err)
+	}
+	if err := store.Delete(DefaultImageName); !errors.Is(err, ErrInvalidImage) {
+		t.Errorf("Expected ErrInvalidImage deleting the default image, got %v", err)
+	}
+	if err := store.Delete("machine-a"); err != nil {
+		t.Errorf("Failed to delete image: %v", err)
+	}
+	if _, err := store.Get("machine-a"); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("Expected ErrImageNotFound after delete, got %v", err)
+	}
+}
+
+// TestSwitchDisk tests presenting a different disk image to the host
+func TestSwitchDisk(t *testing.T) {
+	tempDir := t.TempDir()
+	firstPath := filepath.Join(tempDir, "first.img")
+	secondPath := filepath.Join(tempDir, "second.img")
+	for _, p := range []string{firstPath, secondPath} {
+		if err := CreateDiskImage(p, 10, DiskFormat{}); err != nil {
+			t.Fatalf("Failed to create disk image: %v", err)
+		}
+	}
+
+	gadget := NewNoOpUsbGadget()
+	manager, err := New(Config{DiskPath: firstPath}, gadget)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	err = manager.BeginTransaction(func(tx *Transaction) error {
+		return tx.WriteFile("/first.txt", strings.NewReader("first"), 5)
+	})
+	if err != nil {
+		t.Fatalf("Failed to write to the first image: %v", err)
+	}
+
+	if err := manager.SwitchDisk(secondPath); err != nil {
+		t.Fatalf("Failed to switch disk: %v", err)
+	}
+	if manager.DiskPath() != secondPath || gadget.GetBackingFile() != secondPath {
+		t.Errorf("Expected %s to be active, got %s (gadget %s)", secondPath, manager.DiskPath(), gadget.GetBackingFile())
+	}
+	if !gadget.IsConnected() {
+		t.Error("Expected gadget to be reconnected after switching")
+	}
+	if files := manager.index.snapshot(); len(files) != 0 {
+		t.Errorf("Expected the first image's hashes to be dropped, got %v", files)
+	}
+
+	if err := manager.SwitchDisk(filepath.Join(tempDir, "missing.img")); err == nil {
+		t.Error("Expected error switching to a missing image")
+	}
+	if manager.DiskPath() != secondPath {
+		t.Errorf("Expected %s to stay active, got %s", secondPath, manager.DiskPath())
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	tempDir := t.TempDir()
+	diskPath := filepath.Join(tempDir, "test.img")
+	if err := CreateDiskImage(diskPath, 10, DiskFormat{}); err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+
+	// A copy left by an interrupted restore is discarded at startup
+	if err := os.WriteFile(restoreImagePath(diskPath), []byte("partial"), 0644); err != nil {
+		t.Fatalf("Failed to create leftover restore image: %v", err)
+	}
+	manager, err := New(Config{
+		DiskPath:      diskPath,
+		SnapshotDir:   filepath.Join(tempDir, "snapshots"),
+		SnapshotLimit: 2,
+	}, NewNoOpUsbGadget())
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	if _, err := os.Stat(restoreImagePath(diskPath)); !os.IsNotExist(err) {
+		t.Errorf("Expected the leftover restore image to be removed, got %v", err)
+	}
+
+	write := func(name, content string) {
+		t.Helper()
+		err := manager.BeginTransaction(func(tx *Transaction) error {
+			return tx.WriteFile(name, bytes.NewReader([]byte(content)), int64(len(content)))
+		})
+		if err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	write("/before.txt", "before")
+	snapshot, err := manager.Snapshot("before-upload")
+	if err != nil {
+		t.Fatalf("Failed to take snapshot: %v", err)
+	}
+	if snapshot.Source != diskPath {
+		t.Errorf("Expected source %s, got %s", diskPath, snapshot.Source)
+	}
+	if _, err := manager.Snapshot("before-upload"); !errors.Is(err, ErrSnapshotExists) {
+		t.Errorf("Expected ErrSnapshotExists, got %v", err)
+	}
+	if _, err := manager.Snapshot("../escape"); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("Expected ErrInvalidSnapshot, got %v", err)
+	}
+
+	write("/after.txt", "after")
+	if err := manager.Restore("before-upload"); err != nil {
+		t.Fatalf("Failed to restore snapshot: %v", err)
+	}
+	if files := manager.index.snapshot(); len(files) != 0 {
+		t.Errorf("Expected the replaced image's hashes to be dropped, got %v", files)
+	}
+	if _, err := manager.ReadFile("/after.txt"); err == nil {
+		t.Error("Expected after.txt to be gone after restore")
+	}
+	reader, err := manager.ReadFile("/before.txt")
+	if err != nil {
+		t.Fatalf("Expected before.txt after restore: %v", err)
+	}
+	reader.Close()
+	if err := manager.Restore("missing"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("Expected ErrSnapshotNotFound, got %v", err)
+	}
+
+	// Retention keeps the newest two
+	if _, err := manager.Snapshot("second"); err != nil {
+		t.Fatalf("Failed to take snapshot: %v", err)
+	}
+	if _, err := manager.Snapshot("third"); err != nil {
+		t.Fatalf("Failed to take snapshot: %v", err)
+	}
+	snapshots, err := manager.ListSnapshots()
+	if err != nil {
+		t.Fatalf("Failed to list snapshots: %v", err)
+	}
+	if len(snapshots) != 2 || snapshots[0].Name != "third" || snapshots[1].Name != "second" {
+		t.Errorf("Expected [third second], got %+v", snapshots)
+	}
+
+	if err := manager.DeleteSnapshot("second"); err != nil {
+		t.Fatalf("Failed to delete snapshot: %v", err)
+	}
+	if err := manager.DeleteSnapshot("second"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("Expected ErrSnapshotNotFound, got %v", err)
+	}
+
+	// Snapshots of another image aren't restored over the active one
+	otherPath := filepath.Join(tempDir, "other.img")
+	if err := CreateDiskImage(otherPath, 10, DiskFormat{}); err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+	if err := manager.SwitchDisk(otherPath); err != nil {
+		t.Fatalf("Failed to switch disk: %v", err)
+	}
+	if err := manager.Restore("third"); !errors.Is(err, ErrSnapshotSource) {
+		t.Errorf("Expected ErrSnapshotSource, got %v", err)
+	}
+	if _, err := manager.ReadFile("/before.txt"); err == nil {
+		t.Error("Expected the other image to be left as it was")
+	}
+}
+
+func TestResize(t *testing.T) {
+	tempDir := t.TempDir()
+	diskPath := filepath.Join(tempDir, "test.img")
+	if err := CreateDiskImage(diskPath, 10, DiskFormat{}); err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+
+	gadget := NewNoOpUsbGadget()
+	manager, err := New(Config{DiskPath: diskPath}, gadget)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+
+	content := bytes.Repeat([]byte("stitch"), 1024*1024/6)
+	err = manager.BeginTransaction(func(tx *Transaction) error {
+		for _, name := range []string{"/a.dst", "/Flowers/b.dst", "/Flowers/c.dst"} {
+			if err := tx.WriteFile(name, bytes.NewReader(content), int64(len(content))); err != nil {
+				return err
+			}
+		}
+		return tx.Mkdir("/Orders/Spring")
+	})
+	if err != nil {
+		t.Fatalf("Failed to write files: %v", err)
+	}
+
+	plan, err := manager.PlanResize(20)
+	if err != nil {
+		t.Fatalf("Failed to plan resize: %v", err)
+	}
+	if plan.Files != 3 || plan.Directories != 3 || plan.CurrentSizeMB != 10 || !plan.Fits {
+		t.Errorf("Unexpected plan: %+v", plan)
+	}
+	if info, _ := os.Stat(diskPath); info.Size() != 10*1024*1024 {
+		t.Errorf("Dry run changed the disk size to %d", info.Size())
+	}
+
+	if _, err := manager.Resize(2); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("Expected ErrDiskFull shrinking below the contents, got %v", err)
+	}
+
+	if _, err := manager.Resize(20); err != nil {
+		t.Fatalf("Failed to resize: %v", err)
+	}
+	if info, _ := os.Stat(diskPath); info.Size() != 20*1024*1024 {
+		t.Errorf("Expected a 20MB image, got %d bytes", info.Size())
+	}
+	if !gadget.IsConnected() {
+		t.Error("Expected gadget to be reconnected after resizing")
+	}
+
+	reader, err := manager.ReadFile("/Flowers/c.dst")
+	if err != nil {
+		t.Fatalf("Expected file to survive the resize: %v", err)
+	}
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	if !bytes.Equal(data, content) {
+		t.Error("File content changed during resize")
+	}
+	if entries, err := manager.ReadDir("/Orders/Spring"); err != nil || len(entries) != 0 {
+		t.Errorf("Expected the empty directory to survive the resize, got %v, %v", entries, err)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(tempDir, ".resize-*"))
+	if len(matches) != 0 {
+		t.Errorf("Expected scratch images to be removed, found %v", matches)
+	}
+}
+
+func TestResizeEmptyFile(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "test.img")
+	if err := CreateDiskImage(diskPath, 10, DiskFormat{}); err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+	manager, err := New(Config{DiskPath: diskPath}, NewNoOpUsbGadget())
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+
+	err = manager.BeginTransaction(func(tx *Transaction) error {
+		if err := tx.WriteFile("/empty.dst", bytes.NewReader(nil), 0); err != nil {
+			return err
+		}
+		return tx.WriteFile("/rose.dst", strings.NewReader("stitches"), 8)
+	})
+	if err != nil {
+		t.Fatalf("Failed to write files: %v", err)
+	}
+
+	if _, err := manager.Resize(20); err != nil {
+		t.Fatalf("Failed to resize a disk with an empty file: %v", err)
+	}
+	reader, err := manager.ReadFile("/empty.dst")
+	if err != nil {
+		t.Fatalf("Expected the empty file to survive the resize: %v", err)
+	}
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	if len(data) != 0 {
+		t.Errorf("Expected an empty file, got %d bytes", len(data))
+	}
+}
+
+func TestResizeFormats(t *testing.T) {
+	formats := []struct {
+		name   string
+		format DiskFormat
+	}{
+		{"fat32 mbr", DiskFormat{PartitionTable: PartitionMBR}},
+		{"fat16 superfloppy", DiskFormat{Filesystem: FilesystemFAT16}},
+		{"fat16 mbr 2k clusters", DiskFormat{Filesystem: FilesystemFAT16, PartitionTable: PartitionMBR, ClusterSize: 2048}},
+	}
+
+	for _, tt := range formats {
+		t.Run(tt.name, func(t *testing.T) {
+			diskPath := filepath.Join(t.TempDir(), "test.img")
+			if err := CreateDiskImage(diskPath, 10, tt.format); err != nil {
+				t.Fatalf("Failed to create disk image: %v", err)
+			}
+			manager, err := New(Config{DiskPath: diskPath, Format: tt.format}, NewNoOpUsbGadget())
+			if err != nil {
+				t.Fatalf("Failed to create manager: %v", err)
+			}
+
+			err = manager.BeginTransaction(func(tx *Transaction) error {
+				return tx.WriteFile("/Flowers/rose.dst", strings.NewReader("stitches"), 8)
+			})
+			if err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+
+			plan, err := manager.PlanResize(20)
+			if err != nil || !plan.Fits || plan.Files != 1 {
+				t.Fatalf("Unexpected plan %+v: %v", plan, err)
+			}
+			if _, err := manager.Resize(20); err != nil {
+				t.Fatalf("Failed to resize: %v", err)
+			}
+
+			offset, err := volumeOffset(diskPath)
+			if err != nil {
+				t.Fatalf("Failed to find volume: %v", err)
+			}
+			if partitioned := tt.format.PartitionTable == PartitionMBR; (offset > 0) != partitioned {
+				t.Errorf("Expected partitioned=%v after resizing, volume at offset %d", partitioned, offset)
+			}
+			reader, err := manager.ReadFile("/Flowers/rose.dst")
+			if err != nil {
+				t.Fatalf("Expected the file to survive the resize: %v", err)
+			}
+			data, _ := io.ReadAll(reader)
+			reader.Close()
+			if string(data) != "stitches" {
+				t.Errorf("File content changed during resize: %q", data)
+			}
+		})
+	}
+}
+
+func TestDiskFormats(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      DiskFormat
+		sizeMB      int64
+		fatType     fat.Type
+		clusterSize int
+		partitioned bool
+	}{
+		{"fat32 superfloppy", DiskFormat{}, 10, fat.FAT32, 512, false},
+		{"fat32 mbr", DiskFormat{PartitionTable: PartitionMBR}, 10, fat.FAT32, 512, true},
+		{"fat32 4k clusters", DiskFormat{ClusterSize: 4096, Label: "MACHINE A"}, 40, fat.FAT32, 4096, false},
+		{"fat16 superfloppy", DiskFormat{Filesystem: FilesystemFAT16}, 10, fat.FAT16, 1024, false},
+		{"fat16 mbr 2k clusters", DiskFormat{Filesystem: FilesystemFAT16, PartitionTable: PartitionMBR, ClusterSize: 2048}, 32, fat.FAT16, 2048, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diskPath := filepath.Join(t.TempDir(), "test.img")
+			if err := CreateDiskImage(diskPath, tt.sizeMB, tt.format); err != nil {
+				t.Fatalf("Failed to create disk image: %v", err)
+			}
+
+			check := func() {
+				t.Helper()
+				offset, err := volumeOffset(diskPath)
+				if err != nil {
+					t.Fatalf("Failed to find volume: %v", err)
+				}
+				if (offset > 0) != tt.partitioned {
+					t.Errorf("Expected partitioned=%v, volume at offset %d", tt.partitioned, offset)
+				}
+				f, err := os.Open(diskPath)
+				if err != nil {
+					t.Fatalf("Failed to open image: %v", err)
+				}
+				defer f.Close()
+				v, err := fat.Open(f, offset)
+				if err != nil {
+					t.Fatalf("Failed to open volume: %v", err)
+				}
+				if v.Type != tt.fatType || v.ClusterSize() != tt.clusterSize {
+					t.Errorf("Expected %v with %d byte clusters, got %v with %d", tt.fatType, tt.clusterSize, v.Type, v.ClusterSize())
+				}
+				label := tt.format.Label
+				if label == "" {
+					label = DefaultVolumeLabel
+				}
+				if v.Label != label {
+					t.Errorf("Expected label %q, got %q", label, v.Label)
+				}
+			}
+			check()
+
+			// New opens the disk through openDisk
+			manager, err := New(Config{DiskPath: diskPath, Format: tt.format}, NewNoOpUsbGadget())
+			if err != nil {
+				t.Fatalf("Failed to open disk: %v", err)
+			}
+			if _, err := manager.ReadDir("/"); err != nil {
+				t.Errorf("Failed to read root directory: %v", err)
+			}
+
+			// Clearing recreates the disk in the same format
+			if err := manager.ClearFiles(); err != nil {
+				t.Fatalf("Failed to clear files: %v", err)
+			}
+			check()
+			if _, err := manager.ReadDir("/"); err != nil {
+				t.Errorf("Failed to read root directory after clearing: %v", err)
+			}
+		})
+	}
+
+	if _, err := New(Config{DiskPath: "unused", Format: DiskFormat{Filesystem: "exfat"}}, NewNoOpUsbGadget()); !errors.Is(err, ErrInvalidFormat) {
+		t.Errorf("Expected ErrInvalidFormat for exfat, got %v", err)
+	}
+}
+
+func TestClearInPlace(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "test.img")
+	format := DiskFormat{ClusterSize: 4096, Label: "MACHINE A"}
+	if err := CreateDiskImage(diskPath, 40, format); err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+
+	gadget := NewNoOpUsbGadget()
+	manager, err := New(Config{DiskPath: diskPath}, gadget)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+
+	write := func(names ...string) {
+		t.Helper()
+		err := manager.BeginTransaction(func(tx *Transaction) error {
+			for _, name := range names {
+				if err := tx.WriteFile(name, bytes.NewReader([]byte(name)), int64(len(name))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to write files: %v", err)
+		}
+	}
+	volume := func() *fat.Volume {
+		t.Helper()
+		f, err := os.Open(diskPath)
+		if err != nil {
+			t.Fatalf("Failed to open image: %v", err)
+		}
+		t.Cleanup(func() { f.Close() })
+		v, err := fat.Open(f, 0)
+		if err != nil {
+			t.Fatalf("Failed to open volume: %v", err)
+		}
+		return v
+	}
+
+	write("/rose.dst", "/Flowers/tulip.pes", "/Flowers/daisy.pes")
+	before := volume()
+	info, _ := os.Stat(diskPath)
+
+	// Clearing a subfolder keeps everything else
+	if err := manager.ClearDirectory("/Flowers"); err != nil {
+		t.Fatalf("Failed to clear directory: %v", err)
+	}
+	entries, err := manager.ReadDir("/Flowers")
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Expected /Flowers to be empty, got %d entries, %v", len(entries), err)
+	}
+	if _, err := manager.ReadFile("/rose.dst"); err != nil {
+		t.Errorf("Expected rose.dst to be kept: %v", err)
+	}
+	if err := manager.ClearDirectory("/missing"); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("Expected ErrFileNotFound, got %v", err)
+	}
+
+	if err := manager.ClearFiles(); err != nil {
+		t.Fatalf("Failed to clear files: %v", err)
+	}
+	entries, err = manager.ReadDir("/")
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Expected an empty disk, got %d entries, %v", len(entries), err)
+	}
+	if !gadget.IsConnected() {
+		t.Error("Expected gadget to be reconnected after clearing")
+	}
+
+	// The same file was rewritten, keeping label, serial and geometry
+	after := volume()
+	if after.Label != "MACHINE A" || after.VolumeID != before.VolumeID || after.ClusterSize() != 4096 {
+		t.Errorf("Expected label %q, serial %08x and 4096 byte clusters, got %q, %08x, %d",
+			"MACHINE A", before.VolumeID, after.Label, after.VolumeID, after.ClusterSize())
+	}
+	if newInfo, _ := os.Stat(diskPath); !os.SameFile(info, newInfo) {
+		t.Error("Expected the disk image to be cleared in place")
+	}
+
+	// The cleared disk is writable again
+	write("/again.dst")
+	if _, err := manager.ReadFile("/again.dst"); err != nil {
+		t.Errorf("Expected to read a file written after clearing: %v", err)
+	}
+}
+
+func TestCheckRepair(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "test.img")
+	if err := CreateDiskImage(diskPath, 40, DiskFormat{}); err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+
+	gadget := NewNoOpUsbGadget()
+	if _, err := New(Config{DiskPath: diskPath, StartupCheck: "fsck"}, gadget); err == nil {
+		t.Error("Expected an unsupported startup check to be rejected")
+	}
+
+	manager, err := New(Config{DiskPath: diskPath, StartupCheck: CheckOnly}, gadget)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	result, ok := manager.LastCheck()
+	if !ok || !result.Clean() || result.Error != "" {
+		t.Fatalf("Expected a clean startup check, got %+v (ran: %v)", result, ok)
+	}
+
+	// Allocate the last cluster in the first FAT only: a lost cluster and
+	// mismatched FAT copies
+	f, err := os.OpenFile(diskPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open image: %v", err)
+	}
+	v, err := fat.Open(f, 0)
+	if err != nil {
+		t.Fatalf("Failed to open volume: %v", err)
+	}
+	last := int64(v.ClusterCount()) + 1
+	if _, err := f.WriteAt([]byte{0xFF, 0xFF, 0xFF, 0x0F}, int64(v.ReservedSectors*v.BytesPerSector)+last*4); err != nil {
+		t.Fatalf("Failed to corrupt FAT: %v", err)
+	}
+	f.Close()
+
+	result, err = manager.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if result.Clean() || result.LostClusters != 1 || result.Repaired {
+		t.Fatalf("Expected one lost cluster and no repair, got %+v", result)
+	}
+	if last, _ := manager.LastCheck(); last.Clean() {
+		t.Error("Expected LastCheck to report the problems found")
+	}
+
+	result, err = manager.Repair()
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if !result.Repaired {
+		t.Errorf("Expected the problems to be repaired, got %+v", result)
+	}
+	if !gadget.IsConnected() {
+		t.Error("Expected gadget to be reconnected after repair")
+	}
+
+	result, err = manager.Check()
+	if err != nil || !result.Clean() {
+		t.Errorf("Expected a clean disk after repair, got %+v, %v", result, err)
+	}
+	if _, err := manager.ReadDir("/"); err != nil {
+		t.Errorf("Expected the repaired disk to be readable: %v", err)
+	}
+}
+
+func TestShadowTransaction(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "test.img")
+	if err := CreateDiskImage(diskPath, 40, DiskFormat{}); err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+
+	// A shadow image left by a crash is discarded at startup
+	if err := os.WriteFile(shadowImagePath(diskPath), []byte("partial"), 0644); err != nil {
+		t.Fatalf("Failed to create leftover shadow image: %v", err)
+	}
+
+	gadget := NewNoOpUsbGadget()
+	config := Config{DiskPath: diskPath, TransactionMode: TransactionShadow}
+	manager, err := New(config, gadget)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	if _, err := os.Stat(shadowImagePath(diskPath)); !os.IsNotExist(err) {
+		t.Errorf("Expected the leftover shadow image to be removed, got %v", err)
+	}
+
+	write := func(tx *Transaction, name string) error {
+		return tx.WriteFile(name, bytes.NewReader([]byte(name)), int64(len(name)))
+	}
+
+	before, _ := os.Stat(diskPath)
+	err = manager.BeginTransaction(func(tx *Transaction) error {
+		return write(tx, "/rose.dst")
+	})
+	if err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+	after, _ := os.Stat(diskPath)
+	if os.SameFile(before, after) {
+		t.Error("Expected the shadow image to replace the disk image")
+	}
+	if _, err := os.Stat(shadowImagePath(diskPath)); !os.IsNotExist(err) {
+		t.Errorf("Expected no shadow image after commit, got %v", err)
+	}
+	if gadget.GetBackingFile() != diskPath {
+		t.Errorf("Expected the gadget to be pointed at %s again, got %q", diskPath, gadget.GetBackingFile())
+	}
+	if _, err := manager.ReadFile("/rose.dst"); err != nil {
+		t.Errorf("Expected to read the committed file: %v", err)
+	}
+
+	// A failed transaction leaves the disk image untouched
+	failure := errors.New("upload interrupted")
+	err = manager.BeginTransaction(func(tx *Transaction) error {
+		if err := write(tx, "/tulip.pes"); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("Expected the transaction error, got %v", err)
+	}
+	if unchanged, _ := os.Stat(diskPath); !os.SameFile(after, unchanged) {
+		t.Error("Expected a failed transaction not to replace the disk image")
+	}
+	if _, err := manager.ReadFile("/tulip.pes"); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("Expected tulip.pes to be rolled back, got %v", err)
+	}
+	if !gadget.IsConnected() {
+		t.Error("Expected gadget to be reconnected after a failed transaction")
+	}
+
+	err = manager.ReplaceContents(func(tx *Transaction) error {
+		return write(tx, "/daisy.pes")
+	})
+	if err != nil {
+		t.Fatalf("ReplaceContents failed: %v", err)
+	}
+	entries, err := manager.ReadDir("/")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "daisy.pes" {
+		t.Errorf("Expected only daisy.pes after ReplaceContents, got %d entries, %v", len(entries), err)
+	}
+}
+
+// TestDuplicateUploads tests content hashing and the duplicate policies
+func TestDuplicateUploads(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "test.img")
+	if err := CreateDiskImage(diskPath, 40, DiskFormat{}); err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+
+	if _, err := New(Config{DiskPath: diskPath, DuplicatePolicy: "link"}, NewNoOpUsbGadget()); err == nil {
+		t.Error("Expected an unknown duplicate policy to be rejected")
+	}
+
+	manager, err := New(Config{DiskPath: diskPath}, NewNoOpUsbGadget())
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+
+	design := []byte("the same rose design")
+	sum := sha256.Sum256(design)
+	wantSum := hex.EncodeToString(sum[:])
+
+	write := func(policy DuplicatePolicy, names ...string) []WriteResult {
+		t.Helper()
+		var written []WriteResult
+		err := manager.BeginTransaction(func(tx *Transaction) error {
+			if policy != "" {
+				if err := tx.SetDuplicatePolicy(policy); err != nil {
+					return err
+				}
+			}
+			for _, name := range names {
+				if err := tx.WriteFile(name, bytes.NewReader(design), int64(len(design))); err != nil {
+					return err
+				}
+			}
+			written = tx.Written()
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Transaction failed: %v", err)
+		}
+		return written
+	}
+	exists := func(name string) bool {
+		_, err := manager.ReadFile(name)
+		return err == nil
+	}
+
+	// Duplicates within one transaction are found too; the default keeps both
+	written := write("", "/rose.dst", "/ROSE2.DST")
+	if len(written) != 2 || written[0].SHA256 != wantSum || len(written[0].DuplicateOf) != 0 {
+		t.Fatalf("Unexpected first write result: %+v", written)
+	}
+	if got := written[1].DuplicateOf; len(got) != 1 || got[0] != "/rose.dst" {
+		t.Errorf("Expected /ROSE2.DST to be reported as a duplicate of /rose.dst, got %v", got)
+	}
+	if !exists("/rose.dst") || !exists("/ROSE2.DST") {
+		t.Error("Expected the keep policy to store both copies")
+	}
+
+	// Skip drops the new copy
+	written = write(DuplicateSkip, "/Designs/rose3.dst")
+	if !written[0].Skipped || len(written[0].DuplicateOf) != 2 {
+		t.Errorf("Expected the copy to be skipped as a duplicate of both, got %+v", written[0])
+	}
+	if exists("/Designs/rose3.dst") {
+		t.Error("Expected the skipped copy not to be stored")
+	}
+
+	// Replace removes the existing copies
+	written = write(DuplicateReplace, "/rose4.dst")
+	if !written[0].Replaced {
+		t.Errorf("Expected the existing copies to be replaced, got %+v", written[0])
+	}
+	if exists("/rose.dst") || exists("/ROSE2.DST") || !exists("/rose4.dst") {
+		t.Error("Expected only the replacing copy to remain")
+	}
+
+	// Writing the same contents to the same path again is not a duplicate
+	written = write(DuplicateSkip, "/rose4.dst")
+	if written[0].Skipped || len(written[0].DuplicateOf) != 0 {
+		t.Errorf("Expected rewriting a file not to count as a duplicate, got %+v", written[0])
+	}
+
+	hashes, err := manager.ContentHashes("/")
+	if err != nil {
+		t.Fatalf("ContentHashes failed: %v", err)
+	}
+	if len(hashes) != 1 || hashes["rose4.dst"] != wantSum {
+		t.Errorf("Expected only rose4.dst with hash %s, got %v", wantSum, hashes)
+	}
+
+	// Files written behind the index's back are hashed again
+	other := []byte("a tulip")
+	err = manager.BeginTransaction(func(tx *Transaction) error {
+		return tx.writer.WriteFile("/rose4.dst", bytes.NewReader(other), int64(len(other)))
+	})
+	if err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+	otherSum := sha256.Sum256(other)
+	hashes, _ = manager.ContentHashes("/")
+	if hashes["rose4.dst"] != hex.EncodeToString(otherSum[:]) {
+		t.Errorf("Expected the changed file to be hashed again, got %v", hashes)
+	}
+
+	// Only the listed directory is hashed again
+	write("", "/Sub/rose5.dst")
+	err = manager.BeginTransaction(func(tx *Transaction) error {
+		return tx.writer.WriteFile("/Sub/rose5.dst", bytes.NewReader(other), int64(len(other)))
+	})
+	if err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+	manager.ContentHashes("/")
+	if e := manager.index.snapshot()["/sub/rose5.dst"]; e.sum != wantSum {
+		t.Errorf("Expected listing / not to hash /Sub again, got %+v", e)
+	}
+	hashes, _ = manager.ContentHashes("/Sub")
+	if hashes["rose5.dst"] != hex.EncodeToString(otherSum[:]) {
+		t.Errorf("Expected listing /Sub to hash it again, got %v", hashes)
+	}
+
+	// Skipping a duplicate leaves the file at its path alone, whether the
+	// contents can be read twice or have to be spooled
+	write("", "/keep.dst")
+	for _, r := range []io.Reader{bytes.NewReader(design), io.MultiReader(bytes.NewReader(design))} {
+		var written []WriteResult
+		err := manager.BeginTransaction(func(tx *Transaction) error {
+			if err := tx.SetDuplicatePolicy(DuplicateSkip); err != nil {
+				return err
+			}
+			if err := tx.WriteFile("/rose4.dst", r, int64(len(design))); err != nil {
+				return err
+			}
+			written = tx.Written()
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Transaction failed: %v", err)
+		}
+		if !written[0].Skipped || len(written[0].DuplicateOf) != 1 || written[0].DuplicateOf[0] != "/keep.dst" {
+			t.Errorf("Expected the copy to be skipped as a duplicate of /keep.dst, got %+v", written[0])
+		}
+		reader, err := manager.ReadFile("/rose4.dst")
+		if err != nil {
+			t.Fatalf("Expected /rose4.dst to remain: %v", err)
+		}
+		data, _ := io.ReadAll(reader)
+		reader.Close()
+		if !bytes.Equal(data, other) {
+			t.Errorf("Expected /rose4.dst to keep its contents, got %q", data)
+		}
+	}
+}
+
+// TestPlanSync tests comparing a client's folder with the disk
+func TestPlanSync(t *testing.T) {
+	diskPath := filepath.Join(t.TempDir(), "test.img")
+	if err := CreateDiskImage(diskPath, 40, DiskFormat{}); err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+	manager, err := New(Config{DiskPath: diskPath}, NewNoOpUsbGadget())
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+
+	hash := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+	err = manager.BeginTransaction(func(tx *Transaction) error {
+		for name, data := range map[string]string{
+			"/Machine/rose.dst":          "rose",
+			"/Machine/Flowers/Tulip.pes": "old tulip",
+			"/Machine/stale.jef":         "stale",
+			"/elsewhere.dst":             "not synced",
+		} {
+			if err := tx.WriteFile(name, strings.NewReader(data), int64(len(data))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+
+	manifest := []SyncFile{
+		{Path: "rose.dst", Size: 4, SHA256: hash("rose")},
+		{Path: "flowers/tulip.pes", Size: 9, SHA256: hash("new tulip")},
+		{Path: "daisy.pes", Size: 5, SHA256: hash("daisy")},
+	}
+	plan, err := manager.PlanSync("/Machine", manifest)
+	if err != nil {
+		t.Fatalf("PlanSync failed: %v", err)
+	}
+	if len(plan.Add) != 1 || plan.Add[0].Path != "daisy.pes" {
+		t.Errorf("Expected to add daisy.pes, got %+v", plan.Add)
+	}
+	if len(plan.Update) != 1 || plan.Update[0].Path != "flowers/tulip.pes" {
+		t.Errorf("Expected to update flowers/tulip.pes (names compare without case), got %+v", plan.Update)
+	}
+	if len(plan.Delete) != 1 || plan.Delete[0] != "stale.jef" || plan.Unchanged != 1 {
+		t.Errorf("Expected to delete only stale.jef with 1 unchanged, got %+v", plan)
+	}
+	if _, ok := plan.Upload("DAISY.PES"); !ok {
+		t.Error("Expected the plan to expect daisy.pes")
+	}
+
+	for _, bad := range [][]SyncFile{
+		{{Path: "../escape.dst", SHA256: hash("x")}},
+		{{Path: "rose.dst", SHA256: "not a hash"}},
+		{{Path: "rose.dst", SHA256: hash("x")}, {Path: "ROSE.DST", SHA256: hash("x")}},
+	} {
+		if _, err := manager.PlanSync("/Machine", bad); !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("Expected ErrInvalidPath for %+v, got %v", bad, err)
+		}
+	}
+}
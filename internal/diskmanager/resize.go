@@ -0,0 +1,309 @@
+package diskmanager
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/jgarman/embroidery-buddy/internal/fat"
+)
+
+// ResizePlan estimates whether the disk contents fit in a new image size
+type ResizePlan struct {
+	CurrentSizeMB int64 `json:"currentSizeMb"`
+	NewSizeMB     int64 `json:"newSizeMb"`
+	Files         int   `json:"files"`
+	Directories   int   `json:"directories"`
+
+	// DataBytes is the total size of the files
+	DataBytes int64 `json:"dataBytes"`
+
+	// RequiredBytes is the space the files and directories take on the new
+	// filesystem, rounded up to whole clusters
+	RequiredBytes int64 `json:"requiredBytes"`
+
+	// CapacityBytes is the data area of the new filesystem
+	CapacityBytes int64 `json:"capacityBytes"`
+
+	Fits bool `json:"fits"`
+}
+
+// resizeEntry is a file or directory to carry over to the resized image
+type resizeEntry struct {
+	path  string
+	size  int64
+	isDir bool
+
+	// entries is the number of directory entries (directories only)
+	entries int
+}
+
+// Directory slots per entry when estimating directory sizes: the short name
+// plus two long-name slots, enough for names of up to 26 characters
+const resizeSlotsPerEntry = 3
+
+// PlanResize estimates a resize without changing the disk. A scratch image of
+// the new size is formatted next to the disk image to measure its capacity.
+func (m *Manager) PlanResize(newSizeMB int64) (ResizePlan, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.filesystem == nil {
+		return ResizePlan{}, ErrDiskNotInitialized
+	}
+
+	scratch, err := m.scratchImagePath()
+	if err != nil {
+		return ResizePlan{}, err
+	}
+	defer os.Remove(scratch)
+
+	plan, _, err := m.planResize(scratch, newSizeMB)
+	return plan, err
+}
+
+// Resize changes the size of the disk image while keeping its files. A fresh
+// filesystem of the new size is built and every file is copied across while the
+// host is disconnected, then it replaces the current image. The new filesystem
+// has the configured format, so FAT16 and partitioned disks stay that way.
+// Shrinking fails with ErrDiskFull when the files don't fit. Every directory is
+// carried over, empty ones included.
+func (m *Manager) Resize(newSizeMB int64) (ResizePlan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.filesystem == nil {
+		return ResizePlan{}, ErrDiskNotInitialized
+	}
+
+	scratch, err := m.scratchImagePath()
+	if err != nil {
+		return ResizePlan{}, err
+	}
+	defer os.Remove(scratch)
+
+	// Disconnect the USB gadget so the host can't write during the copy
+	if err := m.gadget.Disconnect(); err != nil {
+		return ResizePlan{}, fmt.Errorf("failed to disconnect USB gadget: %w", err)
+	}
+
+	// Ensure we reconnect even if there's an error
+	defer func() {
+		if err := m.gadget.Reconnect(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to reconnect USB gadget: %v\n", err)
+		}
+	}()
+
+	plan, entries, err := m.planResize(scratch, newSizeMB)
+	if err != nil {
+		return plan, err
+	}
+	if !plan.Fits {
+		return plan, fmt.Errorf("%w: %d bytes needed, %d available at %dMB",
+			ErrDiskFull, plan.RequiredBytes, plan.CapacityBytes, newSizeMB)
+	}
+
+	if err := m.copyEntries(scratch, entries); err != nil {
+		return plan, err
+	}
+
+	m.disk = nil
+	m.filesystem = nil
+	if err := os.Rename(scratch, m.config.DiskPath); err != nil {
+		if reopenErr := m.openDisk(); reopenErr != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to reopen disk: %v\n", reopenErr)
+		}
+		return plan, fmt.Errorf("failed to replace disk image: %w", err)
+	}
+
+	// The hashes are of the replaced image's files
+	m.index.reset()
+
+	if err := m.openDisk(); err != nil {
+		return plan, fmt.Errorf("failed to reopen disk: %w", err)
+	}
+	return plan, nil
+}
+
+// scratchImagePath reserves a temporary file name next to the disk image, so the
+// finished image can be renamed over it
+func (m *Manager) scratchImagePath() (string, error) {
+	file, err := os.CreateTemp(filepath.Dir(m.config.DiskPath), ".resize-*.img")
+	if err != nil {
+		return "", fmt.Errorf("failed to create scratch image: %w", err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return file.Name(), nil
+}
+
+// planResize formats an image of the new size at scratch and measures the
+// current contents against it. The caller must hold the lock.
+func (m *Manager) planResize(scratch string, newSizeMB int64) (ResizePlan, []resizeEntry, error) {
+	if newSizeMB < 1 {
+		return ResizePlan{}, nil, fmt.Errorf("%w: size must be at least 1 MB", ErrOperationFailed)
+	}
+
+	info, err := os.Stat(m.config.DiskPath)
+	if err != nil {
+		return ResizePlan{}, nil, fmt.Errorf("failed to stat disk image: %w", err)
+	}
+
+	entries, err := walkFilesystem(m.filesystem, "/")
+	if err != nil {
+		return ResizePlan{}, nil, err
+	}
+
+	if err := CreateDiskImage(scratch, newSizeMB, m.config.Format); err != nil {
+		return ResizePlan{}, nil, err
+	}
+	clusterSize, clusterCount, err := volumeGeometry(scratch)
+	if err != nil {
+		return ResizePlan{}, nil, err
+	}
+
+	plan := ResizePlan{
+		CurrentSizeMB: info.Size() / (1024 * 1024),
+		NewSizeMB:     newSizeMB,
+		CapacityBytes: clusterSize * clusterCount,
+	}
+	clusters := func(n int64) int64 {
+		if n == 0 {
+			return 0
+		}
+		return (n + clusterSize - 1) / clusterSize
+	}
+
+	// Every directory takes whole clusters for its entries, including "." and ".."
+	rootEntries := 0
+	used := int64(0)
+	for _, e := range entries {
+		if path.Dir(e.path) == "/" {
+			rootEntries++
+		}
+		if e.isDir {
+			plan.Directories++
+			used += clusters(int64((e.entries+2)*resizeSlotsPerEntry*32)) * clusterSize
+			continue
+		}
+		plan.Files++
+		plan.DataBytes += e.size
+		used += clusters(e.size) * clusterSize
+	}
+	// The root directory always has at least one cluster
+	used += max(1, clusters(int64(rootEntries*resizeSlotsPerEntry*32))) * clusterSize
+
+	plan.RequiredBytes = used
+	plan.Fits = used <= plan.CapacityBytes
+	return plan, entries, nil
+}
+
+// walkFilesystem lists every file and directory below dirPath in on-disk order
+func walkFilesystem(fs filesystem.FileSystem, dirPath string) ([]resizeEntry, error) {
+	infos, err := fs.ReadDir(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", dirPath, err)
+	}
+
+	var entries []resizeEntry
+	for _, info := range infos {
+		if info.Name() == "." || info.Name() == ".." {
+			continue
+		}
+		entryPath := path.Join(dirPath, info.Name())
+		if !info.IsDir() {
+			entries = append(entries, resizeEntry{path: entryPath, size: info.Size()})
+			continue
+		}
+
+		children, err := walkFilesystem(fs, entryPath)
+		if err != nil {
+			return nil, err
+		}
+		direct := 0
+		for _, child := range children {
+			if path.Dir(child.path) == entryPath {
+				direct++
+			}
+		}
+		entries = append(entries, resizeEntry{path: entryPath, isDir: true, entries: direct})
+		entries = append(entries, children...)
+	}
+	return entries, nil
+}
+
+// volumeGeometry returns the cluster size and data cluster count of an image
+func volumeGeometry(imagePath string) (int64, int64, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open disk image: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to stat disk image: %w", err)
+	}
+	offset, _, err := fat.FindVolume(file, info.Size())
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to find FAT volume: %w", err)
+	}
+	volume, err := fat.Open(file, offset)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open FAT volume: %w", err)
+	}
+	return int64(volume.ClusterSize()), int64(volume.ClusterCount()), nil
+}
+
+// copyEntries copies the listed files and directories from the current
+// filesystem into the image at dstPath. The caller must hold the lock.
+func (m *Manager) copyEntries(dstPath string, entries []resizeEntry) error {
+	// openImage finds the volume of partitioned images and reads FAT16
+	dst, dstFS, err := openImage(dstPath)
+	if err != nil {
+		return fmt.Errorf("failed to open resized disk: %w", err)
+	}
+	defer dst.Close()
+
+	writer := NewFilesystemWriterOfType(m.config.Writer, dstPath, dstFS)
+	if err := writer.Begin(); err != nil {
+		return fmt.Errorf("failed to initialize filesystem writer: %w", err)
+	}
+
+	for _, e := range entries {
+		if e.isDir {
+			if err := writer.Mkdir(e.path); err != nil {
+				writer.End()
+				return fmt.Errorf("failed to create %s: %w", e.path, err)
+			}
+			continue
+		}
+		// go-diskfs can't open empty files, which have no first cluster
+		if e.size == 0 {
+			if err := writer.WriteFile(e.path, strings.NewReader(""), 0); err != nil {
+				writer.End()
+				return fmt.Errorf("failed to copy %s: %w", e.path, err)
+			}
+			continue
+		}
+		src, err := m.filesystem.OpenFile(e.path, os.O_RDONLY)
+		if err != nil {
+			writer.End()
+			return fmt.Errorf("failed to open %s: %w", e.path, err)
+		}
+		err = writer.WriteFile(e.path, src, e.size)
+		src.Close()
+		if err != nil {
+			writer.End()
+			return fmt.Errorf("failed to copy %s: %w", e.path, err)
+		}
+	}
+
+	if err := writer.End(); err != nil {
+		return fmt.Errorf("failed to finalize filesystem writer: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package diskmanager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jgarman/embroidery-buddy/internal/fat"
+)
+
+// TransactionMode selects how transactions write to the disk image
+type TransactionMode string
+
+const (
+	// TransactionDirect writes to the disk image in place. A power cut during
+	// a transaction can leave the image half-written.
+	TransactionDirect TransactionMode = "direct"
+
+	// TransactionShadow writes to a copy of the disk image and renames it over
+	// the original once the transaction succeeds, so after a crash the machine
+	// sees either the old or the new contents. Needs free space next to the
+	// disk image for the copy (none on filesystems with reflinks).
+	TransactionShadow TransactionMode = "shadow"
+)
+
+// shadowImagePath returns the path of the shadow copy of a disk image. It
+// lives next to the image so the final rename stays on one filesystem.
+func shadowImagePath(diskPath string) string {
+	return diskPath + ".shadow"
+}
+
+// removeShadowImage deletes a shadow image left behind by an interrupted
+// transaction. The disk image itself was never touched by it.
+func removeShadowImage(diskPath string) {
+	shadow := shadowImagePath(diskPath)
+	err := os.Remove(shadow)
+	switch {
+	case err == nil:
+		fmt.Fprintf(os.Stderr, "warning: discarded unfinished transaction %s\n", shadow)
+	case !os.IsNotExist(err):
+		fmt.Fprintf(os.Stderr, "warning: failed to remove shadow image %s: %v\n", shadow, err)
+	}
+}
+
+// runShadowTransaction runs fn against a shadow copy of the disk image and
+// swaps it in only if fn succeeds: the copy is synced, renamed over the disk
+// image and handed to the USB gadget again. With clear set the copy is emptied
+// before fn runs. On failure the disk image is left exactly as it was.
+// The caller must hold the lock and have disconnected the USB gadget.
+func (m *Manager) runShadowTransaction(clear bool, fn func(*Transaction) error) error {
+	shadow := shadowImagePath(m.config.DiskPath)
+	os.Remove(shadow)
+	if err := CopyImage(m.config.DiskPath, shadow); err != nil {
+		return fmt.Errorf("failed to create shadow image: %w", err)
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(shadow)
+		}
+	}()
+
+	if clear {
+		err := editImage(shadow, func(volume *fat.Volume) error {
+			return volume.Clear()
+		})
+		if err != nil {
+			return fmt.Errorf("failed to clear shadow image: %w", err)
+		}
+	}
+
+	shadowDisk, shadowFS, err := openImage(shadow)
+	if err != nil {
+		return fmt.Errorf("failed to open shadow image: %w", err)
+	}
+	tx, err := m.writeImage(shadow, shadowFS, fn)
+	shadowDisk.Close()
+	if errors.Is(err, ErrImageStillAttached) {
+		// Only the shadow is attached; the disk image can go back to the host
+		return fmt.Errorf("failed to write shadow image: %v", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := syncPath(shadow); err != nil {
+		return fmt.Errorf("failed to sync shadow image: %w", err)
+	}
+
+	m.disk = nil
+	m.filesystem = nil
+	if err := os.Rename(shadow, m.config.DiskPath); err != nil {
+		if reopenErr := m.openDisk(); reopenErr != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to reopen disk: %v\n", reopenErr)
+		}
+		return fmt.Errorf("failed to replace disk image: %w", err)
+	}
+	committed = true
+
+	// Make the rename itself durable
+	if err := syncPath(filepath.Dir(m.config.DiskPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to sync disk image directory: %v\n", err)
+	}
+
+	// The gadget still holds the replaced image open
+	if err := m.gadget.SetBackingFile(m.config.DiskPath); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to change USB gadget backing file: %v\n", err)
+	}
+
+	if err := m.openDisk(); err != nil {
+		m.index.reset()
+		return fmt.Errorf("failed to reopen disk: %w", err)
+	}
+	m.index.apply(m.filesystem, tx)
+	return nil
+}
+
+// syncPath flushes a file or directory to stable storage
+func syncPath(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
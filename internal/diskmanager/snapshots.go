@@ -0,0 +1,277 @@
+package diskmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSnapshotsDisabled = errors.New("snapshots are not enabled")
+	ErrSnapshotNotFound  = errors.New("snapshot not found")
+	ErrSnapshotExists    = errors.New("snapshot already exists")
+	ErrInvalidSnapshot   = errors.New("invalid snapshot name")
+	ErrSnapshotSource    = errors.New("snapshot is of another disk image")
+)
+
+// Snapshot describes a point-in-time copy of a disk image
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+
+	// Source is the disk image the snapshot was taken from
+	Source string `json:"source"`
+	Size   int64  `json:"size"`
+}
+
+// snapshotPath returns the image file of a snapshot
+func (m *Manager) snapshotPath(name string) string {
+	return filepath.Join(m.config.SnapshotDir, name+".img")
+}
+
+// snapshotMetaPath returns the metadata file of a snapshot
+func (m *Manager) snapshotMetaPath(name string) string {
+	return filepath.Join(m.config.SnapshotDir, name+".json")
+}
+
+// Snapshot copies the current disk image into the snapshot directory while the
+// host is disconnected. An empty name uses the current time. Copies are reflinks
+// where the filesystem supports them and sparse otherwise. Once more than
+// Config.SnapshotLimit snapshots exist the oldest are removed.
+func (m *Manager) Snapshot(name string) (Snapshot, error) {
+	if m.config.SnapshotDir == "" {
+		return Snapshot{}, ErrSnapshotsDisabled
+	}
+	if name == "" {
+		name = time.Now().UTC().Format("20060102-150405")
+	}
+	if !imageNamePattern.MatchString(name) {
+		return Snapshot{}, fmt.Errorf("%w: %q (use lowercase letters, digits, '-' and '_')", ErrInvalidSnapshot, name)
+	}
+	if err := os.MkdirAll(m.config.SnapshotDir, 0755); err != nil {
+		return Snapshot{}, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := os.Stat(m.snapshotMetaPath(name)); err == nil {
+		return Snapshot{}, fmt.Errorf("%w: %s", ErrSnapshotExists, name)
+	}
+
+	// Disconnect the USB gadget so the host can't write during the copy
+	if err := m.gadget.Disconnect(); err != nil {
+		return Snapshot{}, fmt.Errorf("failed to disconnect USB gadget: %w", err)
+	}
+
+	// Ensure we reconnect even if there's an error
+	defer func() {
+		if err := m.gadget.Reconnect(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to reconnect USB gadget: %v\n", err)
+		}
+	}()
+
+	// A leftover image without metadata is from an interrupted snapshot
+	os.Remove(m.snapshotPath(name))
+	if err := CopyImage(m.config.DiskPath, m.snapshotPath(name)); err != nil {
+		return Snapshot{}, err
+	}
+
+	info, err := os.Stat(m.snapshotPath(name))
+	if err != nil {
+		os.Remove(m.snapshotPath(name))
+		return Snapshot{}, fmt.Errorf("failed to stat snapshot: %w", err)
+	}
+	snapshot := Snapshot{
+		Name:    name,
+		Created: time.Now().UTC(),
+		Source:  m.config.DiskPath,
+		Size:    info.Size(),
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		os.Remove(m.snapshotPath(name))
+		return Snapshot{}, fmt.Errorf("failed to marshal snapshot metadata: %w", err)
+	}
+	if err := os.WriteFile(m.snapshotMetaPath(name), data, 0644); err != nil {
+		os.Remove(m.snapshotPath(name))
+		return Snapshot{}, fmt.Errorf("failed to write snapshot metadata: %w", err)
+	}
+
+	m.pruneSnapshots()
+	return snapshot, nil
+}
+
+// pruneSnapshots removes the oldest snapshots beyond Config.SnapshotLimit
+func (m *Manager) pruneSnapshots() {
+	if m.config.SnapshotLimit <= 0 {
+		return
+	}
+	snapshots, err := m.listSnapshots()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to list snapshots for pruning: %v\n", err)
+		return
+	}
+	for len(snapshots) > m.config.SnapshotLimit {
+		oldest := snapshots[len(snapshots)-1]
+		if err := m.deleteSnapshot(oldest.Name); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to prune snapshot %s: %v\n", oldest.Name, err)
+		}
+		snapshots = snapshots[:len(snapshots)-1]
+	}
+}
+
+// restoreImagePath returns where a snapshot is copied before it replaces the
+// disk image
+func restoreImagePath(diskPath string) string {
+	return diskPath + ".restore"
+}
+
+// removeRestoreImage deletes a copy left by a restore that was interrupted
+// before it replaced the disk image
+func removeRestoreImage(diskPath string) {
+	restore := restoreImagePath(diskPath)
+	err := os.Remove(restore)
+	switch {
+	case err == nil:
+		fmt.Fprintf(os.Stderr, "warning: discarded unfinished restore %s\n", restore)
+	case !os.IsNotExist(err):
+		fmt.Fprintf(os.Stderr, "warning: failed to remove restore image %s: %v\n", restore, err)
+	}
+}
+
+// Restore replaces the current disk image with a snapshot taken from it. The
+// snapshot is copied next to the disk image first and renamed over it, so a
+// failed restore leaves the current contents in place. Snapshots of other
+// disk images are refused with ErrSnapshotSource.
+func (m *Manager) Restore(name string) error {
+	if m.config.SnapshotDir == "" {
+		return ErrSnapshotsDisabled
+	}
+	if !imageNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, err := os.ReadFile(m.snapshotMetaPath(name))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("failed to read snapshot metadata: %w", err)
+	}
+	if filepath.Clean(snapshot.Source) != filepath.Clean(m.config.DiskPath) {
+		return fmt.Errorf("%w: %s was taken from %s", ErrSnapshotSource, name, filepath.Base(snapshot.Source))
+	}
+
+	// Disconnect the USB gadget before replacing the image
+	if err := m.gadget.Disconnect(); err != nil {
+		return fmt.Errorf("failed to disconnect USB gadget: %w", err)
+	}
+
+	// Ensure we reconnect even if there's an error
+	defer func() {
+		if err := m.gadget.Reconnect(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to reconnect USB gadget: %v\n", err)
+		}
+	}()
+
+	tmpPath := restoreImagePath(m.config.DiskPath)
+	os.Remove(tmpPath)
+	if err := CopyImage(m.snapshotPath(name), tmpPath); err != nil {
+		return err
+	}
+
+	m.disk = nil
+	m.filesystem = nil
+	if err := os.Rename(tmpPath, m.config.DiskPath); err != nil {
+		os.Remove(tmpPath)
+		if reopenErr := m.openDisk(); reopenErr != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to reopen disk: %v\n", reopenErr)
+		}
+		return fmt.Errorf("failed to replace disk image: %w", err)
+	}
+
+	// The hashes are of the replaced image's files
+	m.index.reset()
+
+	if err := m.openDisk(); err != nil {
+		return fmt.Errorf("failed to reopen disk: %w", err)
+	}
+	return nil
+}
+
+// ListSnapshots returns the snapshots, newest first
+func (m *Manager) ListSnapshots() ([]Snapshot, error) {
+	if m.config.SnapshotDir == "" {
+		return nil, ErrSnapshotsDisabled
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.listSnapshots()
+}
+
+// listSnapshots reads the snapshot metadata, newest first
+func (m *Manager) listSnapshots() ([]Snapshot, error) {
+	matches, err := filepath.Glob(filepath.Join(m.config.SnapshotDir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	snapshots := make([]Snapshot, 0, len(matches))
+	for _, match := range matches {
+		data, err := os.ReadFile(match)
+		if err != nil {
+			continue
+		}
+		var snapshot Snapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			continue
+		}
+		snapshot.Name = strings.TrimSuffix(filepath.Base(match), ".json")
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.After(snapshots[j].Created)
+	})
+	return snapshots, nil
+}
+
+// DeleteSnapshot removes a snapshot
+func (m *Manager) DeleteSnapshot(name string) error {
+	if m.config.SnapshotDir == "" {
+		return ErrSnapshotsDisabled
+	}
+	if !imageNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.deleteSnapshot(name)
+}
+
+// deleteSnapshot removes a snapshot's files. The caller must hold the lock.
+func (m *Manager) deleteSnapshot(name string) error {
+	if err := os.Remove(m.snapshotMetaPath(name)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+		}
+		return fmt.Errorf("failed to remove snapshot metadata: %w", err)
+	}
+	if err := os.Remove(m.snapshotPath(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove snapshot image: %w", err)
+	}
+	return nil
+}
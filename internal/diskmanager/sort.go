@@ -0,0 +1,156 @@
+package diskmanager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jgarman/embroidery-buddy/internal/fat"
+)
+
+// SortKey selects the order used when sorting a directory
+type SortKey string
+
+const (
+	// SortByName orders entries alphabetically (case-insensitive)
+	SortByName SortKey = "name"
+
+	// SortByTime orders entries by modification time, oldest first (i.e., upload order)
+	SortByTime SortKey = "time"
+
+	// SortByCustom orders entries as listed in SortOrder.Names
+	SortByCustom SortKey = "custom"
+)
+
+// SortOrder describes how the entries of a directory are ordered
+type SortOrder struct {
+	Key SortKey
+
+	// Names lists entry names in the wanted order (SortByCustom only).
+	// Entries not listed follow the listed ones, sorted by name.
+	Names []string
+}
+
+// lessFunc returns the comparison function for the sort order
+func (o SortOrder) lessFunc() (func(a, b fat.DirEntry) bool, error) {
+	byName := func(a, b fat.DirEntry) bool {
+		la, lb := strings.ToLower(a.Name), strings.ToLower(b.Name)
+		if la != lb {
+			return la < lb
+		}
+		return a.Name < b.Name
+	}
+
+	switch o.Key {
+	case SortByName:
+		return byName, nil
+	case SortByTime:
+		return func(a, b fat.DirEntry) bool {
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+			return byName(a, b)
+		}, nil
+	case SortByCustom:
+		position := make(map[string]int, len(o.Names))
+		for i, name := range o.Names {
+			position[strings.ToLower(path.Base(name))] = i
+		}
+		return func(a, b fat.DirEntry) bool {
+			pa, oka := position[strings.ToLower(a.Name)]
+			pb, okb := position[strings.ToLower(b.Name)]
+			switch {
+			case oka && okb:
+				return pa < pb
+			case oka != okb:
+				return oka
+			default:
+				return byName(a, b)
+			}
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown sort order %q", ErrInvalidPath, o.Key)
+	}
+}
+
+// SortDirectory rewrites the entries of a directory in the given order.
+// Embroidery machines list files in raw directory-entry order, so this controls
+// the order designs appear on the machine's screen. The USB gadget is disconnected
+// while the directory is rewritten.
+func (m *Manager) SortDirectory(dirPath string, order SortOrder) error {
+	less, err := order.lessFunc()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.filesystem == nil {
+		return ErrDiskNotInitialized
+	}
+
+	// Disconnect the USB gadget before rewriting the directory
+	if err := m.gadget.Disconnect(); err != nil {
+		return fmt.Errorf("failed to disconnect USB gadget: %w", err)
+	}
+
+	// Ensure we reconnect even if there's an error
+	defer func() {
+		if err := m.gadget.Reconnect(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to reconnect USB gadget: %v\n", err)
+		}
+	}()
+
+	sortErr := sortDirectories(m.config.DiskPath, []string{normalizePath(dirPath)}, less)
+
+	// Reopen the disk so go-diskfs sees the new entry order
+	if err := m.openDisk(); err != nil {
+		return fmt.Errorf("failed to reopen disk: %w", err)
+	}
+
+	return sortErr
+}
+
+// sortDirectories sorts each directory directly on a disk image.
+// The caller must hold the lock and have disconnected the USB gadget.
+func sortDirectories(diskPath string, dirs []string, less func(a, b fat.DirEntry) bool) error {
+	return editImage(diskPath, func(volume *fat.Volume) error {
+		for _, dir := range dirs {
+			if err := volume.SortDir(dir, less); err != nil {
+				if errors.Is(err, fat.ErrNotFound) || errors.Is(err, fat.ErrNotDirectory) {
+					return fmt.Errorf("%w: %s", ErrFileNotFound, dir)
+				}
+				return fmt.Errorf("failed to sort %s: %w", dir, err)
+			}
+		}
+		return nil
+	})
+}
+
+// touchedDirectories returns the directories a transaction may have changed,
+// parents before children
+func (t *Transaction) touchedDirectories() []string {
+	dirs := make([]string, 0, len(t.dirs))
+	for dir := range t.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// touch records that a path (and therefore its parent directories) changed
+func (t *Transaction) touch(filePath string) {
+	if t.dirs == nil {
+		t.dirs = make(map[string]bool)
+	}
+	for dir := path.Dir(normalizePath(filePath)); ; dir = path.Dir(dir) {
+		t.dirs[dir] = true
+		if dir == "/" {
+			break
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package diskmanager
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// SyncFile is one file of a client's folder. Path is relative to the
+// directory being synced and uses forward slashes.
+type SyncFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// SyncPlan lists the changes that make a directory on the disk match a
+// client's folder. Paths are relative to the synced directory.
+type SyncPlan struct {
+	// Add and Update are the files the client has to send
+	Add    []SyncFile `json:"add"`
+	Update []SyncFile `json:"update"`
+
+	// Delete are files on the disk the client doesn't have
+	Delete []string `json:"delete"`
+
+	// Unchanged counts the files that already match
+	Unchanged int `json:"unchanged"`
+}
+
+// Empty reports whether the disk already matches the client's folder
+func (p SyncPlan) Empty() bool {
+	return len(p.Add) == 0 && len(p.Update) == 0 && len(p.Delete) == 0
+}
+
+// Upload returns the file the plan expects the client to send for a path
+func (p SyncPlan) Upload(relPath string) (SyncFile, bool) {
+	for _, list := range [][]SyncFile{p.Add, p.Update} {
+		for _, f := range list {
+			if strings.EqualFold(f.Path, relPath) {
+				return f, true
+			}
+		}
+	}
+	return SyncFile{}, false
+}
+
+// CleanSyncPath validates a path from a sync manifest and returns it cleaned
+// and relative. Paths that are empty or leave the synced directory are
+// rejected with ErrInvalidPath.
+func CleanSyncPath(relPath string) (string, error) {
+	if relPath == "" || strings.Contains(relPath, "\\") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPath, relPath)
+	}
+	for _, part := range strings.Split(relPath, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%w: %q", ErrInvalidPath, relPath)
+		}
+	}
+	cleaned := strings.TrimPrefix(path.Clean("/"+relPath), "/")
+	if cleaned == "" {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPath, relPath)
+	}
+	return cleaned, nil
+}
+
+// PlanSync compares the files below root on the disk with a client's manifest
+// by path (ignoring case, like FAT) and content hash. Empty directories on the
+// disk are not reported.
+func (m *Manager) PlanSync(root string, manifest []SyncFile) (SyncPlan, error) {
+	root = normalizePath(root)
+
+	wanted := make(map[string]SyncFile, len(manifest))
+	for _, f := range manifest {
+		relPath, err := CleanSyncPath(f.Path)
+		if err != nil {
+			return SyncPlan{}, err
+		}
+		sum, err := hex.DecodeString(f.SHA256)
+		if err != nil || len(sum) != 32 {
+			return SyncPlan{}, fmt.Errorf("%w: bad sha256 for %s", ErrInvalidPath, relPath)
+		}
+		key := indexKey(path.Join(root, relPath))
+		if _, dup := wanted[key]; dup {
+			return SyncPlan{}, fmt.Errorf("%w: %s is listed twice", ErrInvalidPath, relPath)
+		}
+		wanted[key] = SyncFile{Path: relPath, Size: f.Size, SHA256: hex.EncodeToString(sum)}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.filesystem == nil {
+		return SyncPlan{}, ErrDiskNotInitialized
+	}
+	if err := m.index.refresh(m.filesystem, root, true); err != nil {
+		return SyncPlan{}, err
+	}
+	files := m.index.snapshot()
+
+	plan := SyncPlan{Add: []SyncFile{}, Update: []SyncFile{}, Delete: []string{}}
+	for key, f := range wanted {
+		existing, ok := files[key]
+		switch {
+		case !ok:
+			plan.Add = append(plan.Add, f)
+		case existing.sum != f.SHA256:
+			plan.Update = append(plan.Update, f)
+		default:
+			plan.Unchanged++
+		}
+	}
+
+	prefix := indexKey(root)
+	if prefix != "/" {
+		prefix += "/"
+	}
+	for key, e := range files {
+		if _, ok := wanted[key]; ok || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		// Report the name as stored rather than case-folded
+		relPath := key[len(prefix):]
+		if len(e.path) > len(prefix) && strings.EqualFold(e.path[:len(prefix)], prefix) {
+			relPath = e.path[len(prefix):]
+		}
+		plan.Delete = append(plan.Delete, relPath)
+	}
+
+	sort.Slice(plan.Add, func(i, j int) bool { return plan.Add[i].Path < plan.Add[j].Path })
+	sort.Slice(plan.Update, func(i, j int) bool { return plan.Update[i].Path < plan.Update[j].Path })
+	sort.Strings(plan.Delete)
+	return plan, nil
+}
@@ -14,6 +14,10 @@ type UsbGadget interface {
 	// Reconnect reconnects the USB gadget to the host
 	Reconnect() error
 
+	// SetBackingFile changes the disk image presented to the host.
+	// The gadget must be disconnected.
+	SetBackingFile(diskPath string) error
+
 	// IsConnected returns true if the USB gadget is currently connected to a host
 	IsConnected() bool
 }
@@ -194,6 +194,23 @@ func (g *LinuxUsbGadget) Reconnect() error {
 	return nil
 }
 
+// SetBackingFile rewrites lun.0/file so the host sees a different disk image.
+// The gadget must be disconnected so the host never sees the file change under it.
+func (g *LinuxUsbGadget) SetBackingFile(diskPath string) error {
+	if g.connected {
+		return fmt.Errorf("cannot change backing file while the gadget is connected")
+	}
+
+	gadgetBase := filepath.Join("/sys/kernel/config/usb_gadget", g.config.GadgetShortName)
+	massStorageDir := filepath.Join(gadgetBase, "functions/mass_storage.usb0")
+	if err := writeSysfs(filepath.Join(massStorageDir, "lun.0/file"), diskPath); err != nil {
+		return err
+	}
+
+	g.config.DiskPath = diskPath
+	return nil
+}
+
 // IsConnected returns true if the USB gadget is currently connected to a host
 func (g *LinuxUsbGadget) IsConnected() bool {
 	return g.connected
@@ -1,10 +1,13 @@
 package diskmanager
 
+import "fmt"
+
 // NoOpUsbGadget is a no-op implementation of UsbGadget for testing
 type NoOpUsbGadget struct {
 	connected       bool
 	disconnectCalls int
 	reconnectCalls  int
+	backingFile     string
 }
 
 // NewNoOpUsbGadget creates a new no-op USB gadget implementation
@@ -42,6 +45,20 @@ func (g *NoOpUsbGadget) Reconnect() error {
 	return nil
 }
 
+// SetBackingFile records the disk image path
+func (g *NoOpUsbGadget) SetBackingFile(diskPath string) error {
+	if g.connected {
+		return fmt.Errorf("cannot change backing file while the gadget is connected")
+	}
+	g.backingFile = diskPath
+	return nil
+}
+
+// GetBackingFile returns the path last passed to SetBackingFile
+func (g *NoOpUsbGadget) GetBackingFile() string {
+	return g.backingFile
+}
+
 // IsConnected returns the connection status
 func (g *NoOpUsbGadget) IsConnected() bool {
 	return g.connected
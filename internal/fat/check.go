@@ -0,0 +1,350 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+)
+
+// ProblemKind classifies an inconsistency found by Check
+type ProblemKind string
+
+const (
+	// ProblemFATMismatch means the FAT copies differ
+	ProblemFATMismatch ProblemKind = "fat_mismatch"
+
+	// ProblemBadChain means a cluster chain points outside the data region,
+	// into a free cluster or back into itself
+	ProblemBadChain ProblemKind = "bad_chain"
+
+	// ProblemCrossLinked means a cluster belongs to more than one chain
+	ProblemCrossLinked ProblemKind = "cross_linked"
+
+	// ProblemSizeMismatch means a file's size doesn't match its chain length
+	ProblemSizeMismatch ProblemKind = "size_mismatch"
+
+	// ProblemLostClusters means clusters are allocated but no entry uses them
+	ProblemLostClusters ProblemKind = "lost_clusters"
+)
+
+// Problem is an inconsistency found by Check
+type Problem struct {
+	Kind   ProblemKind `json:"kind"`
+	Path   string      `json:"path,omitempty"`
+	Detail string      `json:"detail"`
+}
+
+// Report is the result of Check or Repair
+type Report struct {
+	Files        int       `json:"files"`
+	Directories  int       `json:"directories"`
+	UsedClusters int       `json:"usedClusters"`
+	FreeClusters int       `json:"freeClusters"`
+	LostClusters int       `json:"lostClusters"`
+	Problems     []Problem `json:"problems"`
+
+	// Repaired is set when Repair fixed the problems listed
+	Repaired bool `json:"repaired"`
+}
+
+// Clean reports whether no problems were found
+func (r Report) Clean() bool {
+	return len(r.Problems) == 0
+}
+
+// Check validates the allocation tables, directory entries and cluster chains
+// of the volume without changing it
+func (v *Volume) Check() (Report, error) {
+	return v.check(false)
+}
+
+// Repair checks the volume and fixes what it finds, the way fsck.fat -a would:
+//   - bad chains are cut at the last good cluster
+//   - the later of two cross-linked chains is cut where it joins the first
+//   - file sizes are fitted to their chains and surplus clusters freed
+//   - lost clusters are freed
+//   - every FAT copy is rewritten from the first
+//
+// Entries left without any cluster are removed. The report lists the problems
+// as found, before repair.
+func (v *Volume) Repair() (Report, error) {
+	return v.check(true)
+}
+
+// checker holds the state of a Check or Repair pass
+type checker struct {
+	v      *Volume
+	repair bool
+	report Report
+
+	// owner maps each cluster to 1 + the index of the path using it in paths
+	owner []int
+	paths []string
+
+	// dirty is set once the in-memory table needs flushing
+	dirty bool
+}
+
+func (v *Volume) check(repair bool) (Report, error) {
+	c := &checker{
+		v:      v,
+		repair: repair,
+		report: Report{Problems: []Problem{}},
+		owner:  make([]int, len(v.table)),
+	}
+
+	if err := c.compareFATs(); err != nil {
+		return c.report, err
+	}
+
+	root := dir{cluster: 0}
+	var rootClusters []uint32
+	if v.Type == FAT32 {
+		kept, kind, detail := c.claim(v.RootCluster, "/")
+		if len(kept) == 0 {
+			return c.report, fmt.Errorf("root directory is unusable: %s", detail)
+		}
+		if kind != "" {
+			c.add(kind, "/", "%s", detail)
+			if repair {
+				c.truncate(kept)
+			}
+		}
+		rootClusters = kept
+	}
+	if err := c.walkDir(root, rootClusters, "/"); err != nil {
+		return c.report, err
+	}
+
+	c.findLost()
+
+	if repair && !c.report.Clean() {
+		if err := v.flushTable(); err != nil {
+			return c.report, err
+		}
+		c.report.Repaired = true
+	}
+
+	for cl := uint32(2); cl < uint32(len(v.table)); cl++ {
+		switch {
+		case v.table[cl] == 0:
+			c.report.FreeClusters++
+		case !v.isBad(v.table[cl]):
+			c.report.UsedClusters++
+		}
+	}
+	return c.report, nil
+}
+
+// add records a problem
+func (c *checker) add(kind ProblemKind, p string, format string, args ...any) {
+	c.report.Problems = append(c.report.Problems, Problem{Kind: kind, Path: p, Detail: fmt.Sprintf(format, args...)})
+}
+
+// compareFATs checks that every FAT copy matches the first
+func (c *checker) compareFATs() error {
+	v := c.v
+	size := int64(v.SectorsPerFAT) * int64(v.BytesPerSector)
+	first := make([]byte, size)
+	if _, err := v.dev.ReadAt(first, v.offset+v.fatStart); err != nil {
+		return fmt.Errorf("failed to read FAT: %w", err)
+	}
+
+	other := make([]byte, size)
+	for i := 1; i < v.NumFATs; i++ {
+		if _, err := v.dev.ReadAt(other, v.offset+v.fatStart+int64(i)*size); err != nil {
+			return fmt.Errorf("failed to read FAT %d: %w", i+1, err)
+		}
+		if !bytes.Equal(first, other) {
+			c.add(ProblemFATMismatch, "", "FAT %d differs from FAT 1", i+1)
+			c.dirty = true
+		}
+	}
+	return nil
+}
+
+// claim follows the chain starting at first and assigns its clusters to p. It
+// stops at the first cluster that can't belong to the chain and returns the
+// clusters before it, with the kind of problem found.
+func (c *checker) claim(first uint32, p string) ([]uint32, ProblemKind, string) {
+	v := c.v
+	var kept []uint32
+	var kind ProblemKind
+	var detail string
+
+	seen := make(map[uint32]bool)
+	for cl := first; ; {
+		if !v.validCluster(cl) {
+			kind = ProblemBadChain
+			if cl == 0 && len(kept) > 0 {
+				detail = fmt.Sprintf("chain runs into a free cluster after cluster %d", kept[len(kept)-1])
+			} else {
+				detail = fmt.Sprintf("chain points to invalid cluster %d", cl)
+			}
+			break
+		}
+		if seen[cl] {
+			kind, detail = ProblemBadChain, fmt.Sprintf("chain loops at cluster %d", cl)
+			break
+		}
+		if owner := c.owner[cl]; owner != 0 {
+			kind, detail = ProblemCrossLinked, fmt.Sprintf("cluster %d is also used by %s", cl, c.paths[owner-1])
+			break
+		}
+		seen[cl] = true
+		kept = append(kept, cl)
+
+		next := v.table[cl]
+		if v.isEOC(next) {
+			break
+		}
+		cl = next
+	}
+
+	c.paths = append(c.paths, p)
+	for _, cl := range kept {
+		c.owner[cl] = len(c.paths)
+	}
+	return kept, kind, detail
+}
+
+// truncate ends a chain at its last cluster
+func (c *checker) truncate(clusters []uint32) {
+	c.v.table[clusters[len(clusters)-1]] = c.v.eoc()
+	c.dirty = true
+}
+
+// release frees clusters that were claimed by a chain
+func (c *checker) release(clusters []uint32) {
+	for _, cl := range clusters {
+		c.v.table[cl] = 0
+		c.owner[cl] = 0
+	}
+	c.dirty = true
+}
+
+// walkDir checks the entries of a directory held in clusters (none for the
+// FAT16 root directory) and recurses into its subdirectories
+func (c *checker) walkDir(d dir, clusters []uint32, dirPath string) error {
+	v := c.v
+
+	var raw []byte
+	var err error
+	if d.cluster == 0 && v.Type == FAT16 {
+		raw, _, err = v.readDirRaw(d)
+	} else {
+		raw, err = v.readClusters(clusters)
+	}
+	if err != nil {
+		return err
+	}
+
+	clusterSize := int64(v.clusterSize)
+	changed := false
+	for _, e := range parseDir(raw) {
+		if e.IsVolumeLabel() || e.isDotEntry() {
+			continue
+		}
+		p := path.Join(dirPath, e.Name)
+		short := raw[(e.slot+e.slots-1)*dirEntrySize:][:dirEntrySize]
+		if e.IsDir() {
+			c.report.Directories++
+		} else {
+			c.report.Files++
+		}
+
+		if e.Cluster == 0 {
+			if e.IsDir() {
+				c.add(ProblemBadChain, p, "directory has no clusters")
+				if c.repair {
+					deleteEntry(raw, e)
+					changed = true
+				}
+			} else if e.Size > 0 {
+				c.add(ProblemSizeMismatch, p, "size is %d bytes but the file has no clusters", e.Size)
+				if c.repair {
+					binary.LittleEndian.PutUint32(short[28:], 0)
+					changed = true
+				}
+			}
+			continue
+		}
+
+		kept, kind, detail := c.claim(e.Cluster, p)
+		if kind != "" {
+			c.add(kind, p, "%s", detail)
+			if c.repair {
+				if len(kept) == 0 {
+					deleteEntry(raw, e)
+					changed = true
+					continue
+				}
+				c.truncate(kept)
+			}
+		}
+		if len(kept) == 0 {
+			continue
+		}
+
+		if e.IsDir() {
+			if err := c.walkDir(dir{cluster: e.Cluster}, kept, p); err != nil {
+				return err
+			}
+			continue
+		}
+
+		need := (int64(e.Size) + clusterSize - 1) / clusterSize
+		have := int64(len(kept))
+		switch {
+		case have < need:
+			// A cut chain always shortens the file; only report sizes that
+			// were wrong to begin with
+			if kind == "" {
+				c.add(ProblemSizeMismatch, p, "size is %d bytes but the chain has only %d clusters", e.Size, have)
+			}
+			if c.repair {
+				binary.LittleEndian.PutUint32(short[28:], uint32(have*clusterSize))
+				changed = true
+			}
+		case have > need:
+			c.add(ProblemSizeMismatch, p, "size is %d bytes but the chain has %d clusters", e.Size, have)
+			if c.repair {
+				c.release(kept[need:])
+				if need == 0 {
+					binary.LittleEndian.PutUint16(short[20:], 0)
+					binary.LittleEndian.PutUint16(short[26:], 0)
+					changed = true
+				} else {
+					c.truncate(kept[:need])
+				}
+			}
+		}
+	}
+
+	if changed {
+		return v.writeDirRaw(d, raw, clusters)
+	}
+	return nil
+}
+
+// findLost counts, and when repairing frees, allocated clusters no chain claimed
+func (c *checker) findLost() {
+	v := c.v
+	lost := 0
+	for cl := uint32(2); cl < uint32(len(v.table)); cl++ {
+		entry := v.table[cl]
+		if entry == 0 || v.isBad(entry) || c.owner[cl] != 0 {
+			continue
+		}
+		lost++
+		if c.repair {
+			v.table[cl] = 0
+			c.dirty = true
+		}
+	}
+	if lost > 0 {
+		c.report.LostClusters = lost
+		c.add(ProblemLostClusters, "", "%d clusters are allocated but not used by any file", lost)
+	}
+}
@@ -0,0 +1,111 @@
+package fat
+
+import "fmt"
+
+// Clear empties the volume in place. Every cluster is freed and the root
+// directory is emptied; only the allocation tables and root directory are
+// written. The boot sector, and with it the geometry, label and volume serial
+// number, is left alone.
+func (v *Volume) Clear() error {
+	if v.Type == FAT32 && !v.validCluster(v.RootCluster) {
+		return fmt.Errorf("invalid root cluster %d", v.RootCluster)
+	}
+
+	// Read the root directory while its chain is still intact
+	root := dir{cluster: 0}
+	raw, clusters, err := v.readDirRaw(root)
+	if err != nil {
+		// A broken FAT32 root chain still leaves the first cluster usable
+		if v.Type != FAT32 {
+			return err
+		}
+		clusters = []uint32{v.RootCluster}
+		raw = make([]byte, v.clusterSize)
+	}
+
+	for c := uint32(2); c < uint32(len(v.table)); c++ {
+		v.table[c] = 0
+	}
+
+	// The FAT32 root directory keeps only its first cluster
+	if v.Type == FAT32 {
+		v.table[v.RootCluster] = fat32Mask
+		raw = raw[:v.clusterSize]
+		clusters = clusters[:1]
+	}
+
+	if err := v.writeDirRaw(root, keepSlots(raw, true), clusters); err != nil {
+		return err
+	}
+	return v.flushTable()
+}
+
+// ClearDir removes everything inside a directory, freeing the clusters of its
+// files and subdirectories. The directory itself stays.
+func (v *Volume) ClearDir(dirPath string) error {
+	d, err := v.lookupDir(dirPath)
+	if err != nil {
+		return err
+	}
+
+	raw, clusters, err := v.readDirRaw(d)
+	if err != nil {
+		return err
+	}
+	for _, e := range parseDir(raw) {
+		if e.IsVolumeLabel() || e.isDotEntry() {
+			continue
+		}
+		if err := v.freeEntry(e); err != nil {
+			return err
+		}
+	}
+
+	if err := v.writeDirRaw(d, keepSlots(raw, d.cluster == 0), clusters); err != nil {
+		return err
+	}
+	return v.flushTable()
+}
+
+// freeEntry frees the clusters of a file, or of a directory and everything in it
+func (v *Volume) freeEntry(e DirEntry) error {
+	if e.Cluster == 0 {
+		return nil
+	}
+	if e.IsDir() {
+		raw, _, err := v.readDirRaw(dir{cluster: e.Cluster})
+		if err != nil {
+			return err
+		}
+		for _, child := range parseDir(raw) {
+			if child.isDotEntry() {
+				continue
+			}
+			if err := v.freeEntry(child); err != nil {
+				return err
+			}
+		}
+	}
+
+	clusters, err := v.chain(e.Cluster)
+	for _, c := range clusters {
+		v.table[c] = 0
+	}
+	if err != nil {
+		return fmt.Errorf("failed to free %s: %w", e.Name, err)
+	}
+	return nil
+}
+
+// keepSlots returns a copy of raw directory slots holding only the volume label
+// (root directories) or the "." and ".." entries (subdirectories)
+func keepSlots(raw []byte, root bool) []byte {
+	out := make([]byte, len(raw))
+	n := 0
+	for _, e := range parseDir(raw) {
+		if (root && e.IsVolumeLabel()) || (!root && e.isDotEntry()) {
+			n += copy(out[n*dirEntrySize:], raw[e.slot*dirEntrySize:(e.slot+e.slots)*dirEntrySize]) / dirEntrySize
+		}
+	}
+	return out
+}
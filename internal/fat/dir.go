@@ -0,0 +1,358 @@
+package fat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	dirEntrySize = 32
+
+	attrReadOnly  = 0x01
+	attrHidden    = 0x02
+	attrSystem    = 0x04
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLongName  = 0x0F
+
+	entryFree    = 0xE5
+	entryEnd     = 0x00
+	lastLongFlag = 0x40
+
+	// NT reserved byte flags for lower-case short names
+	ntLowerBase = 0x08
+	ntLowerExt  = 0x10
+)
+
+// DirEntry is a file or directory found in a directory
+type DirEntry struct {
+	// Name is the long name if the entry has one, otherwise the short name
+	Name string
+
+	// ShortName is the 8.3 name (e.g., "ROSE~1.DST")
+	ShortName string
+
+	Attr    byte
+	Cluster uint32
+	Size    uint32
+	ModTime time.Time
+
+	// slot is the index of the first 32 byte slot of the entry (including long name slots)
+	// and slots the number of slots it occupies
+	slot, slots int
+}
+
+// IsDir reports whether the entry is a subdirectory
+func (e DirEntry) IsDir() bool {
+	return e.Attr&attrDirectory != 0
+}
+
+// IsVolumeLabel reports whether the entry is the volume label
+func (e DirEntry) IsVolumeLabel() bool {
+	return e.Attr&attrVolumeID != 0 && e.Attr != attrLongName
+}
+
+// isDotEntry reports whether the entry is "." or ".."
+func (e DirEntry) isDotEntry() bool {
+	return e.ShortName == "." || e.ShortName == ".."
+}
+
+// dir identifies a directory on the volume: cluster 0 means the root directory
+type dir struct {
+	cluster uint32
+}
+
+// readDirRaw returns the raw slots of a directory and the clusters holding them
+// (no clusters for the fixed FAT16 root directory)
+func (v *Volume) readDirRaw(d dir) ([]byte, []uint32, error) {
+	if d.cluster == 0 && v.Type == FAT16 {
+		raw := make([]byte, v.RootEntries*dirEntrySize)
+		if _, err := v.dev.ReadAt(raw, v.offset+v.rootDirStart); err != nil {
+			return nil, nil, fmt.Errorf("failed to read root directory: %w", err)
+		}
+		return raw, nil, nil
+	}
+
+	first := d.cluster
+	if first == 0 {
+		first = v.RootCluster
+	}
+	clusters, err := v.chain(first)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := v.readClusters(clusters)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, clusters, nil
+}
+
+// writeDirRaw writes back slots previously read with readDirRaw
+func (v *Volume) writeDirRaw(d dir, raw []byte, clusters []uint32) error {
+	if d.cluster == 0 && v.Type == FAT16 {
+		if _, err := v.dev.WriteAt(raw, v.offset+v.rootDirStart); err != nil {
+			return fmt.Errorf("failed to write root directory: %w", err)
+		}
+		return nil
+	}
+	return v.writeClusters(clusters, raw)
+}
+
+// parseDir decodes the entries of a raw directory.
+// Deleted entries are skipped; parsing stops at the end marker.
+func parseDir(raw []byte) []DirEntry {
+	var entries []DirEntry
+	var longParts [][]uint16
+	longStart := -1
+	var longChecksum byte
+
+	for i := 0; i+dirEntrySize <= len(raw); i += dirEntrySize {
+		slot := raw[i : i+dirEntrySize]
+		index := i / dirEntrySize
+
+		if slot[0] == entryEnd {
+			break
+		}
+		if slot[0] == entryFree {
+			longParts, longStart = nil, -1
+			continue
+		}
+
+		if slot[11] == attrLongName {
+			if slot[0]&lastLongFlag != 0 {
+				// First physical slot of a long name (holds the last part of the name)
+				longParts, longStart = nil, index
+				longChecksum = slot[13]
+			}
+			if longStart >= 0 {
+				longParts = append(longParts, longNamePart(slot))
+			}
+			continue
+		}
+
+		e := DirEntry{
+			ShortName: shortName(slot),
+			Attr:      slot[11],
+			Cluster:   uint32(binary.LittleEndian.Uint16(slot[26:])) | uint32(binary.LittleEndian.Uint16(slot[20:]))<<16,
+			Size:      binary.LittleEndian.Uint32(slot[28:]),
+			ModTime:   fatTime(binary.LittleEndian.Uint16(slot[24:]), binary.LittleEndian.Uint16(slot[22:])),
+			slot:      index,
+			slots:     1,
+		}
+		e.Name = e.ShortName
+
+		if longStart >= 0 && longChecksum == shortNameChecksum(slot[:11]) {
+			e.Name = joinLongName(longParts)
+			e.slot = longStart
+			e.slots = index - longStart + 1
+		}
+		longParts, longStart = nil, -1
+
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+// deleteEntry marks every slot of an entry as deleted
+func deleteEntry(raw []byte, e DirEntry) {
+	for i := e.slot; i < e.slot+e.slots; i++ {
+		raw[i*dirEntrySize] = entryFree
+	}
+}
+
+// longNamePart extracts the 13 UCS-2 characters stored in a long name slot
+func longNamePart(slot []byte) []uint16 {
+	var chars []uint16
+	for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+		for j := r[0]; j < r[1]; j += 2 {
+			chars = append(chars, binary.LittleEndian.Uint16(slot[j:]))
+		}
+	}
+	return chars
+}
+
+// joinLongName assembles a long name from its slots, which are stored last part first
+func joinLongName(parts [][]uint16) string {
+	var chars []uint16
+	for i := len(parts) - 1; i >= 0; i-- {
+		chars = append(chars, parts[i]...)
+	}
+	for i, c := range chars {
+		if c == 0x0000 || c == 0xFFFF {
+			chars = chars[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(chars))
+}
+
+// shortName formats the 8.3 name of a short entry
+func shortName(slot []byte) string {
+	base := strings.TrimRight(string(slot[0:8]), " ")
+	ext := strings.TrimRight(string(slot[8:11]), " ")
+	if slot[0] == 0x05 {
+		// 0x05 stands in for a leading 0xE5 byte
+		base = "\xe5" + base[1:]
+	}
+	if slot[12]&ntLowerBase != 0 {
+		base = strings.ToLower(base)
+	}
+	if slot[12]&ntLowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// shortNameChecksum computes the checksum long name slots use to refer to their short entry
+func shortNameChecksum(name []byte) byte {
+	var sum byte
+	for _, c := range name[:11] {
+		sum = (sum>>1 | sum<<7) + c
+	}
+	return sum
+}
+
+// fatTime converts a FAT date and time to a time.Time in the local zone
+func fatTime(date, tm uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(
+		1980+int(date>>9), time.Month(date>>5&0x0F), int(date&0x1F),
+		int(tm>>11), int(tm>>5&0x3F), int(tm&0x1F)*2, 0, time.Local)
+}
+
+// ReadDir lists the entries of a directory.
+// The volume label and the "." and ".." entries are omitted.
+func (v *Volume) ReadDir(dirPath string) ([]DirEntry, error) {
+	d, err := v.lookupDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, _, err := v.readDirRaw(d)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []DirEntry
+	for _, e := range parseDir(raw) {
+		if e.IsVolumeLabel() || e.isDotEntry() {
+			continue
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// Lookup finds the entry for a path. The root directory has no entry and returns ErrNotFound.
+func (v *Volume) Lookup(p string) (DirEntry, error) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return DirEntry{}, fmt.Errorf("%w: the root directory has no entry", ErrNotFound)
+	}
+
+	parent, name := path.Split(p)
+	entries, err := v.ReadDir(parent)
+	if err != nil {
+		return DirEntry{}, err
+	}
+	for _, e := range entries {
+		if strings.EqualFold(e.Name, name) || strings.EqualFold(e.ShortName, name) {
+			return e, nil
+		}
+	}
+	return DirEntry{}, fmt.Errorf("%w: %s", ErrNotFound, p)
+}
+
+// lookupDir resolves a directory path
+func (v *Volume) lookupDir(p string) (dir, error) {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return dir{cluster: 0}, nil
+	}
+
+	e, err := v.Lookup(p)
+	if err != nil {
+		return dir{}, err
+	}
+	if !e.IsDir() {
+		return dir{}, fmt.Errorf("%w: %s", ErrNotDirectory, p)
+	}
+	return dir{cluster: e.Cluster}, nil
+}
+
+// SortDir rewrites the entries of a directory in the order given by less.
+// The volume label and "." / ".." entries stay first, deleted slots are dropped
+// and the free space moves to the end of the directory. Only directory slots are
+// rewritten; file data and the FAT are untouched.
+func (v *Volume) SortDir(dirPath string, less func(a, b DirEntry) bool) error {
+	d, err := v.lookupDir(dirPath)
+	if err != nil {
+		return err
+	}
+
+	raw, clusters, err := v.readDirRaw(d)
+	if err != nil {
+		return err
+	}
+
+	var fixed, movable []DirEntry
+	for _, e := range parseDir(raw) {
+		if e.IsVolumeLabel() || e.isDotEntry() {
+			fixed = append(fixed, e)
+		} else {
+			movable = append(movable, e)
+		}
+	}
+	sort.SliceStable(movable, func(i, j int) bool {
+		return less(movable[i], movable[j])
+	})
+
+	sorted := make([]byte, len(raw))
+	pos := 0
+	for _, e := range append(fixed, movable...) {
+		n := copy(sorted[pos:], raw[e.slot*dirEntrySize:(e.slot+e.slots)*dirEntrySize])
+		pos += n
+	}
+
+	return v.writeDirRaw(d, sorted, clusters)
+}
+
+// ReadFile returns the contents of a file
+func (v *Volume) ReadFile(p string) ([]byte, error) {
+	e, err := v.Lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if e.IsDir() {
+		return nil, fmt.Errorf("%w: %s is a directory", ErrNotFound, p)
+	}
+	if e.Size == 0 {
+		return []byte{}, nil
+	}
+
+	clusters, err := v.chain(e.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(clusters))*int64(v.clusterSize) < int64(e.Size) {
+		return nil, fmt.Errorf("cluster chain of %s is shorter than its size", p)
+	}
+	data, err := v.readClusters(clusters)
+	if err != nil {
+		return nil, err
+	}
+	return data[:e.Size], nil
+}
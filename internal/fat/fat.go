@@ -0,0 +1,362 @@
+// Package fat reads and modifies FAT16 and FAT32 volumes at the on-disk structure level.
+//
+// go-diskfs and the kernel vfat driver hide details such as the order of directory
+// entries and the layout of cluster chains. Embroidery machines care about both
+// (they list files in raw directory order), so this package works directly on the
+// boot sector, allocation tables and directory slots of a disk image.
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrNotFAT          = errors.New("not a FAT volume")
+	ErrUnsupportedType = errors.New("unsupported FAT type")
+	ErrNotFound        = errors.New("path not found")
+	ErrNotDirectory    = errors.New("not a directory")
+)
+
+// Type is the FAT variant of a volume
+type Type int
+
+const (
+	FAT16 Type = 16
+	FAT32 Type = 32
+)
+
+func (t Type) String() string {
+	return fmt.Sprintf("FAT%d", int(t))
+}
+
+const (
+	// Cluster values at or above these mark the end of a chain
+	fat16EOC = 0xFFF8
+	fat32EOC = 0x0FFFFFF8
+
+	// Bad cluster markers
+	fat16Bad = 0xFFF7
+	fat32Bad = 0x0FFFFFF7
+
+	fat32Mask = 0x0FFFFFFF
+)
+
+// Device is the storage holding a volume, usually the disk image file
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Volume is an opened FAT16 or FAT32 filesystem
+type Volume struct {
+	dev    Device
+	offset int64 // byte offset of the volume within the device
+
+	Type              Type
+	BytesPerSector    int
+	SectorsPerCluster int
+	ReservedSectors   int
+	NumFATs           int
+	RootEntries       int // FAT16 only: fixed root directory size in entries
+	TotalSectors      uint32
+	SectorsPerFAT     uint32
+	RootCluster       uint32 // FAT32 only
+	FSInfoSector      int    // FAT32 only
+	VolumeID          uint32
+	Label             string
+
+	fatStart     int64 // byte offset of the first FAT (relative to the volume)
+	rootDirStart int64 // byte offset of the FAT16 root directory
+	dataStart    int64 // byte offset of cluster 2
+	clusterSize  int
+	clusterCount uint32 // number of data clusters
+
+	// table holds the first FAT in memory; entries are normalized to uint32
+	table []uint32
+
+	// nextFree is where the allocator starts looking for free clusters
+	nextFree uint32
+}
+
+// Open reads the boot sector and allocation table of the volume at offset
+func Open(dev Device, offset int64) (*Volume, error) {
+	bs := make([]byte, 512)
+	if _, err := dev.ReadAt(bs, offset); err != nil {
+		return nil, fmt.Errorf("failed to read boot sector: %w", err)
+	}
+	if bs[510] != 0x55 || bs[511] != 0xAA {
+		return nil, fmt.Errorf("%w: missing boot signature", ErrNotFAT)
+	}
+
+	v := &Volume{
+		dev:               dev,
+		offset:            offset,
+		BytesPerSector:    int(binary.LittleEndian.Uint16(bs[0x0B:])),
+		SectorsPerCluster: int(bs[0x0D]),
+		ReservedSectors:   int(binary.LittleEndian.Uint16(bs[0x0E:])),
+		NumFATs:           int(bs[0x10]),
+		RootEntries:       int(binary.LittleEndian.Uint16(bs[0x11:])),
+		TotalSectors:      uint32(binary.LittleEndian.Uint16(bs[0x13:])),
+		SectorsPerFAT:     uint32(binary.LittleEndian.Uint16(bs[0x16:])),
+	}
+	if v.TotalSectors == 0 {
+		v.TotalSectors = binary.LittleEndian.Uint32(bs[0x20:])
+	}
+
+	switch v.BytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, fmt.Errorf("%w: invalid sector size %d", ErrNotFAT, v.BytesPerSector)
+	}
+	if v.SectorsPerCluster == 0 || v.SectorsPerCluster&(v.SectorsPerCluster-1) != 0 {
+		return nil, fmt.Errorf("%w: invalid sectors per cluster %d", ErrNotFAT, v.SectorsPerCluster)
+	}
+	if v.NumFATs == 0 || v.ReservedSectors == 0 {
+		return nil, fmt.Errorf("%w: invalid FAT layout", ErrNotFAT)
+	}
+
+	// A zero 16-bit FAT size means the FAT32 extended boot record is present.
+	// This is how Linux decides too; go-diskfs writes FAT32 volumes with fewer
+	// clusters than the specification's FAT32 threshold.
+	if v.SectorsPerFAT == 0 {
+		v.Type = FAT32
+		v.SectorsPerFAT = binary.LittleEndian.Uint32(bs[0x24:])
+		v.RootCluster = binary.LittleEndian.Uint32(bs[0x2C:])
+		v.FSInfoSector = int(binary.LittleEndian.Uint16(bs[0x30:]))
+		v.VolumeID = binary.LittleEndian.Uint32(bs[0x43:])
+		v.Label = trimLabel(bs[0x47 : 0x47+11])
+	} else {
+		v.Type = FAT16
+		v.VolumeID = binary.LittleEndian.Uint32(bs[0x27:])
+		v.Label = trimLabel(bs[0x2B : 0x2B+11])
+	}
+
+	v.clusterSize = v.BytesPerSector * v.SectorsPerCluster
+	v.fatStart = int64(v.ReservedSectors) * int64(v.BytesPerSector)
+	rootDirSectors := (v.RootEntries*dirEntrySize + v.BytesPerSector - 1) / v.BytesPerSector
+	v.rootDirStart = v.fatStart + int64(v.NumFATs)*int64(v.SectorsPerFAT)*int64(v.BytesPerSector)
+	v.dataStart = v.rootDirStart + int64(rootDirSectors)*int64(v.BytesPerSector)
+
+	dataSectors := int64(v.TotalSectors) - v.dataStart/int64(v.BytesPerSector)
+	if dataSectors <= 0 {
+		return nil, fmt.Errorf("%w: no data region", ErrNotFAT)
+	}
+	v.clusterCount = uint32(dataSectors / int64(v.SectorsPerCluster))
+
+	if v.Type == FAT16 && v.clusterCount < 4085 {
+		return nil, fmt.Errorf("%w: FAT12 volumes are not supported", ErrUnsupportedType)
+	}
+
+	// The FAT may not have room for every data cluster if the formatter rounded down
+	entriesPerFAT := uint32(int64(v.SectorsPerFAT) * int64(v.BytesPerSector) / int64(v.entrySize()))
+	if entriesPerFAT < v.clusterCount+2 {
+		v.clusterCount = entriesPerFAT - 2
+	}
+
+	if err := v.loadTable(); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// trimLabel converts a space-padded 11 byte label field to a string
+func trimLabel(b []byte) string {
+	end := len(b)
+	for end > 0 && (b[end-1] == ' ' || b[end-1] == 0) {
+		end--
+	}
+	return string(b[:end])
+}
+
+// entrySize returns the size of one FAT entry in bytes
+func (v *Volume) entrySize() int {
+	if v.Type == FAT32 {
+		return 4
+	}
+	return 2
+}
+
+// ClusterSize returns the size of a cluster in bytes
+func (v *Volume) ClusterSize() int {
+	return v.clusterSize
+}
+
+// ClusterCount returns the number of data clusters on the volume
+func (v *Volume) ClusterCount() uint32 {
+	return v.clusterCount
+}
+
+// loadTable reads the first FAT into memory
+func (v *Volume) loadTable() error {
+	raw := make([]byte, int64(v.SectorsPerFAT)*int64(v.BytesPerSector))
+	if _, err := v.dev.ReadAt(raw, v.offset+v.fatStart); err != nil {
+		return fmt.Errorf("failed to read FAT: %w", err)
+	}
+
+	count := v.clusterCount + 2
+	v.table = make([]uint32, count)
+	for i := uint32(0); i < count; i++ {
+		if v.Type == FAT32 {
+			v.table[i] = binary.LittleEndian.Uint32(raw[i*4:]) & fat32Mask
+		} else {
+			v.table[i] = uint32(binary.LittleEndian.Uint16(raw[i*2:]))
+		}
+	}
+	return nil
+}
+
+// flushTable writes the in-memory table to every FAT copy and, on FAT32,
+// updates the free cluster count in the FSInfo sector
+func (v *Volume) flushTable() error {
+	// Start from the FAT on disk so entries 0 and 1 (media byte and flags) and
+	// the reserved FAT32 bits are kept
+	raw := make([]byte, int64(v.SectorsPerFAT)*int64(v.BytesPerSector))
+	if _, err := v.dev.ReadAt(raw, v.offset+v.fatStart); err != nil {
+		return fmt.Errorf("failed to read FAT: %w", err)
+	}
+
+	free := uint32(0)
+	for c := uint32(2); c < uint32(len(v.table)); c++ {
+		if v.table[c] == 0 {
+			free++
+		}
+		if v.Type == FAT32 {
+			old := binary.LittleEndian.Uint32(raw[c*4:]) &^ fat32Mask
+			binary.LittleEndian.PutUint32(raw[c*4:], old|v.table[c]&fat32Mask)
+		} else {
+			binary.LittleEndian.PutUint16(raw[c*2:], uint16(v.table[c]))
+		}
+	}
+
+	for i := 0; i < v.NumFATs; i++ {
+		at := v.offset + v.fatStart + int64(i)*int64(len(raw))
+		if _, err := v.dev.WriteAt(raw, at); err != nil {
+			return fmt.Errorf("failed to write FAT %d: %w", i+1, err)
+		}
+	}
+
+	if v.Type == FAT32 && v.FSInfoSector > 0 {
+		info := make([]byte, 8)
+		binary.LittleEndian.PutUint32(info[0:], free)
+		binary.LittleEndian.PutUint32(info[4:], 0xFFFFFFFF) // no next-free hint
+		at := v.offset + int64(v.FSInfoSector)*int64(v.BytesPerSector) + 0x1E8
+		if _, err := v.dev.WriteAt(info, at); err != nil {
+			return fmt.Errorf("failed to update FSInfo sector: %w", err)
+		}
+	}
+	return nil
+}
+
+// isEOC reports whether a FAT entry marks the end of a chain
+func (v *Volume) isEOC(entry uint32) bool {
+	if v.Type == FAT32 {
+		return entry >= fat32EOC
+	}
+	return entry >= fat16EOC
+}
+
+// eoc returns the end of chain marker written by this package
+func (v *Volume) eoc() uint32 {
+	if v.Type == FAT32 {
+		return fat32Mask
+	}
+	return 0xFFFF
+}
+
+// isBad reports whether a FAT entry marks a bad cluster
+func (v *Volume) isBad(entry uint32) bool {
+	if v.Type == FAT32 {
+		return entry == fat32Bad
+	}
+	return entry == fat16Bad
+}
+
+// validCluster reports whether a cluster number lies in the data region
+func (v *Volume) validCluster(c uint32) bool {
+	return c >= 2 && c < v.clusterCount+2
+}
+
+// clusterOffset returns the device offset of a data cluster
+func (v *Volume) clusterOffset(c uint32) int64 {
+	return v.offset + v.dataStart + int64(c-2)*int64(v.clusterSize)
+}
+
+// chain follows a cluster chain from its first cluster
+func (v *Volume) chain(first uint32) ([]uint32, error) {
+	var clusters []uint32
+	seen := make(map[uint32]bool)
+
+	for c := first; ; {
+		if !v.validCluster(c) {
+			return clusters, fmt.Errorf("cluster chain from %d points to invalid cluster %d", first, c)
+		}
+		if seen[c] {
+			return clusters, fmt.Errorf("cluster chain from %d loops at cluster %d", first, c)
+		}
+		seen[c] = true
+		clusters = append(clusters, c)
+
+		next := v.table[c]
+		if v.isEOC(next) {
+			return clusters, nil
+		}
+		c = next
+	}
+}
+
+// readClusters reads the contents of the given clusters in order
+func (v *Volume) readClusters(clusters []uint32) ([]byte, error) {
+	data := make([]byte, len(clusters)*v.clusterSize)
+	for i, c := range clusters {
+		if _, err := v.dev.ReadAt(data[i*v.clusterSize:(i+1)*v.clusterSize], v.clusterOffset(c)); err != nil {
+			return nil, fmt.Errorf("failed to read cluster %d: %w", c, err)
+		}
+	}
+	return data, nil
+}
+
+// writeClusters writes data across the given clusters in order
+func (v *Volume) writeClusters(clusters []uint32, data []byte) error {
+	for i, c := range clusters {
+		if _, err := v.dev.WriteAt(data[i*v.clusterSize:(i+1)*v.clusterSize], v.clusterOffset(c)); err != nil {
+			return fmt.Errorf("failed to write cluster %d: %w", c, err)
+		}
+	}
+	return nil
+}
+
+// FindVolume locates the FAT volume in a disk image.
+// Superfloppy images (no partition table) return offset 0; otherwise the first
+// FAT partition of the MBR is used. The returned size is the volume size in bytes.
+func FindVolume(dev io.ReaderAt, imageSize int64) (offset int64, size int64, err error) {
+	sector := make([]byte, 512)
+	if _, err := dev.ReadAt(sector, 0); err != nil {
+		return 0, 0, fmt.Errorf("failed to read first sector: %w", err)
+	}
+	if sector[510] != 0x55 || sector[511] != 0xAA {
+		return 0, 0, fmt.Errorf("%w: missing boot signature", ErrNotFAT)
+	}
+
+	// A boot sector starts with a jump instruction and has a valid sector size;
+	// an MBR has neither.
+	if (sector[0] == 0xEB || sector[0] == 0xE9) && binary.LittleEndian.Uint16(sector[0x0B:])%512 == 0 &&
+		binary.LittleEndian.Uint16(sector[0x0B:]) != 0 {
+		return 0, imageSize, nil
+	}
+
+	for i := 0; i < 4; i++ {
+		entry := sector[0x1BE+i*16 : 0x1BE+(i+1)*16]
+		switch entry[4] {
+		case 0x04, 0x06, 0x0B, 0x0C, 0x0E:
+			start := int64(binary.LittleEndian.Uint32(entry[8:])) * 512
+			length := int64(binary.LittleEndian.Uint32(entry[12:])) * 512
+			return start, length, nil
+		}
+	}
+
+	return 0, 0, fmt.Errorf("%w: no FAT partition in partition table", ErrNotFAT)
+}
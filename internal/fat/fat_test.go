@@ -0,0 +1,584 @@
+package fat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// createImage formats a FAT32 superfloppy image and writes the given files with go-diskfs
+func createImage(t *testing.T, names ...string) string {
+	t.Helper()
+
+	imagePath := filepath.Join(t.TempDir(), "test.img")
+	d, err := diskfs.Create(imagePath, 10*1024*1024, diskfs.SectorSizeDefault)
+	if err != nil {
+		t.Fatalf("Failed to create disk: %v", err)
+	}
+	fs, err := d.CreateFilesystem(disk.FilesystemSpec{
+		Partition:   0,
+		FSType:      filesystem.TypeFat32,
+		VolumeLabel: "EMBROIDERY",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create filesystem: %v", err)
+	}
+
+	for _, name := range names {
+		if dir := filepath.Dir(name); dir != "/" {
+			if err := fs.Mkdir(dir); err != nil {
+				t.Fatalf("Failed to create directory %s: %v", dir, err)
+			}
+		}
+		f, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+		if _, err := f.Write([]byte(name)); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		f.Close()
+	}
+	d.Close()
+
+	return imagePath
+}
+
+// openImage opens the FAT volume of an image file
+func openImage(t *testing.T, imagePath string) (*Volume, *os.File) {
+	t.Helper()
+
+	f, err := os.OpenFile(imagePath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open image: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Failed to stat image: %v", err)
+	}
+	offset, _, err := FindVolume(f, info.Size())
+	if err != nil {
+		t.Fatalf("FindVolume failed: %v", err)
+	}
+	v, err := Open(f, offset)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return v, f
+}
+
+func names(entries []DirEntry) []string {
+	var result []string
+	for _, e := range entries {
+		result = append(result, e.Name)
+	}
+	return result
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestOpen tests reading the boot sector of a go-diskfs image
+func TestOpen(t *testing.T) {
+	v, _ := openImage(t, createImage(t))
+
+	if v.Type != FAT32 {
+		t.Errorf("Expected FAT32, got %s", v.Type)
+	}
+	if v.Label != "EMBROIDERY" {
+		t.Errorf("Expected label EMBROIDERY, got %q", v.Label)
+	}
+	if v.ClusterCount() == 0 {
+		t.Error("Expected data clusters")
+	}
+}
+
+// TestReadDir tests listing files with long and short names in directory order
+func TestReadDir(t *testing.T) {
+	v, _ := openImage(t, createImage(t, "/zebra.dst", "/Apple Blossom.exp", "/designs/rose.dst"))
+
+	entries, err := v.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	expected := []string{"zebra.dst", "Apple Blossom.exp", "designs"}
+	if !equal(names(entries), expected) {
+		t.Errorf("Expected %v, got %v", expected, names(entries))
+	}
+
+	entries, err = v.ReadDir("/DESIGNS")
+	if err != nil {
+		t.Fatalf("ReadDir of subdirectory failed: %v", err)
+	}
+	if !equal(names(entries), []string{"rose.dst"}) {
+		t.Errorf("Expected [rose.dst], got %v", names(entries))
+	}
+
+	if _, err := v.ReadDir("/missing"); err == nil {
+		t.Error("Expected error for missing directory")
+	}
+	if _, err := v.ReadDir("/zebra.dst"); err == nil {
+		t.Error("Expected error for file used as directory")
+	}
+}
+
+// TestSortDir tests that sorting rewrites the on-disk entry order and survives reopening
+func TestSortDir(t *testing.T) {
+	imagePath := createImage(t, "/zebra.dst", "/Apple Blossom.exp", "/mango.dst", "/designs/rose.dst")
+	v, _ := openImage(t, imagePath)
+
+	byName := func(a, b DirEntry) bool { return a.Name < b.Name }
+	if err := v.SortDir("/", byName); err != nil {
+		t.Fatalf("SortDir failed: %v", err)
+	}
+
+	// Reopen so nothing cached survives
+	v, _ = openImage(t, imagePath)
+	entries, err := v.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	expected := []string{"Apple Blossom.exp", "designs", "mango.dst", "zebra.dst"}
+	if !equal(names(entries), expected) {
+		t.Errorf("Expected %v, got %v", expected, names(entries))
+	}
+
+	// File data must be untouched
+	e, err := v.Lookup("/zebra.dst")
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if e.Size != uint32(len("/zebra.dst")) {
+		t.Errorf("Expected size %d, got %d", len("/zebra.dst"), e.Size)
+	}
+
+	if _, err := v.Lookup("/designs/rose.dst"); err != nil {
+		t.Errorf("Lookup in subdirectory after sort failed: %v", err)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	v, _ := openImage(t, createImage(t, "/rose.dst", "/Flowers/tulip.pes"))
+
+	data, err := v.ReadFile("/Flowers/tulip.pes")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if string(data) != "/Flowers/tulip.pes" {
+		t.Errorf("Unexpected content %q", data)
+	}
+	if _, err := v.ReadFile("/missing.dst"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        FormatOptions
+		size        int64
+		clusterSize int
+	}{
+		{"fat16 default", FormatOptions{Type: FAT16, Label: "embroidery"}, 10 * 1024 * 1024, 1024},
+		{"fat16 2k clusters", FormatOptions{Type: FAT16, ClusterSize: 2048, Label: "OLD MACHINE"}, 32 * 1024 * 1024, 2048},
+		{"fat32 4k clusters", FormatOptions{Type: FAT32, ClusterSize: 4096, Label: "EMBROIDERY"}, 64 * 1024 * 1024, 4096},
+		{"fat32 no label", FormatOptions{Type: FAT32}, 10 * 1024 * 1024, 512},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imagePath := filepath.Join(t.TempDir(), "test.img")
+			f, err := os.Create(imagePath)
+			if err != nil {
+				t.Fatalf("Failed to create image: %v", err)
+			}
+			if err := f.Truncate(tt.size); err != nil {
+				t.Fatalf("Failed to size image: %v", err)
+			}
+			if err := Format(f, 0, tt.size, tt.opts); err != nil {
+				t.Fatalf("Format failed: %v", err)
+			}
+			f.Close()
+
+			v, _ := openImage(t, imagePath)
+			if v.Type != tt.opts.Type {
+				t.Errorf("Expected %v, got %v", tt.opts.Type, v.Type)
+			}
+			if v.ClusterSize() != tt.clusterSize {
+				t.Errorf("Expected %d byte clusters, got %d", tt.clusterSize, v.ClusterSize())
+			}
+			wantLabel := strings.ToUpper(tt.opts.Label)
+			if wantLabel == "" {
+				wantLabel = "NO NAME"
+			}
+			if v.Label != wantLabel {
+				t.Errorf("Expected label %q, got %q", wantLabel, v.Label)
+			}
+			entries, err := v.ReadDir("/")
+			if err != nil {
+				t.Fatalf("ReadDir failed: %v", err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("Expected an empty root directory, got %v", names(entries))
+			}
+		})
+	}
+
+	// FAT16 can't address this many 512 byte clusters
+	f, err := os.Create(filepath.Join(t.TempDir(), "big.img"))
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	defer f.Close()
+	if err := Format(f, 0, 64*1024*1024, FormatOptions{Type: FAT16, ClusterSize: 512}); !errors.Is(err, ErrInvalidFormat) {
+		t.Errorf("Expected ErrInvalidFormat, got %v", err)
+	}
+	if err := Format(f, 0, 10*1024*1024, FormatOptions{Type: FAT32, Label: "MUCH TOO LONG"}); !errors.Is(err, ErrInvalidFormat) {
+		t.Errorf("Expected ErrInvalidFormat, got %v", err)
+	}
+}
+
+// zeroReader delivers an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// freeClusters counts the free clusters of a volume
+func freeClusters(v *Volume) int {
+	free := 0
+	for c := uint32(2); c < uint32(len(v.table)); c++ {
+		if v.table[c] == 0 {
+			free++
+		}
+	}
+	return free
+}
+
+func TestClear(t *testing.T) {
+	imagePath := createImage(t, "/rose.dst", "/Flowers/tulip.pes", "/Flowers/daisy.pes")
+	v, _ := openImage(t, imagePath)
+	volumeID := v.VolumeID
+
+	if err := v.Clear(); err != nil {
+		t.Fatalf("Clear failed: %v", err)
+	}
+
+	v, _ = openImage(t, imagePath)
+	entries, err := v.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected an empty root directory, got %v", names(entries))
+	}
+	if v.Label != "EMBROIDERY" || v.VolumeID != volumeID {
+		t.Errorf("Expected label and serial to be kept, got %q %08x", v.Label, v.VolumeID)
+	}
+	if free := freeClusters(v); free != int(v.ClusterCount())-1 {
+		t.Errorf("Expected every cluster but the root to be free, %d of %d free", free, v.ClusterCount())
+	}
+
+	// go-diskfs can still use the cleared volume
+	d, err := diskfs.Open(imagePath)
+	if err != nil {
+		t.Fatalf("Failed to open cleared image: %v", err)
+	}
+	defer d.Close()
+	fs, err := d.GetFilesystem(0)
+	if err != nil {
+		t.Fatalf("Failed to read cleared filesystem: %v", err)
+	}
+	f, err := fs.OpenFile("/new.dst", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("Failed to create file on cleared volume: %v", err)
+	}
+	f.Close()
+}
+
+func TestClearDir(t *testing.T) {
+	imagePath := createImage(t, "/rose.dst", "/Flowers/tulip.pes", "/Flowers/daisy.pes")
+	v, _ := openImage(t, imagePath)
+	before := freeClusters(v)
+
+	if err := v.ClearDir("/Flowers"); err != nil {
+		t.Fatalf("ClearDir failed: %v", err)
+	}
+
+	v, _ = openImage(t, imagePath)
+	if got := names(mustReadDir(t, v, "/")); !equal(got, []string{"rose.dst", "Flowers"}) {
+		t.Errorf("Expected root to be untouched, got %v", got)
+	}
+	if got := mustReadDir(t, v, "/Flowers"); len(got) != 0 {
+		t.Errorf("Expected /Flowers to be empty, got %v", names(got))
+	}
+	if after := freeClusters(v); after != before+2 {
+		t.Errorf("Expected 2 clusters to be freed, %d free before and %d after", before, after)
+	}
+	if data, err := v.ReadFile("/rose.dst"); err != nil || string(data) != "/rose.dst" {
+		t.Errorf("Expected rose.dst to be kept, got %q, %v", data, err)
+	}
+
+	if err := v.ClearDir("/rose.dst"); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("Expected ErrNotDirectory, got %v", err)
+	}
+}
+
+func mustReadDir(t *testing.T, v *Volume, dirPath string) []DirEntry {
+	t.Helper()
+	entries, err := v.ReadDir(dirPath)
+	if err != nil {
+		t.Fatalf("ReadDir %s failed: %v", dirPath, err)
+	}
+	return entries
+}
+
+func TestCheckRepair(t *testing.T) {
+	imagePath := createImage(t, "/rose.dst", "/Flowers/tulip.pes", "/Flowers/daisy.pes")
+	v, f := openImage(t, imagePath)
+
+	report, err := v.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !report.Clean() || report.Files != 3 || report.Directories != 1 {
+		t.Fatalf("Expected a clean volume with 3 files and 1 directory, got %+v", report)
+	}
+
+	// Corrupt the volume: rose.dst's chain runs into tulip.pes, a free cluster
+	// is allocated without an owner, and the second FAT is out of date
+	rose, err := v.Lookup("/rose.dst")
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	tulip, err := v.Lookup("/Flowers/tulip.pes")
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	v.table[rose.Cluster] = tulip.Cluster
+	lost := v.ClusterCount()
+	v.table[lost] = v.eoc()
+	if err := v.flushTable(); err != nil {
+		t.Fatalf("flushTable failed: %v", err)
+	}
+	fatSize := int64(v.SectorsPerFAT) * int64(v.BytesPerSector)
+	if _, err := f.WriteAt(make([]byte, 4), v.offset+v.fatStart+fatSize+int64(lost)*4); err != nil {
+		t.Fatalf("Failed to corrupt FAT 2: %v", err)
+	}
+
+	v, _ = openImage(t, imagePath)
+	report, err = v.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	kinds := make(map[ProblemKind]bool)
+	for _, p := range report.Problems {
+		kinds[p.Kind] = true
+	}
+	for _, kind := range []ProblemKind{ProblemFATMismatch, ProblemCrossLinked, ProblemSizeMismatch, ProblemLostClusters} {
+		if !kinds[kind] {
+			t.Errorf("Expected a %s problem, got %+v", kind, report.Problems)
+		}
+	}
+	if report.LostClusters != 1 || report.Repaired {
+		t.Errorf("Expected 1 lost cluster and no repair, got %+v", report)
+	}
+
+	// Check doesn't change anything
+	v, _ = openImage(t, imagePath)
+	if again, _ := v.Check(); len(again.Problems) != len(report.Problems) {
+		t.Errorf("Expected Check to leave the volume alone, got %+v", again.Problems)
+	}
+
+	report, err = v.Repair()
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if !report.Repaired {
+		t.Errorf("Expected Repaired to be set, got %+v", report)
+	}
+
+	v, _ = openImage(t, imagePath)
+	report, err = v.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !report.Clean() {
+		t.Errorf("Expected a clean volume after repair, got %+v", report.Problems)
+	}
+	data, err := v.ReadFile("/rose.dst")
+	if err != nil || string(data) != "/rose.dst" {
+		t.Errorf("Expected rose.dst to survive the repair, got %q, %v", data, err)
+	}
+	// Fitting rose.dst to its size gave the shared cluster back to tulip.pes
+	data, err = v.ReadFile("/Flowers/tulip.pes")
+	if err != nil || string(data) != "/Flowers/tulip.pes" {
+		t.Errorf("Expected tulip.pes to survive the repair, got %q, %v", data, err)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	formatted := func(t *testing.T, opts FormatOptions, size int64) string {
+		imagePath := filepath.Join(t.TempDir(), "test.img")
+		f, err := os.Create(imagePath)
+		if err != nil {
+			t.Fatalf("Failed to create image: %v", err)
+		}
+		defer f.Close()
+		if err := f.Truncate(size); err != nil {
+			t.Fatalf("Failed to size image: %v", err)
+		}
+		if err := Format(f, 0, size, opts); err != nil {
+			t.Fatalf("Format failed: %v", err)
+		}
+		return imagePath
+	}
+
+	tests := []struct {
+		name  string
+		image func(t *testing.T) string
+	}{
+		{"go-diskfs fat32", func(t *testing.T) string { return createImage(t, "/existing.dst") }},
+		{"fat16", func(t *testing.T) string {
+			return formatted(t, FormatOptions{Type: FAT16, Label: "EMBROIDERY"}, 10*1024*1024)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imagePath := tt.image(t)
+			v, _ := openImage(t, imagePath)
+			freeBefore := freeClusters(v)
+			now := time.Date(2025, 3, 14, 15, 9, 26, 0, time.Local)
+
+			big := bytes.Repeat([]byte("stitch"), 3*v.ClusterSize()/2)
+			files := map[string][]byte{
+				"/rose.dst":                     []byte("rose"),
+				"/Designs/Long Name Rose.pes":   big,
+				"/Designs/Long Name Rose 2.pes": []byte("second"),
+				"/Designs/Seasonal/tulip.jef":   []byte("tulip"),
+				"/empty.pes":                    {},
+			}
+			// In a fixed order, so directory entries land in a known order
+			for _, name := range []string{"/rose.dst", "/Designs/Long Name Rose.pes",
+				"/Designs/Long Name Rose 2.pes", "/Designs/Seasonal/tulip.jef", "/empty.pes"} {
+				data := files[name]
+				if err := v.WriteFile(name, bytes.NewReader(data), int64(len(data)), now); err != nil {
+					t.Fatalf("WriteFile %s failed: %v", name, err)
+				}
+			}
+
+			// Replacing keeps one entry; the size is only a hint
+			files["/rose.dst"] = []byte("a longer rose")
+			if err := v.WriteFile("/ROSE.DST", io.MultiReader(bytes.NewReader(files["/rose.dst"])), -1, now); err != nil {
+				t.Fatalf("WriteFile replacing rose.dst failed: %v", err)
+			}
+			if err := v.Flush(); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+
+			v, _ = openImage(t, imagePath)
+			for name, data := range files {
+				got, err := v.ReadFile(name)
+				if err != nil || !bytes.Equal(got, data) {
+					t.Errorf("Expected %s to hold %d bytes, got %d, %v", name, len(data), len(got), err)
+				}
+			}
+			rose, _ := v.Lookup("/rose.dst")
+			if rose.Name != "rose.dst" || !rose.ModTime.Equal(now) {
+				t.Errorf("Expected rose.dst modified %v, got %q %v", now, rose.Name, rose.ModTime)
+			}
+			var shorts []string
+			for _, e := range mustReadDir(t, v, "/Designs") {
+				shorts = append(shorts, e.ShortName)
+			}
+			if !equal(shorts, []string{"LONGNA~1.PES", "LONGNA~2.PES", "SEASONAL"}) {
+				t.Errorf("Expected unique short names, got %v", shorts)
+			}
+			if report, err := v.Check(); err != nil || !report.Clean() {
+				t.Errorf("Expected a clean volume, got %+v, %v", report.Problems, err)
+			}
+
+			// Removing everything gives every cluster back
+			for _, name := range []string{"/rose.dst", "/empty.pes", "/Designs/Long Name Rose.pes",
+				"/Designs/Long Name Rose 2.pes", "/Designs/Seasonal/tulip.jef", "/Designs/Seasonal", "/Designs"} {
+				if err := v.Remove(name); err != nil {
+					t.Fatalf("Remove %s failed: %v", name, err)
+				}
+			}
+			if err := v.Remove("/missing.pes"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected ErrNotFound, got %v", err)
+			}
+			if free := freeClusters(v); free != freeBefore {
+				t.Errorf("Expected %d free clusters after removing everything, got %d", freeBefore, free)
+			}
+
+			// A size that doesn't fit is only an upper bound for the data
+			tooBig := int64(v.ClusterCount()+1) * int64(v.ClusterSize())
+			if err := v.WriteFile("/small.bin", strings.NewReader("small"), tooBig, now); err != nil {
+				t.Errorf("Expected an oversized size hint to be ignored, got %v", err)
+			}
+			if err := v.Remove("/small.bin"); err != nil {
+				t.Fatalf("Remove failed: %v", err)
+			}
+
+			// Data that doesn't fit is refused and its clusters freed
+			huge := io.LimitReader(zeroReader{}, tooBig)
+			if err := v.WriteFile("/huge.bin", huge, -1, now); !errors.Is(err, ErrNoSpace) {
+				t.Errorf("Expected ErrNoSpace, got %v", err)
+			}
+			if free := freeClusters(v); free != freeBefore {
+				t.Errorf("Expected a refused write to free its clusters, %d free", free)
+			}
+		})
+	}
+
+	// go-diskfs reads what the writer wrote
+	imagePath := createImage(t)
+	v, _ := openImage(t, imagePath)
+	if err := v.WriteFile("/Designs/Long Name Rose.pes", strings.NewReader("rose"), 4, time.Now()); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := v.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	d, err := diskfs.Open(imagePath)
+	if err != nil {
+		t.Fatalf("Failed to open image: %v", err)
+	}
+	defer d.Close()
+	fs, err := d.GetFilesystem(0)
+	if err != nil {
+		t.Fatalf("Failed to read filesystem: %v", err)
+	}
+	f, err := fs.OpenFile("/Designs/Long Name Rose.pes", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("go-diskfs failed to open the file: %v", err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil || string(data) != "rose" {
+		t.Errorf("Expected go-diskfs to read %q, got %q, %v", "rose", data, err)
+	}
+}
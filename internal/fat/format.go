@@ -0,0 +1,323 @@
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrInvalidFormat = errors.New("invalid format options")
+
+// FormatOptions describes a volume to create with Format
+type FormatOptions struct {
+	Type Type
+
+	// ClusterSize in bytes, a power of two from 512 to 65536. 0 picks a size
+	// based on the volume size.
+	ClusterSize int
+
+	// Label is the volume label, up to 11 characters
+	Label string
+
+	// HiddenSectors is the number of sectors before the volume, i.e. its start
+	// sector when it lives in a partition
+	HiddenSectors uint32
+}
+
+const (
+	formatSectorSize = 512
+
+	fat16ReservedSectors = 1
+	fat16RootEntries     = 512
+	fat32ReservedSectors = 32
+	fat32FSInfoSector    = 1
+	fat32BackupBoot      = 6
+
+	// Cluster count limits that decide the FAT type
+	fat16MinClusters = 4085
+	fat16MaxClusters = 65524
+	fat32MaxClusters = 0x0FFFFFF5
+
+	mediaFixed = 0xF8
+)
+
+// layout is the computed geometry of a volume to format
+type layout struct {
+	totalSectors      uint32
+	sectorsPerCluster int
+	reservedSectors   int
+	rootEntries       int
+	sectorsPerFAT     uint32
+	clusters          uint32
+}
+
+// Format writes an empty FAT16 or FAT32 filesystem of size bytes at offset.
+// Everything the filesystem uses is overwritten, so the device may hold old data.
+func Format(dev Device, offset, size int64, opts FormatOptions) error {
+	label, err := formatLabel(opts.Label)
+	if err != nil {
+		return err
+	}
+	l, err := computeLayout(opts, size)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	volumeID := uint32(now.Unix()<<20 | int64(now.Nanosecond()/1000000))
+
+	bs := bootSector(opts, l, label, volumeID)
+
+	// Clear the reserved area, FATs and root directory
+	rootDirSectors := (l.rootEntries*dirEntrySize + formatSectorSize - 1) / formatSectorSize
+	metaSectors := int64(l.reservedSectors) + 2*int64(l.sectorsPerFAT) + int64(rootDirSectors)
+	if opts.Type == FAT32 {
+		metaSectors += int64(l.sectorsPerCluster) // root directory cluster
+	}
+	if err := zeroRange(dev, offset, metaSectors*formatSectorSize); err != nil {
+		return err
+	}
+
+	if _, err := dev.WriteAt(bs, offset); err != nil {
+		return fmt.Errorf("failed to write boot sector: %w", err)
+	}
+	if opts.Type == FAT32 {
+		info := fsInfoSector(l.clusters - 1)
+		for _, sector := range []int64{fat32FSInfoSector, fat32BackupBoot + fat32FSInfoSector} {
+			if _, err := dev.WriteAt(info, offset+sector*formatSectorSize); err != nil {
+				return fmt.Errorf("failed to write FSInfo sector: %w", err)
+			}
+		}
+		if _, err := dev.WriteAt(bs, offset+fat32BackupBoot*formatSectorSize); err != nil {
+			return fmt.Errorf("failed to write backup boot sector: %w", err)
+		}
+	}
+
+	// The first entries of each FAT hold the media byte and end-of-chain
+	// markers; on FAT32 cluster 2 is the root directory
+	var head []byte
+	if opts.Type == FAT32 {
+		head = make([]byte, 12)
+		binary.LittleEndian.PutUint32(head[0:], 0x0FFFFF00|mediaFixed)
+		binary.LittleEndian.PutUint32(head[4:], 0x0FFFFFFF)
+		binary.LittleEndian.PutUint32(head[8:], 0x0FFFFFFF)
+	} else {
+		head = make([]byte, 4)
+		binary.LittleEndian.PutUint16(head[0:], 0xFF00|mediaFixed)
+		binary.LittleEndian.PutUint16(head[2:], 0xFFFF)
+	}
+	fatStart := offset + int64(l.reservedSectors)*formatSectorSize
+	for i := int64(0); i < 2; i++ {
+		if _, err := dev.WriteAt(head, fatStart+i*int64(l.sectorsPerFAT)*formatSectorSize); err != nil {
+			return fmt.Errorf("failed to write FAT: %w", err)
+		}
+	}
+
+	// The volume label is also stored as the first root directory entry
+	if label != "           " {
+		entry := make([]byte, dirEntrySize)
+		copy(entry, label)
+		entry[11] = attrVolumeID
+		putFATTime(entry, now)
+		rootStart := fatStart + 2*int64(l.sectorsPerFAT)*formatSectorSize
+		if _, err := dev.WriteAt(entry, rootStart); err != nil {
+			return fmt.Errorf("failed to write volume label: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// computeLayout picks the cluster size and FAT size for a volume
+func computeLayout(opts FormatOptions, size int64) (layout, error) {
+	if size/formatSectorSize > 0xFFFFFFFF {
+		return layout{}, fmt.Errorf("%w: volume of %d bytes is too large", ErrInvalidFormat, size)
+	}
+	l := layout{totalSectors: uint32(size / formatSectorSize)}
+
+	switch opts.Type {
+	case FAT16:
+		l.reservedSectors = fat16ReservedSectors
+		l.rootEntries = fat16RootEntries
+	case FAT32:
+		l.reservedSectors = fat32ReservedSectors
+	default:
+		return layout{}, fmt.Errorf("%w: unsupported FAT type %d", ErrInvalidFormat, int(opts.Type))
+	}
+
+	clusterSize := opts.ClusterSize
+	if clusterSize == 0 {
+		clusterSize = defaultClusterSize(opts.Type, size)
+	}
+	if clusterSize < formatSectorSize || clusterSize > 65536 || clusterSize&(clusterSize-1) != 0 {
+		return layout{}, fmt.Errorf("%w: cluster size %d must be a power of two from 512 to 65536", ErrInvalidFormat, clusterSize)
+	}
+	l.sectorsPerCluster = clusterSize / formatSectorSize
+
+	// Size the FAT for every cluster that could fit without it; this slightly
+	// overestimates, which only costs a few unused FAT sectors
+	entrySize := int64(2)
+	if opts.Type == FAT32 {
+		entrySize = 4
+	}
+	rootDirSectors := int64(l.rootEntries*dirEntrySize+formatSectorSize-1) / formatSectorSize
+	available := int64(l.totalSectors) - int64(l.reservedSectors) - rootDirSectors
+	maxClusters := available / int64(l.sectorsPerCluster)
+	l.sectorsPerFAT = uint32(((maxClusters+2)*entrySize + formatSectorSize - 1) / formatSectorSize)
+
+	dataSectors := available - 2*int64(l.sectorsPerFAT)
+	if dataSectors <= 0 {
+		return layout{}, fmt.Errorf("%w: volume of %d bytes is too small", ErrInvalidFormat, size)
+	}
+	clusters := dataSectors / int64(l.sectorsPerCluster)
+
+	switch opts.Type {
+	case FAT16:
+		if clusters < fat16MinClusters || clusters > fat16MaxClusters {
+			return layout{}, fmt.Errorf("%w: FAT16 needs %d to %d clusters, %d bytes with %d byte clusters gives %d",
+				ErrInvalidFormat, fat16MinClusters, fat16MaxClusters, size, clusterSize, clusters)
+		}
+	case FAT32:
+		if clusters < 1 || clusters > fat32MaxClusters {
+			return layout{}, fmt.Errorf("%w: %d bytes with %d byte clusters gives %d clusters",
+				ErrInvalidFormat, size, clusterSize, clusters)
+		}
+	}
+	l.clusters = uint32(clusters)
+	return l, nil
+}
+
+// defaultClusterSize follows the sizes Windows picks when formatting
+func defaultClusterSize(t Type, size int64) int {
+	const mb = 1024 * 1024
+	if t == FAT16 {
+		switch {
+		case size <= 16*mb:
+			return 1024
+		case size <= 128*mb:
+			return 2048
+		case size <= 256*mb:
+			return 4096
+		case size <= 512*mb:
+			return 8192
+		case size <= 1024*mb:
+			return 16384
+		case size <= 2048*mb:
+			return 32768
+		default:
+			return 65536
+		}
+	}
+	switch {
+	case size <= 260*mb:
+		return 512
+	case size <= 8192*mb:
+		return 4096
+	case size <= 16384*mb:
+		return 8192
+	case size <= 32768*mb:
+		return 16384
+	default:
+		return 32768
+	}
+}
+
+// formatLabel converts a label to the upper case, space padded on-disk form
+func formatLabel(label string) (string, error) {
+	label = strings.ToUpper(strings.TrimSpace(label))
+	if len(label) > 11 {
+		return "", fmt.Errorf("%w: label %q is longer than 11 characters", ErrInvalidFormat, label)
+	}
+	for _, c := range label {
+		if c < 0x20 || c > 0x7E || strings.ContainsRune(`"*+,./:;<=>?[\]|`, c) {
+			return "", fmt.Errorf("%w: label %q contains %q", ErrInvalidFormat, label, c)
+		}
+	}
+	return label + strings.Repeat(" ", 11-len(label)), nil
+}
+
+// bootSector builds the boot sector of a new volume
+func bootSector(opts FormatOptions, l layout, label string, volumeID uint32) []byte {
+	bs := make([]byte, formatSectorSize)
+
+	// Many embedded FAT drivers only accept volumes that look like Windows made them
+	copy(bs[0x03:], "MSWIN4.1")
+	binary.LittleEndian.PutUint16(bs[0x0B:], formatSectorSize)
+	bs[0x0D] = byte(l.sectorsPerCluster)
+	binary.LittleEndian.PutUint16(bs[0x0E:], uint16(l.reservedSectors))
+	bs[0x10] = 2
+	binary.LittleEndian.PutUint16(bs[0x11:], uint16(l.rootEntries))
+	if opts.Type == FAT16 && l.totalSectors < 0x10000 {
+		binary.LittleEndian.PutUint16(bs[0x13:], uint16(l.totalSectors))
+	} else {
+		binary.LittleEndian.PutUint32(bs[0x20:], l.totalSectors)
+	}
+	bs[0x15] = mediaFixed
+	binary.LittleEndian.PutUint16(bs[0x18:], 63)  // sectors per track
+	binary.LittleEndian.PutUint16(bs[0x1A:], 255) // heads
+	binary.LittleEndian.PutUint32(bs[0x1C:], opts.HiddenSectors)
+
+	ebr := 0x24
+	if opts.Type == FAT32 {
+		bs[0], bs[1], bs[2] = 0xEB, 0x58, 0x90
+		binary.LittleEndian.PutUint32(bs[0x24:], l.sectorsPerFAT)
+		binary.LittleEndian.PutUint32(bs[0x2C:], 2) // root directory cluster
+		binary.LittleEndian.PutUint16(bs[0x30:], fat32FSInfoSector)
+		binary.LittleEndian.PutUint16(bs[0x32:], fat32BackupBoot)
+		ebr = 0x40
+	} else {
+		bs[0], bs[1], bs[2] = 0xEB, 0x3C, 0x90
+		binary.LittleEndian.PutUint16(bs[0x16:], uint16(l.sectorsPerFAT))
+	}
+
+	bs[ebr] = 0x80   // drive number
+	bs[ebr+2] = 0x29 // extended boot signature
+	binary.LittleEndian.PutUint32(bs[ebr+3:], volumeID)
+	if strings.TrimSpace(label) == "" {
+		copy(bs[ebr+7:], "NO NAME    ")
+	} else {
+		copy(bs[ebr+7:], label)
+	}
+	copy(bs[ebr+18:], fmt.Sprintf("%-8s", opts.Type.String()))
+
+	bs[510], bs[511] = 0x55, 0xAA
+	return bs
+}
+
+// fsInfoSector builds the FAT32 FSInfo sector
+func fsInfoSector(free uint32) []byte {
+	s := make([]byte, formatSectorSize)
+	binary.LittleEndian.PutUint32(s[0x000:], 0x41615252)
+	binary.LittleEndian.PutUint32(s[0x1E4:], 0x61417272)
+	binary.LittleEndian.PutUint32(s[0x1E8:], free)
+	binary.LittleEndian.PutUint32(s[0x1EC:], 3) // next free cluster hint
+	binary.LittleEndian.PutUint32(s[0x1FC:], 0xAA550000)
+	return s
+}
+
+// putFATTime stores t as the modification time of a directory entry
+func putFATTime(entry []byte, t time.Time) {
+	date := uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+	tm := uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	binary.LittleEndian.PutUint16(entry[22:], tm)
+	binary.LittleEndian.PutUint16(entry[24:], date)
+}
+
+// zeroRange writes zeros over length bytes at offset
+func zeroRange(dev Device, offset, length int64) error {
+	buf := make([]byte, 64*1024)
+	for length > 0 {
+		n := int64(len(buf))
+		if length < n {
+			n = length
+		}
+		if _, err := dev.WriteAt(buf[:n], offset); err != nil {
+			return fmt.Errorf("failed to clear volume metadata: %w", err)
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
@@ -0,0 +1,616 @@
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+var (
+	ErrNoSpace     = errors.New("no space left on volume")
+	ErrExists      = errors.New("path already exists")
+	ErrInvalidName = errors.New("invalid file name")
+	ErrNotEmpty    = errors.New("directory not empty")
+)
+
+// writeBufferSize is how much file data is read before it is written out.
+// Freshly allocated clusters are usually contiguous, so each buffer goes to
+// the device in a single write.
+const writeBufferSize = 1024 * 1024
+
+// maxLongName is the longest name a long name entry can hold, in UTF-16 units
+const maxLongName = 255
+
+// WriteFile creates or replaces a file with the contents of r, creating parent
+// directories as needed. size is used to allocate the clusters up front when
+// that many are free, and may be -1 if unknown or an upper bound for streamed
+// data; the file holds whatever r delivers either way.
+//
+// File data and directory entries are written straight to the device, but
+// changes to the FAT stay in memory until Flush.
+func (v *Volume) WriteFile(p string, r io.Reader, size int64, modTime time.Time) error {
+	p = path.Clean("/" + p)
+	parentPath, name := path.Split(p)
+	if name == "" {
+		return fmt.Errorf("%w: %q", ErrInvalidName, p)
+	}
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+
+	parent, err := v.mkdirAll(path.Clean(parentPath), modTime)
+	if err != nil {
+		return err
+	}
+
+	// Write the data before touching the directory, so a failed write leaves
+	// any existing file intact
+	first, written, err := v.writeData(r, size)
+	if err != nil {
+		return err
+	}
+	if written > 0xFFFFFFFF {
+		v.freeChain(first)
+		return fmt.Errorf("%w: %s is larger than 4GB", ErrNoSpace, p)
+	}
+
+	raw, clusters, err := v.readDirRaw(parent)
+	if err != nil {
+		v.freeChain(first)
+		return err
+	}
+	old, replace := findEntry(raw, name)
+	if replace {
+		if old.IsDir() {
+			v.freeChain(first)
+			return fmt.Errorf("%w: %s is a directory", ErrExists, p)
+		}
+		// Like vfat, replacing a file keeps its name as it was spelled
+		name = old.Name
+		deleteEntry(raw, old)
+	}
+
+	err = v.addEntry(parent, raw, clusters, name, 0, first, uint32(written), modTime)
+	if err != nil {
+		v.freeChain(first)
+		return err
+	}
+
+	// The old contents are only released once the new entry is written
+	if replace {
+		v.freeChain(old.Cluster)
+	}
+	return nil
+}
+
+// Mkdir creates a directory and any missing parents. Existing directories are
+// left alone.
+func (v *Volume) Mkdir(dirPath string, modTime time.Time) error {
+	_, err := v.mkdirAll(path.Clean("/"+dirPath), modTime)
+	return err
+}
+
+// Remove deletes a file or an empty directory and frees its clusters
+func (v *Volume) Remove(p string) error {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return fmt.Errorf("%w: cannot remove the root directory", ErrInvalidName)
+	}
+	parentPath, name := path.Split(p)
+
+	parent, err := v.lookupDir(parentPath)
+	if err != nil {
+		return err
+	}
+	raw, clusters, err := v.readDirRaw(parent)
+	if err != nil {
+		return err
+	}
+	e, ok := findEntry(raw, name)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, p)
+	}
+
+	if e.IsDir() {
+		children, _, err := v.readDirRaw(dir{cluster: e.Cluster})
+		if err != nil {
+			return err
+		}
+		for _, child := range parseDir(children) {
+			if !child.isDotEntry() {
+				return fmt.Errorf("%w: %s", ErrNotEmpty, p)
+			}
+		}
+	}
+
+	deleteEntry(raw, e)
+	if err := v.writeDirRaw(parent, raw, clusters); err != nil {
+		return err
+	}
+	v.freeChain(e.Cluster)
+	return nil
+}
+
+// Flush writes the in-memory FAT to every FAT copy and updates the free
+// cluster count
+func (v *Volume) Flush() error {
+	return v.flushTable()
+}
+
+// mkdirAll resolves a directory path, creating the directories that are missing
+func (v *Volume) mkdirAll(dirPath string, modTime time.Time) (dir, error) {
+	current := dir{cluster: 0}
+	if dirPath == "/" {
+		return current, nil
+	}
+
+	for _, name := range strings.Split(strings.Trim(dirPath, "/"), "/") {
+		raw, clusters, err := v.readDirRaw(current)
+		if err != nil {
+			return dir{}, err
+		}
+		if e, ok := findEntry(raw, name); ok {
+			if !e.IsDir() {
+				return dir{}, fmt.Errorf("%w: %s", ErrNotDirectory, name)
+			}
+			current = dir{cluster: e.Cluster}
+			continue
+		}
+
+		created, err := v.createDir(current, raw, clusters, name, modTime)
+		if err != nil {
+			return dir{}, err
+		}
+		current = created
+	}
+	return current, nil
+}
+
+// createDir adds a subdirectory to parent, whose slots were read into raw
+func (v *Volume) createDir(parent dir, raw []byte, clusters []uint32, name string, modTime time.Time) (dir, error) {
+	if err := ValidateName(name); err != nil {
+		return dir{}, err
+	}
+
+	allocated, err := v.allocate(0, 1)
+	if err != nil {
+		return dir{}, err
+	}
+	cluster := allocated[0]
+
+	// A new directory holds only "." and ".."
+	data := make([]byte, v.clusterSize)
+	dot := data[0:dirEntrySize]
+	copy(dot, ".          ")
+	putShortEntry(dot, attrDirectory, 0, cluster, 0, modTime)
+	dotdot := data[dirEntrySize : 2*dirEntrySize]
+	copy(dotdot, "..         ")
+	putShortEntry(dotdot, attrDirectory, 0, parent.cluster, 0, modTime)
+	if err := v.writeClusters(allocated, data); err != nil {
+		v.freeChain(cluster)
+		return dir{}, err
+	}
+
+	if err := v.addEntry(parent, raw, clusters, name, attrDirectory, cluster, 0, modTime); err != nil {
+		v.freeChain(cluster)
+		return dir{}, err
+	}
+	return dir{cluster: cluster}, nil
+}
+
+// writeData writes the contents of r to newly allocated clusters and returns
+// the first cluster (0 for an empty file) and the number of bytes written
+func (v *Volume) writeData(r io.Reader, size int64) (uint32, int64, error) {
+	clusterSize := int64(v.clusterSize)
+
+	// Preallocate the whole file when its size is known so the clusters are
+	// contiguous. Callers streaming data of unknown length pass an upper bound
+	// that may not fit; then clusters are allocated as the data arrives and
+	// ErrNoSpace only comes once the data itself runs out of room.
+	var clusters []uint32
+	if size > 0 {
+		clusters, _ = v.allocate(0, int((size+clusterSize-1)/clusterSize))
+	}
+	fail := func(err error) (uint32, int64, error) {
+		if len(clusters) > 0 {
+			v.freeChain(clusters[0])
+		}
+		return 0, 0, err
+	}
+
+	bufferSize := (writeBufferSize + clusterSize - 1) / clusterSize * clusterSize
+	buf := make([]byte, bufferSize)
+	used := 0
+	var written int64
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			need := int((int64(n) + clusterSize - 1) / clusterSize)
+			if used+need > len(clusters) {
+				var prev uint32
+				if len(clusters) > 0 {
+					prev = clusters[len(clusters)-1]
+				}
+				more, err := v.allocate(prev, used+need-len(clusters))
+				if err != nil {
+					return fail(err)
+				}
+				clusters = append(clusters, more...)
+			}
+
+			chunk := buf[:int64(need)*clusterSize]
+			clear(chunk[n:])
+			if err := v.writeRuns(clusters[used:used+need], chunk); err != nil {
+				return fail(err)
+			}
+			used += need
+			written += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return fail(fmt.Errorf("failed to read file data: %w", readErr))
+		}
+	}
+
+	// Give back what the size overestimated
+	if used < len(clusters) {
+		if used == 0 {
+			return fail(nil)
+		}
+		for _, c := range clusters[used:] {
+			v.table[c] = 0
+		}
+		v.table[clusters[used-1]] = v.eoc()
+		clusters = clusters[:used]
+	}
+
+	if used == 0 {
+		return 0, 0, nil
+	}
+	return clusters[0], written, nil
+}
+
+// writeRuns writes data across clusters, one device write per run of
+// consecutive clusters
+func (v *Volume) writeRuns(clusters []uint32, data []byte) error {
+	for start := 0; start < len(clusters); {
+		end := start + 1
+		for end < len(clusters) && clusters[end] == clusters[end-1]+1 {
+			end++
+		}
+		chunk := data[start*v.clusterSize : end*v.clusterSize]
+		if _, err := v.dev.WriteAt(chunk, v.clusterOffset(clusters[start])); err != nil {
+			return fmt.Errorf("failed to write cluster %d: %w", clusters[start], err)
+		}
+		start = end
+	}
+	return nil
+}
+
+// allocate claims n free clusters and links them into a chain, appended to the
+// chain ending at prev unless prev is 0. Free clusters are taken in order from
+// just after prev (or where the last allocation stopped), so they are
+// contiguous whenever the free space is.
+func (v *Volume) allocate(prev uint32, n int) ([]uint32, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	start := v.nextFree
+	if v.validCluster(prev + 1) {
+		start = prev + 1
+	}
+	if !v.validCluster(start) {
+		start = 2
+	}
+
+	clusters := make([]uint32, 0, n)
+	limit := v.clusterCount + 2
+	for i, c := uint32(0), start; i < v.clusterCount && len(clusters) < n; i++ {
+		if v.table[c] == 0 {
+			clusters = append(clusters, c)
+		}
+		c++
+		if c == limit {
+			c = 2
+		}
+	}
+	if len(clusters) < n {
+		return nil, fmt.Errorf("%w: %d clusters needed, %d free", ErrNoSpace, n, len(clusters))
+	}
+
+	for i, c := range clusters {
+		if i+1 < len(clusters) {
+			v.table[c] = clusters[i+1]
+		} else {
+			v.table[c] = v.eoc()
+		}
+	}
+	if prev != 0 {
+		v.table[prev] = clusters[0]
+	}
+	v.nextFree = clusters[len(clusters)-1] + 1
+	return clusters, nil
+}
+
+// freeChain frees the cluster chain starting at first, as far as it is intact
+func (v *Volume) freeChain(first uint32) {
+	if first == 0 {
+		return
+	}
+	clusters, _ := v.chain(first)
+	for _, c := range clusters {
+		v.table[c] = 0
+	}
+}
+
+// addEntry adds an entry for name to a directory whose slots were read into
+// raw, growing the directory by a cluster if it is full
+func (v *Volume) addEntry(d dir, raw []byte, clusters []uint32, name string, attr byte, cluster, size uint32, modTime time.Time) error {
+	existing := make(map[string]bool)
+	for _, e := range parseDir(raw) {
+		short := raw[(e.slot+e.slots-1)*dirEntrySize:]
+		existing[string(short[:11])] = true
+	}
+	slots := entrySlots(name, existing)
+	short := slots[len(slots)-dirEntrySize:]
+	putShortEntry(short, attr, short[12], cluster, size, modTime)
+
+	n := len(slots) / dirEntrySize
+	pos := freeSlots(raw, n)
+	if pos < 0 {
+		if d.cluster == 0 && v.Type == FAT16 {
+			return fmt.Errorf("%w: the root directory is full", ErrNoSpace)
+		}
+		grow := (n*dirEntrySize + v.clusterSize - 1) / v.clusterSize
+		more, err := v.allocate(clusters[len(clusters)-1], grow)
+		if err != nil {
+			return err
+		}
+		clusters = append(clusters, more...)
+		raw = append(raw, make([]byte, grow*v.clusterSize)...)
+		pos = freeSlots(raw, n)
+	}
+
+	copy(raw[pos*dirEntrySize:], slots)
+	return v.writeDirRaw(d, raw, clusters)
+}
+
+// freeSlots returns the index of the first run of n free slots in raw, or -1
+func freeSlots(raw []byte, n int) int {
+	total := len(raw) / dirEntrySize
+	run := 0
+	for i := 0; i < total; i++ {
+		switch raw[i*dirEntrySize] {
+		case entryEnd:
+			// Everything from the end marker on is free
+			start := i - run
+			if start+n <= total {
+				return start
+			}
+			return -1
+		case entryFree:
+			run++
+			if run == n {
+				return i - n + 1
+			}
+		default:
+			run = 0
+		}
+	}
+	return -1
+}
+
+// findEntry looks up name in raw directory slots, ignoring case
+func findEntry(raw []byte, name string) (DirEntry, bool) {
+	for _, e := range parseDir(raw) {
+		if e.IsVolumeLabel() || e.isDotEntry() {
+			continue
+		}
+		if strings.EqualFold(e.Name, name) || strings.EqualFold(e.ShortName, name) {
+			return e, true
+		}
+	}
+	return DirEntry{}, false
+}
+
+// putShortEntry fills in the attributes, flags, cluster, size and times of a
+// short entry whose name is already set
+func putShortEntry(entry []byte, attr, ntFlags byte, cluster, size uint32, t time.Time) {
+	entry[11] = attr
+	entry[12] = ntFlags
+	binary.LittleEndian.PutUint16(entry[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(entry[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(entry[28:], size)
+
+	putFATTime(entry, t)
+	// Creation and access times match the modification time
+	entry[13] = 0
+	copy(entry[14:18], entry[22:26])
+	copy(entry[18:20], entry[24:26])
+}
+
+// entrySlots builds the directory slots for name: long name slots when the
+// name isn't a plain 8.3 name, followed by the short entry with its name and
+// NT case flags set. existing holds the short names already in the directory.
+func entrySlots(name string, existing map[string]bool) []byte {
+	short, flags, ok := plainShortName(name)
+	if ok && !existing[string(short[:])] {
+		slots := make([]byte, dirEntrySize)
+		copy(slots, short[:])
+		slots[12] = flags
+		return slots
+	}
+
+	short = generateShortName(name, existing)
+	checksum := shortNameChecksum(short[:])
+
+	units := utf16.Encode([]rune(name))
+	count := (len(units) + 12) / 13
+	slots := make([]byte, (count+1)*dirEntrySize)
+	for i := 0; i < count; i++ {
+		// Long name slots are stored last part first
+		slot := slots[(count-1-i)*dirEntrySize:]
+		slot[0] = byte(i + 1)
+		if i == count-1 {
+			slot[0] |= lastLongFlag
+		}
+		slot[11] = attrLongName
+		slot[13] = checksum
+
+		j := 0
+		for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+			for off := r[0]; off < r[1]; off += 2 {
+				unit := uint16(0xFFFF)
+				switch k := i*13 + j; {
+				case k < len(units):
+					unit = units[k]
+				case k == len(units):
+					unit = 0x0000
+				}
+				binary.LittleEndian.PutUint16(slot[off:], unit)
+				j++
+			}
+		}
+	}
+	copy(slots[count*dirEntrySize:], short[:])
+	return slots
+}
+
+// plainShortName returns the 8.3 name for names that need no long name: a
+// base of up to 8 and an extension of up to 3 valid characters, each either
+// all upper or all lower case (stored upper case with the NT lower case flags).
+func plainShortName(name string) ([11]byte, byte, bool) {
+	var short [11]byte
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	if len(base) == 0 || len(base) > 8 || len(ext) > 3 || (ext == "" && strings.HasSuffix(name, ".")) {
+		return short, 0, false
+	}
+
+	var flags byte
+	for _, part := range []struct {
+		s    string
+		flag byte
+	}{{base, ntLowerBase}, {ext, ntLowerExt}} {
+		upper, lower := false, false
+		for _, c := range part.s {
+			switch {
+			case c >= 'a' && c <= 'z':
+				lower = true
+			case c >= 'A' && c <= 'Z':
+				upper = true
+			case !validShortChar(c):
+				return short, 0, false
+			}
+		}
+		if upper && lower {
+			return short, 0, false
+		}
+		if lower {
+			flags |= part.flag
+		}
+	}
+
+	copy(short[:], fmt.Sprintf("%-8s%-3s", strings.ToUpper(base), strings.ToUpper(ext)))
+	if short[0] == entryFree {
+		short[0] = 0x05
+	}
+	return short, flags, true
+}
+
+// generateShortName derives a unique 8.3 alias for a long name the way
+// Windows does: invalid characters become "_", and a "~N" tail is added when
+// the name had to be shortened or the alias is taken
+func generateShortName(name string, existing map[string]bool) [11]byte {
+	clean := func(s string, max int) (string, bool) {
+		var b strings.Builder
+		lossy := false
+		for _, c := range strings.ToUpper(s) {
+			switch {
+			case c == ' ' || c == '.':
+				lossy = true
+				continue
+			case !validShortChar(c):
+				c = '_'
+				lossy = true
+			}
+			if b.Len() == max {
+				lossy = true
+				break
+			}
+			b.WriteRune(c)
+		}
+		return b.String(), lossy
+	}
+
+	trimmed := strings.TrimLeft(name, ". ")
+	base, ext := trimmed, ""
+	if i := strings.LastIndexByte(trimmed, '.'); i >= 0 {
+		base, ext = trimmed[:i], trimmed[i+1:]
+	}
+	baseName, baseLossy := clean(base, 8)
+	extName, extLossy := clean(ext, 3)
+	if baseName == "" {
+		baseName, baseLossy = "_", true
+	}
+
+	var short [11]byte
+	format := func(b string) {
+		copy(short[:], fmt.Sprintf("%-8s%-3s", b, extName))
+	}
+
+	format(baseName)
+	if !baseLossy && !extLossy && !existing[string(short[:])] {
+		return short
+	}
+	for n := 1; ; n++ {
+		tail := fmt.Sprintf("~%d", n)
+		prefix := baseName
+		if len(prefix) > 8-len(tail) {
+			prefix = prefix[:8-len(tail)]
+		}
+		format(prefix + tail)
+		if !existing[string(short[:])] {
+			return short
+		}
+	}
+}
+
+// validShortChar reports whether c may appear in an 8.3 name (upper case
+// letters and digits are checked by the caller's case handling)
+func validShortChar(c rune) bool {
+	switch {
+	case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		return true
+	case c > 0x7F:
+		return false
+	}
+	return strings.ContainsRune("!#$%&'()-@^_`{}~", c)
+}
+
+// ValidateName checks that a name can be stored as a long name. Errors wrap
+// ErrInvalidName.
+func ValidateName(name string) error {
+	if name == "." || name == ".." || strings.TrimRight(name, ". ") == "" {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	if len(utf16.Encode([]rune(name))) > maxLongName {
+		return fmt.Errorf("%w: %q is longer than %d characters", ErrInvalidName, name, maxLongName)
+	}
+	for _, c := range name {
+		if c < 0x20 || strings.ContainsRune(`"*/:<>?\|`, c) {
+			return fmt.Errorf("%w: %q contains %q", ErrInvalidName, name, c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+// Package filenames turns uploaded filenames into names embroidery machines can display.
+//
+// Many machines only show 8.3 names, choke on non-ASCII characters, or truncate long
+// names so that different designs collide on screen. A Policy describes what the
+// target machine can handle, and a Normalizer applies it to every file of an upload
+// while keeping track of the names already used on the disk.
+package filenames
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Mode selects how names are rewritten
+type Mode string
+
+const (
+	// ModePreserve keeps names as uploaded (only path separators and control characters are removed)
+	ModePreserve Mode = "preserve"
+
+	// ModeASCII transliterates names to printable ASCII
+	ModeASCII Mode = "ascii"
+
+	// ModeShort produces uppercase DOS 8.3 names (e.g., ROSE~1.DST)
+	ModeShort Mode = "8.3"
+)
+
+// Collision selects what happens when a stored name is already taken
+type Collision string
+
+const (
+	// CollisionOverwrite replaces the existing file
+	CollisionOverwrite Collision = "overwrite"
+
+	// CollisionRename adds a numeric suffix to the new file
+	CollisionRename Collision = "rename"
+)
+
+// Policy describes the filenames a machine can handle
+type Policy struct {
+	// Mode selects how names are rewritten
+	Mode Mode
+
+	// MaxLength limits the length of the name including the extension (0 for no limit).
+	// Ignored in ModeShort, which is always 8.3.
+	MaxLength int
+
+	// OnCollision selects what happens when the stored name already exists
+	OnCollision Collision
+}
+
+// DefaultPolicy keeps names as uploaded and overwrites existing files
+func DefaultPolicy() Policy {
+	return Policy{
+		Mode:        ModePreserve,
+		OnCollision: CollisionOverwrite,
+	}
+}
+
+// Validate checks the policy for unknown values
+func (p Policy) Validate() error {
+	switch p.Mode {
+	case ModePreserve, ModeASCII, ModeShort:
+	default:
+		return fmt.Errorf("unknown filename mode %q (use: preserve, ascii, 8.3)", p.Mode)
+	}
+	switch p.OnCollision {
+	case CollisionOverwrite, CollisionRename:
+	default:
+		return fmt.Errorf("unknown collision policy %q (use: overwrite, rename)", p.OnCollision)
+	}
+	if p.MaxLength < 0 {
+		return fmt.Errorf("max filename length must not be negative")
+	}
+	return nil
+}
+
+// Rename records how one uploaded file was stored
+type Rename struct {
+	Original string `json:"original"`
+	Stored   string `json:"stored"`
+}
+
+// ListFunc returns the names already present in a directory on the disk.
+// It should return an empty list (not an error) for directories that don't exist yet.
+type ListFunc func(dir string) ([]string, error)
+
+// Normalizer applies a Policy to the files of a single upload.
+// It remembers names handed out earlier in the same upload so files within a
+// ZIP archive can't collide with each other either.
+type Normalizer struct {
+	policy Policy
+	list   ListFunc
+
+	// taken maps a directory to the upper-cased names used in it (FAT is case-insensitive)
+	taken map[string]map[string]bool
+
+	// dirs maps original directory paths to their stored form so all files share one folder
+	dirs map[string]string
+}
+
+// NewNormalizer creates a normalizer for one upload
+func NewNormalizer(policy Policy, list ListFunc) *Normalizer {
+	return &Normalizer{
+		policy: policy,
+		list:   list,
+		taken:  make(map[string]map[string]bool),
+		dirs:   map[string]string{"/": "/"},
+	}
+}
+
+// Normalize maps an uploaded file path (e.g., "/Flowers/Rosé.dst") to the path it
+// should be stored under on the disk
+func (n *Normalizer) Normalize(filePath string) (string, error) {
+	filePath = path.Clean("/" + filePath)
+	dir, name := path.Split(filePath)
+
+	storedDir, err := n.directory(path.Clean(dir))
+	if err != nil {
+		return "", err
+	}
+
+	stored := n.name(name)
+	if stored == "" {
+		return "", fmt.Errorf("filename %q has no usable characters", name)
+	}
+
+	taken, err := n.takenIn(storedDir)
+	if err != nil {
+		return "", err
+	}
+
+	if taken[strings.ToUpper(stored)] && n.policy.OnCollision == CollisionRename {
+		stored, err = n.unique(stored, taken)
+		if err != nil {
+			return "", err
+		}
+	}
+	taken[strings.ToUpper(stored)] = true
+
+	return path.Join(storedDir, stored), nil
+}
+
+// directory returns the stored form of a directory path, normalizing each component once
+func (n *Normalizer) directory(dir string) (string, error) {
+	if stored, ok := n.dirs[dir]; ok {
+		return stored, nil
+	}
+
+	parent, name := path.Split(dir)
+	storedParent, err := n.directory(path.Clean(parent))
+	if err != nil {
+		return "", err
+	}
+
+	stored := n.name(name)
+	if stored == "" {
+		return "", fmt.Errorf("directory name %q has no usable characters", name)
+	}
+
+	// Directories merge with existing ones of the same name rather than being renamed
+	taken, err := n.takenIn(storedParent)
+	if err != nil {
+		return "", err
+	}
+	taken[strings.ToUpper(stored)] = true
+
+	storedPath := path.Join(storedParent, stored)
+	n.dirs[dir] = storedPath
+	return storedPath, nil
+}
+
+// takenIn returns the set of names in use in a stored directory, loading it on first use
+func (n *Normalizer) takenIn(dir string) (map[string]bool, error) {
+	if taken, ok := n.taken[dir]; ok {
+		return taken, nil
+	}
+
+	taken := make(map[string]bool)
+	if n.list != nil {
+		names, err := n.list(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", dir, err)
+		}
+		for _, name := range names {
+			taken[strings.ToUpper(name)] = true
+		}
+	}
+
+	n.taken[dir] = taken
+	return taken, nil
+}
+
+// name applies the policy to a single path component
+func (n *Normalizer) name(name string) string {
+	name = stripUnsafe(name)
+
+	switch n.policy.Mode {
+	case ModeASCII:
+		name = Transliterate(name)
+	case ModeShort:
+		return shortName(name)
+	}
+
+	return truncate(name, n.policy.MaxLength)
+}
+
+// unique adds a numeric suffix before the extension until the name is free
+func (n *Normalizer) unique(name string, taken map[string]bool) (string, error) {
+	base, ext := splitExt(name)
+
+	for i := 1; i < 10000; i++ {
+		var candidate string
+		if n.policy.Mode == ModeShort {
+			// DOS style: ROSE~1.DST, keeping the base within 8 characters
+			suffix := fmt.Sprintf("~%d", i)
+			candidate = cut(base, 8-len(suffix)) + suffix + ext
+		} else {
+			suffix := fmt.Sprintf("-%d", i)
+			candidate = base + suffix + ext
+			if n.policy.MaxLength > 0 && len(candidate) > n.policy.MaxLength {
+				// Shorten the base so the suffix and extension survive
+				candidate = cut(base, n.policy.MaxLength-len(suffix)-len(ext)) + suffix + ext
+			}
+		}
+
+		if !taken[strings.ToUpper(candidate)] {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("no free name found for %q", name)
+}
+
+// stripUnsafe removes characters FAT can't store and trims spaces and dots at the end
+func stripUnsafe(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			continue
+		case strings.ContainsRune(`"*/:<>?\|`, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return strings.TrimRight(strings.TrimSpace(b.String()), ".")
+}
+
+// transliterations covers letters that don't decompose into an ASCII base letter
+var transliterations = map[rune]string{
+	'ß': "ss", 'Æ': "AE", 'æ': "ae", 'Œ': "OE", 'œ': "oe",
+	'Ø': "O", 'ø': "o", 'Đ': "D", 'đ': "d", 'Ł': "L", 'ł': "l",
+	'Þ': "Th", 'þ': "th", 'Ð': "D", 'ð': "d", 'ı': "i",
+	'‘': "'", '’': "'", '“': "", '”': "", '–': "-", '—': "-",
+}
+
+// Transliterate converts a name to printable ASCII.
+// Accented letters lose their accents; anything else without an ASCII form becomes "_".
+func Transliterate(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(name) {
+		switch {
+		case r < 0x80:
+			b.WriteRune(r)
+		case unicode.Is(unicode.Mn, r):
+			// Combining accent left over from decomposition
+			continue
+		default:
+			if t, ok := transliterations[r]; ok {
+				b.WriteString(t)
+			} else {
+				b.WriteRune('_')
+			}
+		}
+	}
+	return b.String()
+}
+
+// shortName converts a name to an uppercase 8.3 name with only DOS-legal characters
+func shortName(name string) string {
+	base, ext := splitExt(Transliterate(name))
+
+	clean := func(s string, limit int) string {
+		var b strings.Builder
+		for _, r := range strings.ToUpper(s) {
+			if b.Len() >= limit {
+				break
+			}
+			switch {
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+				b.WriteRune(r)
+			case strings.ContainsRune("!#$%&'()-@^_`{}~", r):
+				b.WriteRune(r)
+			case r == ' ' || r == '.':
+				// Spaces and extra dots are dropped
+			default:
+				b.WriteRune('_')
+			}
+		}
+		return b.String()
+	}
+
+	base = clean(base, 8)
+	ext = clean(strings.TrimPrefix(ext, "."), 3)
+	if base == "" {
+		return ""
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// truncate shortens a name to maxLength while preserving its extension
+func truncate(name string, maxLength int) string {
+	if maxLength <= 0 || len(name) <= maxLength {
+		return name
+	}
+
+	base, ext := splitExt(name)
+	if len(ext) >= maxLength {
+		return cut(name, maxLength)
+	}
+	return strings.TrimRight(cut(base, maxLength-len(ext)), " .") + ext
+}
+
+// cut shortens s to at most n bytes without splitting a UTF-8 sequence
+func cut(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func utf8RuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// splitExt splits a name into base and extension (including the dot).
+// Names starting with a dot have no extension.
+func splitExt(name string) (string, string) {
+	ext := path.Ext(name)
+	if ext == name {
+		return name, ""
+	}
+	return strings.TrimSuffix(name, ext), ext
+}
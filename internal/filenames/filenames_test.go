@@ -0,0 +1,108 @@
+package filenames
+
+import (
+	"testing"
+)
+
+// TestTransliterate tests conversion of accented and special characters to ASCII
+func TestTransliterate(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"rose.dst", "rose.dst"},
+		{"Rosé Pétale.pes", "Rose Petale.pes"},
+		{"Straße.jef", "Strasse.jef"},
+		{"Smørrebrød.exp", "Smorrebrod.exp"},
+		{"花.dst", "_.dst"},
+	}
+
+	for _, tt := range tests {
+		result := Transliterate(tt.input)
+		if result != tt.expected {
+			t.Errorf("Transliterate(%q) = %q, expected %q", tt.input, result, tt.expected)
+		}
+	}
+}
+
+// TestNormalizeModes tests each naming mode on a single file
+func TestNormalizeModes(t *testing.T) {
+	tests := []struct {
+		policy   Policy
+		input    string
+		expected string
+	}{
+		{Policy{Mode: ModePreserve, OnCollision: CollisionOverwrite}, "Rosé.dst", "/Rosé.dst"},
+		{Policy{Mode: ModePreserve, OnCollision: CollisionOverwrite}, `bad:name?.dst`, "/bad_name_.dst"},
+		{Policy{Mode: ModeASCII, OnCollision: CollisionOverwrite}, "Rosé.dst", "/Rose.dst"},
+		{Policy{Mode: ModeShort, OnCollision: CollisionOverwrite}, "Christmas Tree.dst", "/CHRISTMA.DST"},
+		{Policy{Mode: ModeShort, OnCollision: CollisionOverwrite}, "my.design.file.jef+", "/MYDESIGN.JEF"},
+		{Policy{Mode: ModePreserve, MaxLength: 12, OnCollision: CollisionOverwrite}, "butterfly-large.pes", "/butterfl.pes"},
+		{Policy{Mode: ModeASCII, OnCollision: CollisionOverwrite}, "/Fleurs/Été/rose.dst", "/Fleurs/Ete/rose.dst"},
+	}
+
+	for _, tt := range tests {
+		n := NewNormalizer(tt.policy, nil)
+		result, err := n.Normalize(tt.input)
+		if err != nil {
+			t.Errorf("Normalize(%q) with mode %s failed: %v", tt.input, tt.policy.Mode, err)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("Normalize(%q) with mode %s = %q, expected %q", tt.input, tt.policy.Mode, result, tt.expected)
+		}
+	}
+}
+
+// TestNormalizeCollisions tests suffixes for names already on disk or earlier in the upload
+func TestNormalizeCollisions(t *testing.T) {
+	existing := map[string][]string{
+		"/": {"ROSE.DST", "tulip.pes"},
+	}
+	list := func(dir string) ([]string, error) {
+		return existing[dir], nil
+	}
+
+	short := NewNormalizer(Policy{Mode: ModeShort, OnCollision: CollisionRename}, list)
+	expected := []string{"/ROSE~1.DST", "/ROSE~2.DST"}
+	for _, want := range expected {
+		got, err := short.Normalize("rose.dst")
+		if err != nil {
+			t.Fatalf("Normalize failed: %v", err)
+		}
+		if got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+
+	long := NewNormalizer(Policy{Mode: ModePreserve, OnCollision: CollisionRename}, list)
+	got, err := long.Normalize("Tulip.pes")
+	if err != nil {
+		t.Fatalf("Normalize failed: %v", err)
+	}
+	if got != "/Tulip-1.pes" {
+		t.Errorf("Expected %q, got %q", "/Tulip-1.pes", got)
+	}
+
+	overwrite := NewNormalizer(Policy{Mode: ModePreserve, OnCollision: CollisionOverwrite}, list)
+	got, err = overwrite.Normalize("tulip.pes")
+	if err != nil {
+		t.Fatalf("Normalize failed: %v", err)
+	}
+	if got != "/tulip.pes" {
+		t.Errorf("Expected %q, got %q", "/tulip.pes", got)
+	}
+}
+
+// TestPolicyValidate tests rejection of unknown policy values
+func TestPolicyValidate(t *testing.T) {
+	if err := DefaultPolicy().Validate(); err != nil {
+		t.Errorf("Default policy should be valid: %v", err)
+	}
+	if err := (Policy{Mode: "dos", OnCollision: CollisionRename}).Validate(); err == nil {
+		t.Error("Expected error for unknown mode")
+	}
+	if err := (Policy{Mode: ModeShort, OnCollision: "skip"}).Validate(); err == nil {
+		t.Error("Expected error for unknown collision policy")
+	}
+}
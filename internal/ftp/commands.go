@@ -0,0 +1,593 @@
+package ftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jgarman/embroidery-buddy/internal/auth"
+	"github.com/jgarman/embroidery-buddy/internal/dav"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+	"github.com/jgarman/embroidery-buddy/internal/fat"
+	"golang.org/x/net/webdav"
+)
+
+// errNotStored reports an upload received in full that couldn't be written
+var errNotStored = errors.New("file not stored")
+
+// command is an FTP command the server understands
+type command struct {
+	handler func(sess *session, arg string)
+
+	// role is what the client must be logged in as (0 for commands that
+	// work before logging in)
+	role auth.Role
+}
+
+var commands = map[string]command{
+	"USER": {handler: (*session).cmdUser},
+	"PASS": {handler: (*session).cmdPass},
+	"SYST": {handler: (*session).cmdSyst},
+	"FEAT": {handler: (*session).cmdFeat},
+	"OPTS": {handler: (*session).cmdOpts},
+	"NOOP": {handler: (*session).cmdNoop},
+	"TYPE": {handler: (*session).cmdType, role: auth.Viewer},
+	"MODE": {handler: (*session).cmdMode, role: auth.Viewer},
+	"STRU": {handler: (*session).cmdStru, role: auth.Viewer},
+	"PWD":  {handler: (*session).cmdPwd, role: auth.Viewer},
+	"XPWD": {handler: (*session).cmdPwd, role: auth.Viewer},
+	"CWD":  {handler: (*session).cmdCwd, role: auth.Viewer},
+	"XCWD": {handler: (*session).cmdCwd, role: auth.Viewer},
+	"CDUP": {handler: (*session).cmdCdup, role: auth.Viewer},
+	"XCUP": {handler: (*session).cmdCdup, role: auth.Viewer},
+	"PASV": {handler: (*session).cmdPasv, role: auth.Viewer},
+	"EPSV": {handler: (*session).cmdEpsv, role: auth.Viewer},
+	"PORT": {handler: (*session).cmdPort, role: auth.Viewer},
+	"EPRT": {handler: (*session).cmdPort, role: auth.Viewer},
+	"LIST": {handler: (*session).cmdList, role: auth.Viewer},
+	"NLST": {handler: (*session).cmdNlst, role: auth.Viewer},
+	"REST": {handler: (*session).cmdRest, role: auth.Viewer},
+	"RETR": {handler: (*session).cmdRetr, role: auth.Viewer},
+	"STOR": {handler: (*session).cmdStor, role: auth.Uploader},
+	"APPE": {handler: (*session).cmdAppe, role: auth.Uploader},
+	"ALLO": {handler: (*session).cmdAllo, role: auth.Viewer},
+	"DELE": {handler: (*session).cmdDele, role: auth.Uploader},
+	"MKD":  {handler: (*session).cmdMkd, role: auth.Uploader},
+	"XMKD": {handler: (*session).cmdMkd, role: auth.Uploader},
+	"RMD":  {handler: (*session).cmdRmd, role: auth.Uploader},
+	"XRMD": {handler: (*session).cmdRmd, role: auth.Uploader},
+	"RNFR": {handler: (*session).cmdRnfr, role: auth.Uploader},
+	"RNTO": {handler: (*session).cmdRnto, role: auth.Uploader},
+	"SIZE": {handler: (*session).cmdSize, role: auth.Viewer},
+	"MDTM": {handler: (*session).cmdMdtm, role: auth.Viewer},
+	"ABOR": {handler: (*session).cmdAbor, role: auth.Viewer},
+}
+
+// features are listed in reply to FEAT
+var features = []string{"EPSV", "PASV", "SIZE", "MDTM", "REST STREAM", "UTF8"}
+
+// run runs one command. It returns false when the connection should close.
+func (sess *session) run(name, arg string) bool {
+	switch name {
+	case "QUIT":
+		sess.reply(221, "Goodbye")
+		return false
+	case "RNFR", "RNTO":
+	default:
+		// A rename is two commands in a row
+		sess.renameFrom = ""
+	}
+
+	cmd, ok := commands[name]
+	switch {
+	case !ok:
+		sess.reply(502, "Command not implemented")
+	case cmd.role != 0 && !sess.loggedIn:
+		sess.reply(530, "Please log in with USER and PASS")
+	case sess.role < cmd.role:
+		sess.reply(550, "Permission denied: this needs the "+cmd.role.String()+" role")
+	default:
+		cmd.handler(sess, arg)
+	}
+	return sess.failures < maxLoginAttempts
+}
+
+func (sess *session) fs() webdav.FileSystem {
+	return sess.server.fs
+}
+
+// resolve turns a path from the client into an absolute path on the disk
+func (sess *session) resolve(arg string) string {
+	if path.IsAbs(arg) {
+		return path.Clean(arg)
+	}
+	return path.Join(sess.cwd, arg)
+}
+
+// replyError reports a failed filesystem operation
+func (sess *session) replyError(err error) {
+	switch {
+	case os.IsNotExist(err):
+		sess.reply(550, "No such file or directory")
+	case os.IsExist(err):
+		sess.reply(550, "File exists")
+	case errors.Is(err, fat.ErrInvalidName):
+		sess.reply(553, "File name not allowed")
+	case errors.Is(err, dav.ErrFileTooLarge):
+		sess.reply(552, "File too large")
+	case errors.Is(err, dav.ErrClosed):
+		sess.reply(421, "Service not available, closing control connection")
+	default:
+		log.Printf("FTP: %v", err)
+		sess.reply(550, err.Error())
+	}
+}
+
+// stat describes the file or directory at p, named as stored on the disk
+func (sess *session) stat(p string) (string, os.FileInfo, error) {
+	fi, err := sess.fs().Stat(context.Background(), p)
+	if err != nil {
+		return "", nil, err
+	}
+	if p != "/" {
+		p = path.Join(path.Dir(p), fi.Name())
+	}
+	return p, fi, nil
+}
+
+func (sess *session) cmdUser(arg string) {
+	sess.user = arg
+	sess.loggedIn = false
+	sess.role = 0
+	sess.reply(331, "Password required for "+arg)
+}
+
+func (sess *session) cmdPass(arg string) {
+	if sess.user == "" {
+		sess.reply(503, "Log in with USER first")
+		return
+	}
+	id, err := sess.server.options.Authenticator.CheckPassword(sess.user, arg)
+	if err != nil {
+		sess.failures++
+		log.Printf("FTP: failed login for %q from %s", sess.user, sess.conn.RemoteAddr())
+		sess.reply(530, "Login incorrect")
+		return
+	}
+	sess.loggedIn = true
+	sess.role = id.Role
+	sess.failures = 0
+	sess.reply(230, "Logged in")
+}
+
+func (sess *session) cmdSyst(arg string) {
+	sess.reply(215, "UNIX Type: L8")
+}
+
+func (sess *session) cmdFeat(arg string) {
+	sess.replyLines(211, "Features:", features, "End")
+}
+
+func (sess *session) cmdOpts(arg string) {
+	if strings.EqualFold(arg, "UTF8 ON") {
+		sess.reply(200, "UTF8 mode enabled")
+		return
+	}
+	sess.reply(501, "Option not understood")
+}
+
+func (sess *session) cmdNoop(arg string) {
+	sess.reply(200, "OK")
+}
+
+// cmdType accepts ASCII and binary alike; files are always sent unchanged
+func (sess *session) cmdType(arg string) {
+	switch strings.ToUpper(arg) {
+	case "A", "A N", "I", "L 8":
+		sess.reply(200, "Type set to "+arg)
+	default:
+		sess.reply(504, "Type not supported")
+	}
+}
+
+func (sess *session) cmdMode(arg string) {
+	if strings.EqualFold(arg, "S") {
+		sess.reply(200, "Mode set to S")
+		return
+	}
+	sess.reply(504, "Only stream mode is supported")
+}
+
+func (sess *session) cmdStru(arg string) {
+	if strings.EqualFold(arg, "F") {
+		sess.reply(200, "Structure set to F")
+		return
+	}
+	sess.reply(504, "Only file structure is supported")
+}
+
+func (sess *session) cmdPwd(arg string) {
+	sess.reply(257, quote(sess.cwd)+" is the current directory")
+}
+
+func (sess *session) cmdCwd(arg string) {
+	p, fi, err := sess.stat(sess.resolve(arg))
+	if err != nil {
+		sess.replyError(err)
+		return
+	}
+	if !fi.IsDir() {
+		sess.reply(550, "Not a directory")
+		return
+	}
+	sess.cwd = p
+	sess.reply(250, "Directory changed to "+p)
+}
+
+func (sess *session) cmdCdup(arg string) {
+	sess.cmdCwd("..")
+}
+
+func (sess *session) cmdPasv(arg string) {
+	local := sess.conn.LocalAddr().(*net.TCPAddr)
+	announce := local.IP.To4()
+	if host := sess.server.options.PublicHost; host != "" {
+		announce = net.ParseIP(host).To4()
+	}
+	if announce == nil {
+		sess.reply(425, "Use EPSV")
+		return
+	}
+
+	l, err := sess.server.listenPassive(local.IP)
+	if err != nil {
+		log.Printf("FTP: %v", err)
+		sess.reply(425, "Can't open data connection")
+		return
+	}
+	sess.setPassive(l)
+
+	port := l.Addr().(*net.TCPAddr).Port
+	sess.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)",
+		announce[0], announce[1], announce[2], announce[3], port>>8, port&0xff))
+}
+
+func (sess *session) cmdEpsv(arg string) {
+	if strings.EqualFold(arg, "ALL") {
+		sess.reply(200, "EPSV ALL accepted")
+		return
+	}
+
+	l, err := sess.server.listenPassive(sess.conn.LocalAddr().(*net.TCPAddr).IP)
+	if err != nil {
+		log.Printf("FTP: %v", err)
+		sess.reply(425, "Can't open data connection")
+		return
+	}
+	sess.setPassive(l)
+	sess.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", l.Addr().(*net.TCPAddr).Port))
+}
+
+// cmdPort refuses active mode: the client would have to accept connections
+// from the device, which firewalls and NAT tend to block
+func (sess *session) cmdPort(arg string) {
+	sess.reply(502, "Only passive mode is supported, use PASV or EPSV")
+}
+
+// transfer opens the data connection, runs fn on it and reports the result
+func (sess *session) transfer(fn func(conn net.Conn) error) error {
+	conn, err := sess.dataConn()
+	if err != nil {
+		sess.reply(425, "Can't open data connection: "+err.Error())
+		return err
+	}
+	sess.reply(150, "Opening data connection")
+	err = fn(conn)
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, dav.ErrFileTooLarge):
+			sess.reply(552, "File too large")
+		case errors.Is(err, diskmanager.ErrDiskFull):
+			sess.reply(452, "Insufficient storage space")
+		case errors.Is(err, errNotStored):
+			sess.reply(451, "Local error; file not stored")
+		default:
+			sess.reply(426, "Connection closed; transfer aborted")
+		}
+		return err
+	}
+	sess.reply(226, "Transfer complete")
+	return nil
+}
+
+// listArgs drops the ls options (like -la) some clients send with LIST
+func listArgs(arg string) string {
+	for strings.HasPrefix(arg, "-") {
+		_, arg, _ = strings.Cut(arg, " ")
+	}
+	return arg
+}
+
+// readDir lists a directory, or describes a single file
+func (sess *session) readDir(arg string) ([]os.FileInfo, error) {
+	p, fi, err := sess.stat(sess.resolve(listArgs(arg)))
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []os.FileInfo{fi}, nil
+	}
+
+	dir, err := sess.fs().OpenFile(context.Background(), p, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return dir.Readdir(0)
+}
+
+func (sess *session) cmdList(arg string) {
+	entries, err := sess.readDir(arg)
+	if err != nil {
+		sess.replyError(err)
+		return
+	}
+	now := time.Now()
+	sess.transfer(func(conn net.Conn) error {
+		for _, fi := range entries {
+			if _, err := io.WriteString(conn, listLine(fi, now)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (sess *session) cmdNlst(arg string) {
+	entries, err := sess.readDir(arg)
+	if err != nil {
+		sess.replyError(err)
+		return
+	}
+	sess.transfer(func(conn net.Conn) error {
+		for _, fi := range entries {
+			if _, err := io.WriteString(conn, fi.Name()+"\r\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// listLine formats an entry the way ls -l does, which is what clients parse
+func listLine(fi os.FileInfo, now time.Time) string {
+	mod := fi.ModTime()
+	stamp := mod.Format("Jan _2 15:04")
+	if mod.Before(now.AddDate(0, -6, 0)) || mod.After(now.Add(time.Hour)) {
+		stamp = mod.Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s 1 ftp ftp %12d %s %s\r\n", fi.Mode().String(), fi.Size(), stamp, fi.Name())
+}
+
+func (sess *session) cmdRest(arg string) {
+	offset, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || offset < 0 {
+		sess.reply(501, "Invalid offset")
+		return
+	}
+	sess.restart = offset
+	sess.reply(350, fmt.Sprintf("Restarting at %d", offset))
+}
+
+func (sess *session) cmdRetr(arg string) {
+	offset := sess.restart
+	sess.restart = 0
+
+	p := sess.resolve(arg)
+	f, err := sess.fs().OpenFile(context.Background(), p, os.O_RDONLY, 0)
+	if err != nil {
+		sess.replyError(err)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		sess.replyError(err)
+		return
+	}
+	if fi.IsDir() {
+		sess.reply(550, "Not a plain file")
+		return
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			sess.replyError(err)
+			return
+		}
+	}
+
+	sess.transfer(func(conn net.Conn) error {
+		_, err := io.Copy(conn, f)
+		return err
+	})
+}
+
+func (sess *session) cmdStor(arg string) {
+	sess.store(arg, os.O_TRUNC)
+}
+
+func (sess *session) cmdAppe(arg string) {
+	sess.store(arg, os.O_APPEND)
+}
+
+// store receives a file. The filesystem queues its contents for the disk when
+// it is closed, so a transfer that fails part way leaves the file unclosed and
+// nothing is written. Closing waits for the transaction writing the file, so
+// the transfer only completes once the file is on the disk.
+func (sess *session) store(arg string, flag int) {
+	offset := sess.restart
+	sess.restart = 0
+	if offset > 0 {
+		// Resume writes over the end of the file rather than truncating it
+		flag = 0
+	}
+
+	p := sess.resolve(arg)
+	f, err := sess.fs().OpenFile(context.Background(), p, os.O_RDWR|os.O_CREATE|flag, 0644)
+	if err != nil {
+		sess.replyError(err)
+		return
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			sess.replyError(err)
+			return
+		}
+	}
+
+	var written int64
+	err = sess.transfer(func(conn net.Conn) error {
+		var err error
+		written, err = io.Copy(f, conn)
+		if err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("%w: %w", errNotStored, err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("FTP: upload of %s failed: %v", p, err)
+		return
+	}
+	log.Printf("FTP: %s stored %s (%d bytes)", sess.user, p, written)
+}
+
+// cmdAllo needs no space reserving; the disk is checked when files are written
+func (sess *session) cmdAllo(arg string) {
+	sess.reply(202, "No storage allocation necessary")
+}
+
+func (sess *session) cmdDele(arg string) {
+	p, fi, err := sess.stat(sess.resolve(arg))
+	if err != nil {
+		sess.replyError(err)
+		return
+	}
+	if fi.IsDir() {
+		sess.reply(550, "Is a directory, use RMD")
+		return
+	}
+	if err := sess.fs().RemoveAll(context.Background(), p); err != nil {
+		sess.replyError(err)
+		return
+	}
+	sess.reply(250, "Deleted "+p)
+}
+
+func (sess *session) cmdMkd(arg string) {
+	p := sess.resolve(arg)
+	if err := sess.fs().Mkdir(context.Background(), p, 0755); err != nil {
+		sess.replyError(err)
+		return
+	}
+	sess.reply(257, quote(p)+" created")
+}
+
+func (sess *session) cmdRmd(arg string) {
+	p, fi, err := sess.stat(sess.resolve(arg))
+	if err != nil {
+		sess.replyError(err)
+		return
+	}
+	if !fi.IsDir() {
+		sess.reply(550, "Not a directory")
+		return
+	}
+	if p == "/" {
+		sess.reply(550, "Can't remove the root directory")
+		return
+	}
+	if entries, err := sess.readDir(p); err != nil {
+		sess.replyError(err)
+		return
+	} else if len(entries) > 0 {
+		sess.reply(550, "Directory not empty")
+		return
+	}
+	if err := sess.fs().RemoveAll(context.Background(), p); err != nil {
+		sess.replyError(err)
+		return
+	}
+	sess.reply(250, "Removed "+p)
+}
+
+func (sess *session) cmdRnfr(arg string) {
+	p, _, err := sess.stat(sess.resolve(arg))
+	if err != nil {
+		sess.replyError(err)
+		return
+	}
+	sess.renameFrom = p
+	sess.reply(350, "Ready for RNTO")
+}
+
+func (sess *session) cmdRnto(arg string) {
+	from := sess.renameFrom
+	sess.renameFrom = ""
+	if from == "" {
+		sess.reply(503, "Use RNFR first")
+		return
+	}
+	if err := sess.fs().Rename(context.Background(), from, sess.resolve(arg)); err != nil {
+		sess.replyError(err)
+		return
+	}
+	sess.reply(250, "Renamed")
+}
+
+func (sess *session) cmdSize(arg string) {
+	_, fi, err := sess.stat(sess.resolve(arg))
+	if err != nil {
+		sess.replyError(err)
+		return
+	}
+	if fi.IsDir() {
+		sess.reply(550, "Not a plain file")
+		return
+	}
+	sess.reply(213, strconv.FormatInt(fi.Size(), 10))
+}
+
+func (sess *session) cmdMdtm(arg string) {
+	_, fi, err := sess.stat(sess.resolve(arg))
+	if err != nil {
+		sess.replyError(err)
+		return
+	}
+	sess.reply(213, fi.ModTime().UTC().Format("20060102150405"))
+}
+
+// cmdAbor has nothing to abort: transfers finish before the next command is
+// read
+func (sess *session) cmdAbor(arg string) {
+	sess.reply(226, "No transfer in progress")
+}
+
+// quote wraps a path in double quotes for a 257 reply, doubling any inside it
+func quote(p string) string {
+	return `"` + strings.ReplaceAll(p, `"`, `""`) + `"`
+}
@@ -0,0 +1,369 @@
+package ftp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jgarman/embroidery-buddy/internal/auth"
+	"github.com/jgarman/embroidery-buddy/internal/dav"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+	"github.com/jlaffaye/ftp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testServer is an FTP server on a fresh disk image
+type testServer struct {
+	addr    string
+	fs      *dav.FileSystem
+	manager *diskmanager.Manager
+	gadget  *diskmanager.NoOpUsbGadget
+}
+
+// newTestAuthenticator has an uploader, embroidery/secret, and a viewer,
+// guest/guest. The hashes are at the lowest cost to keep the tests quick.
+func newTestAuthenticator(t *testing.T) *auth.Authenticator {
+	t.Helper()
+	var options auth.Options
+	for _, u := range []struct {
+		name, password string
+		role           auth.Role
+	}{
+		{"embroidery", "secret", auth.Uploader},
+		{"guest", "guest", auth.Viewer},
+	} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(u.password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("Failed to hash password: %v", err)
+		}
+		options.Users = append(options.Users, auth.User{Username: u.name, PasswordHash: string(hash), Role: u.role})
+	}
+	a, err := auth.New(options)
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	return a
+}
+
+// newTestServer starts a server with the users of newTestAuthenticator. The
+// filesystem waits for delay before writing changes to the disk.
+func newTestServer(t *testing.T, delay time.Duration) *testServer {
+	t.Helper()
+	diskPath := filepath.Join(t.TempDir(), "test.img")
+	if err := diskmanager.CreateDiskImage(diskPath, 10, diskmanager.DiskFormat{}); err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+	gadget := diskmanager.NewNoOpUsbGadget()
+	manager, err := diskmanager.New(diskmanager.Config{DiskPath: diskPath}, gadget)
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	t.Cleanup(func() { manager.Close() })
+	gadget.ResetCounts()
+
+	fs := dav.New(manager, dav.Options{Delay: delay, MaxFileSize: 1024 * 1024})
+	server := New(fs, Options{Authenticator: newTestAuthenticator(t)})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(l) }()
+	t.Cleanup(func() {
+		server.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Expected Serve to return ErrServerClosed, got %v", err)
+		}
+	})
+
+	return &testServer{addr: l.Addr().String(), fs: fs, manager: manager, gadget: gadget}
+}
+
+// dial connects and logs in
+func (ts *testServer) dial(t *testing.T) *ftp.ServerConn {
+	t.Helper()
+	c, err := ftp.Dial(ts.addr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { c.Quit() })
+	if err := c.Login("embroidery", "secret"); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	return c
+}
+
+// diskNames lists a directory of the disk image itself
+func (ts *testServer) diskNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := ts.manager.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir %s failed: %v", dir, err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func retr(t *testing.T, c *ftp.ServerConn, name string) string {
+	t.Helper()
+	r, err := c.Retr(name)
+	if err != nil {
+		t.Fatalf("RETR %s failed: %v", name, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Reading %s failed: %v", name, err)
+	}
+	return string(data)
+}
+
+// replyCode returns the FTP reply code of a failed command
+func replyCode(err error) int {
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		return te.Code
+	}
+	return 0
+}
+
+// TestStoreAndRetrieve tests the commands a machine or digitising program
+// uses, and that uploads are on the disk once STOR succeeds
+func TestStoreAndRetrieve(t *testing.T) {
+	ts := newTestServer(t, 10*time.Millisecond)
+	c := ts.dial(t)
+
+	if err := c.MakeDir("Flowers"); err != nil {
+		t.Fatalf("MKD failed: %v", err)
+	}
+	if err := c.ChangeDir("Flowers"); err != nil {
+		t.Fatalf("CWD failed: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("rose%d.dst", i)
+		if err := c.Stor(name, strings.NewReader("rose "+name)); err != nil {
+			t.Fatalf("STOR %s failed: %v", name, err)
+		}
+	}
+
+	// Some programs connect once per file
+	other := ts.dial(t)
+	if err := other.Stor("/Flowers/tulip.pes", strings.NewReader("tulip")); err != nil {
+		t.Fatalf("STOR on a second connection failed: %v", err)
+	}
+
+	if got := ts.diskNames(t, "/Flowers"); len(got) != 6 {
+		t.Fatalf("Expected the uploads on the disk once stored, got %v", got)
+	}
+
+	entries, err := c.List("")
+	if err != nil {
+		t.Fatalf("LIST failed: %v", err)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("Expected 6 entries, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if e.Type != ftp.EntryTypeFile || e.Size == 0 {
+			t.Errorf("Unexpected entry %+v", e)
+		}
+	}
+	names, err := c.NameList("/Flowers")
+	if err != nil || len(names) != 6 {
+		t.Fatalf("NLST returned %v, %v", names, err)
+	}
+	if got := retr(t, c, "tulip.pes"); got != "tulip" {
+		t.Errorf("Expected the stored contents, got %q", got)
+	}
+	if size, err := c.FileSize("/Flowers/ROSE1.DST"); err != nil || size != int64(len("rose rose1.dst")) {
+		t.Errorf("SIZE returned %d, %v", size, err)
+	}
+
+	if err := c.Rename("rose4.dst", "lily.dst"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := c.Delete("rose3.dst"); err != nil {
+		t.Fatalf("DELE failed: %v", err)
+	}
+
+	if err := ts.fs.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	want := []string{"lily.dst", "rose0.dst", "rose1.dst", "rose2.dst", "tulip.pes"}
+	if got := ts.diskNames(t, "/Flowers"); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected %v on the disk, got %v", want, got)
+	}
+	if got := retr(t, c, "/Flowers/lily.dst"); got != "rose rose4.dst" {
+		t.Errorf("Expected the renamed file from the disk, got %q", got)
+	}
+
+	// Resume a download part way
+	r, err := c.RetrFrom("lily.dst", 5)
+	if err != nil {
+		t.Fatalf("RETR with REST failed: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "rose4.dst" {
+		t.Errorf("Expected the end of the file, got %q", data)
+	}
+}
+
+// TestDelayedCommit tests that uploads sent at the same time over separate
+// connections are written together once the delay has passed
+func TestDelayedCommit(t *testing.T) {
+	ts := newTestServer(t, 500*time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		c := ts.dial(t)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Stor(fmt.Sprintf("/design%d.jef", i), bytes.NewReader(make([]byte, 1000))); err != nil {
+				t.Errorf("STOR failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if names := ts.diskNames(t, "/"); len(names) != 3 {
+		t.Errorf("Expected the uploads on the disk once stored, got %v", names)
+	}
+	if ts.gadget.GetDisconnectCalls() != 1 {
+		t.Errorf("Expected one transaction, got %d", ts.gadget.GetDisconnectCalls())
+	}
+}
+
+// TestLogin tests that only configured users get in
+func TestLogin(t *testing.T) {
+	ts := newTestServer(t, time.Hour)
+
+	for _, creds := range [][2]string{{"embroidery", "wrong"}, {"nobody", "secret"}} {
+		c, err := ftp.Dial(ts.addr, ftp.DialWithTimeout(5*time.Second))
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		if err := c.Login(creds[0], creds[1]); replyCode(err) != 530 {
+			t.Errorf("Expected 530 for %s/%s, got %v", creds[0], creds[1], err)
+		}
+		c.Quit()
+	}
+
+	c, err := ftp.Dial(ts.addr, ftp.DialWithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Quit()
+	if err := c.MakeDir("/Flowers"); replyCode(err) != 530 {
+		t.Errorf("Expected 530 before logging in, got %v", err)
+	}
+	if names := ts.diskNames(t, "/"); len(names) != 0 {
+		t.Errorf("Expected nothing written, got %v", names)
+	}
+
+	// Viewers can look but not change anything
+	if err := c.Login("guest", "guest"); err != nil {
+		t.Fatalf("Login as a viewer failed: %v", err)
+	}
+	if _, err := c.List("/"); err != nil {
+		t.Errorf("Expected a viewer to list files, got %v", err)
+	}
+	for name, run := range map[string]func() error{
+		"STOR": func() error { return c.Stor("/rose.dst", strings.NewReader("rose")) },
+		"MKD":  func() error { return c.MakeDir("/Flowers") },
+		"DELE": func() error { return c.Delete("/rose.dst") },
+		"RNTO": func() error { return c.Rename("/rose.dst", "/tulip.dst") },
+	} {
+		if err := run(); replyCode(err) != 550 {
+			t.Errorf("%s as a viewer: expected 550, got %v", name, err)
+		}
+	}
+	if names := ts.diskNames(t, "/"); len(names) != 0 {
+		t.Errorf("Expected nothing written by a viewer, got %v", names)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	if err := New(ts.fs, Options{}).Serve(l); !errors.Is(err, ErrNoUsers) {
+		t.Errorf("Expected ErrNoUsers without an authenticator, got %v", err)
+	}
+}
+
+// TestErrors tests the replies to commands that fail
+func TestErrors(t *testing.T) {
+	ts := newTestServer(t, 10*time.Millisecond)
+	c := ts.dial(t)
+
+	if err := c.MakeDir("/Flowers"); err != nil {
+		t.Fatalf("MKD failed: %v", err)
+	}
+	if err := c.Stor("/Flowers/rose.dst", strings.NewReader("rose")); err != nil {
+		t.Fatalf("STOR failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		run  func() error
+		code int
+	}{
+		{"RETR missing", func() error { _, err := c.Retr("/tulip.dst"); return err }, 550},
+		{"STOR missing directory", func() error { return c.Stor("/Tulips/tulip.dst", strings.NewReader("x")) }, 550},
+		{"STOR invalid name", func() error { return c.Stor("/what?.dst", strings.NewReader("x")) }, 553},
+		{"STOR too large", func() error { return c.Stor("/big.dst", bytes.NewReader(make([]byte, 2*1024*1024))) }, 552},
+		{"MKD existing", func() error { return c.MakeDir("/flowers") }, 550},
+		{"RMD not empty", func() error { return c.RemoveDir("/Flowers") }, 550},
+		{"DELE directory", func() error { return c.Delete("/Flowers") }, 550},
+		{"CWD file", func() error { return c.ChangeDir("/Flowers/rose.dst") }, 550},
+	}
+	for _, tt := range tests {
+		if err := tt.run(); replyCode(err) != tt.code {
+			t.Errorf("%s: expected %d, got %v", tt.name, tt.code, err)
+		}
+	}
+
+	// An upload the disk can't take fails rather than completing
+	filler := 9 * 1024 * 1024
+	err := ts.manager.BeginTransaction(func(tx *diskmanager.Transaction) error {
+		return tx.WriteFile("/filler.bin", bytes.NewReader(make([]byte, filler)), int64(filler))
+	})
+	if err != nil {
+		t.Fatalf("Failed to fill the disk: %v", err)
+	}
+	if err := c.Stor("/full.dst", bytes.NewReader(make([]byte, 1024*1024))); replyCode(err) != 452 {
+		t.Errorf("STOR on a full disk: expected 452, got %v", err)
+	}
+	if _, err := c.FileSize("/full.dst"); err == nil {
+		t.Error("Expected the upload that didn't fit not to be listed")
+	}
+	if err := ts.manager.BeginTransaction(func(tx *diskmanager.Transaction) error {
+		return tx.RemoveFile("/filler.bin")
+	}); err != nil {
+		t.Fatalf("Failed to remove the filler: %v", err)
+	}
+
+	if err := ts.fs.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if got := ts.diskNames(t, "/"); len(got) != 1 || got[0] != "Flowers" {
+		t.Errorf("Expected only /Flowers on the disk, got %v", got)
+	}
+	if got := ts.diskNames(t, "/Flowers"); len(got) != 1 || got[0] != "rose.dst" {
+		t.Errorf("Expected only rose.dst in /Flowers, got %v", got)
+	}
+}
@@ -0,0 +1,325 @@
+// Package ftp is a small passive-mode FTP server for the disk, for digitising
+// software and older network workflows that can only push designs over FTP.
+//
+// The server works on the same webdav.FileSystem as WebDAV clients (see the
+// dav package), so uploads are held in memory and written to the disk in one
+// transaction once no more have arrived for a short while. STORs sent at the
+// same time disconnect the machine once, even over separate connections. A
+// STOR is only answered once its transaction has written the file.
+package ftp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jgarman/embroidery-buddy/internal/auth"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	// ErrServerClosed is returned by Serve after Close
+	ErrServerClosed = errors.New("ftp: server closed")
+
+	// ErrNoUsers is returned by Serve without an Authenticator to log in with
+	ErrNoUsers = errors.New("ftp: no users configured")
+)
+
+const (
+	// maxLoginAttempts is how many wrong passwords end the connection
+	maxLoginAttempts = 3
+
+	// maxLineLength limits a command line, which is far longer than any path
+	maxLineLength = 4096
+
+	// dataTimeout is how long to wait for the client to open a data connection
+	dataTimeout = 30 * time.Second
+)
+
+// Options configures a Server
+type Options struct {
+	// Authenticator checks the passwords of users logging in. Their role
+	// decides what they can do: viewers can list and download, uploaders can
+	// also change files.
+	Authenticator *auth.Authenticator
+
+	// PassivePortMin and PassivePortMax are the range of ports used for data
+	// connections. Leave both 0 to let the system choose.
+	PassivePortMin int
+	PassivePortMax int
+
+	// PublicHost is the IPv4 address announced in PASV replies, for clients
+	// reaching the server through NAT ("" uses the address they connected to)
+	PublicHost string
+
+	// IdleTimeout closes connections that send no command for this long
+	// (0 for no limit)
+	IdleTimeout time.Duration
+}
+
+// Server serves a webdav.FileSystem over FTP
+type Server struct {
+	fs      webdav.FileSystem
+	options Options
+
+	mu       sync.Mutex
+	listener net.Listener
+	sessions map[*session]struct{}
+	nextPort int
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// New creates an FTP server for fs
+func New(fs webdav.FileSystem, options Options) *Server {
+	return &Server{
+		fs:       fs,
+		options:  options,
+		sessions: make(map[*session]struct{}),
+	}
+}
+
+// ListenAndServe listens on addr (e.g. ":21") and serves connections until
+// Close is called
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called, then returns
+// ErrServerClosed
+func (s *Server) Serve(l net.Listener) error {
+	if s.options.Authenticator == nil {
+		l.Close()
+		return ErrNoUsers
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		sess := &session{
+			server: s,
+			conn:   conn,
+			reader: bufio.NewReaderSize(conn, maxLineLength),
+			cwd:    "/",
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.sessions[sess] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			sess.serve()
+			s.mu.Lock()
+			delete(s.sessions, sess)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections and closes the open ones. Files already
+// stored are left for the filesystem to write.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for sess := range s.sessions {
+		sess.close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// listenPassive opens a listener for a data connection on ip, using the next
+// free port of the passive range
+func (s *Server) listenPassive(ip net.IP) (net.Listener, error) {
+	min, max := s.options.PassivePortMin, s.options.PassivePortMax
+	if min <= 0 || max < min {
+		return net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	}
+
+	count := max - min + 1
+	s.mu.Lock()
+	start := s.nextPort
+	s.nextPort = (s.nextPort + 1) % count
+	s.mu.Unlock()
+
+	var err error
+	for i := 0; i < count; i++ {
+		port := min + (start+i)%count
+		var l net.Listener
+		l, err = net.Listen("tcp", net.JoinHostPort(ip.String(), fmt.Sprint(port)))
+		if err == nil {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("no free passive port between %d and %d: %w", min, max, err)
+}
+
+// session is one control connection
+type session struct {
+	server *Server
+	conn   net.Conn
+	reader *bufio.Reader
+
+	user     string
+	loggedIn bool
+	role     auth.Role
+	failures int
+
+	cwd        string
+	renameFrom string
+	restart    int64
+
+	mu      sync.Mutex
+	passive net.Listener
+}
+
+// serve reads and runs commands until the client quits or the connection
+// fails
+func (sess *session) serve() {
+	defer sess.close()
+
+	sess.reply(220, "Embroidery Buddy FTP server ready")
+	for {
+		if timeout := sess.server.options.IdleTimeout; timeout > 0 {
+			sess.conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		line, err := sess.readLine()
+		if err != nil {
+			if errors.Is(err, errLineTooLong) {
+				sess.reply(500, "Command line too long")
+			}
+			return
+		}
+
+		command, arg, _ := strings.Cut(line, " ")
+		command = strings.ToUpper(command)
+		if !sess.run(command, arg) {
+			return
+		}
+	}
+}
+
+var errLineTooLong = errors.New("command line too long")
+
+// readLine reads a command line without its line ending
+func (sess *session) readLine() (string, error) {
+	line, err := sess.reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", errLineTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// reply sends a single-line reply
+func (sess *session) reply(code int, message string) {
+	fmt.Fprintf(sess.conn, "%d %s\r\n", code, message)
+}
+
+// replyLines sends a multi-line reply; lines after the first are indented
+func (sess *session) replyLines(code int, first string, lines []string, last string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d-%s\r\n", code, first)
+	for _, line := range lines {
+		fmt.Fprintf(&b, " %s\r\n", line)
+	}
+	fmt.Fprintf(&b, "%d %s\r\n", code, last)
+	io.WriteString(sess.conn, b.String())
+}
+
+// setPassive replaces the listener waiting for the next data connection
+func (sess *session) setPassive(l net.Listener) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.passive != nil {
+		sess.passive.Close()
+	}
+	sess.passive = l
+}
+
+// dataConn accepts the data connection for a transfer. Only the client of
+// the control connection may open it.
+func (sess *session) dataConn() (net.Conn, error) {
+	sess.mu.Lock()
+	l := sess.passive
+	sess.passive = nil
+	sess.mu.Unlock()
+	if l == nil {
+		return nil, errors.New("use PASV or EPSV first")
+	}
+	defer l.Close()
+
+	if tl, ok := l.(*net.TCPListener); ok {
+		tl.SetDeadline(time.Now().Add(dataTimeout))
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !sameHost(conn.RemoteAddr(), sess.conn.RemoteAddr()) {
+		conn.Close()
+		log.Printf("FTP: refused data connection from %s for %s", conn.RemoteAddr(), sess.conn.RemoteAddr())
+		return nil, errors.New("data connection from another host")
+	}
+	return conn, nil
+}
+
+// close ends the session and any transfer waiting for a data connection
+func (sess *session) close() {
+	sess.setPassive(nil)
+	sess.conn.Close()
+}
+
+// sameHost reports whether two TCP addresses have the same IP
+func sameHost(a, b net.Addr) bool {
+	ta, ok1 := a.(*net.TCPAddr)
+	tb, ok2 := b.(*net.TCPAddr)
+	return ok1 && ok2 && ta.IP.Equal(tb.IP)
+}
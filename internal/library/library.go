@@ -0,0 +1,491 @@
+// Package library keeps a persistent catalogue of designs on the Pi's own filesystem.
+//
+// The virtual USB drive is small and is wiped by ClearFiles, so designs live here
+// with their metadata and tags, and only the working set is copied onto the drive.
+package library
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jgarman/embroidery-buddy/internal/design"
+)
+
+var (
+	ErrNotFound    = errors.New("design not found")
+	ErrExists      = errors.New("design already in library")
+	ErrInvalidName = errors.New("invalid design name")
+	ErrInUse       = errors.New("design is used by a set")
+)
+
+const (
+	indexFile = "index.json"
+	filesDir  = "files"
+)
+
+// Entry is the metadata of one design in the library
+type Entry struct {
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	Format string    `json:"format"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256"`
+	Tags   []string  `json:"tags"`
+	Notes  string    `json:"notes,omitempty"`
+	Added  time.Time `json:"added"`
+
+	// Stitch information, filled in for formats the design package can decode
+	Stitches int     `json:"stitches,omitempty"`
+	WidthMM  float64 `json:"widthMm,omitempty"`
+	HeightMM float64 `json:"heightMm,omitempty"`
+
+	// DrivePath is where the design was last copied onto the USB drive ("" if not loaded)
+	DrivePath string `json:"drivePath,omitempty"`
+}
+
+// HasTag reports whether the entry carries a tag (case-insensitive)
+func (e Entry) HasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Query selects entries from the library
+type Query struct {
+	// Text matches names, tags and notes (case-insensitive substring)
+	Text string
+
+	// Tags lists tags an entry must all carry
+	Tags []string
+
+	// Format limits results to one file format (e.g., "dst")
+	Format string
+}
+
+// matches reports whether an entry satisfies the query
+func (q Query) matches(e Entry) bool {
+	if q.Format != "" && !strings.EqualFold(q.Format, e.Format) {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !e.HasTag(tag) {
+			return false
+		}
+	}
+	if q.Text == "" {
+		return true
+	}
+
+	text := strings.ToLower(q.Text)
+	if strings.Contains(strings.ToLower(e.Name), text) || strings.Contains(strings.ToLower(e.Notes), text) {
+		return true
+	}
+	for _, tag := range e.Tags {
+		if strings.Contains(strings.ToLower(tag), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// Update holds the metadata fields to change; nil fields are left as they are
+type Update struct {
+	Name  *string   `json:"name"`
+	Tags  *[]string `json:"tags"`
+	Notes *string   `json:"notes"`
+}
+
+// Library is a directory of design files with a JSON index
+type Library struct {
+	root string
+
+	mu      sync.RWMutex
+	entries map[string]*Entry
+	sets    setIndex
+}
+
+// Open opens the library in root, creating the directory if needed
+func Open(root string) (*Library, error) {
+	if err := os.MkdirAll(filepath.Join(root, filesDir), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create library directory: %w", err)
+	}
+
+	l := &Library{
+		root:    root,
+		entries: make(map[string]*Entry),
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, indexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read library index: %w", err)
+	}
+	if err == nil {
+		var entries []*Entry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse library index: %w", err)
+		}
+		for _, e := range entries {
+			l.entries[e.ID] = e
+		}
+	}
+
+	if err := l.loadSets(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Root returns the directory holding the library
+func (l *Library) Root() string {
+	return l.root
+}
+
+// filePath returns where the data of an entry is stored
+func (l *Library) filePath(e *Entry) string {
+	return filepath.Join(l.root, filesDir, e.ID+"."+e.Format)
+}
+
+// save writes the index atomically. The caller must hold the write lock.
+func (l *Library) save() error {
+	entries := make([]*Entry, 0, len(l.entries))
+	for _, e := range l.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal library index: %w", err)
+	}
+
+	return writeAtomic(filepath.Join(l.root, indexFile), data)
+}
+
+// writeAtomic replaces a file by writing a temporary file and renaming it
+func writeAtomic(filePath string, data []byte) error {
+	tmp := filePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(filePath), err)
+	}
+	if err := os.Rename(tmp, filePath); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", filepath.Base(filePath), err)
+	}
+	return nil
+}
+
+// newID returns a random identifier for an entry
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// cleanName reduces an uploaded filename to its base name
+func cleanName(name string) (string, error) {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == "" || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	if ext == "" {
+		return "", fmt.Errorf("%w: %q has no file extension", ErrInvalidName, name)
+	}
+	return name, nil
+}
+
+// Add stores a design in the library. If a design with the same content is
+// already present, its entry is returned together with ErrExists.
+func (l *Library) Add(name string, r io.Reader, tags []string) (Entry, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	e := &Entry{
+		ID:     id,
+		Name:   name,
+		Format: strings.TrimPrefix(strings.ToLower(path.Ext(name)), "."),
+		Tags:   normalizeTags(tags),
+		Added:  time.Now().UTC(),
+	}
+
+	// Stream to a temporary file while hashing, then move it into place
+	tmp, err := os.CreateTemp(filepath.Join(l.root, filesDir), ".upload-*")
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to create library file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to store design: %w", err)
+	}
+	e.Size = size
+	e.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	if format, err := design.FormatForPath(name); err == nil {
+		if data, err := os.ReadFile(tmp.Name()); err == nil {
+			if d, err := format.Decode(bytes.NewReader(data)); err == nil {
+				minX, minY, maxX, maxY := d.Bounds()
+				e.Stitches = d.StitchCount()
+				e.WidthMM = float64(maxX-minX) / 10
+				e.HeightMM = float64(maxY-minY) / 10
+			}
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, existing := range l.entries {
+		if existing.SHA256 == e.SHA256 {
+			return *existing, fmt.Errorf("%w as %s", ErrExists, existing.Name)
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), l.filePath(e)); err != nil {
+		return Entry{}, fmt.Errorf("failed to store design: %w", err)
+	}
+	l.entries[e.ID] = e
+	if err := l.save(); err != nil {
+		delete(l.entries, e.ID)
+		os.Remove(l.filePath(e))
+		return Entry{}, err
+	}
+
+	return *e, nil
+}
+
+// Get returns the entry with the given id
+func (l *Library) Get(id string) (Entry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	e, ok := l.entries[id]
+	if !ok {
+		return Entry{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return *e, nil
+}
+
+// Open opens the data of a design for reading
+func (l *Library) Open(id string) (io.ReadCloser, Entry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	e, ok := l.entries[id]
+	if !ok {
+		return nil, Entry{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	f, err := os.Open(l.filePath(e))
+	if err != nil {
+		return nil, Entry{}, fmt.Errorf("failed to open design %s: %w", id, err)
+	}
+	return f, *e, nil
+}
+
+// Search returns the entries matching a query, sorted by name
+func (l *Library) Search(q Query) []Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	results := make([]Entry, 0)
+	for _, e := range l.entries {
+		if q.matches(*e) {
+			results = append(results, *e)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := strings.ToLower(results[i].Name), strings.ToLower(results[j].Name)
+		if a != b {
+			return a < b
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
+
+// Tags returns every tag in use, sorted
+func (l *Library) Tags() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	seen := make(map[string]string)
+	for _, e := range l.entries {
+		for _, tag := range e.Tags {
+			seen[strings.ToLower(tag)] = tag
+		}
+	}
+	tags := make([]string, 0, len(seen))
+	for _, tag := range seen {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Update changes the metadata of an entry
+func (l *Library) Update(id string, u Update) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[id]
+	if !ok {
+		return Entry{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	updated := *e
+	if u.Name != nil {
+		name, err := cleanName(*u.Name)
+		if err != nil {
+			return Entry{}, err
+		}
+		if !strings.EqualFold(path.Ext(name), "."+e.Format) {
+			return Entry{}, fmt.Errorf("%w: the extension must stay .%s", ErrInvalidName, e.Format)
+		}
+		updated.Name = name
+	}
+	if u.Tags != nil {
+		updated.Tags = normalizeTags(*u.Tags)
+	}
+	if u.Notes != nil {
+		updated.Notes = *u.Notes
+	}
+
+	l.entries[id] = &updated
+	if err := l.save(); err != nil {
+		l.entries[id] = e
+		return Entry{}, err
+	}
+	return updated, nil
+}
+
+// SetDrivePaths records where designs were copied onto the USB drive
+// (an empty path marks a design as no longer on the drive)
+func (l *Library) SetDrivePaths(paths map[string]string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for id, drivePath := range paths {
+		if e, ok := l.entries[id]; ok {
+			e.DrivePath = drivePath
+		}
+	}
+	return l.save()
+}
+
+// ForgetDrivePaths marks every design as no longer on the USB drive and no set
+// as active (e.g., after a clear)
+func (l *Library) ForgetDrivePaths() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, e := range l.entries {
+		e.DrivePath = ""
+	}
+	if err := l.save(); err != nil {
+		return err
+	}
+
+	if l.sets.Active != "" {
+		l.sets.Active = ""
+		return l.saveSets()
+	}
+	return nil
+}
+
+// ForgetDrivePathsIn marks the designs stored in a folder on the USB drive (or
+// below it) as no longer on the drive, and no set as active
+func (l *Library) ForgetDrivePathsIn(folder string) error {
+	folder = path.Clean("/" + folder)
+	if folder == "/" {
+		return l.ForgetDrivePaths()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// FAT names are case-insensitive
+	prefix := strings.ToLower(folder) + "/"
+	for _, e := range l.entries {
+		if strings.HasPrefix(strings.ToLower(e.DrivePath), prefix) {
+			e.DrivePath = ""
+		}
+	}
+	if err := l.save(); err != nil {
+		return err
+	}
+
+	if l.sets.Active != "" {
+		l.sets.Active = ""
+		return l.saveSets()
+	}
+	return nil
+}
+
+// Remove deletes a design and its data from the library
+func (l *Library) Remove(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if names := l.setsUsing(id); len(names) > 0 {
+		return fmt.Errorf("%w: %s", ErrInUse, strings.Join(names, ", "))
+	}
+
+	delete(l.entries, id)
+	if err := l.save(); err != nil {
+		l.entries[id] = e
+		return err
+	}
+	if err := os.Remove(l.filePath(e)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove design file: %w", err)
+	}
+	return nil
+}
+
+// normalizeTags trims tags and drops empty and duplicate ones
+func normalizeTags(tags []string) []string {
+	result := make([]string, 0, len(tags))
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		result = append(result, tag)
+	}
+	return result
+}
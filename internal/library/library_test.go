@@ -0,0 +1,237 @@
+package library
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// TestAddAndReopen tests that designs and metadata survive reopening the library
+func TestAddAndReopen(t *testing.T) {
+	root := t.TempDir()
+
+	l, err := Open(root)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	e, err := l.Add("Rose.pes", bytes.NewReader([]byte("rose data")), []string{"flowers", " Flowers ", ""})
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if e.Format != "pes" || e.Size != 9 {
+		t.Errorf("Unexpected entry: %+v", e)
+	}
+	if len(e.Tags) != 1 || e.Tags[0] != "flowers" {
+		t.Errorf("Expected tags [flowers], got %v", e.Tags)
+	}
+
+	l, err = Open(root)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	reader, got, err := l.Open(e.ID)
+	if err != nil {
+		t.Fatalf("Open design failed: %v", err)
+	}
+	defer reader.Close()
+	data, _ := io.ReadAll(reader)
+	if string(data) != "rose data" {
+		t.Errorf("Expected %q, got %q", "rose data", data)
+	}
+	if got.Name != "Rose.pes" {
+		t.Errorf("Expected name Rose.pes, got %q", got.Name)
+	}
+}
+
+// TestAddDuplicate tests that identical content is stored once
+func TestAddDuplicate(t *testing.T) {
+	l, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	first, err := l.Add("rose.dst", bytes.NewReader([]byte("same")), nil)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	existing, err := l.Add("copy of rose.dst", bytes.NewReader([]byte("same")), nil)
+	if !errors.Is(err, ErrExists) {
+		t.Fatalf("Expected ErrExists, got %v", err)
+	}
+	if existing.ID != first.ID {
+		t.Errorf("Expected existing entry %s, got %s", first.ID, existing.ID)
+	}
+
+	if _, err := l.Add("noextension", bytes.NewReader([]byte("x")), nil); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Expected ErrInvalidName, got %v", err)
+	}
+}
+
+// TestSearch tests text, tag and format queries
+func TestSearch(t *testing.T) {
+	l, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	add := func(name string, tags ...string) {
+		if _, err := l.Add(name, bytes.NewReader([]byte(name)), tags); err != nil {
+			t.Fatalf("Add %s failed: %v", name, err)
+		}
+	}
+	add("tulip.dst", "flowers", "spring")
+	add("Rose.pes", "flowers")
+	add("snowflake.dst", "holiday")
+
+	tests := []struct {
+		query    Query
+		expected []string
+	}{
+		{Query{}, []string{"Rose.pes", "snowflake.dst", "tulip.dst"}},
+		{Query{Tags: []string{"FLOWERS"}}, []string{"Rose.pes", "tulip.dst"}},
+		{Query{Tags: []string{"flowers", "spring"}}, []string{"tulip.dst"}},
+		{Query{Text: "hol"}, []string{"snowflake.dst"}},
+		{Query{Format: "dst", Text: "spring"}, []string{"tulip.dst"}},
+	}
+
+	for _, tt := range tests {
+		results := l.Search(tt.query)
+		var names []string
+		for _, e := range results {
+			names = append(names, e.Name)
+		}
+		if len(names) != len(tt.expected) {
+			t.Errorf("Search(%+v) = %v, expected %v", tt.query, names, tt.expected)
+			continue
+		}
+		for i := range names {
+			if names[i] != tt.expected[i] {
+				t.Errorf("Search(%+v) = %v, expected %v", tt.query, names, tt.expected)
+				break
+			}
+		}
+	}
+}
+
+// TestUpdateAndRemove tests metadata changes and deletion
+func TestUpdateAndRemove(t *testing.T) {
+	l, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	e, err := l.Add("rose.dst", bytes.NewReader([]byte("rose")), nil)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	name, tags := "Red Rose.dst", []string{"red"}
+	updated, err := l.Update(e.ID, Update{Name: &name, Tags: &tags})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if updated.Name != name || !updated.HasTag("RED") {
+		t.Errorf("Unexpected updated entry: %+v", updated)
+	}
+
+	badName := "rose.pes"
+	if _, err := l.Update(e.ID, Update{Name: &badName}); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Expected ErrInvalidName when changing the extension, got %v", err)
+	}
+
+	if err := l.Remove(e.ID); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := l.Get(e.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after remove, got %v", err)
+	}
+}
+
+// TestSets tests saving, activating and deleting sets
+func TestSets(t *testing.T) {
+	root := t.TempDir()
+	l, err := Open(root)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	rose, err := l.Add("rose.dst", bytes.NewReader([]byte("rose")), nil)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	if _, err := l.SaveSet(Set{Name: "Holiday", Items: []SetItem{{ID: "missing"}}}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for unknown design, got %v", err)
+	}
+	if _, err := l.SaveSet(Set{Name: "a/b"}); !errors.Is(err, ErrInvalidSet) {
+		t.Errorf("Expected ErrInvalidSet for bad name, got %v", err)
+	}
+
+	saved, err := l.SaveSet(Set{Name: "Customer A", Items: []SetItem{{ID: rose.ID, Folder: "Order 12/"}}})
+	if err != nil {
+		t.Fatalf("SaveSet failed: %v", err)
+	}
+	if saved.Items[0].Folder != "/Order 12" {
+		t.Errorf("Expected folder /Order 12, got %q", saved.Items[0].Folder)
+	}
+
+	if err := l.Remove(rose.ID); !errors.Is(err, ErrInUse) {
+		t.Errorf("Expected ErrInUse removing a design used by a set, got %v", err)
+	}
+
+	if err := l.MarkActive("Customer A", map[string]string{rose.ID: "/Order 12/rose.dst"}); err != nil {
+		t.Fatalf("MarkActive failed: %v", err)
+	}
+
+	// Sets and the active marker survive reopening
+	l, err = Open(root)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	sets, active := l.Sets()
+	if len(sets) != 1 || active != "Customer A" {
+		t.Errorf("Expected one active set, got %d sets, active %q", len(sets), active)
+	}
+	if e, _ := l.Get(rose.ID); e.DrivePath != "/Order 12/rose.dst" {
+		t.Errorf("Expected drive path to be recorded, got %q", e.DrivePath)
+	}
+
+	if err := l.DeleteSet("customer a"); err != nil {
+		t.Fatalf("DeleteSet failed: %v", err)
+	}
+	if _, err := l.GetSet("Customer A"); !errors.Is(err, ErrSetNotFound) {
+		t.Errorf("Expected ErrSetNotFound after delete, got %v", err)
+	}
+	if err := l.Remove(rose.ID); err != nil {
+		t.Errorf("Remove after deleting the set failed: %v", err)
+	}
+}
+
+// TestForgetDrivePathsIn tests forgetting the designs of a cleared folder
+func TestForgetDrivePathsIn(t *testing.T) {
+	l, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	rose, err := l.Add("rose.dst", bytes.NewReader([]byte("rose")), nil)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	tulip, err := l.Add("tulip.dst", bytes.NewReader([]byte("tulip")), nil)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := l.SetDrivePaths(map[string]string{rose.ID: "/rose.dst", tulip.ID: "/Flowers/tulip.dst"}); err != nil {
+		t.Fatalf("SetDrivePaths failed: %v", err)
+	}
+
+	if err := l.ForgetDrivePathsIn("/flowers"); err != nil {
+		t.Fatalf("ForgetDrivePathsIn failed: %v", err)
+	}
+	if e, _ := l.Get(tulip.ID); e.DrivePath != "" {
+		t.Errorf("Expected tulip to be forgotten, got %q", e.DrivePath)
+	}
+	if e, _ := l.Get(rose.ID); e.DrivePath != "/rose.dst" {
+		t.Errorf("Expected rose to stay on the drive, got %q", e.DrivePath)
+	}
+}
@@ -0,0 +1,184 @@
+package library
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSetNotFound = errors.New("set not found")
+	ErrInvalidSet  = errors.New("invalid set")
+)
+
+const setsFile = "sets.json"
+
+// SetItem places one library design in a folder on the drive
+type SetItem struct {
+	ID string `json:"id"`
+
+	// Folder on the drive, "/" for the top level
+	Folder string `json:"folder"`
+}
+
+// Set is a named drive layout built from library designs, e.g. "Holiday stock"
+type Set struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Items       []SetItem `json:"items"`
+	Updated     time.Time `json:"updated"`
+}
+
+// setIndex is the on-disk form of the saved sets
+type setIndex struct {
+	// Active is the set last activated onto the drive ("" after a clear)
+	Active string `json:"active"`
+	Sets   []*Set `json:"sets"`
+}
+
+// loadSets reads the saved sets
+func (l *Library) loadSets() error {
+	data, err := os.ReadFile(filepath.Join(l.root, setsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read sets: %w", err)
+	}
+	if err := json.Unmarshal(data, &l.sets); err != nil {
+		return fmt.Errorf("failed to parse sets: %w", err)
+	}
+	return nil
+}
+
+// saveSets writes the saved sets. The caller must hold the write lock.
+func (l *Library) saveSets() error {
+	sort.Slice(l.sets.Sets, func(i, j int) bool {
+		return strings.ToLower(l.sets.Sets[i].Name) < strings.ToLower(l.sets.Sets[j].Name)
+	})
+
+	data, err := json.MarshalIndent(l.sets, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal sets: %w", err)
+	}
+	return writeAtomic(filepath.Join(l.root, setsFile), data)
+}
+
+// findSet returns the index of a set by name (case-insensitive), or -1
+func (l *Library) findSet(name string) int {
+	for i, s := range l.sets.Sets {
+		if strings.EqualFold(s.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// setsUsing returns the names of the sets that contain a design
+func (l *Library) setsUsing(id string) []string {
+	var names []string
+	for _, s := range l.sets.Sets {
+		for _, item := range s.Items {
+			if item.ID == id {
+				names = append(names, s.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// Sets returns every saved set sorted by name, and the name of the active one
+func (l *Library) Sets() ([]Set, string) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	sets := make([]Set, 0, len(l.sets.Sets))
+	for _, s := range l.sets.Sets {
+		sets = append(sets, *s)
+	}
+	return sets, l.sets.Active
+}
+
+// GetSet returns a saved set by name
+func (l *Library) GetSet(name string) (Set, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	i := l.findSet(name)
+	if i < 0 {
+		return Set{}, fmt.Errorf("%w: %s", ErrSetNotFound, name)
+	}
+	return *l.sets.Sets[i], nil
+}
+
+// SaveSet creates or replaces a set. Every item must refer to a design in the library.
+func (l *Library) SaveSet(set Set) (Set, error) {
+	set.Name = strings.TrimSpace(set.Name)
+	if set.Name == "" || strings.ContainsAny(set.Name, "/\\") {
+		return Set{}, fmt.Errorf("%w: name must be non-empty and must not contain slashes", ErrInvalidSet)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	items := make([]SetItem, 0, len(set.Items))
+	for _, item := range set.Items {
+		if _, ok := l.entries[item.ID]; !ok {
+			return Set{}, fmt.Errorf("%w: %s", ErrNotFound, item.ID)
+		}
+		items = append(items, SetItem{ID: item.ID, Folder: path.Clean("/" + item.Folder)})
+	}
+	set.Items = items
+	set.Updated = time.Now().UTC()
+
+	saved := &set
+	if i := l.findSet(set.Name); i >= 0 {
+		l.sets.Sets[i] = saved
+	} else {
+		l.sets.Sets = append(l.sets.Sets, saved)
+	}
+	if err := l.saveSets(); err != nil {
+		return Set{}, err
+	}
+	return set, nil
+}
+
+// DeleteSet removes a saved set. The designs stay in the library.
+func (l *Library) DeleteSet(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := l.findSet(name)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrSetNotFound, name)
+	}
+	if strings.EqualFold(l.sets.Active, l.sets.Sets[i].Name) {
+		l.sets.Active = ""
+	}
+	l.sets.Sets = append(l.sets.Sets[:i], l.sets.Sets[i+1:]...)
+	return l.saveSets()
+}
+
+// MarkActive records that a set now makes up the whole drive and where each of
+// its designs was stored. All other designs are marked as no longer on the drive.
+func (l *Library) MarkActive(name string, drivePaths map[string]string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for id, e := range l.entries {
+		e.DrivePath = drivePaths[id]
+	}
+	if err := l.save(); err != nil {
+		return err
+	}
+
+	l.sets.Active = name
+	return l.saveSets()
+}
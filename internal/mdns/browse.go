@@ -0,0 +1,290 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Instance is a service found by Browse
+type Instance struct {
+	Name       string   // Instance name (e.g., "Embroidery Buddy")
+	Host       string   // Target host (e.g., "raspberrypi.local")
+	Port       int      // Port number
+	Addrs      []net.IP // Addresses of the host
+	TXTRecords []string // TXT records (key=value pairs)
+}
+
+// URL returns the base URL of an HTTP or HTTPS instance, preferring an IPv4
+// address so it works without an mDNS resolver
+func (i Instance) URL(scheme string) string {
+	host := strings.TrimSuffix(i.Host, ".")
+	for _, addr := range i.Addrs {
+		if addr.To4() != nil {
+			host = addr.String()
+			break
+		}
+	}
+	if host == "" && len(i.Addrs) > 0 {
+		host = "[" + i.Addrs[0].String() + "]"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, host, i.Port)
+}
+
+// mdnsAddr is the IPv4 mDNS multicast group
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// DNS record types used by service discovery
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeTXT  = 16
+	typeAAAA = 28
+	typeSRV  = 33
+	classIN  = 1
+)
+
+// Browse looks for instances of a service type (e.g. "_http._tcp") on the
+// local network for the given time. It sends a one-shot query from an
+// ephemeral port, which responders answer directly (RFC 6762 section 6.7), so
+// it needs neither Avahi nor port 5353.
+func Browse(serviceType string, timeout time.Duration) ([]Instance, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open socket: %w", err)
+	}
+	defer conn.Close()
+
+	service := strings.TrimSuffix(serviceType, ".") + ".local."
+	query := buildQuery(service)
+
+	deadline := time.Now().Add(timeout)
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	// Ask again part way through, in case the first query was lost
+	if _, err := conn.WriteToUDP(query, mdnsAddr); err != nil {
+		return nil, fmt.Errorf("failed to send query: %w", err)
+	}
+	resend := time.AfterFunc(timeout/3, func() { conn.WriteToUDP(query, mdnsAddr) })
+	defer resend.Stop()
+
+	records := newRecordSet()
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		// Ignore anything that isn't a well-formed DNS response
+		_ = records.parse(buf[:n])
+	}
+
+	return records.instances(service), nil
+}
+
+// buildQuery encodes a PTR query for a service with the unicast-response bit set
+func buildQuery(service string) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[4:], 1) // one question
+	msg = appendName(msg, service)
+	msg = binary.BigEndian.AppendUint16(msg, typePTR)
+	msg = binary.BigEndian.AppendUint16(msg, classIN|0x8000)
+	return msg
+}
+
+// appendName encodes a dotted name as DNS labels
+func appendName(msg []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
+
+// recordSet collects the records of every response, keyed by lower-case name
+type recordSet struct {
+	ptr  map[string][]string
+	srv  map[string]srvRecord
+	txt  map[string][]string
+	addr map[string][]net.IP
+}
+
+type srvRecord struct {
+	target string
+	port   int
+}
+
+func newRecordSet() *recordSet {
+	return &recordSet{
+		ptr:  make(map[string][]string),
+		srv:  make(map[string]srvRecord),
+		txt:  make(map[string][]string),
+		addr: make(map[string][]net.IP),
+	}
+}
+
+var errMalformed = errors.New("malformed DNS message")
+
+// parse adds the answer, authority and additional records of a message
+func (s *recordSet) parse(msg []byte) error {
+	if len(msg) < 12 || msg[2]&0x80 == 0 {
+		return errMalformed
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	records := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return errMalformed
+		}
+		off = next + 4
+	}
+
+	for i := 0; i < records; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return errMalformed
+		}
+		rtype := binary.BigEndian.Uint16(msg[next:])
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		data := next + 10
+		if data+length > len(msg) {
+			return errMalformed
+		}
+		rdata := msg[data : data+length]
+		key := strings.ToLower(name)
+
+		switch rtype {
+		case typePTR:
+			if target, _, err := readName(msg, data); err == nil {
+				s.ptr[key] = appendUnique(s.ptr[key], target)
+			}
+		case typeSRV:
+			if length >= 7 {
+				if target, _, err := readName(msg, data+6); err == nil {
+					s.srv[key] = srvRecord{target: target, port: int(binary.BigEndian.Uint16(rdata[4:]))}
+				}
+			}
+		case typeTXT:
+			var txt []string
+			for j := 0; j < len(rdata); {
+				l := int(rdata[j])
+				if j+1+l > len(rdata) {
+					break
+				}
+				if l > 0 {
+					txt = append(txt, string(rdata[j+1:j+1+l]))
+				}
+				j += 1 + l
+			}
+			s.txt[key] = txt
+		case typeA, typeAAAA:
+			if length == net.IPv4len || length == net.IPv6len {
+				ip := net.IP(append([]byte(nil), rdata...))
+				if !containsIP(s.addr[key], ip) {
+					s.addr[key] = append(s.addr[key], ip)
+				}
+			}
+		}
+		off = data + length
+	}
+	return nil
+}
+
+// instances resolves the PTR records of a service into instances
+func (s *recordSet) instances(service string) []Instance {
+	var found []Instance
+	for _, ptr := range s.ptr[strings.ToLower(service)] {
+		srv, ok := s.srv[strings.ToLower(ptr)]
+		if !ok {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimSuffix(ptr, "."), "."+strings.TrimSuffix(service, "."))
+		found = append(found, Instance{
+			Name:       unescapeName(name),
+			Host:       srv.target,
+			Port:       srv.port,
+			Addrs:      s.addr[strings.ToLower(srv.target)],
+			TXTRecords: s.txt[strings.ToLower(ptr)],
+		})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Name < found[j].Name })
+	return found
+}
+
+// readName decodes a possibly compressed name at off and returns it with the
+// offset following it
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errMalformed
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errMalformed
+			}
+			labels = append(labels, escapeLabel(string(msg[off+1:off+1+l])))
+			off += 1 + l
+		}
+	}
+}
+
+// escapeLabel escapes dots inside a label, which instance names may contain
+func escapeLabel(label string) string {
+	return strings.ReplaceAll(label, ".", "\\.")
+}
+
+// unescapeName undoes escapeLabel
+func unescapeName(name string) string {
+	return strings.ReplaceAll(name, "\\.", ".")
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, existing := range list {
+		if strings.EqualFold(existing, s) {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func containsIP(list []net.IP, ip net.IP) bool {
+	for _, existing := range list {
+		if existing.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
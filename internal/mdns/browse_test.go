@@ -0,0 +1,211 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+const service = "_http._tcp.local."
+
+// record is a resource record for building test responses
+type record struct {
+	name  string
+	rtype uint16
+	data  []byte
+}
+
+// response encodes the records as the answers of a DNS response
+func response(records ...record) []byte {
+	msg := make([]byte, 12)
+	msg[2] = 0x84 // response, authoritative
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(records)))
+	for _, r := range records {
+		msg = encodeName(msg, r.name)
+		msg = binary.BigEndian.AppendUint16(msg, r.rtype)
+		msg = binary.BigEndian.AppendUint16(msg, classIN)
+		msg = binary.BigEndian.AppendUint32(msg, 120)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(r.data)))
+		msg = append(msg, r.data...)
+	}
+	return msg
+}
+
+// encodeName encodes a name like appendName, keeping escaped dots in their
+// label
+func encodeName(msg []byte, name string) []byte {
+	var label []byte
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == '\\' && i+1 < len(name):
+			i++
+			label = append(label, name[i])
+		case name[i] == '.':
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+			label = label[:0]
+		default:
+			label = append(label, name[i])
+		}
+	}
+	return append(msg, 0)
+}
+
+func ptr(instance string) record {
+	return record{service, typePTR, encodeName(nil, instance+"."+service)}
+}
+
+func srv(instance, target string, port uint16) record {
+	data := make([]byte, 6)
+	binary.BigEndian.PutUint16(data[4:], port)
+	return record{instance + "." + service, typeSRV, encodeName(data, target)}
+}
+
+func txt(instance string, entries ...string) record {
+	var data []byte
+	for _, e := range entries {
+		data = append(data, byte(len(e)))
+		data = append(data, e...)
+	}
+	return record{instance + "." + service, typeTXT, data}
+}
+
+func addr(host string, ip net.IP) record {
+	if ip4 := ip.To4(); ip4 != nil {
+		return record{host, typeA, ip4}
+	}
+	return record{host, typeAAAA, ip.To16()}
+}
+
+// TestParseResponses tests turning responses into instances
+func TestParseResponses(t *testing.T) {
+	v4 := net.ParseIP("192.168.1.20").To4()
+	v6 := net.ParseIP("fe80::1")
+
+	tests := []struct {
+		name      string
+		responses [][]byte
+		expected  []Instance
+	}{
+		{
+			"complete response",
+			[][]byte{response(ptr("Embroidery Buddy"), srv("Embroidery Buddy", "pi.local.", 80),
+				txt("Embroidery Buddy", "path=/", "version=1"), addr("pi.local.", v4), addr("pi.local.", v6))},
+			[]Instance{{Name: "Embroidery Buddy", Host: "pi.local.", Port: 80, Addrs: []net.IP{v4, v6}, TXTRecords: []string{"path=/", "version=1"}}},
+		},
+		{
+			"records split across responses",
+			[][]byte{response(ptr("Studio")), response(srv("Studio", "studio.local.", 8080)), response(addr("studio.local.", v4))},
+			[]Instance{{Name: "Studio", Host: "studio.local.", Port: 8080, Addrs: []net.IP{v4}}},
+		},
+		{
+			"repeated answers",
+			[][]byte{response(ptr("Studio"), srv("Studio", "studio.local.", 80), addr("studio.local.", v4)),
+				response(ptr("Studio"), addr("studio.local.", v4))},
+			[]Instance{{Name: "Studio", Host: "studio.local.", Port: 80, Addrs: []net.IP{v4}}},
+		},
+		{
+			"names differ in case",
+			[][]byte{response(ptr("Studio"), srv("STUDIO", "Studio.local.", 80), addr("studio.LOCAL.", v4))},
+			[]Instance{{Name: "Studio", Host: "Studio.local.", Port: 80, Addrs: []net.IP{v4}}},
+		},
+		{
+			"dot in the instance name",
+			[][]byte{response(ptr("Buddy v2\\.0"), srv("Buddy v2\\.0", "pi.local.", 80))},
+			[]Instance{{Name: "Buddy v2.0", Host: "pi.local.", Port: 80}},
+		},
+		{
+			"sorted by name",
+			[][]byte{response(ptr("Workshop"), srv("Workshop", "b.local.", 80), ptr("Attic"), srv("Attic", "a.local.", 80))},
+			[]Instance{{Name: "Attic", Host: "a.local.", Port: 80}, {Name: "Workshop", Host: "b.local.", Port: 80}},
+		},
+		{
+			"no SRV record",
+			[][]byte{response(ptr("Studio"), addr("studio.local.", v4))},
+			nil,
+		},
+		{
+			"another service",
+			[][]byte{response(record{"_ftp._tcp.local.", typePTR, encodeName(nil, "Studio._ftp._tcp.local.")})},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		records := newRecordSet()
+		for _, msg := range tt.responses {
+			if err := records.parse(msg); err != nil {
+				t.Fatalf("%s: parse failed: %v", tt.name, err)
+			}
+		}
+		if found := records.instances(service); !reflect.DeepEqual(found, tt.expected) {
+			t.Errorf("%s: found %+v, expected %+v", tt.name, found, tt.expected)
+		}
+	}
+}
+
+// TestCompressedNames tests following name pointers, and that a pointer loop
+// is rejected
+func TestCompressedNames(t *testing.T) {
+	// "Studio" then a pointer to the service name, the first after the header
+	data := append([]byte("\x06Studio"), 0xC0, 12)
+	msg := response(record{service, typePTR, data}, srv("Studio", "studio.local.", 80))
+
+	records := newRecordSet()
+	if err := records.parse(msg); err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	found := records.instances(service)
+	if len(found) != 1 || found[0].Name != "Studio" || found[0].Port != 80 {
+		t.Errorf("Expected the compressed name to resolve to Studio, got %+v", found)
+	}
+
+	loop := []byte{0xC0, 0}
+	if _, _, err := readName(loop, 0); !errors.Is(err, errMalformed) {
+		t.Errorf("Expected errMalformed for a pointer loop, got %v", err)
+	}
+}
+
+// TestMalformedResponses tests that broken messages are rejected
+func TestMalformedResponses(t *testing.T) {
+	complete := response(ptr("Studio"), srv("Studio", "studio.local.", 80))
+	query := buildQuery(service)
+
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"empty", nil},
+		{"short header", complete[:8]},
+		{"query", query},
+		{"truncated record", complete[:len(complete)-3]},
+		{"truncated name", complete[:16]},
+		{"missing records", append(append([]byte(nil), complete[:6]...), 0, 9, 0, 0, 0, 0)},
+	}
+
+	for _, tt := range tests {
+		if err := newRecordSet().parse(tt.msg); !errors.Is(err, errMalformed) {
+			t.Errorf("%s: expected errMalformed, got %v", tt.name, err)
+		}
+	}
+}
+
+// TestInstanceURL tests that URLs prefer an IPv4 address over the host name
+func TestInstanceURL(t *testing.T) {
+	tests := []struct {
+		instance Instance
+		expected string
+	}{
+		{Instance{Host: "pi.local.", Port: 80, Addrs: []net.IP{net.ParseIP("fe80::1"), net.ParseIP("192.168.1.20")}}, "http://192.168.1.20:80"},
+		{Instance{Host: "pi.local.", Port: 8080, Addrs: []net.IP{net.ParseIP("fe80::1")}}, "http://pi.local:8080"},
+		{Instance{Port: 443, Addrs: []net.IP{net.ParseIP("fe80::1")}}, "http://[fe80::1]:443"},
+	}
+
+	for _, tt := range tests {
+		if url := tt.instance.URL("http"); url != tt.expected {
+			t.Errorf("URL() = %q, expected %q", url, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Package tlscert provides the certificate the web UI and API are served with
+// over HTTPS.
+//
+// A certificate and key can be given as PEM files (for example from the
+// network's own CA or an ACME client). Otherwise a self-signed certificate is
+// created for the device's hostname, hostname.local and IP addresses and kept
+// on the SD card, so browsers only have to be told to trust it once. It is
+// replaced when it no longer covers those names, such as after the device is
+// given a new address, or when it is about to expire.
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// CertFile and KeyFile are the names of the self-signed certificate and
+	// its key in the directory given to SelfSigned
+	CertFile = "selfsigned.crt"
+	KeyFile  = "selfsigned.key"
+
+	// validity is how long a self-signed certificate lasts. Apple devices
+	// refuse server certificates valid for longer than 825 days.
+	validity = 825 * 24 * time.Hour
+
+	// renewBefore is how long before it expires a self-signed certificate is
+	// replaced
+	renewBefore = 30 * 24 * time.Hour
+)
+
+// ErrNoHosts is returned when a self-signed certificate is asked for no names
+var ErrNoHosts = errors.New("no hostnames or addresses for the certificate")
+
+// Load loads a certificate and its key from PEM files
+func Load(certFile, keyFile string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// SelfSigned returns the self-signed certificate kept in dir. A new one is
+// created when there is none, when it doesn't cover every one of hosts (names
+// or IP addresses), or when it expires within 30 days.
+func SelfSigned(dir string, hosts []string) (tls.Certificate, error) {
+	if len(hosts) == 0 {
+		return tls.Certificate{}, ErrNoHosts
+	}
+	certPath := filepath.Join(dir, CertFile)
+	keyPath := filepath.Join(dir, KeyFile)
+
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil && covers(cert.Leaf, hosts) {
+		return cert, nil
+	}
+
+	certPEM, keyPEM, err := generate(hosts, time.Now())
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+	// The key first, so a certificate is never left with another's key
+	if err := writeFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writeFile(certPath, certPEM, 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// covers reports whether a certificate is valid for all of hosts for at least
+// another renewBefore
+func covers(leaf *x509.Certificate, hosts []string) bool {
+	if leaf == nil || time.Now().Add(renewBefore).After(leaf.NotAfter) {
+		return false
+	}
+	for _, host := range hosts {
+		if leaf.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// generate creates a self-signed certificate and key for hosts, as PEM
+func generate(hosts []string, now time.Time) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"Embroidery Buddy"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode key: %w", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// writeFile replaces a file by writing a temporary one and renaming it
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// LocalHosts returns the names and addresses the device is reached at: its
+// hostname, hostname.local, localhost and the addresses of its network
+// interfaces. Link-local IPv6 addresses are left out, as browsers can't use
+// them in a URL without a zone.
+func LocalHosts() ([]string, error) {
+	var hosts []string
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hostname = strings.TrimSuffix(hostname, ".local")
+		hosts = append(hosts, hostname, hostname+".local")
+	}
+	hosts = append(hosts, "localhost")
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		hosts = append(hosts, ipNet.IP.String())
+	}
+	return hosts, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate, as browsers
+// show it, so it can be checked before trusting the certificate
+func Fingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,127 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSelfSigned tests that the certificate is kept until the names it covers
+// change
+func TestSelfSigned(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tls")
+	hosts := []string{"embroidery", "embroidery.local", "192.168.1.20", "::1"}
+
+	cert, err := SelfSigned(dir, hosts)
+	if err != nil {
+		t.Fatalf("SelfSigned failed: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	for _, host := range hosts {
+		if err := leaf.VerifyHostname(host); err != nil {
+			t.Errorf("Certificate doesn't cover %s: %v", host, err)
+		}
+	}
+	if leaf.NotAfter.Sub(leaf.NotBefore) > 826*24*time.Hour {
+		t.Errorf("Certificate is valid for too long: %v", leaf.NotAfter.Sub(leaf.NotBefore))
+	}
+	if info, err := os.Stat(filepath.Join(dir, KeyFile)); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the key to be private, got %v (%v)", info.Mode(), err)
+	}
+
+	// The same names get the same certificate
+	again, err := SelfSigned(dir, hosts[:2])
+	if err != nil {
+		t.Fatalf("SelfSigned failed: %v", err)
+	}
+	if Fingerprint(again) != Fingerprint(cert) {
+		t.Error("Expected the saved certificate to be reused")
+	}
+
+	// A new address gets a new one
+	moved, err := SelfSigned(dir, append(hosts, "10.0.0.5"))
+	if err != nil {
+		t.Fatalf("SelfSigned failed: %v", err)
+	}
+	if Fingerprint(moved) == Fingerprint(cert) {
+		t.Error("Expected a new certificate for a new address")
+	}
+	if _, err := Load(filepath.Join(dir, CertFile), filepath.Join(dir, KeyFile)); err != nil {
+		t.Errorf("Expected the new certificate to be saved: %v", err)
+	}
+
+	if _, err := SelfSigned(dir, nil); !errors.Is(err, ErrNoHosts) {
+		t.Errorf("Expected ErrNoHosts, got %v", err)
+	}
+}
+
+// TestRenew tests that a certificate close to expiring is replaced
+func TestRenew(t *testing.T) {
+	dir := t.TempDir()
+	hosts := []string{"embroidery.local"}
+
+	certPEM, keyPEM, err := generate(hosts, time.Now().Add(-validity+7*24*time.Hour))
+	if err != nil {
+		t.Fatalf("generate failed: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, CertFile), certPEM, 0644)
+	os.WriteFile(filepath.Join(dir, KeyFile), keyPEM, 0600)
+	old, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %v", err)
+	}
+
+	cert, err := SelfSigned(dir, hosts)
+	if err != nil {
+		t.Fatalf("SelfSigned failed: %v", err)
+	}
+	if Fingerprint(cert) == Fingerprint(old) {
+		t.Error("Expected a certificate expiring within a week to be replaced")
+	}
+}
+
+// TestLoad tests loading a certificate from files
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyPEM, err := generate([]string{"embroidery.example.com"}, time.Now())
+	if err != nil {
+		t.Fatalf("generate failed: %v", err)
+	}
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	os.WriteFile(certPath, certPEM, 0644)
+	os.WriteFile(keyPath, keyPEM, 0600)
+
+	if _, err := Load(certPath, keyPath); err != nil {
+		t.Errorf("Load failed: %v", err)
+	}
+	if _, err := Load(certPath, certPath); err == nil {
+		t.Error("Expected an error for a missing key")
+	}
+	if _, err := Load(filepath.Join(dir, "missing.pem"), keyPath); err == nil {
+		t.Error("Expected an error for a missing certificate")
+	}
+}
+
+func TestLocalHosts(t *testing.T) {
+	hosts, err := LocalHosts()
+	if err != nil {
+		t.Fatalf("LocalHosts failed: %v", err)
+	}
+	found := false
+	for _, host := range hosts {
+		if host == "localhost" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected localhost in %v", hosts)
+	}
+}
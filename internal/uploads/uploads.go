@@ -0,0 +1,481 @@
+// Package uploads stages resumable uploads on the Pi's own filesystem.
+//
+// An upload is created with its final length and then receives its data in
+// chunks, each appended at the offset the previous ones reached. A dropped
+// connection only loses the chunk in flight: the bytes already written stay
+// on the SD card, and the client asks for the offset and carries on from
+// there. Once every byte has arrived the upload is committed to the disk
+// image in one go. Uploads nobody has touched for a while are removed.
+package uploads
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound       = errors.New("upload not found")
+	ErrInvalid        = errors.New("invalid upload")
+	ErrTooLarge       = errors.New("upload is larger than allowed")
+	ErrOffsetMismatch = errors.New("upload offset mismatch")
+	ErrIncomplete     = errors.New("upload is not complete")
+	ErrInUse          = errors.New("upload is in use")
+	ErrNoSpace        = errors.New("not enough staging space")
+)
+
+const (
+	infoExt = ".json"
+	dataExt = ".part"
+)
+
+// Upload describes a staged upload and where it goes once complete
+type Upload struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+
+	// Dir is the directory on the disk the file is stored in
+	Dir string `json:"path"`
+
+	// Duplicates overrides the duplicate policy when the upload is committed
+	Duplicates string `json:"duplicates,omitempty"`
+
+	// Length is the size of the whole file, Offset how much of it arrived
+	Length int64 `json:"length"`
+	Offset int64 `json:"offset"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Complete reports whether every byte of the upload has arrived
+func (u Upload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+// Options configures a Store
+type Options struct {
+	// MaxSize is the largest upload accepted in bytes (0 for no limit)
+	MaxSize int64
+
+	// MaxTotal limits the combined length of the staged uploads in bytes, so
+	// they can't fill the SD card (0 for no limit). An upload's whole length
+	// counts from when it is created.
+	MaxTotal int64
+
+	// MaxAge is how long an upload may go without receiving data before
+	// Collect removes it (0 keeps uploads until they're committed or cancelled)
+	MaxAge time.Duration
+}
+
+// Store is a directory of staged uploads. Each upload has a JSON file with
+// its description and a file with the data received so far.
+type Store struct {
+	dir     string
+	options Options
+
+	mu      sync.Mutex
+	uploads map[string]*Upload
+
+	// busy holds the uploads being appended to or committed
+	busy map[string]bool
+}
+
+// Open opens the staging directory, creating it if needed, and picks up the
+// uploads left there before a restart. Uploads that can't be read, say after
+// a power cut while one was created, are discarded with a warning.
+func Open(dir string, options Options) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload staging directory: %w", err)
+	}
+
+	s := &Store{
+		dir:     dir,
+		options: options,
+		uploads: make(map[string]*Upload),
+		busy:    make(map[string]bool),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload staging directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		id, ext, _ := strings.Cut(name, ".")
+		if !validID(id) {
+			continue
+		}
+		switch "." + ext {
+		case infoExt:
+			u, err := s.load(id)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: discarded staged upload: %v\n", err)
+				os.Remove(s.infoPath(id))
+				os.Remove(s.dataPath(id))
+				continue
+			}
+			s.uploads[id] = u
+		case dataExt:
+			// Data without a description is from a creation that failed
+			if _, err := os.Stat(s.infoPath(id)); os.IsNotExist(err) {
+				os.Remove(filepath.Join(dir, name))
+			}
+		case infoExt + ".tmp":
+			// A description that was being replaced
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+
+	return s, nil
+}
+
+// load reads the description of an upload. The offset comes from the data
+// file, which may be ahead of the description after a crash.
+func (s *Store) load(id string) (*Upload, error) {
+	data, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload %s: %w", id, err)
+	}
+	var u Upload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, fmt.Errorf("failed to parse upload %s: %w", id, err)
+	}
+	if u.Length <= 0 {
+		return nil, fmt.Errorf("upload %s has no length", id)
+	}
+	u.ID = id
+
+	info, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload %s: %w", id, err)
+	}
+	u.Offset = min(info.Size(), u.Length)
+	return &u, nil
+}
+
+func (s *Store) infoPath(id string) string {
+	return filepath.Join(s.dir, id+infoExt)
+}
+
+func (s *Store) dataPath(id string) string {
+	return filepath.Join(s.dir, id+dataExt)
+}
+
+// save writes the description of an upload. It is synced before it replaces
+// the old one, and the directory after, so a power cut leaves one or the other.
+func (s *Store) save(u *Upload) error {
+	data, err := json.MarshalIndent(u, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode upload %s: %w", u.ID, err)
+	}
+	tmp := s.infoPath(u.ID) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write upload %s: %w", u.ID, err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.infoPath(u.ID))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write upload %s: %w", u.ID, err)
+	}
+
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to write upload %s: %w", u.ID, err)
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("failed to write upload %s: %w", u.ID, err)
+	}
+	return nil
+}
+
+// newID returns a random identifier for an upload
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validID reports whether id could have come from newID. Other files in the
+// staging directory are left alone.
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// Create starts an upload of u.Length bytes. The filename is reduced to its
+// base name; the ID, offset and times are filled in.
+func (s *Store) Create(u Upload) (Upload, error) {
+	name := path.Base(strings.ReplaceAll(u.Filename, "\\", "/"))
+	if name == "." || name == "/" || name == "" {
+		return Upload{}, fmt.Errorf("%w: filename is required", ErrInvalid)
+	}
+	if u.Length <= 0 {
+		return Upload{}, fmt.Errorf("%w: length must be positive", ErrInvalid)
+	}
+	if s.options.MaxSize > 0 && u.Length > s.options.MaxSize {
+		return Upload{}, fmt.Errorf("%w: %d bytes, the limit is %d", ErrTooLarge, u.Length, s.options.MaxSize)
+	}
+
+	id, err := newID()
+	if err != nil {
+		return Upload{}, err
+	}
+	now := time.Now().UTC()
+	u.ID = id
+	u.Filename = name
+	u.Offset = 0
+	u.Created = now
+	u.Updated = now
+
+	// Held until the upload is added, so uploads created at the same time
+	// can't both take the last of the space
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.options.MaxTotal > 0 {
+		if staged := s.staged(); staged+u.Length > s.options.MaxTotal {
+			return Upload{}, fmt.Errorf("%w: %d bytes are staged, the limit is %d", ErrNoSpace, staged, s.options.MaxTotal)
+		}
+	}
+
+	f, err := os.OpenFile(s.dataPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return Upload{}, fmt.Errorf("failed to create upload: %w", err)
+	}
+	f.Close()
+	if err := s.save(&u); err != nil {
+		os.Remove(s.dataPath(id))
+		return Upload{}, err
+	}
+
+	s.uploads[id] = &u
+	return u, nil
+}
+
+// staged returns the combined length of the staged uploads. The caller must
+// hold s.mu.
+func (s *Store) staged() int64 {
+	var total int64
+	for _, u := range s.uploads {
+		total += u.Length
+	}
+	return total
+}
+
+// Get returns the upload with the given id
+func (s *Store) Get(id string) (Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok {
+		return Upload{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return *u, nil
+}
+
+// List returns every staged upload, oldest first
+func (s *Store) List() []Upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Upload, 0, len(s.uploads))
+	for _, u := range s.uploads {
+		list = append(list, *u)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Created.Equal(list[j].Created) {
+			return list[i].Created.Before(list[j].Created)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// acquire marks an upload busy so it can't be appended to, committed or
+// removed by anyone else
+func (s *Store) acquire(id string) (*Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if s.busy[id] {
+		return nil, fmt.Errorf("%w: %s is receiving data or being committed", ErrInUse, id)
+	}
+	s.busy[id] = true
+	return u, nil
+}
+
+func (s *Store) release(id string) {
+	s.mu.Lock()
+	delete(s.busy, id)
+	s.mu.Unlock()
+}
+
+// Append writes data read from r at offset, which must be where the upload
+// has got to. Everything read before an error is kept, so the upload can
+// carry on from the returned offset. Data beyond the upload's length is
+// refused with ErrTooLarge.
+func (s *Store) Append(id string, offset int64, r io.Reader) (Upload, error) {
+	u, err := s.acquire(id)
+	if err != nil {
+		return Upload{}, err
+	}
+	defer s.release(id)
+
+	s.mu.Lock()
+	current := *u
+	s.mu.Unlock()
+	if offset != current.Offset {
+		return current, fmt.Errorf("%w: the upload is at %d, not %d", ErrOffsetMismatch, current.Offset, offset)
+	}
+
+	f, err := os.OpenFile(s.dataPath(id), os.O_WRONLY, 0)
+	if err != nil {
+		return current, fmt.Errorf("failed to open upload: %w", err)
+	}
+	// Start from the offset: a crash may have left bytes past it
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return current, fmt.Errorf("failed to open upload: %w", err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return current, fmt.Errorf("failed to open upload: %w", err)
+	}
+
+	n, copyErr := io.Copy(f, io.LimitReader(r, current.Length-offset))
+	if copyErr == nil {
+		// Anything left over doesn't fit
+		if extra, _ := r.Read(make([]byte, 1)); extra > 0 {
+			copyErr = fmt.Errorf("%w: more than the declared %d bytes", ErrTooLarge, current.Length)
+		}
+	} else {
+		copyErr = fmt.Errorf("chunk ended after %d bytes: %w", n, copyErr)
+	}
+
+	// Make sure what was received survives a power cut before reporting it
+	syncErr := f.Sync()
+	if closeErr := f.Close(); syncErr == nil {
+		syncErr = closeErr
+	}
+	if syncErr != nil {
+		return current, fmt.Errorf("failed to write upload: %w", syncErr)
+	}
+
+	s.mu.Lock()
+	u.Offset = offset + n
+	u.Updated = time.Now().UTC()
+	current = *u
+	s.mu.Unlock()
+	if err := s.save(&current); err != nil {
+		return current, err
+	}
+	return current, copyErr
+}
+
+// Commit passes the data of a complete upload to store, and removes the
+// upload if it succeeds. If it fails the upload is kept for another try.
+func (s *Store) Commit(id string, store func(u Upload, data *os.File) error) error {
+	u, err := s.acquire(id)
+	if err != nil {
+		return err
+	}
+	defer s.release(id)
+
+	s.mu.Lock()
+	current := *u
+	s.mu.Unlock()
+	if !current.Complete() {
+		return fmt.Errorf("%w: %d of %d bytes received", ErrIncomplete, current.Offset, current.Length)
+	}
+
+	f, err := os.Open(s.dataPath(id))
+	if err != nil {
+		return fmt.Errorf("failed to open upload: %w", err)
+	}
+	err = store(current, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return s.remove(id)
+}
+
+// Remove cancels an upload and deletes its data
+func (s *Store) Remove(id string) error {
+	if _, err := s.acquire(id); err != nil {
+		return err
+	}
+	defer s.release(id)
+	return s.remove(id)
+}
+
+// remove deletes an acquired upload
+func (s *Store) remove(id string) error {
+	s.mu.Lock()
+	delete(s.uploads, id)
+	s.mu.Unlock()
+
+	if err := os.Remove(s.infoPath(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove upload %s: %w", id, err)
+	}
+	if err := os.Remove(s.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove upload %s: %w", id, err)
+	}
+	return nil
+}
+
+// Collect removes the uploads that haven't received data for longer than
+// MaxAge, returning them
+func (s *Store) Collect() ([]Upload, error) {
+	if s.options.MaxAge <= 0 {
+		return nil, nil
+	}
+	cutoff := time.Now().Add(-s.options.MaxAge)
+
+	var removed []Upload
+	var errs []error
+	for _, u := range s.List() {
+		if u.Updated.After(cutoff) {
+			continue
+		}
+		if err := s.Remove(u.ID); err != nil {
+			if !errors.Is(err, ErrInUse) && !errors.Is(err, ErrNotFound) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		removed = append(removed, u)
+	}
+	return removed, errors.Join(errs...)
+}
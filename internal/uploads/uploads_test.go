@@ -0,0 +1,239 @@
+package uploads
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func openStore(t *testing.T, dir string, options Options) *Store {
+	t.Helper()
+	s, err := Open(dir, options)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return s
+}
+
+// TestResume tests that an upload carries on from where a dropped chunk
+// stopped, also after reopening the store
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, Options{})
+
+	u, err := s.Create(Upload{Filename: "designs/pack.zip", Dir: "/flowers", Length: 10})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if u.Filename != "pack.zip" || u.Offset != 0 || u.ID == "" {
+		t.Errorf("Unexpected upload: %+v", u)
+	}
+
+	// The connection drops after four bytes
+	dropped := io.MultiReader(strings.NewReader("0123"), iotest.ErrReader(io.ErrUnexpectedEOF))
+	u, err = s.Append(u.ID, 0, dropped)
+	if err == nil || u.Offset != 4 {
+		t.Fatalf("Expected an error at offset 4, got %d, %v", u.Offset, err)
+	}
+
+	s = openStore(t, dir, Options{})
+	u, err = s.Get(u.ID)
+	if err != nil {
+		t.Fatalf("Get after reopening failed: %v", err)
+	}
+	if u.Offset != 4 || u.Dir != "/flowers" {
+		t.Errorf("Expected offset 4 in /flowers after reopening, got %+v", u)
+	}
+
+	if _, err := s.Append(u.ID, 2, strings.NewReader("23")); !errors.Is(err, ErrOffsetMismatch) {
+		t.Errorf("Expected ErrOffsetMismatch, got %v", err)
+	}
+	u, err = s.Append(u.ID, 4, strings.NewReader("456789"))
+	if err != nil || !u.Complete() {
+		t.Fatalf("Expected a complete upload, got %+v, %v", u, err)
+	}
+
+	var got string
+	err = s.Commit(u.ID, func(u Upload, f *os.File) error {
+		data, err := io.ReadAll(f)
+		got = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if got != "0123456789" {
+		t.Errorf("Expected the whole file, got %q", got)
+	}
+	if _, err := s.Get(u.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the committed upload to be gone, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected an empty staging directory, found %d files", len(entries))
+	}
+}
+
+// TestLimits tests uploads that are too large or receive too much data
+func TestLimits(t *testing.T) {
+	s := openStore(t, t.TempDir(), Options{MaxSize: 8})
+
+	if _, err := s.Create(Upload{Filename: "big.pes", Length: 9}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+	if _, err := s.Create(Upload{Filename: "", Length: 1}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid for a missing filename, got %v", err)
+	}
+	if _, err := s.Create(Upload{Filename: "empty.pes"}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid for no length, got %v", err)
+	}
+
+	u, err := s.Create(Upload{Filename: "rose.pes", Length: 4})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	u, err = s.Append(u.ID, 0, strings.NewReader("too long"))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+	if u.Offset != 4 {
+		t.Errorf("Expected the declared length to be kept, got offset %d", u.Offset)
+	}
+}
+
+// TestStagingLimit tests that uploads are refused once the staged ones would
+// take up more than MaxTotal, counting their whole length from the start
+func TestStagingLimit(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, Options{MaxTotal: 10})
+
+	first, err := s.Create(Upload{Filename: "rose.pes", Length: 6})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := s.Create(Upload{Filename: "tulip.pes", Length: 5}); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Expected ErrNoSpace, got %v", err)
+	}
+	if _, err := s.Create(Upload{Filename: "daisy.pes", Length: 4}); err != nil {
+		t.Errorf("Expected an upload that fits to be created, got %v", err)
+	}
+
+	// Staged uploads still count after a restart
+	s = openStore(t, dir, Options{MaxTotal: 10})
+	if _, err := s.Create(Upload{Filename: "tulip.pes", Length: 5}); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Expected ErrNoSpace after reopening, got %v", err)
+	}
+
+	if err := s.Remove(first.ID); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := s.Create(Upload{Filename: "tulip.pes", Length: 5}); err != nil {
+		t.Errorf("Expected the space to be freed by Remove, got %v", err)
+	}
+}
+
+// TestBrokenUploads tests that uploads left unreadable by a power cut are
+// discarded when the store is opened, and the rest are kept
+func TestBrokenUploads(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, Options{})
+	good, err := s.Create(Upload{Filename: "rose.pes", Length: 4})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	truncated := strings.Repeat("1", 32)
+	noData := strings.Repeat("2", 32)
+	noLength := strings.Repeat("3", 32)
+	files := map[string]string{
+		truncated + infoExt: `{"filename": "tulip.pes", "len`,
+		truncated + dataExt: "",
+		noData + infoExt:    `{"filename": "daisy.pes", "length": 4}`,
+		noLength + infoExt:  `{}`,
+		noLength + dataExt:  "",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	s = openStore(t, dir, Options{})
+	if list := s.List(); len(list) != 1 || list[0].ID != good.ID {
+		t.Errorf("Expected only %s to be kept, got %+v", good.ID, list)
+	}
+	for name := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", name, err)
+		}
+	}
+}
+
+// TestCommitFailure tests that a failed commit keeps the upload, and that an
+// incomplete upload can't be committed
+func TestCommitFailure(t *testing.T) {
+	s := openStore(t, t.TempDir(), Options{})
+	u, err := s.Create(Upload{Filename: "rose.pes", Length: 4})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	noop := func(Upload, *os.File) error { return nil }
+	if err := s.Commit(u.ID, noop); !errors.Is(err, ErrIncomplete) {
+		t.Errorf("Expected ErrIncomplete, got %v", err)
+	}
+
+	if _, err := s.Append(u.ID, 0, strings.NewReader("rose")); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	errFull := errors.New("disk full")
+	if err := s.Commit(u.ID, func(Upload, *os.File) error { return errFull }); !errors.Is(err, errFull) {
+		t.Errorf("Expected the commit's error, got %v", err)
+	}
+	if _, err := s.Get(u.ID); err != nil {
+		t.Errorf("Expected the upload to be kept, got %v", err)
+	}
+
+	if err := s.Remove(u.ID); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := s.Remove(u.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+// TestCollect tests that only uploads idle for longer than MaxAge are removed
+func TestCollect(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, Options{MaxAge: time.Hour})
+
+	old, err := s.Create(Upload{Filename: "old.pes", Length: 4})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	recent, err := s.Create(Upload{Filename: "recent.pes", Length: 4})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	s.mu.Lock()
+	s.uploads[old.ID].Updated = time.Now().Add(-2 * time.Hour)
+	s.mu.Unlock()
+
+	removed, err := s.Collect()
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+	if len(removed) != 1 || removed[0].ID != old.ID {
+		t.Errorf("Expected only the old upload to be removed, got %+v", removed)
+	}
+	if list := s.List(); len(list) != 1 || list[0].ID != recent.ID {
+		t.Errorf("Expected the recent upload to be kept, got %+v", list)
+	}
+	if _, err := os.Stat(s.dataPath(old.ID)); !os.IsNotExist(err) {
+		t.Errorf("Expected the old upload's data to be deleted, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package webui
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+)
+
+// checkResponse is returned by CheckHandler and RepairHandler
+type checkResponse struct {
+	Success bool                    `json:"success"`
+	Check   diskmanager.CheckResult `json:"check"`
+}
+
+// CheckHandler checks the filesystem of the disk image without changing it
+func (h *Handler) CheckHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := h.diskManager.Check()
+	if err != nil {
+		writeError(w, err, "Failed to check filesystem")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, checkResponse{Success: true, Check: result})
+}
+
+// RepairHandler checks the filesystem of the disk image and repairs the
+// problems found. The disk is disconnected from the machine while it runs.
+func (h *Handler) RepairHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Repairing filesystem")
+	result, err := h.diskManager.Repair()
+	if err != nil {
+		writeError(w, err, "Failed to repair filesystem")
+		return
+	}
+	if result.Repaired {
+		log.Printf("Repaired %d filesystem problems", len(result.Problems))
+	}
+
+	writeJSON(w, http.StatusOK, checkResponse{Success: true, Check: result})
+}
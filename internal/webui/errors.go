@@ -0,0 +1,85 @@
+package webui
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+	"github.com/jgarman/embroidery-buddy/internal/library"
+	"github.com/jgarman/embroidery-buddy/internal/uploads"
+)
+
+// apiErrors maps the sentinel errors of the disk, disk images, snapshots,
+// library and resumable uploads to responses. An empty message uses the error's own.
+var apiErrors = []struct {
+	err     error
+	status  int
+	code    api.Code
+	message string
+}{
+	{diskmanager.ErrDiskFull, http.StatusInsufficientStorage, api.CodeDiskFull, "Disk is full. Please clear some files and try again."},
+	{diskmanager.ErrDiskNotInitialized, http.StatusServiceUnavailable, api.CodeDiskNotInitialized, "Disk not initialized"},
+	{diskmanager.ErrFileNotFound, http.StatusNotFound, api.CodeNotFound, "File not found"},
+	{diskmanager.ErrInvalidPath, http.StatusBadRequest, api.CodeInvalidPath, ""},
+	{diskmanager.ErrPathExists, http.StatusConflict, api.CodeAlreadyExists, ""},
+	{diskmanager.ErrDirectoryNotEmpty, http.StatusConflict, api.CodeDirectoryNotEmpty, "Directory is not empty"},
+	{diskmanager.ErrImageNotFound, http.StatusNotFound, api.CodeNotFound, "Disk image not found"},
+	{diskmanager.ErrInvalidImage, http.StatusBadRequest, api.CodeInvalidName, ""},
+	{diskmanager.ErrImageExists, http.StatusConflict, api.CodeAlreadyExists, ""},
+	{diskmanager.ErrImageActive, http.StatusConflict, api.CodeInUse, ""},
+	{diskmanager.ErrSnapshotsDisabled, http.StatusNotFound, api.CodeNotEnabled, "Snapshots are not enabled"},
+	{diskmanager.ErrSnapshotNotFound, http.StatusNotFound, api.CodeNotFound, "Snapshot not found"},
+	{diskmanager.ErrInvalidSnapshot, http.StatusBadRequest, api.CodeInvalidName, ""},
+	{diskmanager.ErrSnapshotExists, http.StatusConflict, api.CodeAlreadyExists, ""},
+	{diskmanager.ErrSnapshotSource, http.StatusConflict, api.CodeImageMismatch, ""},
+	{library.ErrNotFound, http.StatusNotFound, api.CodeNotFound, "Design not found"},
+	{library.ErrSetNotFound, http.StatusNotFound, api.CodeNotFound, "Set not found"},
+	{library.ErrInvalidName, http.StatusBadRequest, api.CodeInvalidName, ""},
+	{library.ErrInvalidSet, http.StatusBadRequest, api.CodeBadRequest, ""},
+	{library.ErrInUse, http.StatusConflict, api.CodeInUse, ""},
+	{uploads.ErrNotFound, http.StatusNotFound, api.CodeNotFound, "Upload not found"},
+	{uploads.ErrInvalid, http.StatusBadRequest, api.CodeBadRequest, ""},
+	{uploads.ErrTooLarge, http.StatusRequestEntityTooLarge, api.CodeTooLarge, ""},
+	{uploads.ErrOffsetMismatch, http.StatusConflict, api.CodeOffsetMismatch, ""},
+	{uploads.ErrIncomplete, http.StatusConflict, api.CodeOffsetMismatch, ""},
+	{uploads.ErrInUse, http.StatusConflict, api.CodeInUse, ""},
+	{uploads.ErrNoSpace, http.StatusInsufficientStorage, api.CodeDiskFull, ""},
+	{errSyncRequest, http.StatusBadRequest, api.CodeBadRequest, ""},
+	{errInvalidZip, http.StatusBadRequest, api.CodeBadRequest, ""},
+}
+
+// writeError writes the response for a failed operation. Errors apiErrors
+// doesn't know are logged and reported as failing to do action.
+func writeError(w http.ResponseWriter, err error, action string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, api.CodeTooLarge,
+			fmt.Sprintf("Request is larger than the limit of %d bytes", tooLarge.Limit))
+		return
+	}
+	for _, e := range apiErrors {
+		if errors.Is(err, e.err) {
+			message := e.message
+			if message == "" {
+				message = err.Error()
+			}
+			writeJSONError(w, e.status, e.code, message)
+			return
+		}
+	}
+	log.Printf("%s: %v", action, err)
+	writeJSONError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("%s: %v", action, err))
+}
+
+// writeJSON encodes v as the JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	api.WriteJSON(w, statusCode, v)
+}
+
+// writeJSONError writes a {"success": false, "error": ..., "code": ...} response
+func writeJSONError(w http.ResponseWriter, statusCode int, code api.Code, message string) {
+	api.WriteError(w, statusCode, code, message)
+}
@@ -0,0 +1,211 @@
+package webui
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+)
+
+// fileInfo describes one entry of a directory listing
+type fileInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	IsDir    bool      `json:"isDir"`
+	Modified time.Time `json:"modified"`
+
+	// SHA256 is the hash of a file's contents, for clients syncing the disk
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// listResponse is returned by ListFilesHandler
+type listResponse struct {
+	Success bool       `json:"success"`
+	Path    string     `json:"path"`
+	Files   []fileInfo `json:"files"`
+}
+
+// ListFilesHandler lists a directory (?path=, default "/") in on-disk order,
+// which is the order the embroidery machine shows, with the SHA-256 of each file
+func (h *Handler) ListFilesHandler(w http.ResponseWriter, r *http.Request) {
+	dirPath := path.Clean("/" + r.URL.Query().Get("path"))
+
+	entries, err := h.diskManager.ReadDir(dirPath)
+	if err != nil {
+		if errors.Is(err, diskmanager.ErrFileNotFound) {
+			writeJSONError(w, http.StatusNotFound, api.CodeNotFound, "Directory not found")
+			return
+		}
+		writeError(w, err, "Failed to list directory")
+		return
+	}
+
+	// The listing is still useful without hashes
+	hashes, err := h.diskManager.ContentHashes(dirPath)
+	if err != nil {
+		log.Printf("Failed to hash files in %s: %v", dirPath, err)
+	}
+
+	files := make([]fileInfo, 0, len(entries))
+	for _, e := range entries {
+		files = append(files, fileInfo{
+			Name:     e.Name(),
+			Size:     e.Size(),
+			IsDir:    e.IsDir(),
+			Modified: e.ModTime(),
+			SHA256:   hashes[e.Name()],
+		})
+	}
+
+	writeJSON(w, http.StatusOK, listResponse{Success: true, Path: dirPath, Files: files})
+}
+
+// pathResponse is returned by the handlers that change a file or directory
+type pathResponse struct {
+	Success bool   `json:"success"`
+	Path    string `json:"path"`
+}
+
+// sortRequest is the JSON body accepted by SortHandler
+type sortRequest struct {
+	// Path is the directory to sort (default "/")
+	Path string `json:"path"`
+
+	// Order is "name", "time" or "custom"
+	Order string `json:"order"`
+
+	// Names gives the wanted order for "custom"
+	Names []string `json:"names"`
+}
+
+// SortHandler rewrites the entry order of a directory on the disk
+func (h *Handler) SortHandler(w http.ResponseWriter, r *http.Request) {
+	var req sortRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Invalid JSON request body")
+		return
+	}
+
+	order := diskmanager.SortOrder{Key: diskmanager.SortKey(req.Order), Names: req.Names}
+	switch order.Key {
+	case diskmanager.SortByName, diskmanager.SortByTime, diskmanager.SortByCustom:
+	default:
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Order must be \"name\", \"time\" or \"custom\"")
+		return
+	}
+
+	dirPath := path.Clean("/" + req.Path)
+	log.Printf("Sorting %s by %s", dirPath, order.Key)
+
+	if err := h.diskManager.SortDirectory(dirPath, order); err != nil {
+		if errors.Is(err, diskmanager.ErrFileNotFound) {
+			writeJSONError(w, http.StatusNotFound, api.CodeNotFound, "Directory not found")
+			return
+		}
+		writeError(w, err, "Failed to sort directory")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pathResponse{Success: true, Path: dirPath})
+}
+
+// DownloadFileHandler returns the contents of a file on the disk
+func (h *Handler) DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
+	filePath := path.Clean("/" + mux.Vars(r)["path"])
+
+	file, err := h.diskManager.ReadFile(filePath)
+	if err != nil {
+		writeError(w, err, "Failed to read file")
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(filePath)}))
+	if _, err := io.Copy(w, file); err != nil {
+		log.Printf("Failed to send %s: %v", filePath, err)
+	}
+}
+
+// DeleteFileHandler removes a file, or an empty directory, from the disk
+func (h *Handler) DeleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	filePath := path.Clean("/" + mux.Vars(r)["path"])
+
+	log.Printf("Deleting %s", filePath)
+	err := h.diskManager.BeginTransaction(func(tx *diskmanager.Transaction) error {
+		return tx.RemoveFile(filePath)
+	})
+	if err != nil {
+		writeError(w, err, "Failed to delete file")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pathResponse{Success: true, Path: filePath})
+}
+
+// moveRequest is the JSON body accepted by MoveFileHandler
+type moveRequest struct {
+	// To is the new path of the file
+	To string `json:"to"`
+}
+
+// MoveFileHandler renames or moves a file on the disk. The file is copied to
+// its new path and removed from the old one in a single transaction.
+func (h *Handler) MoveFileHandler(w http.ResponseWriter, r *http.Request) {
+	sourcePath := path.Clean("/" + mux.Vars(r)["path"])
+
+	var req moveRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil || req.To == "" {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Request body must give the new path as \"to\"")
+		return
+	}
+	targetPath := path.Clean("/" + req.To)
+	if sourcePath == targetPath {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Source and destination are the same")
+		return
+	}
+
+	// Read the file before the transaction, which locks the disk
+	file, err := h.diskManager.ReadFile(sourcePath)
+	if err != nil {
+		writeError(w, err, "Failed to move file")
+		return
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		writeError(w, err, "Failed to move file")
+		return
+	}
+
+	log.Printf("Moving %s to %s", sourcePath, targetPath)
+	err = h.diskManager.BeginTransaction(func(tx *diskmanager.Transaction) error {
+		// A change of case only is a rename of the same entry
+		if strings.EqualFold(sourcePath, targetPath) {
+			if err := tx.RemoveFile(sourcePath); err != nil {
+				return err
+			}
+			return tx.WriteFile(targetPath, bytes.NewReader(data), int64(len(data)))
+		}
+		if err := tx.WriteFile(targetPath, bytes.NewReader(data), int64(len(data))); err != nil {
+			return err
+		}
+		return tx.RemoveFile(sourcePath)
+	})
+	if err != nil {
+		writeError(w, err, "Failed to move file")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, pathResponse{Success: true, Path: targetPath})
+}
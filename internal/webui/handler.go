@@ -12,44 +12,166 @@ import (
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/csrf"
 	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+	"github.com/jgarman/embroidery-buddy/internal/filenames"
+	"github.com/jgarman/embroidery-buddy/internal/library"
+	"github.com/jgarman/embroidery-buddy/internal/uploads"
 )
 
 // Handler manages HTTP requests for the web UI
 type Handler struct {
 	diskManager *diskmanager.Manager
 	templates   *template.Template
+	options     Options
+}
+
+// Options contains optional web UI settings
+type Options struct {
+	// FilenamePolicy controls how uploaded filenames are stored on the disk
+	FilenamePolicy filenames.Policy
+
+	// Library is the design catalogue outside the disk image (nil disables the library API)
+	Library *library.Library
+
+	// Images manages multiple disk images (nil disables the image API)
+	Images *diskmanager.ImageStore
+
+	// Uploads stages resumable uploads (nil disables them)
+	Uploads *uploads.Store
+}
+
+// DefaultOptions returns the options used when nothing is configured
+func DefaultOptions() Options {
+	return Options{
+		FilenamePolicy: filenames.DefaultPolicy(),
+	}
 }
 
 // New creates a new web UI handler
-func New(dm *diskmanager.Manager) (*Handler, error) {
+func New(dm *diskmanager.Manager, options Options) (*Handler, error) {
 	// Parse embedded templates
 	tmpl, err := template.New("index").Parse(indexTemplate)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse template: %w", err)
 	}
+	if _, err := tmpl.New("login").Parse(loginTemplate); err != nil {
+		return nil, fmt.Errorf("failed to parse login template: %w", err)
+	}
+
+	if err := options.FilenamePolicy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid filename policy: %w", err)
+	}
 
 	return &Handler{
 		diskManager: dm,
 		templates:   tmpl,
+		options:     options,
 	}, nil
 }
 
+// newNormalizer creates a filename normalizer for one upload that checks
+// for collisions against the files already on the disk. Names it picks are
+// only good for rejecting invalid uploads before the host is disconnected:
+// another upload can take them before the transaction starts.
+func (h *Handler) newNormalizer() *filenames.Normalizer {
+	return h.normalizerFor(h.diskManager.ReadDir)
+}
+
+// txNormalizer creates a filename normalizer that checks for collisions
+// within a transaction, where the names it picks can't be taken by others
+func (h *Handler) txNormalizer(tx *diskmanager.Transaction) *filenames.Normalizer {
+	return h.normalizerFor(tx.ReadDir)
+}
+
+// normalizerFor creates a filename normalizer listing directories with readDir
+func (h *Handler) normalizerFor(readDir func(string) ([]os.FileInfo, error)) *filenames.Normalizer {
+	return filenames.NewNormalizer(h.options.FilenamePolicy, func(dir string) ([]string, error) {
+		entries, err := readDir(dir)
+		if errors.Is(err, diskmanager.ErrFileNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names, nil
+	})
+}
+
+// uploadResponse is returned after a successful upload
+type uploadResponse struct {
+	Success bool `json:"success"`
+	uploadResult
+}
+
+// uploadResult describes what an upload stored on the disk
+type uploadResult struct {
+	Filename       string             `json:"filename"`
+	Size           int64              `json:"size"`
+	FilesExtracted int                `json:"filesExtracted,omitempty"`
+	Files          []filenames.Rename `json:"files"`
+
+	// Duplicates lists stored files whose contents were already on the disk
+	Duplicates []diskmanager.WriteResult `json:"duplicates,omitempty"`
+}
+
 // IndexHandler serves the main upload page
 func (h *Handler) IndexHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
-	if err := h.templates.ExecuteTemplate(w, "index", nil); err != nil {
+	data := struct {
+		CSRFToken string
+	}{
+		CSRFToken: csrf.Token(r),
+	}
+	if err := h.templates.ExecuteTemplate(w, "index", data); err != nil {
+		log.Printf("Error rendering template: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// LoginPageHandler serves the login form. ?next= is where to go after
+// logging in, and ?failed=1 shows that the last attempt was refused.
+func (h *Handler) LoginPageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	data := struct {
+		Next      string
+		Failed    bool
+		CSRFToken string
+	}{
+		Next:      r.URL.Query().Get("next"),
+		Failed:    r.URL.Query().Get("failed") != "",
+		CSRFToken: csrf.Token(r),
+	}
+	if err := h.templates.ExecuteTemplate(w, "login", data); err != nil {
 		log.Printf("Error rendering template: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
 
-// UploadHandler handles file uploads using streaming multipart reader
+// UploadHandler handles file uploads using streaming multipart reader.
+// ?path= is the directory to store the file, or the contents of a ZIP archive,
+// in (default "/"). ?duplicates=keep|skip|replace overrides the configured
+// duplicate policy.
 func (h *Handler) UploadHandler(w http.ResponseWriter, r *http.Request) {
+	dir := path.Clean("/" + r.URL.Query().Get("path"))
+
+	policy := diskmanager.DuplicatePolicy(r.URL.Query().Get("duplicates"))
+	if !validDuplicatePolicy(policy) {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "duplicates must be \"keep\", \"skip\" or \"replace\"")
+		return
+	}
+
 	// Limit upload size to 200MB
 	r.Body = http.MaxBytesReader(w, r.Body, 200*1024*1024)
 
@@ -58,6 +180,8 @@ func (h *Handler) UploadHandler(w http.ResponseWriter, r *http.Request) {
 	var filename string
 	var fileSize int64
 	var filesExtracted int
+	var stored []filenames.Rename
+	var duplicates []diskmanager.WriteResult
 	var err error
 	var part *multipart.Part
 	var reader *multipart.Reader
@@ -65,7 +189,7 @@ func (h *Handler) UploadHandler(w http.ResponseWriter, r *http.Request) {
 	reader, err = r.MultipartReader()
 	if err != nil {
 		log.Printf("Error creating multipart reader: %v", err)
-		http.Error(w, "Invalid multipart request", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Invalid multipart request")
 		return
 	}
 
@@ -78,7 +202,11 @@ func (h *Handler) UploadHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		if err != nil {
 			log.Printf("Error reading multipart part: %v", err)
-			http.Error(w, "Error reading upload", http.StatusBadRequest)
+			if errors.As(err, new(*http.MaxBytesError)) {
+				writeError(w, err, "Error reading upload")
+				return
+			}
+			writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Error reading upload")
 			return
 		}
 
@@ -92,16 +220,13 @@ func (h *Handler) UploadHandler(w http.ResponseWriter, r *http.Request) {
 		filename = part.FileName()
 		if filename == "" {
 			part.Close()
-			http.Error(w, "Empty filename", http.StatusBadRequest)
+			writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Empty filename")
 			return
 		}
 
 		// Sanitize the filename to prevent path traversal
 		filename = filepath.Base(filename)
 
-		// Store the file in the root directory of the disk
-		filePath := "/" + filename
-
 		log.Printf("Uploading file: %s", filename)
 
 		// Check if this is a zip file
@@ -113,30 +238,12 @@ func (h *Handler) UploadHandler(w http.ResponseWriter, r *http.Request) {
 			bufferedReader := bufio.NewReaderSize(part, 1024*1024)
 
 			// Extract zip contents
-			filesExtracted, fileSize, err = h.extractZipStream(bufferedReader, 200*1024*1024)
+			filesExtracted, fileSize, stored, duplicates, err = h.extractZipStream(bufferedReader, 200*1024*1024, dir, policy)
 			part.Close()
 
 			if err != nil {
 				log.Printf("Error extracting zip file: %v", err)
-
-				// Check for specific error types and provide user-friendly messages
-				var statusCode int
-				var errorMessage string
-
-				if errors.Is(err, diskmanager.ErrDiskFull) {
-					statusCode = http.StatusInsufficientStorage
-					errorMessage = "Disk is full. Please clear some files and try again."
-				} else if errors.Is(err, diskmanager.ErrDiskNotInitialized) {
-					statusCode = http.StatusInternalServerError
-					errorMessage = "Disk not initialized. Please contact support."
-				} else {
-					statusCode = http.StatusInternalServerError
-					errorMessage = fmt.Sprintf("Failed to extract zip file: %v", err)
-				}
-
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(statusCode)
-				fmt.Fprintf(w, `{"success": false, "error": "%s"}`, errorMessage)
+				writeError(w, err, "Failed to extract zip file")
 				return
 			}
 
@@ -148,35 +255,14 @@ func (h *Handler) UploadHandler(w http.ResponseWriter, r *http.Request) {
 			bufferedReader := bufio.NewReaderSize(part, 1024*1024)
 			countingReader := &countingReader{reader: bufferedReader, count: &byteCounter}
 
-			err = h.diskManager.BeginTransaction(func(tx *diskmanager.Transaction) error {
-				// Pass a large size since we're streaming - the actual size will be determined by EOF
-				return tx.WriteFile(filePath, countingReader, 100*1024*1024)
-			})
-
+			// Pass a large size since we're streaming - the actual size will be determined by EOF
+			stored, duplicates, err = h.writeUpload(filename, countingReader, 100*1024*1024, dir, policy)
 			fileSize = byteCounter
 			part.Close()
 
 			if err != nil {
 				log.Printf("Error writing file to disk: %v", err)
-
-				// Check for specific error types and provide user-friendly messages
-				var statusCode int
-				var errorMessage string
-
-				if errors.Is(err, diskmanager.ErrDiskFull) {
-					statusCode = http.StatusInsufficientStorage
-					errorMessage = "Disk is full. Please clear some files and try again."
-				} else if errors.Is(err, diskmanager.ErrDiskNotInitialized) {
-					statusCode = http.StatusInternalServerError
-					errorMessage = "Disk not initialized. Please contact support."
-				} else {
-					statusCode = http.StatusInternalServerError
-					errorMessage = fmt.Sprintf("Failed to save file: %v", err)
-				}
-
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(statusCode)
-				fmt.Fprintf(w, `{"success": false, "error": "%s"}`, errorMessage)
+				writeError(w, err, "Failed to save file")
 				return
 			}
 		}
@@ -186,22 +272,91 @@ func (h *Handler) UploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if filename == "" {
-		http.Error(w, "No file provided", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "No file provided")
 		return
 	}
 
 	// Return success response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	writeJSON(w, http.StatusOK, uploadResponse{
+		Success: true,
+		uploadResult: uploadResult{
+			Filename:       filename,
+			Size:           fileSize,
+			FilesExtracted: filesExtracted,
+			Files:          stored,
+			Duplicates:     duplicates,
+		},
+	})
 	if filesExtracted > 0 {
-		fmt.Fprintf(w, `{"success": true, "filename": "%s", "size": %d, "filesExtracted": %d}`, filename, fileSize, filesExtracted)
 		log.Printf("Successfully extracted %d files from %s (%d bytes total)", filesExtracted, filename, fileSize)
 	} else {
-		fmt.Fprintf(w, `{"success": true, "filename": "%s", "size": %d}`, filename, fileSize)
 		log.Printf("Successfully uploaded: %s (%d bytes)", filename, fileSize)
 	}
 }
 
+// validDuplicatePolicy reports whether policy is a duplicate policy, or empty
+// for the configured one
+func validDuplicatePolicy(policy diskmanager.DuplicatePolicy) bool {
+	switch policy {
+	case "", diskmanager.DuplicateKeep, diskmanager.DuplicateSkip, diskmanager.DuplicateReplace:
+		return true
+	}
+	return false
+}
+
+// writeUpload stores one uploaded file in dir under a name the machine can
+// use, in a single transaction. size is an upper bound for the data in r.
+func (h *Handler) writeUpload(filename string, r io.Reader, size int64, dir string, policy diskmanager.DuplicatePolicy) ([]filenames.Rename, []diskmanager.WriteResult, error) {
+	if _, err := h.newNormalizer().Normalize(path.Join(dir, filename)); err != nil {
+		return nil, nil, fmt.Errorf("%w: filename %s: %v", diskmanager.ErrInvalidPath, filename, err)
+	}
+
+	var filePath string
+	var duplicates []diskmanager.WriteResult
+	err := h.diskManager.BeginTransaction(func(tx *diskmanager.Transaction) error {
+		var err error
+		filePath, err = h.txNormalizer(tx).Normalize(path.Join(dir, filename))
+		if err != nil {
+			return fmt.Errorf("%w: filename %s: %v", diskmanager.ErrInvalidPath, filename, err)
+		}
+		if policy != "" {
+			if err := tx.SetDuplicatePolicy(policy); err != nil {
+				return err
+			}
+		}
+		if err := tx.WriteFile(filePath, r, size); err != nil {
+			return err
+		}
+		duplicates = findDuplicates(tx.Written())
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return []filenames.Rename{{Original: filename, Stored: filePath}}, duplicates, nil
+}
+
+// findDuplicates returns the written files whose contents were already on the
+// disk, logging what happened to each
+func findDuplicates(written []diskmanager.WriteResult) []diskmanager.WriteResult {
+	var duplicates []diskmanager.WriteResult
+	for _, result := range written {
+		if len(result.DuplicateOf) == 0 {
+			continue
+		}
+		switch {
+		case result.Skipped:
+			log.Printf("Skipped %s: already present as %s", result.Path, strings.Join(result.DuplicateOf, ", "))
+		case result.Replaced:
+			log.Printf("Stored %s, replacing duplicate %s", result.Path, strings.Join(result.DuplicateOf, ", "))
+		default:
+			log.Printf("Stored %s, already present as %s", result.Path, strings.Join(result.DuplicateOf, ", "))
+		}
+		duplicates = append(duplicates, result)
+	}
+	return duplicates
+}
+
 // countingReader wraps an io.Reader and counts bytes read
 type countingReader struct {
 	reader io.Reader
@@ -219,41 +374,64 @@ func isZipFile(filename string) bool {
 	return strings.HasSuffix(strings.ToLower(filename), ".zip")
 }
 
-// extractZipStream extracts a zip file from a reader and writes all files to the disk
-// Returns the number of files extracted and any error
-func (h *Handler) extractZipStream(reader io.Reader, maxSize int64) (int, int64, error) {
+// errInvalidZip marks uploaded .zip files that aren't ZIP archives
+var errInvalidZip = errors.New("not a valid ZIP archive")
+
+// extractZipStream extracts a zip file from a reader and writes all files to the disk below dir
+// Returns the number of files extracted, their total size, the names they were stored under,
+// the files that were already on the disk and any error
+func (h *Handler) extractZipStream(reader io.Reader, maxSize int64, dir string, policy diskmanager.DuplicatePolicy) (int, int64, []filenames.Rename, []diskmanager.WriteResult, error) {
 	// Since zip files need random access to read the central directory,
 	// we need to buffer the entire file in memory
 	// For very large files, this could be memory-intensive
 	buf := &bytes.Buffer{}
 	written, err := io.CopyN(buf, reader, maxSize)
 	if err != nil && err != io.EOF {
-		return 0, written, fmt.Errorf("failed to buffer zip file: %w", err)
+		return 0, written, nil, nil, fmt.Errorf("failed to buffer zip file: %w", err)
 	}
 
 	// Create a zip reader from the buffered data
 	zipReader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
 	if err != nil {
-		return 0, written, fmt.Errorf("failed to open zip file: %w", err)
+		return 0, written, nil, nil, fmt.Errorf("%w: %v", errInvalidZip, err)
 	}
 
+	return h.extractZip(zipReader, dir, policy)
+}
+
+// extractZip writes all files of a zip archive to the disk below dir in one
+// transaction. It returns the number of files extracted, their total size,
+// the names they were stored under, the files that were already on the disk
+// and any error.
+func (h *Handler) extractZip(zipReader *zip.Reader, dir string, policy diskmanager.DuplicatePolicy) (int, int64, []filenames.Rename, []diskmanager.WriteResult, error) {
 	filesExtracted := 0
 	totalSize := int64(0)
+	var stored []filenames.Rename
+	var duplicates []diskmanager.WriteResult
+
+	// Reject invalid names before the transaction disconnects the host
+	if _, err := zipPaths(zipReader, dir, h.newNormalizer()); err != nil {
+		return 0, 0, nil, nil, err
+	}
 
 	// Extract all files in a single transaction
-	err = h.diskManager.BeginTransaction(func(tx *diskmanager.Transaction) error {
+	err := h.diskManager.BeginTransaction(func(tx *diskmanager.Transaction) error {
+		// Pick the names again now that no other upload can take them
+		storedPaths, err := zipPaths(zipReader, dir, h.txNormalizer(tx))
+		if err != nil {
+			return err
+		}
+		if policy != "" {
+			if err := tx.SetDuplicatePolicy(policy); err != nil {
+				return err
+			}
+		}
 		for _, zipFile := range zipReader.File {
-			// Skip directories
-			if zipFile.FileInfo().IsDir() {
+			storedPath, ok := storedPaths[zipFile]
+			if !ok {
 				continue
 			}
-
-			// Sanitize the file path to prevent directory traversal
 			cleanPath := filepath.Clean("/" + zipFile.Name)
-			if strings.Contains(cleanPath, "..") {
-				log.Printf("Skipping potentially malicious path in zip: %s", zipFile.Name)
-				continue
-			}
 
 			// Open the file in the zip
 			rc, err := zipFile.Open()
@@ -262,32 +440,69 @@ func (h *Handler) extractZipStream(reader io.Reader, maxSize int64) (int, int64,
 			}
 
 			// Write the file to disk
-			if err := tx.WriteFile(cleanPath, rc, int64(zipFile.UncompressedSize64)); err != nil {
+			if err := tx.WriteFile(storedPath, rc, int64(zipFile.UncompressedSize64)); err != nil {
 				rc.Close()
 				return fmt.Errorf("failed to write file %s: %w", zipFile.Name, err)
 			}
 
 			rc.Close()
+			stored = append(stored, filenames.Rename{Original: cleanPath, Stored: storedPath})
 			filesExtracted++
 			totalSize += int64(zipFile.UncompressedSize64)
 			log.Printf("Extracted: %s (%d bytes)", zipFile.Name, zipFile.UncompressedSize64)
 		}
 
+		duplicates = findDuplicates(tx.Written())
 		return nil
 	})
 
 	if err != nil {
-		return filesExtracted, totalSize, err
+		return filesExtracted, totalSize, stored, duplicates, err
 	}
 
-	return filesExtracted, totalSize, nil
+	return filesExtracted, totalSize, stored, duplicates, nil
 }
 
-// HealthHandler provides a health check endpoint
-func (h *Handler) HealthHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+// zipPaths returns the paths the files of a ZIP archive are stored under in
+// dir. Directories and paths escaping the archive are left out.
+func zipPaths(zipReader *zip.Reader, dir string, normalizer *filenames.Normalizer) (map[*zip.File]string, error) {
+	storedPaths := make(map[*zip.File]string)
+	for _, zipFile := range zipReader.File {
+		// Skip directories
+		if zipFile.FileInfo().IsDir() {
+			continue
+		}
+
+		// Sanitize the file path to prevent directory traversal
+		cleanPath := filepath.Clean("/" + zipFile.Name)
+		if strings.Contains(cleanPath, "..") {
+			log.Printf("Skipping potentially malicious path in zip: %s", zipFile.Name)
+			continue
+		}
+
+		storedPath, err := normalizer.Normalize(path.Join(dir, cleanPath))
+		if err != nil {
+			return nil, fmt.Errorf("%w: filename %s in zip: %v", diskmanager.ErrInvalidPath, zipFile.Name, err)
+		}
+		storedPaths[zipFile] = storedPath
+	}
+	return storedPaths, nil
+}
+
+// healthResponse is returned by HealthHandler
+type healthResponse struct {
+	Success     bool   `json:"success"`
+	Status      string `json:"status"`
+	Temperature string `json:"temperature"`
+
+	// Filesystem is the result of the last filesystem check, if there was one
+	Filesystem *diskmanager.CheckResult `json:"filesystem,omitempty"`
+}
 
+// HealthHandler provides a health check endpoint. It includes the result of
+// the last filesystem check; status is "degraded" while that check found
+// problems that weren't repaired.
+func (h *Handler) HealthHandler(w http.ResponseWriter, r *http.Request) {
 	temperature := "0°C"
 
 	// Get operating temperature
@@ -300,29 +515,49 @@ func (h *Handler) HealthHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	io.WriteString(w, fmt.Sprintf(`{"status": "ok", "temperature": "%s"}`, temperature))
+	health := healthResponse{
+		Success:     true,
+		Status:      "ok",
+		Temperature: temperature,
+	}
+	if check, ok := h.diskManager.LastCheck(); ok {
+		health.Filesystem = &check
+		if check.Error != "" || (!check.Clean() && !check.Repaired) {
+			health.Status = "degraded"
+		}
+	}
+
+	writeJSON(w, http.StatusOK, health)
 }
 
-// ClearFilesHandler clears all files from the disk by recreating the filesystem
+// ClearFilesHandler clears all files from the disk, or only the contents of the
+// folder given in the path query parameter
 func (h *Handler) ClearFilesHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	folder := r.URL.Query().Get("path")
+	if folder == "" {
+		folder = "/"
 	}
 
-	log.Printf("Clearing all files from disk")
+	log.Printf("Clearing files from disk folder %s", folder)
 
-	// Clear all files by recreating the filesystem
-	if err := h.diskManager.ClearFiles(); err != nil {
+	// Clear in place, keeping the volume label and geometry
+	if err := h.diskManager.ClearDirectory(folder); err != nil {
 		log.Printf("Failed to clear files: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to clear files: %v", err), http.StatusInternalServerError)
+		if errors.Is(err, diskmanager.ErrFileNotFound) {
+			writeJSONError(w, http.StatusNotFound, api.CodeNotFound, fmt.Sprintf("Folder not found: %s", folder))
+			return
+		}
+		writeError(w, err, "Failed to clear files")
 		return
 	}
 
-	log.Printf("Successfully cleared all files from disk")
+	log.Printf("Successfully cleared files from disk folder %s", folder)
 
-	// Return success response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	io.WriteString(w, `{"success": true}`)
+	if h.options.Library != nil {
+		if err := h.options.Library.ForgetDrivePathsIn(folder); err != nil {
+			log.Printf("Failed to reset library drive paths: %v", err)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, api.OK)
 }
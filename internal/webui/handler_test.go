@@ -0,0 +1,545 @@
+package webui
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/design"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+	"github.com/jgarman/embroidery-buddy/internal/filenames"
+	"github.com/jgarman/embroidery-buddy/internal/library"
+	"github.com/jgarman/embroidery-buddy/internal/uploads"
+)
+
+// newTestHandler returns a handler for a fresh 10MB disk image
+func newTestHandler(t *testing.T) *Handler {
+	t.Helper()
+	return newTestHandlerWith(t, diskmanager.Config{})
+}
+
+// newTestHandlerWith returns a handler for a fresh 10MB disk image managed
+// with config
+func newTestHandlerWith(t *testing.T, config diskmanager.Config) *Handler {
+	t.Helper()
+	config.DiskPath = filepath.Join(t.TempDir(), "test.img")
+	if err := diskmanager.CreateDiskImage(config.DiskPath, 10, diskmanager.DiskFormat{}); err != nil {
+		t.Fatalf("Failed to create disk image: %v", err)
+	}
+	manager, err := diskmanager.New(config, diskmanager.NewNoOpUsbGadget())
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	t.Cleanup(func() { manager.Close() })
+
+	h, err := New(manager, DefaultOptions())
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	return h
+}
+
+// serve runs a request through a handler function. vars are the route
+// variables the router would have set.
+func serve(handler http.HandlerFunc, req *http.Request, vars map[string]string) *httptest.ResponseRecorder {
+	if vars != nil {
+		req = mux.SetURLVars(req, vars)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// uploadRequest builds a multipart upload of one file
+func uploadRequest(t *testing.T, target, filename string, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatalf("CreateFormFile failed: %v", err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	req := httptest.NewRequest("POST", target, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// decodeError checks that a response is a JSON error with the given status
+// and code
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder, status int, code api.Code) api.ErrorResponse {
+	t.Helper()
+	if rec.Code != status {
+		t.Errorf("Expected status %d, got %d: %s", status, rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected a JSON response, got %q", ct)
+	}
+	var resp api.ErrorResponse
+	dec := json.NewDecoder(rec.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&resp); err != nil {
+		t.Fatalf("Response is not an error envelope: %v", err)
+	}
+	if resp.Success || resp.Error == "" || resp.Code != code {
+		t.Errorf("Expected a %s error, got %+v", code, resp)
+	}
+	return resp
+}
+
+// TestUpload tests that filenames needing escaping come back as valid JSON
+func TestUpload(t *testing.T) {
+	h := newTestHandler(t)
+
+	name := `say "hi"\.dst`
+	rec := serve(h.UploadHandler, uploadRequest(t, "/api/upload", name, []byte("stitches")), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp uploadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Response is not valid JSON: %v\n%s", err, rec.Body.String())
+	}
+	if !resp.Success || len(resp.Files) != 1 {
+		t.Errorf("Expected one stored file, got %+v", resp)
+	}
+}
+
+// TestUploadErrors tests the codes of failed uploads
+func TestUploadErrors(t *testing.T) {
+	h := newTestHandler(t)
+
+	big := bytes.Repeat([]byte{1}, 12*1024*1024)
+	rec := serve(h.UploadHandler, uploadRequest(t, "/api/upload", `big "one".dst`, big), nil)
+	decodeError(t, rec, http.StatusInsufficientStorage, api.CodeDiskFull)
+
+	rec = serve(h.UploadHandler, uploadRequest(t, "/api/upload", "designs.zip", []byte("not a zip")), nil)
+	decodeError(t, rec, http.StatusBadRequest, api.CodeBadRequest)
+
+	rec = serve(h.UploadHandler, uploadRequest(t, "/api/upload?duplicates=maybe", "a.dst", []byte("x")), nil)
+	decodeError(t, rec, http.StatusBadRequest, api.CodeBadRequest)
+
+	req := httptest.NewRequest("POST", "/api/upload", strings.NewReader("plain"))
+	req.Header.Set("Content-Type", "text/plain")
+	decodeError(t, serve(h.UploadHandler, req, nil), http.StatusBadRequest, api.CodeBadRequest)
+}
+
+// TestConcurrentUploads tests that uploads of the same name at the same time
+// are all renamed apart rather than overwriting each other
+func TestConcurrentUploads(t *testing.T) {
+	h := newTestHandler(t)
+	h.options.FilenamePolicy.OnCollision = filenames.CollisionRename
+
+	const n = 8
+	stored := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := []byte(fmt.Sprintf("stitches %d", i))
+			rec := serve(h.UploadHandler, uploadRequest(t, "/api/upload", "rose.dst", data), nil)
+			if rec.Code != http.StatusOK {
+				t.Errorf("Upload %d: expected 200, got %d: %s", i, rec.Code, rec.Body.String())
+				return
+			}
+			var resp uploadResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Files) != 1 {
+				t.Errorf("Upload %d: unexpected response %s", i, rec.Body.String())
+				return
+			}
+			stored[i] = resp.Files[0].Stored
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, name := range stored {
+		if seen[name] {
+			t.Errorf("Two uploads were stored as %s: %v", name, stored)
+		}
+		seen[name] = true
+	}
+	entries, err := h.diskManager.ReadDir("/")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) != n {
+		t.Errorf("Expected %d files on the disk, got %d", n, len(entries))
+	}
+}
+
+// TestClear tests clearing the disk and a folder that doesn't exist
+func TestClear(t *testing.T) {
+	h := newTestHandler(t)
+	serve(h.UploadHandler, uploadRequest(t, "/api/upload", "a.dst", []byte("stitches")), nil)
+
+	rec := serve(h.ClearFilesHandler, httptest.NewRequest("POST", "/api/clear?path=/missing", nil), nil)
+	resp := decodeError(t, rec, http.StatusNotFound, api.CodeNotFound)
+	if !strings.Contains(resp.Error, "/missing") {
+		t.Errorf("Expected the folder in the message, got %q", resp.Error)
+	}
+
+	rec = serve(h.ClearFilesHandler, httptest.NewRequest("POST", "/api/clear", nil), nil)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"success":true}` {
+		t.Errorf("Expected success, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+// chunkRequest builds a PATCH of a resumable upload
+func chunkRequest(id string, offset int, data string) *http.Request {
+	req := httptest.NewRequest("PATCH", "/api/uploads/"+id, strings.NewReader(data))
+	req.Header.Set("Content-Type", tusContentType)
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	return req
+}
+
+// TestResumableUpload tests a resumable upload that is resumed after a chunk
+// with the wrong offset, and one that is cancelled
+func TestResumableUpload(t *testing.T) {
+	h := newTestHandler(t)
+	rec := serve(h.UploadCreateHandler, httptest.NewRequest("POST", "/api/uploads", nil), nil)
+	decodeError(t, rec, http.StatusNotFound, api.CodeNotEnabled)
+
+	store, err := uploads.Open(t.TempDir(), uploads.Options{})
+	if err != nil {
+		t.Fatalf("Failed to open upload store: %v", err)
+	}
+	h.options.Uploads = store
+
+	create := func() string {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/uploads", nil)
+		req.Header.Set("Upload-Length", "8")
+		req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("rose.dst"))+
+			",path "+base64.StdEncoding.EncodeToString([]byte("/flowers")))
+		rec := serve(h.UploadCreateHandler, req, nil)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var resp stagedUploadResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Response is not valid JSON: %v", err)
+		}
+		if rec.Header().Get("Location") != "/api/uploads/"+resp.ID || resp.Dir != "/flowers" {
+			t.Errorf("Unexpected upload %+v at %s", resp.Upload, rec.Header().Get("Location"))
+		}
+		return resp.ID
+	}
+	id := create()
+	vars := map[string]string{"id": id}
+
+	req := chunkRequest(id, 0, "stit")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	decodeError(t, serve(h.UploadChunkHandler, req, vars), http.StatusUnsupportedMediaType, api.CodeBadRequest)
+
+	if rec := serve(h.UploadChunkHandler, chunkRequest(id, 0, "stit"), vars); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = serve(h.UploadChunkHandler, chunkRequest(id, 2, "itch"), vars)
+	decodeError(t, rec, http.StatusConflict, api.CodeOffsetMismatch)
+	if got := rec.Header().Get("Upload-Offset"); got != "4" {
+		t.Errorf("Expected Upload-Offset 4 after a mismatch, got %q", got)
+	}
+
+	rec = serve(h.UploadStatusHandler, httptest.NewRequest("HEAD", "/api/uploads/"+id, nil), vars)
+	if got := rec.Header().Get("Upload-Offset"); rec.Code != http.StatusOK || got != "4" {
+		t.Errorf("Expected offset 4, got %d %q", rec.Code, got)
+	}
+
+	rec = serve(h.UploadChunkHandler, chunkRequest(id, 4, "ches"), vars)
+	var resp chunkResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Expected a JSON success, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if resp.Stored == nil || len(resp.Stored.Files) != 1 || resp.Stored.Files[0].Stored != "/flowers/rose.dst" {
+		t.Errorf("Expected the file to be stored in /flowers, got %+v", resp.Stored)
+	}
+	r, err := h.diskManager.ReadFile("/flowers/rose.dst")
+	if err != nil {
+		t.Fatalf("Stored file can't be read: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "stitches" {
+		t.Errorf("Expected the whole file, got %q", data)
+	}
+	rec = serve(h.UploadStatusHandler, httptest.NewRequest("GET", "/api/uploads/"+id, nil), vars)
+	decodeError(t, rec, http.StatusNotFound, api.CodeNotFound)
+
+	id = create()
+	vars = map[string]string{"id": id}
+	rec = serve(h.UploadCancelHandler, httptest.NewRequest("DELETE", "/api/uploads/"+id, nil), vars)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if list := store.List(); len(list) != 0 {
+		t.Errorf("Expected no uploads after cancelling, got %+v", list)
+	}
+}
+
+// TestLoadFailure tests that designs are not recorded as on the drive when a
+// shadow transaction putting them there fails
+func TestLoadFailure(t *testing.T) {
+	h := newTestHandlerWith(t, diskmanager.Config{TransactionMode: diskmanager.TransactionShadow})
+	lib, err := library.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open library: %v", err)
+	}
+	h.options.Library = lib
+
+	small, err := lib.Add("rose.dst", strings.NewReader("stitches"), nil)
+	if err != nil {
+		t.Fatalf("Failed to add design: %v", err)
+	}
+	big, err := lib.Add("big.dst", bytes.NewReader(bytes.Repeat([]byte{1}, 12*1024*1024)), nil)
+	if err != nil {
+		t.Fatalf("Failed to add design: %v", err)
+	}
+
+	body := fmt.Sprintf(`{"ids": [%q, %q]}`, small.ID, big.ID)
+	rec := serve(h.LibraryLoadHandler, httptest.NewRequest("POST", "/api/library/load", strings.NewReader(body)), nil)
+	decodeError(t, rec, http.StatusInsufficientStorage, api.CodeDiskFull)
+	if e, _ := lib.Get(small.ID); e.DrivePath != "" {
+		t.Errorf("Expected %s not to be on the drive after a failed load, got %s", e.Name, e.DrivePath)
+	}
+
+	if _, err := lib.SaveSet(library.Set{Name: "spring", Items: []library.SetItem{{ID: small.ID}, {ID: big.ID}}}); err != nil {
+		t.Fatalf("Failed to save set: %v", err)
+	}
+	rec = serve(h.SetActivateHandler, httptest.NewRequest("POST", "/api/sets/spring/activate", nil), map[string]string{"name": "spring"})
+	decodeError(t, rec, http.StatusInsufficientStorage, api.CodeDiskFull)
+	if e, _ := lib.Get(small.ID); e.DrivePath != "" {
+		t.Errorf("Expected %s not to be on the drive after a failed activation, got %s", e.Name, e.DrivePath)
+	}
+	if _, active := lib.Sets(); active != "" {
+		t.Errorf("Expected no active set, got %q", active)
+	}
+}
+
+// TestUnloadFailure tests that designs stay recorded as on the drive when a
+// shadow transaction removing them fails
+func TestUnloadFailure(t *testing.T) {
+	h := newTestHandlerWith(t, diskmanager.Config{TransactionMode: diskmanager.TransactionShadow})
+	lib, err := library.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open library: %v", err)
+	}
+	h.options.Library = lib
+
+	rose, err := lib.Add("rose.dst", strings.NewReader("stitches"), nil)
+	if err != nil {
+		t.Fatalf("Failed to add design: %v", err)
+	}
+	tulip, err := lib.Add("tulip.dst", strings.NewReader("petals"), nil)
+	if err != nil {
+		t.Fatalf("Failed to add design: %v", err)
+	}
+	rec := serve(h.LibraryLoadHandler, httptest.NewRequest("POST", "/api/library/load", strings.NewReader(fmt.Sprintf(`{"ids": [%q]}`, rose.ID))), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Load failed: %d %s", rec.Code, rec.Body.String())
+	}
+	rose, _ = lib.Get(rose.ID)
+
+	// The tulip is recorded at a path that is now a folder, which fails the
+	// transaction after the rose was removed
+	if err := h.diskManager.BeginTransaction(func(tx *diskmanager.Transaction) error { return tx.Mkdir("/tulip") }); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := lib.SetDrivePaths(map[string]string{tulip.ID: "/tulip"}); err != nil {
+		t.Fatalf("Failed to set drive path: %v", err)
+	}
+
+	body := fmt.Sprintf(`{"ids": [%q, %q]}`, rose.ID, tulip.ID)
+	rec = serve(h.LibraryUnloadHandler, httptest.NewRequest("POST", "/api/library/unload", strings.NewReader(body)), nil)
+	if rec.Code == http.StatusOK {
+		t.Fatalf("Expected the unload to fail, got %s", rec.Body.String())
+	}
+	if _, err := h.diskManager.ReadFile(rose.DrivePath); err != nil {
+		t.Errorf("Expected the rose to still be on the drive: %v", err)
+	}
+	if e, _ := lib.Get(rose.ID); e.DrivePath != rose.DrivePath {
+		t.Errorf("Expected the rose to still be recorded at %s, got %q", rose.DrivePath, e.DrivePath)
+	}
+}
+
+// TestUnloadReplacedFile tests that unloading only removes the design itself,
+// not a file that took its place on the drive
+func TestUnloadReplacedFile(t *testing.T) {
+	h := newTestHandler(t)
+	lib, err := library.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open library: %v", err)
+	}
+	h.options.Library = lib
+
+	rose, err := lib.Add("rose.dst", strings.NewReader("stitches"), nil)
+	if err != nil {
+		t.Fatalf("Failed to add design: %v", err)
+	}
+	tulip, err := lib.Add("tulip.dst", strings.NewReader("petals"), nil)
+	if err != nil {
+		t.Fatalf("Failed to add design: %v", err)
+	}
+	body := fmt.Sprintf(`{"ids": [%q, %q]}`, rose.ID, tulip.ID)
+	rec := serve(h.LibraryLoadHandler, httptest.NewRequest("POST", "/api/library/load", strings.NewReader(body)), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Load failed: %d %s", rec.Code, rec.Body.String())
+	}
+	rose, _ = lib.Get(rose.ID)
+	tulip, _ = lib.Get(tulip.ID)
+
+	// Another file written over the rose, say through FTP
+	err = h.diskManager.BeginTransaction(func(tx *diskmanager.Transaction) error {
+		return tx.WriteFile(rose.DrivePath, strings.NewReader("someone else's"), 14)
+	})
+	if err != nil {
+		t.Fatalf("Failed to replace file: %v", err)
+	}
+
+	rec = serve(h.LibraryUnloadHandler, httptest.NewRequest("POST", "/api/library/unload", strings.NewReader(body)), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unload failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	r, err := h.diskManager.ReadFile(rose.DrivePath)
+	if err != nil {
+		t.Fatalf("Expected the replacing file to be kept: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "someone else's" {
+		t.Errorf("Expected the replacing file to be unchanged, got %q", data)
+	}
+	if _, err := h.diskManager.ReadFile(tulip.DrivePath); !errors.Is(err, diskmanager.ErrFileNotFound) {
+		t.Errorf("Expected the unchanged design to be removed, got %v", err)
+	}
+	for _, id := range []string{rose.ID, tulip.ID} {
+		if e, _ := lib.Get(id); e.DrivePath != "" {
+			t.Errorf("Expected %s to be forgotten, got %s", e.Name, e.DrivePath)
+		}
+	}
+}
+
+// TestTransformOutputName tests that a transform's new file gets a name the
+// machine can use, while writing back in place keeps the file's name
+func TestTransformOutputName(t *testing.T) {
+	h := newTestHandler(t)
+	h.options.FilenamePolicy = filenames.Policy{Mode: filenames.ModeShort, OnCollision: filenames.CollisionRename}
+
+	var encoded bytes.Buffer
+	square := &design.Design{Points: []design.Point{{X: 0, Y: 0}, {X: 100, Y: 0}, {X: 100, Y: 100}, {X: 0, Y: 0}}}
+	format, _ := design.FormatForPath("square.dst")
+	if err := format.Encode(&encoded, square); err != nil {
+		t.Fatalf("Failed to encode design: %v", err)
+	}
+	err := h.diskManager.BeginTransaction(func(tx *diskmanager.Transaction) error {
+		return tx.WriteFile("/Square design.dst", bytes.NewReader(encoded.Bytes()), int64(encoded.Len()))
+	})
+	if err != nil {
+		t.Fatalf("Failed to write design: %v", err)
+	}
+
+	transform := func(output string) string {
+		t.Helper()
+		body := fmt.Sprintf(`{"operations": [{"type": "rotate", "degrees": 90}], "output": %q}`, output)
+		req := httptest.NewRequest("POST", "/api/files/Square%20design.dst/transform", strings.NewReader(body))
+		rec := serve(h.TransformHandler, req, map[string]string{"path": "Square design.dst"})
+		var resp transformResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("Transform failed: %d %s", rec.Code, rec.Body.String())
+		}
+		return resp.Path
+	}
+
+	if got := transform("Square design rotated.dst"); got != "/SQUAREDE.DST" {
+		t.Errorf("Expected an 8.3 name, got %s", got)
+	}
+	if got := transform("Square design rotated.dst"); got != "/SQUARE~1.DST" {
+		t.Errorf("Expected a second 8.3 name, got %s", got)
+	}
+	if got := transform(""); got != "/Square design.dst" {
+		t.Errorf("Expected the design to be written back in place, got %s", got)
+	}
+}
+
+// TestErrorCodes tests that every kind of failure has its code
+func TestErrorCodes(t *testing.T) {
+	h := newTestHandler(t)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		vars    map[string]string
+		status  int
+		code    api.Code
+	}{
+		{"download missing file", h.DownloadFileHandler, "GET", "/api/files/missing.dst", "",
+			map[string]string{"path": "missing.dst"}, http.StatusNotFound, api.CodeNotFound},
+		{"delete missing file", h.DeleteFileHandler, "DELETE", "/api/files/missing.dst", "",
+			map[string]string{"path": "missing.dst"}, http.StatusNotFound, api.CodeNotFound},
+		{"move missing file", h.MoveFileHandler, "POST", "/api/files/missing.dst/move", `{"to": "b.dst"}`,
+			map[string]string{"path": "missing.dst"}, http.StatusNotFound, api.CodeNotFound},
+		{"list missing directory", h.ListFilesHandler, "GET", "/api/files?path=/missing", "",
+			nil, http.StatusNotFound, api.CodeNotFound},
+		{"sort bad JSON", h.SortHandler, "POST", "/api/sort", "{", nil, http.StatusBadRequest, api.CodeBadRequest},
+		{"sort bad order", h.SortHandler, "POST", "/api/sort", `{"order": "size"}`,
+			nil, http.StatusBadRequest, api.CodeBadRequest},
+		{"sync outside the folder", h.SyncPlanHandler, "POST", "/api/sync/plan",
+			`{"files": [{"path": "../escape.dst", "size": 1, "sha256": "00"}]}`,
+			nil, http.StatusBadRequest, api.CodeInvalidPath},
+		{"transform unknown format", h.TransformHandler, "POST", "/api/files/notes.txt/transform",
+			`{"operations": [{"op": "rotate", "degrees": 90}]}`,
+			map[string]string{"path": "notes.txt"}, http.StatusBadRequest, api.CodeUnsupportedFormat},
+		{"resize to nothing", h.ResizeHandler, "POST", "/api/disk/resize", `{"sizeMb": 0}`,
+			nil, http.StatusBadRequest, api.CodeBadRequest},
+		{"library disabled", h.LibraryListHandler, "GET", "/api/library", "",
+			nil, http.StatusNotFound, api.CodeNotEnabled},
+		{"images disabled", h.ImageListHandler, "GET", "/api/images", "",
+			nil, http.StatusNotFound, api.CodeNotEnabled},
+		{"snapshots disabled", h.SnapshotListHandler, "GET", "/api/snapshots", "",
+			nil, http.StatusNotFound, api.CodeNotEnabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req := httptest.NewRequest(tt.method, tt.target, body)
+			decodeError(t, serve(tt.handler, req, tt.vars), tt.status, tt.code)
+		})
+	}
+}
+
+// TestHealth tests the typed health response
+func TestHealth(t *testing.T) {
+	h := newTestHandler(t)
+
+	rec := serve(h.HealthHandler, httptest.NewRequest("GET", "/api/health", nil), nil)
+	var resp healthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Response is not valid JSON: %v", err)
+	}
+	if rec.Code != http.StatusOK || !resp.Success || resp.Status != "ok" {
+		t.Errorf("Expected a healthy response, got %d %+v", rec.Code, resp)
+	}
+}
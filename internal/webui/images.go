@@ -0,0 +1,164 @@
+package webui
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+)
+
+// imageRequest is the JSON body accepted by the create and clone handlers
+type imageRequest struct {
+	Name        string `json:"name"`
+	Label       string `json:"label"`
+	Description string `json:"description"`
+
+	// SizeMB is the size of a new image (create only)
+	SizeMB int64 `json:"sizeMb"`
+}
+
+// imageResponse is returned by the handlers that create or change an image
+type imageResponse struct {
+	Success bool `json:"success"`
+	diskmanager.Image
+}
+
+// imageListResponse is returned by ImageListHandler
+type imageListResponse struct {
+	Success bool                `json:"success"`
+	Images  []diskmanager.Image `json:"images"`
+}
+
+// imagesEnabled writes an error and returns false when no image directory is configured
+func (h *Handler) imagesEnabled(w http.ResponseWriter) bool {
+	if h.options.Images == nil {
+		writeJSONError(w, http.StatusNotFound, api.CodeNotEnabled, "Multiple disk images are not enabled")
+		return false
+	}
+	return true
+}
+
+// decodeImageRequest parses the body of a create or clone request
+func decodeImageRequest(w http.ResponseWriter, r *http.Request) (imageRequest, bool) {
+	var req imageRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Invalid JSON request body")
+		return req, false
+	}
+	if req.Label == "" {
+		req.Label = req.Name
+	}
+	return req, true
+}
+
+// ImageListHandler lists the managed disk images
+func (h *Handler) ImageListHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.imagesEnabled(w) {
+		return
+	}
+
+	images, err := h.options.Images.List()
+	if err != nil {
+		writeError(w, err, "Failed to list disk images")
+		return
+	}
+	writeJSON(w, http.StatusOK, imageListResponse{Success: true, Images: images})
+}
+
+// ImageCreateHandler formats a new, empty disk image
+func (h *Handler) ImageCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.imagesEnabled(w) {
+		return
+	}
+	req, ok := decodeImageRequest(w, r)
+	if !ok {
+		return
+	}
+
+	log.Printf("Creating disk image %s (%dMB)", req.Name, req.SizeMB)
+	image, err := h.options.Images.Create(req.Name, req.Label, req.Description, req.SizeMB)
+	if err != nil {
+		writeError(w, err, "Failed to create disk image")
+		return
+	}
+	writeJSON(w, http.StatusOK, imageResponse{Success: true, Image: image})
+}
+
+// ImageCloneHandler copies an existing image to a new one
+func (h *Handler) ImageCloneHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.imagesEnabled(w) {
+		return
+	}
+	req, ok := decodeImageRequest(w, r)
+	if !ok {
+		return
+	}
+
+	source := mux.Vars(r)["name"]
+	copyFile := diskmanager.CopyImage
+	if source == h.options.Images.ActiveName() {
+		// The host may be writing to the active image; copy it while disconnected
+		copyFile = func(src, dst string) error {
+			return h.diskManager.CopyDisk(dst)
+		}
+	}
+
+	log.Printf("Cloning disk image %s to %s", source, req.Name)
+	image, err := h.options.Images.Clone(source, req.Name, req.Label, req.Description, copyFile)
+	if err != nil {
+		writeError(w, err, "Failed to clone disk image")
+		return
+	}
+	writeJSON(w, http.StatusOK, imageResponse{Success: true, Image: image})
+}
+
+// ImageDeleteHandler removes an inactive disk image
+func (h *Handler) ImageDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.imagesEnabled(w) {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if err := h.options.Images.Delete(name); err != nil {
+		writeError(w, err, "Failed to delete disk image")
+		return
+	}
+	log.Printf("Deleted disk image %s", name)
+	writeJSON(w, http.StatusOK, api.OK)
+}
+
+// ImageActivateHandler presents a different disk image to the embroidery machine
+func (h *Handler) ImageActivateHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.imagesEnabled(w) {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	image, err := h.options.Images.Get(name)
+	if err != nil {
+		writeError(w, err, "Failed to activate disk image")
+		return
+	}
+
+	log.Printf("Activating disk image %s", name)
+	if err := h.diskManager.SwitchDisk(h.options.Images.Path(name)); err != nil {
+		writeError(w, err, "Failed to activate disk image")
+		return
+	}
+	if err := h.options.Images.SetActive(name); err != nil {
+		log.Printf("Failed to record active disk image: %v", err)
+	}
+
+	// Library designs recorded on the previous drive are not on this one
+	if h.options.Library != nil {
+		if err := h.options.Library.ForgetDrivePaths(); err != nil {
+			log.Printf("Failed to reset library drive paths: %v", err)
+		}
+	}
+
+	image.Active = true
+	writeJSON(w, http.StatusOK, imageResponse{Success: true, Image: image})
+}
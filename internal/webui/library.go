@@ -0,0 +1,386 @@
+package webui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+	"github.com/jgarman/embroidery-buddy/internal/filenames"
+	"github.com/jgarman/embroidery-buddy/internal/library"
+)
+
+// libraryListResponse is returned by LibraryListHandler
+type libraryListResponse struct {
+	Success bool            `json:"success"`
+	Designs []library.Entry `json:"designs"`
+	Tags    []string        `json:"tags"`
+}
+
+// libraryDuplicate reports an uploaded file whose content is already in the library
+type libraryDuplicate struct {
+	Name     string        `json:"name"`
+	Existing library.Entry `json:"existing"`
+}
+
+// libraryAddResponse is returned by LibraryAddHandler
+type libraryAddResponse struct {
+	Success    bool               `json:"success"`
+	Designs    []library.Entry    `json:"designs"`
+	Duplicates []libraryDuplicate `json:"duplicates"`
+}
+
+// libraryDriveRequest is the JSON body accepted by the load and unload handlers
+type libraryDriveRequest struct {
+	// IDs of the library designs to copy or remove
+	IDs []string `json:"ids"`
+
+	// Folder on the drive to copy into (load only, default "/")
+	Folder string `json:"folder"`
+}
+
+// libraryLoaded reports where a design was copied onto the drive
+type libraryLoaded struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+}
+
+// libraryEntryResponse is returned by the handlers for one design
+type libraryEntryResponse struct {
+	Success bool `json:"success"`
+	library.Entry
+}
+
+// libraryLoadResponse is returned by LibraryLoadHandler
+type libraryLoadResponse struct {
+	Success bool            `json:"success"`
+	Files   []libraryLoaded `json:"files"`
+}
+
+// libraryUnloadResponse is returned by LibraryUnloadHandler
+type libraryUnloadResponse struct {
+	Success bool `json:"success"`
+
+	// Removed is the number of designs taken off the drive
+	Removed int `json:"removed"`
+}
+
+// libraryEnabled writes an error and returns false when no library is configured
+func (h *Handler) libraryEnabled(w http.ResponseWriter) bool {
+	if h.options.Library == nil {
+		writeJSONError(w, http.StatusNotFound, api.CodeNotEnabled, "The design library is not enabled")
+		return false
+	}
+	return true
+}
+
+// LibraryListHandler searches the library (?q=text&tag=a&tag=b&format=dst)
+func (h *Handler) LibraryListHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.libraryEnabled(w) {
+		return
+	}
+
+	query := r.URL.Query()
+	designs := h.options.Library.Search(library.Query{
+		Text:   query.Get("q"),
+		Tags:   query["tag"],
+		Format: query.Get("format"),
+	})
+
+	writeJSON(w, http.StatusOK, libraryListResponse{
+		Success: true,
+		Designs: designs,
+		Tags:    h.options.Library.Tags(),
+	})
+}
+
+// LibraryAddHandler stores uploaded designs in the library.
+// Tags are given as a comma-separated "tags" form field.
+func (h *Handler) LibraryAddHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.libraryEnabled(w) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 200*1024*1024)
+	if err := r.ParseMultipartForm(32 * 1024 * 1024); err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Invalid multipart form")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	var tags []string
+	for _, field := range r.MultipartForm.Value["tags"] {
+		tags = append(tags, strings.Split(field, ",")...)
+	}
+
+	response := libraryAddResponse{
+		Success:    true,
+		Designs:    []library.Entry{},
+		Duplicates: []libraryDuplicate{},
+	}
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "No file uploaded")
+		return
+	}
+
+	for _, header := range files {
+		file, err := header.Open()
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Failed to read uploaded file")
+			return
+		}
+		entry, err := h.options.Library.Add(header.Filename, file, tags)
+		file.Close()
+
+		if errors.Is(err, library.ErrExists) {
+			response.Duplicates = append(response.Duplicates, libraryDuplicate{Name: header.Filename, Existing: entry})
+			continue
+		}
+		if err != nil {
+			writeError(w, err, "Failed to add design")
+			return
+		}
+		log.Printf("Added %s to library as %s", entry.Name, entry.ID)
+		response.Designs = append(response.Designs, entry)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// LibraryGetHandler returns the metadata of one design
+func (h *Handler) LibraryGetHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.libraryEnabled(w) {
+		return
+	}
+
+	entry, err := h.options.Library.Get(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err, "Failed to get design")
+		return
+	}
+	writeJSON(w, http.StatusOK, libraryEntryResponse{Success: true, Entry: entry})
+}
+
+// LibraryDownloadHandler returns the file data of one design
+func (h *Handler) LibraryDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.libraryEnabled(w) {
+		return
+	}
+
+	reader, entry, err := h.options.Library.Open(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err, "Failed to open design")
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", entry.Name))
+	if _, err := io.Copy(w, reader); err != nil {
+		log.Printf("Error sending design %s: %v", entry.ID, err)
+	}
+}
+
+// LibraryUpdateHandler changes the name, tags or notes of a design
+func (h *Handler) LibraryUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.libraryEnabled(w) {
+		return
+	}
+
+	var update library.Update
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&update); err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Invalid JSON request body")
+		return
+	}
+
+	entry, err := h.options.Library.Update(mux.Vars(r)["id"], update)
+	if err != nil {
+		writeError(w, err, "Failed to update design")
+		return
+	}
+	writeJSON(w, http.StatusOK, libraryEntryResponse{Success: true, Entry: entry})
+}
+
+// LibraryDeleteHandler removes a design from the library (not from the drive)
+func (h *Handler) LibraryDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.libraryEnabled(w) {
+		return
+	}
+
+	if err := h.options.Library.Remove(mux.Vars(r)["id"]); err != nil {
+		writeError(w, err, "Failed to delete design")
+		return
+	}
+	writeJSON(w, http.StatusOK, api.OK)
+}
+
+// decodeDriveRequest parses and validates a load or unload request
+func decodeDriveRequest(w http.ResponseWriter, r *http.Request) (libraryDriveRequest, bool) {
+	var req libraryDriveRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Invalid JSON request body")
+		return req, false
+	}
+	if len(req.IDs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "No designs given")
+		return req, false
+	}
+	return req, true
+}
+
+// LibraryLoadHandler copies designs from the library onto the drive in one transaction
+func (h *Handler) LibraryLoadHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.libraryEnabled(w) {
+		return
+	}
+	req, ok := decodeDriveRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// Resolve every design before touching the drive
+	entries := make([]library.Entry, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		entry, err := h.options.Library.Get(id)
+		if err != nil {
+			writeError(w, err, "Failed to get design")
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	// Reject invalid names before the transaction disconnects the host
+	folder := path.Clean("/" + req.Folder)
+	if _, err := drivePaths(h.newNormalizer(), folder, entries); err != nil {
+		writeError(w, err, "Failed to load designs")
+		return
+	}
+
+	loaded := make([]libraryLoaded, 0, len(entries))
+
+	log.Printf("Loading %d designs from library into %s", len(entries), folder)
+
+	err := h.diskManager.BeginTransaction(func(tx *diskmanager.Transaction) error {
+		// Pick the names again now that no other upload can take them
+		paths, err := drivePaths(h.txNormalizer(tx), folder, entries)
+		if err != nil {
+			return err
+		}
+		for i, entry := range entries {
+			drivePath := paths[i]
+			reader, _, err := h.options.Library.Open(entry.ID)
+			if err != nil {
+				return err
+			}
+			err = tx.WriteFile(drivePath, reader, entry.Size)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+			loaded = append(loaded, libraryLoaded{ID: entry.ID, Path: drivePath})
+		}
+		return nil
+	})
+
+	// Record what made it onto the drive. A failed transaction wrote nothing
+	// in shadow mode, and whatever it got to in direct mode.
+	if err == nil || !h.diskManager.Atomic() {
+		paths := make(map[string]string, len(loaded))
+		for _, l := range loaded {
+			paths[l.ID] = l.Path
+		}
+		if err := h.options.Library.SetDrivePaths(paths); err != nil {
+			log.Printf("Failed to record drive paths: %v", err)
+		}
+	}
+
+	if err != nil {
+		log.Printf("Error loading designs: %v", err)
+		writeError(w, err, "Failed to load designs")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, libraryLoadResponse{Success: true, Files: loaded})
+}
+
+// drivePaths returns the paths designs are stored under in folder
+func drivePaths(normalizer *filenames.Normalizer, folder string, entries []library.Entry) ([]string, error) {
+	paths := make([]string, len(entries))
+	for i, entry := range entries {
+		drivePath, err := normalizer.Normalize(path.Join(folder, entry.Name))
+		if err != nil {
+			return nil, fmt.Errorf("%w: filename %s: %v", diskmanager.ErrInvalidPath, entry.Name, err)
+		}
+		paths[i] = drivePath
+	}
+	return paths, nil
+}
+
+// LibraryUnloadHandler removes designs that were loaded from the library from the drive
+func (h *Handler) LibraryUnloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.libraryEnabled(w) {
+		return
+	}
+	req, ok := decodeDriveRequest(w, r)
+	if !ok {
+		return
+	}
+
+	entries := make([]library.Entry, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		entry, err := h.options.Library.Get(id)
+		if err != nil {
+			writeError(w, err, "Failed to get design")
+			return
+		}
+		if entry.DrivePath != "" {
+			entries = append(entries, entry)
+		}
+	}
+
+	removed := make(map[string]string, len(entries))
+	if len(entries) > 0 {
+		log.Printf("Removing %d library designs from the drive", len(entries))
+
+		err := h.diskManager.BeginTransaction(func(tx *diskmanager.Transaction) error {
+			for _, entry := range entries {
+				// The drive may have changed since the design was loaded. Designs
+				// deleted from it are simply forgotten, and a different file now
+				// at the same path is left alone.
+				sum, err := tx.ContentHash(entry.DrivePath)
+				if err != nil && !errors.Is(err, diskmanager.ErrFileNotFound) {
+					return err
+				}
+				if err == nil && sum == entry.SHA256 {
+					if err := tx.RemoveFile(entry.DrivePath); err != nil && !errors.Is(err, diskmanager.ErrFileNotFound) {
+						return err
+					}
+				}
+				removed[entry.ID] = ""
+			}
+			return nil
+		})
+		// A failed transaction removed nothing in shadow mode, and whatever it
+		// got to in direct mode
+		if err == nil || !h.diskManager.Atomic() {
+			if setErr := h.options.Library.SetDrivePaths(removed); setErr != nil {
+				log.Printf("Failed to record drive paths: %v", setErr)
+			}
+		}
+		if err != nil {
+			log.Printf("Error removing designs: %v", err)
+			writeError(w, err, "Failed to remove designs")
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, libraryUnloadResponse{Success: true, Removed: len(removed)})
+}
@@ -0,0 +1,64 @@
+package webui
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+)
+
+// resizeRequest is the JSON body accepted by ResizeHandler
+type resizeRequest struct {
+	SizeMB int64 `json:"sizeMb"`
+
+	// DryRun only estimates whether the files fit
+	DryRun bool `json:"dryRun"`
+}
+
+// resizeResponse is returned by ResizeHandler
+type resizeResponse struct {
+	Success bool                   `json:"success"`
+	DryRun  bool                   `json:"dryRun"`
+	Plan    diskmanager.ResizePlan `json:"plan"`
+}
+
+// ResizeHandler grows or shrinks the disk image while keeping its files, or
+// estimates the result when dryRun is set
+func (h *Handler) ResizeHandler(w http.ResponseWriter, r *http.Request) {
+	var req resizeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Invalid JSON request body")
+		return
+	}
+	if req.SizeMB < 1 {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "sizeMb must be at least 1")
+		return
+	}
+
+	if req.DryRun {
+		plan, err := h.diskManager.PlanResize(req.SizeMB)
+		if err != nil {
+			writeError(w, err, "Failed to plan resize")
+			return
+		}
+		writeJSON(w, http.StatusOK, resizeResponse{Success: true, DryRun: true, Plan: plan})
+		return
+	}
+
+	log.Printf("Resizing disk image to %dMB", req.SizeMB)
+	plan, err := h.diskManager.Resize(req.SizeMB)
+	if err != nil {
+		log.Printf("Error resizing disk image: %v", err)
+		if errors.Is(err, diskmanager.ErrDiskFull) {
+			writeJSONError(w, http.StatusInsufficientStorage, api.CodeDiskFull, "The files on the disk do not fit in the new size.")
+			return
+		}
+		writeError(w, err, "Failed to resize disk image")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resizeResponse{Success: true, Plan: plan})
+}
@@ -0,0 +1,184 @@
+package webui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/gorilla/mux"
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+	"github.com/jgarman/embroidery-buddy/internal/filenames"
+	"github.com/jgarman/embroidery-buddy/internal/library"
+)
+
+// setListResponse is returned by SetListHandler
+type setListResponse struct {
+	Success bool          `json:"success"`
+	Active  string        `json:"active"`
+	Sets    []library.Set `json:"sets"`
+}
+
+// setRequest is the JSON body accepted by SetSaveHandler
+type setRequest struct {
+	Description string            `json:"description"`
+	Items       []library.SetItem `json:"items"`
+}
+
+// setResponse is returned by the handlers for one set
+type setResponse struct {
+	Success bool `json:"success"`
+	library.Set
+}
+
+// setActivateResponse is returned by SetActivateHandler
+type setActivateResponse struct {
+	Success bool            `json:"success"`
+	Set     string          `json:"set"`
+	Files   []libraryLoaded `json:"files"`
+}
+
+// SetListHandler lists the saved design sets
+func (h *Handler) SetListHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.libraryEnabled(w) {
+		return
+	}
+
+	sets, active := h.options.Library.Sets()
+	writeJSON(w, http.StatusOK, setListResponse{Success: true, Active: active, Sets: sets})
+}
+
+// SetGetHandler returns one saved set
+func (h *Handler) SetGetHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.libraryEnabled(w) {
+		return
+	}
+
+	set, err := h.options.Library.GetSet(mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, err, "Failed to get set")
+		return
+	}
+	writeJSON(w, http.StatusOK, setResponse{Success: true, Set: set})
+}
+
+// SetSaveHandler creates or replaces a set
+func (h *Handler) SetSaveHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.libraryEnabled(w) {
+		return
+	}
+
+	var req setRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 256*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Invalid JSON request body")
+		return
+	}
+
+	set, err := h.options.Library.SaveSet(library.Set{
+		Name:        mux.Vars(r)["name"],
+		Description: req.Description,
+		Items:       req.Items,
+	})
+	if err != nil {
+		writeError(w, err, "Failed to save set")
+		return
+	}
+	writeJSON(w, http.StatusOK, setResponse{Success: true, Set: set})
+}
+
+// SetDeleteHandler removes a saved set (the designs stay in the library)
+func (h *Handler) SetDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.libraryEnabled(w) {
+		return
+	}
+
+	if err := h.options.Library.DeleteSet(mux.Vars(r)["name"]); err != nil {
+		writeError(w, err, "Failed to delete set")
+		return
+	}
+	writeJSON(w, http.StatusOK, api.OK)
+}
+
+// SetActivateHandler replaces the whole drive with the designs of a set.
+// The drive is emptied and repopulated while the USB gadget is disconnected once.
+func (h *Handler) SetActivateHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.libraryEnabled(w) {
+		return
+	}
+
+	set, err := h.options.Library.GetSet(mux.Vars(r)["name"])
+	if err != nil {
+		writeError(w, err, "Failed to activate set")
+		return
+	}
+
+	// Resolve designs and names up front. The drive will be empty, so the
+	// normalizer only has to avoid collisions within the set.
+	normalizer := filenames.NewNormalizer(h.options.FilenamePolicy, nil)
+	entries := make([]library.Entry, len(set.Items))
+	drivePaths := make([]string, len(set.Items))
+	for i, item := range set.Items {
+		entry, err := h.options.Library.Get(item.ID)
+		if err != nil {
+			writeError(w, err, "Failed to activate set")
+			return
+		}
+		drivePath, err := normalizer.Normalize(path.Join(item.Folder, entry.Name))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, api.CodeInvalidPath, fmt.Sprintf("Invalid filename %s: %v", entry.Name, err))
+			return
+		}
+		entries[i] = entry
+		drivePaths[i] = drivePath
+	}
+
+	log.Printf("Activating set %q (%d designs)", set.Name, len(entries))
+
+	loaded := make([]libraryLoaded, 0, len(entries))
+	err = h.diskManager.ReplaceContents(func(tx *diskmanager.Transaction) error {
+		for i, entry := range entries {
+			reader, _, err := h.options.Library.Open(entry.ID)
+			if err != nil {
+				return err
+			}
+			err = tx.WriteFile(drivePaths[i], reader, entry.Size)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+			loaded = append(loaded, libraryLoaded{ID: entry.ID, Path: drivePaths[i]})
+		}
+		return nil
+	})
+
+	// A failed activation left the old drive in shadow mode; in direct mode
+	// the drive was cleared and holds whatever was written before the failure
+	if err == nil || !h.diskManager.Atomic() {
+		paths := make(map[string]string, len(loaded))
+		for _, l := range loaded {
+			paths[l.ID] = l.Path
+		}
+		active := set.Name
+		if err != nil {
+			active = ""
+		}
+		if markErr := h.options.Library.MarkActive(active, paths); markErr != nil {
+			log.Printf("Failed to record active set: %v", markErr)
+		}
+	}
+
+	if err != nil {
+		log.Printf("Error activating set %q: %v", set.Name, err)
+		if errors.Is(err, diskmanager.ErrDiskFull) {
+			writeJSONError(w, http.StatusInsufficientStorage, api.CodeDiskFull, "The set does not fit on the disk.")
+			return
+		}
+		writeError(w, err, "Failed to activate set")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, setActivateResponse{Success: true, Set: set.Name, Files: loaded})
+}
@@ -0,0 +1,95 @@
+package webui
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+)
+
+// snapshotRequest is the JSON body accepted by SnapshotCreateHandler
+type snapshotRequest struct {
+	// Name of the snapshot; empty uses the current time
+	Name string `json:"name"`
+}
+
+// snapshotResponse is returned by SnapshotCreateHandler
+type snapshotResponse struct {
+	Success bool `json:"success"`
+	diskmanager.Snapshot
+}
+
+// snapshotListResponse is returned by SnapshotListHandler
+type snapshotListResponse struct {
+	Success   bool                   `json:"success"`
+	Snapshots []diskmanager.Snapshot `json:"snapshots"`
+}
+
+// restoreResponse is returned by SnapshotRestoreHandler
+type restoreResponse struct {
+	Success  bool   `json:"success"`
+	Snapshot string `json:"snapshot"`
+}
+
+// SnapshotListHandler lists the snapshots of the disk image, newest first
+func (h *Handler) SnapshotListHandler(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := h.diskManager.ListSnapshots()
+	if err != nil {
+		writeError(w, err, "Failed to list snapshots")
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshotListResponse{Success: true, Snapshots: snapshots})
+}
+
+// SnapshotCreateHandler takes a snapshot of the current disk image. The body is optional.
+func (h *Handler) SnapshotCreateHandler(w http.ResponseWriter, r *http.Request) {
+	var req snapshotRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req)
+	if err != nil && err != io.EOF {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Invalid JSON request body")
+		return
+	}
+
+	log.Printf("Taking disk snapshot %q", req.Name)
+	snapshot, err := h.diskManager.Snapshot(req.Name)
+	if err != nil {
+		writeError(w, err, "Failed to take snapshot")
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshotResponse{Success: true, Snapshot: snapshot})
+}
+
+// SnapshotRestoreHandler replaces the drive contents with a snapshot
+func (h *Handler) SnapshotRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	log.Printf("Restoring disk snapshot %s", name)
+	if err := h.diskManager.Restore(name); err != nil {
+		writeError(w, err, "Failed to restore snapshot")
+		return
+	}
+
+	// The restored drive may not hold the designs the library recorded
+	if h.options.Library != nil {
+		if err := h.options.Library.ForgetDrivePaths(); err != nil {
+			log.Printf("Failed to reset library drive paths: %v", err)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, restoreResponse{Success: true, Snapshot: name})
+}
+
+// SnapshotDeleteHandler removes a snapshot
+func (h *Handler) SnapshotDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := h.diskManager.DeleteSnapshot(name); err != nil {
+		writeError(w, err, "Failed to delete snapshot")
+		return
+	}
+	log.Printf("Deleted disk snapshot %s", name)
+	writeJSON(w, http.StatusOK, api.OK)
+}
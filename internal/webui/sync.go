@@ -0,0 +1,169 @@
+package webui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+)
+
+// syncManifest is a client's folder: every file it holds below Path on the disk
+type syncManifest struct {
+	// Path is the directory on the disk the folder maps to (default "/")
+	Path  string                 `json:"path"`
+	Files []diskmanager.SyncFile `json:"files"`
+}
+
+// syncResponse is returned by the sync handlers
+type syncResponse struct {
+	Success bool                 `json:"success"`
+	Path    string               `json:"path"`
+	Plan    diskmanager.SyncPlan `json:"plan"`
+}
+
+// errSyncRequest marks sync requests that don't match their plan
+var errSyncRequest = errors.New("invalid sync request")
+
+// SyncPlanHandler compares a client's manifest with the disk and returns the
+// files to send, and the ones the sync would delete
+func (h *Handler) SyncPlanHandler(w http.ResponseWriter, r *http.Request) {
+	var manifest syncManifest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*1024*1024)).Decode(&manifest); err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Invalid JSON request body")
+		return
+	}
+
+	root, plan, ok := h.planSync(w, manifest)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, syncResponse{Success: true, Path: root, Plan: plan})
+}
+
+// SyncHandler applies a sync in one transaction. The multipart body starts
+// with a "manifest" field holding the JSON manifest, followed by a "file" part
+// for every file the plan adds or updates, with its manifest path as the file
+// name. Files on the disk that aren't in the manifest are deleted.
+func (h *Handler) SyncHandler(w http.ResponseWriter, r *http.Request) {
+	// Limit the whole sync to 200MB, like uploads
+	r.Body = http.MaxBytesReader(w, r.Body, 200*1024*1024)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Invalid multipart request")
+		return
+	}
+
+	part, err := reader.NextPart()
+	if err != nil || part.FormName() != "manifest" {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "The first field must be the manifest")
+		return
+	}
+	var manifest syncManifest
+	err = json.NewDecoder(io.LimitReader(part, 4*1024*1024)).Decode(&manifest)
+	part.Close()
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Invalid manifest")
+		return
+	}
+
+	root, plan, ok := h.planSync(w, manifest)
+	if !ok {
+		return
+	}
+	if plan.Empty() {
+		writeJSON(w, http.StatusOK, syncResponse{Success: true, Path: root, Plan: plan})
+		return
+	}
+
+	log.Printf("Syncing %s: %d to add, %d to update, %d to delete",
+		root, len(plan.Add), len(plan.Update), len(plan.Delete))
+
+	err = h.diskManager.BeginTransaction(func(tx *diskmanager.Transaction) error {
+		// The client's folder is the source of truth, duplicates included
+		if err := tx.SetDuplicatePolicy(diskmanager.DuplicateKeep); err != nil {
+			return err
+		}
+
+		received := make(map[string]bool)
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("%w: %v", errSyncRequest, err)
+			}
+			if part.FormName() != "file" {
+				part.Close()
+				continue
+			}
+
+			// part.FileName() drops directories, which the path needs
+			_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+			relPath, err := diskmanager.CleanSyncPath(params["filename"])
+			if err != nil {
+				part.Close()
+				return fmt.Errorf("%w: %v", errSyncRequest, err)
+			}
+			want, ok := plan.Upload(relPath)
+			if !ok {
+				part.Close()
+				return fmt.Errorf("%w: %s is not part of the plan", errSyncRequest, relPath)
+			}
+
+			err = tx.WriteFile(path.Join(root, want.Path), part, want.Size)
+			part.Close()
+			if err != nil {
+				return err
+			}
+			written := tx.Written()
+			if got := written[len(written)-1].SHA256; got != want.SHA256 {
+				return fmt.Errorf("%w: %s has sha256 %s, manifest says %s", errSyncRequest, relPath, got, want.SHA256)
+			}
+			received[want.Path] = true
+		}
+
+		for _, list := range [][]diskmanager.SyncFile{plan.Add, plan.Update} {
+			for _, f := range list {
+				if !received[f.Path] {
+					return fmt.Errorf("%w: %s was not sent", errSyncRequest, f.Path)
+				}
+			}
+		}
+
+		for _, relPath := range plan.Delete {
+			err := tx.RemoveFile(path.Join(root, relPath))
+			if err != nil && !errors.Is(err, diskmanager.ErrFileNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Sync of %s failed: %v", root, err)
+		writeError(w, err, "Failed to sync")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, syncResponse{Success: true, Path: root, Plan: plan})
+}
+
+// planSync works out the plan for a manifest, writing the error response if it
+// can't
+func (h *Handler) planSync(w http.ResponseWriter, manifest syncManifest) (string, diskmanager.SyncPlan, bool) {
+	root := path.Clean("/" + manifest.Path)
+	plan, err := h.diskManager.PlanSync(root, manifest.Files)
+	if err != nil {
+		writeError(w, err, "Failed to compare files")
+		return root, plan, false
+	}
+	return root, plan, true
+}
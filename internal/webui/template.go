@@ -6,3 +6,6 @@ import (
 
 //go:embed templates/index.html
 var indexTemplate string
+
+//go:embed templates/login.html
+var loginTemplate string
@@ -0,0 +1,133 @@
+package webui
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/design"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+)
+
+// transformRequest is the JSON body accepted by TransformHandler
+type transformRequest struct {
+	// Operations are applied in order
+	Operations []design.Operation `json:"operations"`
+
+	// Output is the path to write the result to; empty means overwrite the source
+	// file. It is stored under a name the machine can use, like an upload.
+	Output string `json:"output"`
+}
+
+// transformResponse is returned after a successful transform
+type transformResponse struct {
+	Success  bool     `json:"success"`
+	Path     string   `json:"path"`
+	Stitches int      `json:"stitches"`
+	WidthMM  float64  `json:"widthMm"`
+	HeightMM float64  `json:"heightMm"`
+	Warnings []string `json:"warnings"`
+}
+
+// TransformHandler rotates, mirrors, scales or recentres a design on the disk.
+// The result is written back in place or to a new file in a single transaction.
+// A new file's name goes through the filename policy, as uploads do.
+func (h *Handler) TransformHandler(w http.ResponseWriter, r *http.Request) {
+	sourcePath := path.Clean("/" + mux.Vars(r)["path"])
+
+	var req transformRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Invalid JSON request body")
+		return
+	}
+	if len(req.Operations) == 0 {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "No operations given")
+		return
+	}
+
+	outputPath := sourcePath
+	if req.Output != "" {
+		outputPath = path.Clean("/" + req.Output)
+	}
+	// Writing back in place keeps the name the file already has
+	newFile := !strings.EqualFold(outputPath, sourcePath)
+	if newFile {
+		if _, err := h.newNormalizer().Normalize(outputPath); err != nil {
+			writeError(w, fmt.Errorf("%w: output %s: %v", diskmanager.ErrInvalidPath, outputPath, err), "Invalid output path")
+			return
+		}
+	}
+
+	sourceFormat, err := design.FormatForPath(sourcePath)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeUnsupportedFormat, err.Error())
+		return
+	}
+	outputFormat, err := design.FormatForPath(outputPath)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeUnsupportedFormat, err.Error())
+		return
+	}
+
+	// Parse the stitch data
+	file, err := h.diskManager.ReadFile(sourcePath)
+	if err != nil {
+		writeError(w, err, "Failed to read file")
+		return
+	}
+	d, err := sourceFormat.Decode(file)
+	file.Close()
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, api.CodeInvalidDesign, fmt.Sprintf("Failed to parse design: %v", err))
+		return
+	}
+
+	warnings, err := design.Apply(d, req.Operations)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, err.Error())
+		return
+	}
+
+	var encoded bytes.Buffer
+	if err := outputFormat.Encode(&encoded, d); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, api.CodeInternal, fmt.Sprintf("Failed to encode design: %v", err))
+		return
+	}
+
+	requested := outputPath
+	err = h.diskManager.BeginTransaction(func(tx *diskmanager.Transaction) error {
+		if newFile {
+			var err error
+			outputPath, err = h.txNormalizer(tx).Normalize(requested)
+			if err != nil {
+				return fmt.Errorf("%w: output %s: %v", diskmanager.ErrInvalidPath, requested, err)
+			}
+		}
+		log.Printf("Transforming %s -> %s (%d operations)", sourcePath, outputPath, len(req.Operations))
+		return tx.WriteFile(outputPath, bytes.NewReader(encoded.Bytes()), int64(encoded.Len()))
+	})
+	if err != nil {
+		log.Printf("Error writing transformed design: %v", err)
+		writeError(w, err, "Failed to save file")
+		return
+	}
+
+	minX, minY, maxX, maxY := d.Bounds()
+	if warnings == nil {
+		warnings = []string{}
+	}
+	writeJSON(w, http.StatusOK, transformResponse{
+		Success:  true,
+		Path:     outputPath,
+		Stitches: d.StitchCount(),
+		WidthMM:  float64(maxX-minX) / 10,
+		HeightMM: float64(maxY-minY) / 10,
+		Warnings: warnings,
+	})
+}
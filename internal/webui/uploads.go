@@ -0,0 +1,261 @@
+package webui
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jgarman/embroidery-buddy/internal/api"
+	"github.com/jgarman/embroidery-buddy/internal/diskmanager"
+	"github.com/jgarman/embroidery-buddy/internal/uploads"
+)
+
+// Resumable uploads speak the core of the tus protocol (https://tus.io), with
+// its creation and termination extensions, so tus clients can use them.
+const (
+	tusVersion     = "1.0.0"
+	tusContentType = "application/offset+octet-stream"
+)
+
+// stagedUploadResponse is returned by UploadCreateHandler and
+// UploadStatusHandler
+type stagedUploadResponse struct {
+	Success bool `json:"success"`
+	uploads.Upload
+}
+
+// stagedUploadListResponse is returned by UploadListHandler
+type stagedUploadListResponse struct {
+	Success bool             `json:"success"`
+	Uploads []uploads.Upload `json:"uploads"`
+}
+
+// chunkResponse is returned by UploadChunkHandler
+type chunkResponse struct {
+	Success bool `json:"success"`
+	uploads.Upload
+
+	// Stored is set once the last chunk has arrived and the file is on the disk
+	Stored *uploadResult `json:"stored,omitempty"`
+}
+
+// uploadsEnabled writes an error response if resumable uploads are disabled
+func (h *Handler) uploadsEnabled(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if h.options.Uploads == nil {
+		writeJSONError(w, http.StatusNotFound, api.CodeNotEnabled, "Resumable uploads are not enabled")
+		return false
+	}
+	if v := r.Header.Get("Tus-Resumable"); v != "" && v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeJSONError(w, http.StatusPreconditionFailed, api.CodeBadRequest, fmt.Sprintf("Unsupported tus version %s", v))
+		return false
+	}
+	return true
+}
+
+// setProgressHeaders sets the tus headers that report how far an upload got
+func setProgressHeaders(w http.ResponseWriter, u uploads.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// parseMetadata decodes an Upload-Metadata header: comma-separated keys, each
+// followed by a space and its base64 value
+func parseMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %s", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// UploadCreateHandler starts a resumable upload. The Upload-Length header is
+// the size of the file, and Upload-Metadata carries its "filename" (or
+// "name"). The directory and duplicate policy come from ?path= and
+// ?duplicates= as for /api/upload, or from the "path" and "duplicates"
+// metadata.
+func (h *Handler) UploadCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.uploadsEnabled(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Upload-Length must be the size of the file")
+		return
+	}
+	metadata, err := parseMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, err.Error())
+		return
+	}
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	dir := metadata["path"]
+	if q := r.URL.Query().Get("path"); q != "" {
+		dir = q
+	}
+	policy := diskmanager.DuplicatePolicy(metadata["duplicates"])
+	if q := r.URL.Query().Get("duplicates"); q != "" {
+		policy = diskmanager.DuplicatePolicy(q)
+	}
+	if !validDuplicatePolicy(policy) {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "duplicates must be \"keep\", \"skip\" or \"replace\"")
+		return
+	}
+
+	u, err := h.options.Uploads.Create(uploads.Upload{
+		Filename:   filename,
+		Dir:        path.Clean("/" + dir),
+		Duplicates: string(policy),
+		Length:     length,
+	})
+	if err != nil {
+		writeError(w, err, "Failed to start upload")
+		return
+	}
+	log.Printf("Started resumable upload %s: %s (%d bytes)", u.ID, u.Filename, u.Length)
+
+	setProgressHeaders(w, u)
+	w.Header().Set("Location", "/api/uploads/"+u.ID)
+	writeJSON(w, http.StatusCreated, stagedUploadResponse{Success: true, Upload: u})
+}
+
+// UploadListHandler lists the resumable uploads that haven't been committed
+func (h *Handler) UploadListHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.uploadsEnabled(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, stagedUploadListResponse{Success: true, Uploads: h.options.Uploads.List()})
+}
+
+// UploadStatusHandler reports how much of a resumable upload has arrived, in
+// the Upload-Offset header (for HEAD requests) and the JSON body
+func (h *Handler) UploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.uploadsEnabled(w, r) {
+		return
+	}
+	u, err := h.options.Uploads.Get(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err, "Failed to read upload")
+		return
+	}
+	setProgressHeaders(w, u)
+	writeJSON(w, http.StatusOK, stagedUploadResponse{Success: true, Upload: u})
+}
+
+// UploadChunkHandler appends the body to a resumable upload. Upload-Offset
+// must be the offset the upload has reached. When the last byte arrives the
+// file is stored on the disk in one transaction. If that fails because the
+// disk is full or busy the upload is kept, and an empty chunk at the final
+// offset tries again; invalid files are dropped.
+func (h *Handler) UploadChunkHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.uploadsEnabled(w, r) {
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != tusContentType {
+		writeJSONError(w, http.StatusUnsupportedMediaType, api.CodeBadRequest, "Content-Type must be "+tusContentType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, api.CodeBadRequest, "Upload-Offset must be the offset the upload has reached")
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	u, err := h.options.Uploads.Append(id, offset, r.Body)
+	if u.ID != "" {
+		// Tell the client where to carry on, whatever happened
+		setProgressHeaders(w, u)
+	}
+	if err != nil {
+		writeError(w, err, "Failed to receive upload")
+		return
+	}
+	if !u.Complete() {
+		writeJSON(w, http.StatusOK, chunkResponse{Success: true, Upload: u})
+		return
+	}
+
+	var result uploadResult
+	err = h.options.Uploads.Commit(id, func(u uploads.Upload, data *os.File) error {
+		var err error
+		result, err = h.commitUpload(u, data)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to store resumable upload %s: %v", id, err)
+		// Trying again won't make the file valid
+		if errors.Is(err, errInvalidZip) || errors.Is(err, diskmanager.ErrInvalidPath) {
+			h.options.Uploads.Remove(id)
+		}
+		writeError(w, err, "Failed to save file")
+		return
+	}
+	writeJSON(w, http.StatusOK, chunkResponse{Success: true, Upload: u, Stored: &result})
+}
+
+// commitUpload stores a complete resumable upload on the disk like
+// UploadHandler would, reading ZIP archives from the staging area rather
+// than memory
+func (h *Handler) commitUpload(u uploads.Upload, data *os.File) (uploadResult, error) {
+	policy := diskmanager.DuplicatePolicy(u.Duplicates)
+	result := uploadResult{Filename: u.Filename, Size: u.Length}
+
+	var err error
+	if isZipFile(u.Filename) {
+		zipReader, zipErr := zip.NewReader(data, u.Length)
+		if zipErr != nil {
+			return result, fmt.Errorf("%w: %v", errInvalidZip, zipErr)
+		}
+		result.FilesExtracted, result.Size, result.Files, result.Duplicates, err = h.extractZip(zipReader, u.Dir, policy)
+		if err == nil {
+			log.Printf("Successfully extracted %d files from %s (%d bytes total)", result.FilesExtracted, u.Filename, result.Size)
+		}
+	} else {
+		reader := bufio.NewReaderSize(data, 1024*1024)
+		result.Files, result.Duplicates, err = h.writeUpload(u.Filename, reader, u.Length, u.Dir, policy)
+		if err == nil {
+			log.Printf("Successfully uploaded: %s (%d bytes)", u.Filename, u.Length)
+		}
+	}
+	return result, err
+}
+
+// UploadCancelHandler cancels a resumable upload and deletes what arrived
+func (h *Handler) UploadCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.uploadsEnabled(w, r) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if err := h.options.Uploads.Remove(id); err != nil {
+		writeError(w, err, "Failed to cancel upload")
+		return
+	}
+	log.Printf("Cancelled resumable upload %s", id)
+	writeJSON(w, http.StatusOK, api.OK)
+}
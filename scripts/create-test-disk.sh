@@ -36,7 +36,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = diskmanager.CreateDiskImage(diskPath, sizeMb)
+	err = diskmanager.CreateDiskImage(diskPath, sizeMb, diskmanager.DiskFormat{})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to create disk: %v\n", err)
 		os.Exit(1)
@@ -7,6 +7,7 @@ set -e
 IMAGE_PATH="${IMAGE_PATH:-/tmp/benchmark-test.img}"
 IMAGE_SIZE_MB="${IMAGE_SIZE_MB:-100}"
 ITERATIONS="${ITERATIONS:-5}"
+WRITERS="${WRITERS:-fat,loopback,diskfs}"
 
 echo "=== Disk Copy Benchmark Suite ==="
 echo ""
@@ -40,7 +41,7 @@ func main() {
     path := os.Args[1]
     sizeMB, _ := strconv.ParseInt(os.Args[2], 10, 64)
 
-    if err := diskmanager.CreateDiskImage(path, sizeMB); err != nil {
+    if err := diskmanager.CreateDiskImage(path, sizeMB, diskmanager.DiskFormat{}); err != nil {
         fmt.Printf("Error: %v\n", err)
         os.Exit(1)
     }
@@ -90,7 +91,8 @@ for spec in "${TEST_FILES[@]}"; do
         -image "$IMAGE_PATH" \
         -source "$path" \
         -dest "/benchmark-$name.bin" \
-        -iterations "$ITERATIONS"
+        -iterations "$ITERATIONS" \
+        -writers "$WRITERS"
     echo ""
 done
 
@@ -99,7 +101,7 @@ echo "======================================"
 echo "Benchmark complete!"
 echo ""
 echo "To run a custom benchmark:"
-echo "  /tmp/benchmark-copy -image $IMAGE_PATH -source <your-file> -iterations 5"
+echo "  /tmp/benchmark-copy -image $IMAGE_PATH -source <your-file> -iterations 5 -writers fat,loopback"
 echo ""
 echo "To clean up test files:"
 echo "  rm -f /tmp/test-*.bin /tmp/benchmark-copy"